@@ -2,10 +2,10 @@ package acmednschallenge
 
 import (
 	"context"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"maps"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/coredns/coredns/plugin"
@@ -19,40 +19,62 @@ import (
 
 var log = clog.NewWithPlugin(name)
 
+// errStorageFailed marks errors of the certificate storage. Ordering a certificate while its storage
+// can't be read would replace a certificate that may well be valid, so the check is skipped until
+// the next cycle instead of retried or failed over.
+var errStorageFailed = errors.New("certificate storage failed")
+
 type acmeChallenge struct {
 	Next            plugin.Handler
 	config          *config.ACMEChallengeConfig
-	challenges      *map[string][]string
+	challenges      *challengeStore
 	coreDNSProvider *coreDnsLegoProvider
 	storage         storage.CertStorage
-	obtainOrRenew   func(domain string) (bool, *certificate.Resource, error)
+	storages        map[storage.Options]storage.CertStorage
+	obtainOrRenew   func(cert *config.ManagedCertificate, ca *certificateAuthority) (bool, *storage.Resource, error)
+	obtainForCSR    func(ca *certificateAuthority, csr *x509.CertificateRequest) (*certificate.Resource, error)
+	rejectedCSRs    map[string]time.Time
+	failedCSRs      map[string]*csrFailure
+	blockKeys       string // the keys of the server block, such as "example.org:53 example.net:53"
+	generation      any    // the caddy instance the block was set up by, replaced on every reload
 }
 
-func newAcmeChallenge(config *config.ACMEChallengeConfig) (*acmeChallenge, error) {
-	challenges := make(map[string][]string)
-
-	accountStore, err := storage.NewAccount(config.Account)
-	if err != nil {
-		return nil, err
+func newAcmeChallenge(config *config.ACMEChallengeConfig, manager *certificateManager) (*acmeChallenge, error) {
+	var cas []*certificateAuthority
+	for _, caConfig := range config.CAs {
+		ca, err := manager.certificateAuthority(caConfig)
+		if err != nil {
+			return nil, err
+		}
+		cas = append(cas, ca)
 	}
 
-	coreDNSProvider, err := newCoreDnsLegoProvider(config, accountStore, &challenges, fmt.Sprintf("%s/acme", name))
-	if err != nil {
-		return nil, err
-	}
+	coreDNSProvider := newCoreDnsLegoProvider(config, cas, manager.challenges, fmt.Sprintf("%s/acme", name))
 
-	certStorage, err := storage.New(config.Storage)
+	certStorage, err := manager.certStorage(config.Storage)
 	if err != nil {
 		return nil, err
 	}
+	storages := map[storage.Options]storage.CertStorage{config.Storage: certStorage}
+	for _, cert := range config.Certificates {
+		s, err := manager.certStorage(cert.Storage)
+		if err != nil {
+			return nil, err
+		}
+		storages[cert.Storage] = s
+	}
 
 	challenge := &acmeChallenge{
 		config:          config,
-		challenges:      &challenges,
+		challenges:      manager.challenges,
 		coreDNSProvider: coreDNSProvider,
 		storage:         certStorage,
+		storages:        storages,
 	}
 	challenge.obtainOrRenew = challenge.checkAndCreateOrRenewCert
+	challenge.obtainForCSR = coreDNSProvider.obtainCertificateForCSR
+	challenge.rejectedCSRs = make(map[string]time.Time)
+	challenge.failedCSRs = make(map[string]*csrFailure)
 
 	return challenge, nil
 }
@@ -76,8 +98,8 @@ func (ac *acmeChallenge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *
 		return plugin.NextOrFailure(ac.Name(), ac.Next, ctx, w, r)
 	}
 
-	txtValues, ok := (*ac.challenges)[qNameFqdn]
-	if (!ok) || (len(txtValues) == 0) {
+	txtValues := ac.challenges.get(qNameFqdn)
+	if len(txtValues) == 0 {
 		return plugin.NextOrFailure(ac.Name(), ac.Next, ctx, w, r)
 	}
 
@@ -104,73 +126,150 @@ func (ac *acmeChallenge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *
 	return dns.RcodeSuccess, nil
 }
 
-func (ac *acmeChallenge) start() {
-
-	log.Info("started certificate service")
+// orderState is where the order of a certificate continues after an attempt that is to be retried:
+// the CA of its chain, and how many attempts were made with it.
+type orderState struct {
+	ca      int
+	attempt uint32
+}
 
-	ac.checkAndUpdateCertForAllDomains()
+// orderResult is the outcome of one attempt with a CA.
+type orderResult int
 
-	uptimeTicker := time.NewTicker(ac.config.CertValidationInterval)
+const (
+	orderDone   orderResult = iota // the certificate is valid, or was handled until the next check
+	orderRetry                     // the attempt failed and is to be retried after retryInterval
+	orderFailed                    // the CA gave up on the certificate
+)
 
-	for {
-		select {
-		case <-uptimeTicker.C:
-			ac.checkAndUpdateCertForAllDomains()
+// updateCertificate tries the configured CAs in order, starting at from. It only moves on to the next
+// CA when the current one keeps failing and the stored certificate is missing or close to expiry;
+// every cycle starts with the primary again, so renewals return to it once it is healthy. An attempt
+// to be retried is not waited for: retry is set and the caller calls again with next after
+// retryInterval, so that the wait holds none of its workers.
+func (ac *acmeChallenge) updateCertificate(cert *config.ManagedCertificate, from orderState) (next orderState, retry bool) {
+	cas := ac.coreDNSProvider.caChain(cert)
+	attempt := from.attempt
+	for i := from.ca; i < len(cas); i++ {
+		ca := cas[i]
+		switch ac.updateCertificateWithCA(cert, ca, attempt) {
+		case orderDone:
+			return orderState{}, false
+		case orderRetry:
+			return orderState{ca: i, attempt: attempt + 1}, true
+		}
+		if i == len(cas)-1 {
+			ac.recordExpiring(cert)
+			return orderState{}, false
 		}
+		if !ac.shouldFailOver(cert) {
+			log.Infof("certificate '%s' is not close to expiry yet, not failing over from ca '%s'", cert.Name, ca.name)
+			ac.recordExpiring(cert)
+			return orderState{}, false
+		}
+		log.Warningf("ca '%s' keeps failing for certificate '%s', failing over to ca '%s'", ca.name, cert.Name, cas[i+1].name)
+		attempt = 0
 	}
+	return orderState{}, false
 }
 
-func (ac *acmeChallenge) checkAndUpdateCertForAllDomains() {
-	log.Info("starting cert validation!")
+// updateCertificateWithCA makes attempt number attempt at cert with ca.
+func (ac *acmeChallenge) updateCertificateWithCA(cert *config.ManagedCertificate, ca *certificateAuthority, attempt uint32) orderResult {
+	isNew, certs, err := ac.obtainOrRenew(cert, ca)
+	if errors.Is(err, errStorageFailed) {
+		log.Errorf("skipping certificate '%s' until the next check: %v", cert.Name, err)
+		storageErrors.WithLabelValues(cert.Name, "load").Inc()
+		ac.recordEvent(cert, true, reasonStorageError, "could not load the certificate: %v", err)
+		return orderDone
+	}
+	if err == nil {
+		if isNew {
+			reason := ac.savedReason(cert)
+			err := ac.storageFor(cert).Save(certs)
+			if errors.Is(err, storage.ErrConflict) {
+				log.Warningf("certificate '%s' was stored by another instance in the meantime, keeping theirs: %v", cert.Name, err)
+			} else if err != nil {
+				log.Errorf("could not save certificate '%s': %v", cert.Name, err)
+				storageErrors.WithLabelValues(cert.Name, "save").Inc()
+				ac.recordEvent(cert, true, reasonStorageError, "could not save the certificate obtained from ca '%s': %v", ca.name, err)
+			} else {
+				ac.recordSaved(cert, reason, ca, certs)
+			}
+		} else {
+			log.Infof("Certificate '%s' is still valid, do nothing", cert.Name)
+		}
+		return orderDone
+	}
 
-	var wg sync.WaitGroup
-	for domain := range maps.Keys(ac.config.ManagedDomains) {
-		wg.Add(1)
-		go func(d string) {
-			defer wg.Done()
-			ac.updateCertForDomain(d)
-		}(domain)
+	log.Error(err)
+	if cert.RetryInterval <= 0 || attempt >= cert.MaxRetryCount {
+		ac.recordFailed(cert, ca, err)
+		return orderFailed
 	}
+	log.Infof("retrying certificate '%s' with ca '%s' in %s (attempt %d/%d)", cert.Name, ca.name, cert.RetryInterval, attempt+1, cert.MaxRetryCount)
+	return orderRetry
+}
 
-	wg.Wait()
+// storageFor returns the storage of the zone cert belongs to.
+func (ac *acmeChallenge) storageFor(cert *config.ManagedCertificate) storage.CertStorage {
+	if s, ok := ac.storages[cert.Storage]; ok {
+		return s
+	}
+	return ac.storage
 }
 
-func (ac *acmeChallenge) updateCertForDomain(domain string) {
-	for attempt := uint32(0); ; attempt++ {
-		isNew, certs, err := ac.obtainOrRenew(domain)
-		if err == nil {
-			if isNew {
-				if err := ac.storage.Save(certs); err != nil {
-					log.Errorf("could not save certificate for domain '%s': %v", domain, err)
-				}
-			} else {
-				log.Infof("Certificate for domain '%s' is still valid, do nothing", domain)
-			}
-			return
-		}
+// shouldFailOver reports whether the stored certificate is missing or close to expiry. When the
+// storage can't be read there is nothing to base that on, so it stays with the current CA.
+func (ac *acmeChallenge) shouldFailOver(cert *config.ManagedCertificate) bool {
+	certs, err := ac.storageFor(cert).Load(cert.Name)
+	if errors.Is(err, storage.ErrNotFound) {
+		return true
+	}
+	if err != nil {
+		log.Errorf("could not load certificate '%s': %v", cert.Name, err)
+		return false
+	}
+	return ac.closeToExpiry(certs.Certificate)
+}
 
-		log.Error(err)
-		if ac.config.RetryInterval <= 0 || attempt >= ac.config.MaxRetryCount {
-			return
-		}
-		log.Infof("retrying certificate for domain '%s' in %s (attempt %d/%d)", domain, ac.config.RetryInterval, attempt+1, ac.config.MaxRetryCount)
-		time.Sleep(ac.config.RetryInterval)
+// closeToExpiry reports whether bundle is unparseable or expires within caFailoverBeforeDays.
+func (ac *acmeChallenge) closeToExpiry(bundle []byte) bool {
+	cert, err := parseLeafCertificate(bundle)
+	if err != nil {
+		return true
 	}
+	return time.Until(cert.NotAfter) < time.Duration(ac.config.CAFailoverBeforeDays)*24*time.Hour
 }
 
-func (ac *acmeChallenge) checkAndCreateOrRenewCert(domain string) (bool, *certificate.Resource, error) {
-	certs := ac.storage.Load(domain)
-	if certs == nil {
-		log.Infof("No certificate found for %s, obtaining new one", domain)
-		certs, err := ac.coreDNSProvider.obtainNewCertificate(domain)
+func (ac *acmeChallenge) checkAndCreateOrRenewCert(cert *config.ManagedCertificate, ca *certificateAuthority) (bool, *storage.Resource, error) {
+	certs, err := ac.storageFor(cert).Load(cert.Name)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return false, nil, fmt.Errorf("%w: %w", errStorageFailed, err)
+	}
+	if err != nil {
+		log.Infof("No certificate found for %s, obtaining new one from ca '%s'", cert.Name, ca.name)
+		certs, err := ac.coreDNSProvider.obtainNewCertificate(ca, cert)
 		return true, certs, err
 	} else {
-		log.Infof("Loaded certificate for %s", domain)
-		if !checkIfCertIsValid(ac, certs) {
-			certs, err := ac.coreDNSProvider.renewCertificate(certs)
+		log.Infof("Loaded certificate for %s", cert.Name)
+		if reason := certificateMismatch(certs, cert, ac.coreDNSProvider.caChain(cert)); reason != "" {
+			log.Infof("Certificate for %s no longer matches the configuration (%s), obtaining a new one from ca '%s'", cert.Name, reason, ca.name)
+			certs, err := ac.coreDNSProvider.obtainNewCertificate(ca, cert)
+			return true, certs, err
+		}
+		if !ac.config.SkipRevocationCheck && ac.isRevoked(cert, certs) {
+			log.Warningf("Certificate for %s has been REVOKED by its CA, obtaining a new one from ca '%s'", cert.Name, ca.name)
+			certs, err := ac.coreDNSProvider.obtainNewCertificate(ca, cert)
+			return true, certs, err
+		}
+		if !checkIfCertIsValid(certs, cert.RenewBeforeDays) {
+			if certs.CADirURL != "" && certs.CADirURL != ca.dirURL {
+				log.Infof("Certificate for %s was issued by %s, renewing it with ca '%s'", cert.Name, certs.CADirURL, ca.name)
+			}
+			certs, err := ac.coreDNSProvider.renewCertificate(ca, cert, certs)
 			if err != nil {
-				log.Errorf("Error renewing certificate. the cert for the domain '%s' is probably to old. Trying to obtain a new one.", domain)
-				certs, err := ac.coreDNSProvider.obtainNewCertificate(domain)
+				log.Errorf("Error renewing certificate. the cert '%s' is probably to old. Trying to obtain a new one.", cert.Name)
+				certs, err := ac.coreDNSProvider.obtainNewCertificate(ca, cert)
 				return true, certs, err
 			}
 			return true, certs, err
@@ -179,3 +278,18 @@ func (ac *acmeChallenge) checkAndCreateOrRenewCert(domain string) (bool, *certif
 		return false, certs, nil
 	}
 }
+
+// isRevoked checks whether certs has been revoked. When the CA can't be asked the certificate is
+// assumed not to be revoked and checked again on the next cycle.
+func (ac *acmeChallenge) isRevoked(cert *config.ManagedCertificate, certs *storage.Resource) bool {
+	revoked, method, err := checkRevocation(certs)
+	if err != nil {
+		log.Warningf("could not check revocation of certificate '%s': %v", cert.Name, err)
+		return false
+	}
+	if revoked {
+		revokedCertificates.WithLabelValues(cert.Name, method).Inc()
+		ac.recordEvent(cert, true, reasonRevoked, "certificate was revoked by its CA (checked over %s), obtaining a new one", method)
+	}
+	return revoked
+}
@@ -8,14 +8,21 @@ import (
 	"github.com/coredns/coredns/plugin/acmednschallenge/config"
 	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	"github.com/coredns/coredns/plugin/test"
+	"github.com/go-acme/lego/v4/challenge/dns01"
 	"github.com/miekg/dns"
 )
 
 func newTestChallenge(next plugin.Handler, challenges map[string][]string) *acmeChallenge {
+	store := newChallengeStore()
+	for fqdn, values := range challenges {
+		for _, v := range values {
+			store.add(fqdn, v)
+		}
+	}
 	return &acmeChallenge{
 		Next:       next,
 		config:     &config.ACMEChallengeConfig{DnsTTL: 120},
-		challenges: &challenges,
+		challenges: store,
 	}
 }
 
@@ -95,8 +102,8 @@ func TestServeDNS(t *testing.T) {
 }
 
 func TestPresentCleanUp(t *testing.T) {
-	challenges := map[string][]string{}
-	p := &coreDnsLegoProvider{activeChallenges: &challenges}
+	challenges := newChallengeStore()
+	p := &coreDnsLegoProvider{activeChallenges: challenges}
 
 	if err := p.Present("example.com", "", "keyauth-one"); err != nil {
 		t.Fatalf("Present: %v", err)
@@ -105,20 +112,28 @@ func TestPresentCleanUp(t *testing.T) {
 		t.Fatalf("Present: %v", err)
 	}
 
-	if len(challenges) != 1 {
-		t.Fatalf("got %d fqdn keys, want 1", len(challenges))
+	if challenges.len() != 1 {
+		t.Fatalf("got %d fqdn keys, want 1", challenges.len())
 	}
-	for _, vals := range challenges {
+	for _, vals := range challenges.values {
 		if len(vals) != 2 {
 			t.Errorf("got %d TXT values, want 2 (one per Present call)", len(vals))
 		}
 	}
 
+	// Cleaning up one order leaves the value of the other one, validating the same name.
 	if err := p.CleanUp("example.com", "", "keyauth-one"); err != nil {
 		t.Fatalf("CleanUp: %v", err)
 	}
-	if len(challenges) != 0 {
-		t.Errorf("CleanUp left %d entries, want 0", len(challenges))
+	two := dns01.GetChallengeInfo("example.com", "keyauth-two").Value
+	if got := challenges.get("_acme-challenge.example.com."); len(got) != 1 || got[0] != two {
+		t.Errorf("after the first CleanUp the values are %v, want only %q", got, two)
+	}
+	if err := p.CleanUp("example.com", "", "keyauth-two"); err != nil {
+		t.Fatalf("CleanUp: %v", err)
+	}
+	if challenges.len() != 0 {
+		t.Errorf("CleanUp left %d entries, want 0", challenges.len())
 	}
 }
 
@@ -0,0 +1,131 @@
+package acmednschallenge
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+// How often, and how far apart, the account key is read again when its storage fails at startup.
+var (
+	accountKeyAttempts   = 5
+	accountKeyRetryDelay = 2 * time.Second
+)
+
+// certificateAuthority is a configured ACME directory together with the account used against it.
+type certificateAuthority struct {
+	name          string
+	dirURL        string
+	eabKeyID      string
+	eabHMACKey    string
+	allowInsecure bool
+	rootCAs       *x509.CertPool // nil means the system roots
+	orders        *orderLimiter
+
+	acmeUser *AcmeUser // the stored account, without its registration
+
+	mu         sync.Mutex // guards registered, domains of one CA are ordered concurrently
+	registered *AcmeUser  // acmeUser with the registration resolved with the CA, nil until then
+}
+
+func newCertificateAuthority(ca config.CAConfig, account storage.AccountStorage) (*certificateAuthority, error) {
+	email := ca.Email
+
+	var rootCAs *x509.CertPool
+	if ca.CABundle != "" {
+		pemBytes, err := os.ReadFile(ca.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("could not read caBundle for ca '%s': %w", ca.Name, err)
+		}
+		rootCAs = x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(pemBytes) {
+			return nil, fmt.Errorf("caBundle %s for ca '%s' contains no certificates", ca.CABundle, ca.Name)
+		}
+	}
+
+	var privateKey crypto.PrivateKey
+	alreadyExists := false
+
+	keyPEM, err := loadAccountKey(account, email)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return nil, fmt.Errorf("could not load ACME account key for %s (ca '%s'): %w", email, ca.Name, err)
+	}
+	if err == nil {
+		pk, err := certcrypto.ParsePEMPrivateKey(keyPEM)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse ACME account key for %s: %w", email, err)
+		}
+		privateKey = pk
+		alreadyExists = true
+		log.Infof("loaded existing ACME account for %s (ca '%s')", email, ca.Name)
+	} else {
+		pk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("could not create ACME account key: %w", err)
+		}
+		privateKey = pk
+
+		keyPEM = pem.EncodeToMemory(certcrypto.PEMBlock(pk))
+		err = account.SaveAccountKey(email, keyPEM)
+		switch {
+		case errors.Is(err, storage.ErrConflict):
+			// Loaded once: when the key of the other instance can't be read either, startup fails
+			// rather than racing it again.
+			log.Infof("another instance created the ACME account key for %s (ca '%s') first, loading it", email, ca.Name)
+			if keyPEM, err = loadAccountKey(account, email); err != nil {
+				return nil, fmt.Errorf("could not load the ACME account key for %s (ca '%s') created by another instance: %w", email, ca.Name, err)
+			}
+			if privateKey, err = certcrypto.ParsePEMPrivateKey(keyPEM); err != nil {
+				return nil, fmt.Errorf("could not parse ACME account key for %s: %w", email, err)
+			}
+			alreadyExists = true
+		case err != nil:
+			return nil, err
+		default:
+			log.Infof("created new ACME account key for %s (ca '%s')", email, ca.Name)
+		}
+	}
+
+	return &certificateAuthority{
+		name:          ca.Name,
+		dirURL:        ca.DirURL,
+		eabKeyID:      ca.EABKeyID,
+		eabHMACKey:    ca.EABHMACKey,
+		allowInsecure: ca.AllowInsecure,
+		rootCAs:       rootCAs,
+		orders:        newOrderLimiter(ca.OrderLimit, ca.OrderLimitInterval),
+		acmeUser: &AcmeUser{
+			Email:         email,
+			Key:           privateKey,
+			alreadyExists: alreadyExists,
+		},
+	}, nil
+}
+
+// loadAccountKey reads the account key of email, retrying with a growing delay while the storage
+// fails. A new account is only created on storage.ErrNotFound, so giving up here fails startup
+// rather than silently replacing a long-lived account.
+func loadAccountKey(account storage.AccountStorage, email string) ([]byte, error) {
+	delay := accountKeyRetryDelay
+	for attempt := 1; ; attempt++ {
+		keyPEM, err := account.LoadAccountKey(email)
+		if err == nil || errors.Is(err, storage.ErrNotFound) || attempt >= accountKeyAttempts {
+			return keyPEM, err
+		}
+		log.Warningf("could not load ACME account key for %s, retrying in %s (attempt %d/%d): %v", email, delay, attempt, accountKeyAttempts, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,275 @@
+package acmednschallenge
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+type fakeAccount struct {
+	keys      map[string][]byte
+	saveCalls int
+	loadCalls int
+	loadErrs  []error // returned by the first loads, in order
+	raced     []byte  // stored by another instance just before the first save, which then conflicts
+	conflicts bool    // every save conflicts, without storing a key
+}
+
+func newFakeAccount() *fakeAccount { return &fakeAccount{keys: map[string][]byte{}} }
+
+func (f *fakeAccount) SaveAccountKey(email string, keyPEM []byte) error {
+	f.saveCalls++
+	if f.conflicts {
+		return storage.ErrConflict
+	}
+	if f.raced != nil {
+		f.keys[email], f.raced = f.raced, nil
+		return storage.ErrConflict
+	}
+	f.keys[email] = keyPEM
+	return nil
+}
+func (f *fakeAccount) ListAccounts() ([]string, error) { return nil, nil }
+func (f *fakeAccount) DeleteAccountKey(email string) error {
+	delete(f.keys, email)
+	return nil
+}
+func (f *fakeAccount) LoadAccountKey(email string) ([]byte, error) {
+	f.loadCalls++
+	if f.loadCalls <= len(f.loadErrs) {
+		return nil, f.loadErrs[f.loadCalls-1]
+	}
+	key, ok := f.keys[email]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	return key, nil
+}
+
+func testCA(email string) config.CAConfig {
+	return config.CAConfig{Name: "test", DirURL: "https://acme.example.com/directory", Email: email}
+}
+
+func TestNewCertificateAuthorityGeneratesKey(t *testing.T) {
+	acc := newFakeAccount()
+
+	p, err := newCertificateAuthority(testCA("new@example.com"), acc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if p.acmeUser.alreadyExists {
+		t.Error("alreadyExists = true, want false for a freshly generated account")
+	}
+	if p.acmeUser.Key == nil {
+		t.Error("account key was not generated")
+	}
+	if acc.saveCalls != 1 {
+		t.Errorf("SaveAccountKey called %d times, want 1", acc.saveCalls)
+	}
+}
+
+func TestNewCertificateAuthorityLoadsExistingKey(t *testing.T) {
+	acc := newFakeAccount()
+	if _, err := newCertificateAuthority(testCA("me@example.com"), acc); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+	acc.saveCalls = 0
+
+	p, err := newCertificateAuthority(testCA("me@example.com"), acc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !p.acmeUser.alreadyExists {
+		t.Error("alreadyExists = false, want true when a stored key is loaded")
+	}
+	if acc.saveCalls != 0 {
+		t.Errorf("SaveAccountKey called %d times, want 0 when reusing a stored key", acc.saveCalls)
+	}
+}
+
+func TestNewCertificateAuthorityBadStoredKey(t *testing.T) {
+	acc := newFakeAccount()
+	acc.keys["bad@example.com"] = []byte("not a valid pem key")
+
+	if _, err := newCertificateAuthority(testCA("bad@example.com"), acc); err == nil {
+		t.Fatal("expected an error for an unparseable stored account key, got nil")
+	}
+}
+
+func TestNewCertificateAuthorityStorageFailure(t *testing.T) {
+	defer func(attempts int, delay time.Duration) {
+		accountKeyAttempts, accountKeyRetryDelay = attempts, delay
+	}(accountKeyAttempts, accountKeyRetryDelay)
+	accountKeyAttempts, accountKeyRetryDelay = 3, time.Millisecond
+
+	unavailable := errors.New("vault is sealed")
+	tests := []struct {
+		name       string
+		loadErrs   []error
+		wantErr    bool
+		wantLoads  int
+		wantExists bool
+	}{
+		{name: "recovers after retries", loadErrs: []error{unavailable, unavailable}, wantLoads: 3, wantExists: true},
+		{name: "gives up", loadErrs: []error{unavailable, unavailable, unavailable}, wantErr: true, wantLoads: 3},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			acc := newFakeAccount()
+			if _, err := newCertificateAuthority(testCA("me@example.com"), acc); err != nil {
+				t.Fatalf("seed: %v", err)
+			}
+			acc.saveCalls, acc.loadCalls, acc.loadErrs = 0, 0, tc.loadErrs
+
+			p, err := newCertificateAuthority(testCA("me@example.com"), acc)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tc.wantErr)
+			}
+			if acc.loadCalls != tc.wantLoads {
+				t.Errorf("LoadAccountKey called %d times, want %d", acc.loadCalls, tc.wantLoads)
+			}
+			if acc.saveCalls != 0 {
+				t.Errorf("SaveAccountKey called %d times, want 0: the stored account must not be replaced", acc.saveCalls)
+			}
+			if err == nil && p.acmeUser.alreadyExists != tc.wantExists {
+				t.Errorf("alreadyExists = %v, want %v", p.acmeUser.alreadyExists, tc.wantExists)
+			}
+		})
+	}
+}
+
+func TestCAChain(t *testing.T) {
+	p := newTestProvider("le", "zerossl", "step")
+	p.defaultCAs = []string{"le", "zerossl"}
+	p.domainCAs = map[string][]string{"internal.example.com": {"step"}}
+
+	names := func(chain []*certificateAuthority) string {
+		var n []string
+		for _, ca := range chain {
+			n = append(n, ca.name)
+		}
+		return strings.Join(n, ",")
+	}
+
+	if got := names(p.caChain(&config.ManagedCertificate{Name: "internal.example.com", Zone: "internal.example.com"})); got != "step" {
+		t.Errorf("caChain(internal) = %s, want step", got)
+	}
+	if got := names(p.caChain(&config.ManagedCertificate{Name: "api", Zone: "internal.example.com"})); got != "step" {
+		t.Errorf("caChain(api) = %s, want the ca of its zone", got)
+	}
+	if got := names(p.caChain(&config.ManagedCertificate{Name: "example.com", Zone: "example.com"})); got != "le,zerossl" {
+		t.Errorf("caChain(example.com) = %s, want le,zerossl", got)
+	}
+
+	p.defaultCAs = nil
+	if got := names(p.caChain(&config.ManagedCertificate{Name: "example.com", Zone: "example.com"})); got != "le,zerossl,step" {
+		t.Errorf("caChain without useCA = %s, want every ca", got)
+	}
+}
+
+func TestNewCertificateAuthorityAdoptsConcurrentAccount(t *testing.T) {
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acc := newFakeAccount()
+	acc.raced = pem.EncodeToMemory(certcrypto.PEMBlock(other))
+
+	p, err := newCertificateAuthority(testCA("new@example.com"), acc)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !p.acmeUser.alreadyExists {
+		t.Error("alreadyExists = false, want the account of the other instance")
+	}
+	if !other.Equal(p.acmeUser.Key) {
+		t.Error("the key of the other instance was not used")
+	}
+}
+
+func TestNewCertificateAuthorityConflictWithoutKey(t *testing.T) {
+	acc := newFakeAccount()
+	acc.conflicts = true
+
+	if _, err := newCertificateAuthority(testCA("new@example.com"), acc); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("err = %v, want the failed load of the other instance's key", err)
+	}
+	if acc.saveCalls != 1 {
+		t.Errorf("saveCalls = %d, want 1", acc.saveCalls)
+	}
+}
+
+// fakeACMEDirectory serves the ACME directory, nonces and account registration, counting the
+// registrations.
+func fakeACMEDirectory(t *testing.T, registrations *atomic.Int32) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		switch r.URL.Path {
+		case "/directory":
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"newNonce":%q,"newAccount":%q,"newOrder":%q}`, srv.URL+"/nonce", srv.URL+"/account", srv.URL+"/order")
+		case "/nonce":
+		case "/account":
+			registrations.Add(1)
+			w.Header().Set("Location", srv.URL+"/account/1")
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprint(w, `{"status":"valid"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestGetAcmeClientRegistersOnce(t *testing.T) {
+	var registrations atomic.Int32
+	srv := fakeACMEDirectory(t, &registrations)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &certificateAuthority{name: "test", dirURL: srv.URL + "/directory", allowInsecure: true, acmeUser: &AcmeUser{Email: "me@example.com", Key: key}}
+	p := &coreDnsLegoProvider{acceptedLetsEncryptToS: true}
+
+	// Workers ordering certificates of the same CA at once.
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := p.getAcmeClient(ca, certcrypto.EC256); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := registrations.Load(); n != 1 {
+		t.Errorf("%d registrations, want 1", n)
+	}
+	if ca.acmeUser.Registration != nil {
+		t.Error("the stored account was changed, want the registration on a copy")
+	}
+	if ca.registered == nil || ca.registered.Registration == nil || ca.registered.Registration.URI != srv.URL+"/account/1" {
+		t.Errorf("registered = %+v, want the account URL", ca.registered)
+	}
+}
@@ -0,0 +1,437 @@
+package acmednschallenge
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+)
+
+const defaultValidationInterval = 24 * time.Hour
+
+var (
+	managerMu     sync.Mutex
+	sharedManager *certificateManager
+)
+
+// getManager returns the process-wide certificate manager, creating it for the first server block.
+func getManager() *certificateManager {
+	managerMu.Lock()
+	defer managerMu.Unlock()
+	if sharedManager == nil {
+		sharedManager = newCertificateManager()
+	}
+	return sharedManager
+}
+
+// certificateManager is shared by every server block using the plugin. It owns the challenge store,
+// the ACME accounts and certificate storages, and the one scheduler that keeps the certificates of all
+// blocks renewed. Server blocks only register their configuration with it.
+type certificateManager struct {
+	challenges *challengeStore
+	recheck    chan struct{}
+
+	mu       sync.Mutex
+	cas      map[config.CAConfig]*certificateAuthority
+	accounts []storage.AccountStorage // the account storages of cas
+	storages map[storage.Options]storage.CertStorage
+	blocks   []*acmeChallenge
+	latest   any                      // the generation of the last registered block
+	started  any                      // the generation the scheduler was last started or rechecked for
+	inboxes  map[string]chan struct{} // stop channel of the watcher of every csrInbox directory
+	stop     chan struct{}            // nil while the scheduler is not running
+}
+
+// managedCertificate is a certificate together with the server block whose settings order it.
+type managedCertificate struct {
+	cert  *config.ManagedCertificate
+	block *acmeChallenge
+	order orderState // where a retried order continues
+}
+
+// certificateKey identifies a certificate across server blocks: the same name in the same storage
+// is the same certificate.
+type certificateKey struct {
+	storage storage.Options
+	name    string
+}
+
+func newCertificateManager() *certificateManager {
+	return &certificateManager{
+		challenges: newChallengeStore(),
+		recheck:    make(chan struct{}, 1),
+		cas:        make(map[config.CAConfig]*certificateAuthority),
+		storages:   make(map[storage.Options]storage.CertStorage),
+		inboxes:    make(map[string]chan struct{}),
+	}
+}
+
+// certificateAuthority returns the CA for caConfig, loading or creating its account only the first
+// time a server block asks for it.
+func (m *certificateManager) certificateAuthority(caConfig config.CAConfig) (*certificateAuthority, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ca, ok := m.cas[caConfig]; ok {
+		return ca, nil
+	}
+	accountStore, err := storage.NewAccount(caConfig.Account)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := newCertificateAuthority(caConfig, accountStore)
+	if err != nil {
+		return nil, err
+	}
+	m.cas[caConfig] = ca
+	m.accounts = append(m.accounts, accountStore)
+	return ca, nil
+}
+
+// certStorage returns the certificate storage for o, creating it the first time it is asked for.
+func (m *certificateManager) certStorage(o storage.Options) (storage.CertStorage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.storages[o]; ok {
+		return s, nil
+	}
+	s, err := storage.New(o)
+	if err != nil {
+		return nil, err
+	}
+	m.storages[o] = s
+	// Storages are kept for the life of the process, and so are their watches.
+	if w, ok := storage.WatcherOf(s); ok {
+		go w.Watch(nil, func(domain string) { m.storageChanged(o, domain) })
+	}
+	return s, nil
+}
+
+// storageChanged is called when someone else changed the certificate stored as domain in the storage
+// of o. When a registered block manages it, all certificates are checked again right away.
+func (m *certificateManager) storageChanged(o storage.Options, domain string) {
+	for _, mc := range m.certificates() {
+		if mc.cert.Storage == o && mc.cert.Name == domain {
+			log.Infof("certificate '%s' was changed by another instance, checking again", domain)
+			m.requestRecheck()
+			return
+		}
+	}
+}
+
+// requestRecheck makes the running scheduler check all certificates right away.
+func (m *certificateManager) requestRecheck() {
+	select {
+	case m.recheck <- struct{}{}:
+	default:
+	}
+}
+
+// register adds the certificates of a server block. A certificate another block of the same generation
+// already manages is left to that block, but both must agree on its domains.
+//
+// On a reload the blocks of the new generation are registered before the old ones are unregistered, so
+// a block replaces the one with the same keys of an earlier generation, and the blocks of an earlier
+// generation still registered are neither compared with nor preferred over the new ones.
+func (m *certificateManager) register(ac *acmeChallenge) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	existing := make(map[certificateKey]*config.ManagedCertificate)
+	for _, b := range m.blocks {
+		if b.generation != ac.generation {
+			continue
+		}
+		for _, cert := range b.config.Certificates {
+			if _, ok := existing[certificateKey{cert.Storage, cert.Name}]; !ok {
+				existing[certificateKey{cert.Storage, cert.Name}] = cert
+			}
+		}
+	}
+	for _, cert := range ac.config.Certificates {
+		other, ok := existing[certificateKey{cert.Storage, cert.Name}]
+		if ok && !slices.Equal(other.Domains, cert.Domains) {
+			return fmt.Errorf("certificate '%s' is configured with domains %v in another server block, but %v here", cert.Name, other.Domains, cert.Domains)
+		}
+	}
+	m.blocks = slices.DeleteFunc(m.blocks, func(b *acmeChallenge) bool {
+		return b.blockKeys == ac.blockKeys && b.generation != ac.generation
+	})
+	m.blocks = append(m.blocks, ac)
+	m.latest = ac.generation
+	return nil
+}
+
+// unregister removes a server block, stopping the scheduler once no block is left.
+func (m *certificateManager) unregister(ac *acmeChallenge) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.blocks = slices.DeleteFunc(m.blocks, func(b *acmeChallenge) bool { return b == ac })
+	for dir, stop := range m.inboxes {
+		if m.csrInboxBlockLocked(dir) == nil {
+			close(stop)
+			delete(m.inboxes, dir)
+		}
+	}
+	if len(m.blocks) == 0 && m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+}
+
+// certificates returns every registered certificate once, with the first block that registered it.
+func (m *certificateManager) certificates() []managedCertificate {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.certificatesLocked()
+}
+
+// certificatesLocked takes the blocks of the latest generation first, so that while a reload is under
+// way the new configuration of a certificate applies.
+func (m *certificateManager) certificatesLocked() []managedCertificate {
+	blocks := slices.Clone(m.blocks)
+	slices.SortStableFunc(blocks, func(a, b *acmeChallenge) int {
+		return cmp.Compare(m.rankLocked(a), m.rankLocked(b))
+	})
+	seen := make(map[certificateKey]bool)
+	var certs []managedCertificate
+	for _, ac := range blocks {
+		for _, cert := range ac.config.Certificates {
+			key := certificateKey{cert.Storage, cert.Name}
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			certs = append(certs, managedCertificate{cert: cert, block: ac})
+		}
+	}
+	return certs
+}
+
+// rankLocked is 0 for the blocks of the latest generation and 1 for the others.
+func (m *certificateManager) rankLocked(ac *acmeChallenge) int {
+	if ac.generation == m.latest {
+		return 0
+	}
+	return 1
+}
+
+// start runs the scheduler and the csrInbox watchers. Every block calls it on startup, but only the
+// first block of a generation makes a scheduler that is already running, as after a reload, check all
+// certificates right away, so newly registered blocks are picked up once.
+func (m *certificateManager) start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, ac := range m.blocks {
+		dir := ac.config.CSRInbox
+		if dir == "" {
+			continue
+		}
+		if _, ok := m.inboxes[dir]; ok {
+			continue
+		}
+		stop := make(chan struct{})
+		m.inboxes[dir] = stop
+		go m.watchCSRInbox(dir, ac.config.CSRInboxInterval, stop)
+	}
+
+	if m.stop != nil {
+		if m.started != m.latest {
+			m.started = m.latest
+			m.requestRecheck()
+		}
+		return
+	}
+	m.started = m.latest
+	m.stop = make(chan struct{})
+	go m.run(m.stop)
+}
+
+func (m *certificateManager) run(stop <-chan struct{}) {
+	log.Info("started certificate service")
+
+	m.checkAll()
+
+	ticker := time.NewTicker(m.validationInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.recheck:
+		case <-stop:
+			return
+		}
+		ticker.Reset(m.validationInterval())
+		m.checkAll()
+	}
+}
+
+// validationInterval is the shortest certValidationInterval of all registered blocks.
+func (m *certificateManager) validationInterval() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	interval := time.Duration(0)
+	for _, ac := range m.blocks {
+		if interval == 0 || ac.config.CertValidationInterval < interval {
+			interval = ac.config.CertValidationInterval
+		}
+	}
+	if interval <= 0 {
+		return defaultValidationInterval
+	}
+	return interval
+}
+
+// checkAll checks every certificate with a bounded number of workers, the most urgent first, and then
+// prunes the certificates no longer configured. An order to be retried is queued again after its
+// retryInterval, and checkAll returns once every certificate is done.
+func (m *certificateManager) checkAll() {
+	log.Info("starting cert validation!")
+
+	queue := m.certificates()
+	sortByUrgency(queue)
+
+	jobs := make(chan managedCertificate)
+	var pending sync.WaitGroup // certificates not done yet, including those waiting for a retry
+	pending.Add(len(queue))
+	var wg sync.WaitGroup
+	for i := 0; i < m.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for mc := range jobs {
+				next, retry := mc.block.updateCertificate(mc.cert, mc.order)
+				if !retry {
+					pending.Done()
+					continue
+				}
+				mc.order = next
+				time.AfterFunc(mc.cert.RetryInterval, func() { jobs <- mc })
+			}
+		}()
+	}
+	go func() {
+		for _, mc := range queue {
+			jobs <- mc
+		}
+	}()
+	pending.Wait()
+	close(jobs)
+
+	wg.Wait()
+	m.prune()
+	m.reencrypt()
+}
+
+// reencrypt has the storages encrypting private keys write the keys they found stale while the
+// certificates were checked, or the account keys were loaded, encrypted with the current provider.
+func (m *certificateManager) reencrypt() {
+	m.mu.Lock()
+	var stores []any
+	for _, s := range m.storages {
+		stores = append(stores, s)
+	}
+	for _, a := range m.accounts {
+		stores = append(stores, a)
+	}
+	m.mu.Unlock()
+
+	for _, s := range stores {
+		if r, ok := s.(storage.Reencrypter); ok {
+			r.Reencrypt()
+		}
+	}
+}
+
+// workers is the smallest maxConcurrentOrders of all registered blocks.
+func (m *certificateManager) workers() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	workers := 0
+	for _, ac := range m.blocks {
+		if n := int(ac.config.MaxConcurrentOrders); n > 0 && (workers == 0 || n < workers) {
+			workers = n
+		}
+	}
+	return max(workers, 1)
+}
+
+// sortByUrgency orders queue by how urgently each certificate needs an order: expired (or unparseable)
+// certificates first, then missing ones, then the rest by expiry, soonest first. Certificates whose
+// storage can't be listed go last, as they are skipped anyway. It goes by what List tells of each
+// storage, so that no certificate is loaded twice per check.
+func sortByUrgency(queue []managedCertificate) {
+	const (
+		expired = iota
+		missing
+		valid
+		unavailable
+	)
+	type urgency struct {
+		rank     int
+		notAfter time.Time
+	}
+	// The storage of a certificate, told apart by the block, as storages need not be comparable.
+	type storageKey struct {
+		block   *acmeChallenge
+		options storage.Options
+	}
+	type listing struct {
+		entries map[string]storage.Entry
+		err     error
+	}
+	now := time.Now()
+	listings := make(map[storageKey]listing)
+	urgencies := make(map[*config.ManagedCertificate]urgency, len(queue))
+	for _, mc := range queue {
+		key := storageKey{mc.block, mc.cert.Storage}
+		l, ok := listings[key]
+		if !ok {
+			entries, err := mc.block.storageFor(mc.cert).List()
+			l = listing{entries: make(map[string]storage.Entry, len(entries)), err: err}
+			for _, e := range entries {
+				l.entries[e.Domain] = e
+			}
+			listings[key] = l
+		}
+
+		u := urgency{rank: expired}
+		if e, ok := l.entries[mc.cert.Name]; l.err != nil {
+			u.rank = unavailable
+		} else if !ok {
+			u.rank = missing
+		} else if e.NotAfter.After(now) {
+			u = urgency{rank: valid, notAfter: e.NotAfter}
+		}
+		urgencies[mc.cert] = u
+	}
+
+	slices.SortStableFunc(queue, func(a, b managedCertificate) int {
+		ua, ub := urgencies[a.cert], urgencies[b.cert]
+		if ua.rank != ub.rank {
+			return ua.rank - ub.rank
+		}
+		return ua.notAfter.Compare(ub.notAfter)
+	})
+}
+
+// csrInboxBlock returns the first registered block watching the csrInbox dir, or nil.
+func (m *certificateManager) csrInboxBlock(dir string) *acmeChallenge {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.csrInboxBlockLocked(dir)
+}
+
+func (m *certificateManager) csrInboxBlockLocked(dir string) *acmeChallenge {
+	for _, ac := range m.blocks {
+		if ac.config.CSRInbox == dir {
+			return ac
+		}
+	}
+	return nil
+}
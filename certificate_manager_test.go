@@ -0,0 +1,348 @@
+package acmednschallenge
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+)
+
+// testBlock is a server block managing one certificate per name, recording every certificate it is
+// asked to order into seen.
+func testBlock(seen *[]string, mu *sync.Mutex, names ...string) *acmeChallenge {
+	ac := &acmeChallenge{
+		config:          &config.ACMEChallengeConfig{Certificates: map[string]*config.ManagedCertificate{}},
+		storage:         &fakeStorage{},
+		coreDNSProvider: newTestProvider("primary"),
+	}
+	for _, n := range names {
+		ac.config.Certificates[n] = &config.ManagedCertificate{Name: n, Domains: []string{n}}
+	}
+	ac.obtainOrRenew = func(cert *config.ManagedCertificate, _ *certificateAuthority) (bool, *storage.Resource, error) {
+		mu.Lock()
+		*seen = append(*seen, cert.Name)
+		mu.Unlock()
+		return false, nil, nil
+	}
+	return ac
+}
+
+func TestManagerCheckAllDeduplicates(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	m := newCertificateManager()
+	if err := m.register(testBlock(&seen, &mu, "a.example.com", "b.example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.register(testBlock(&seen, &mu, "b.example.com", "c.example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	m.checkAll()
+
+	sort.Strings(seen)
+	if got := strings.Join(seen, ","); got != "a.example.com,b.example.com,c.example.com" {
+		t.Errorf("attempted %s, want every certificate exactly once", got)
+	}
+}
+
+func TestManagerRegisterConflict(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	m := newCertificateManager()
+	if err := m.register(testBlock(&seen, &mu, "example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	other := testBlock(&seen, &mu, "example.com")
+	other.config.Certificates["example.com"].Domains = []string{"example.com", "*.example.com"}
+	if err := m.register(other); err == nil {
+		t.Fatal("expected an error for a certificate with different domains in two blocks")
+	}
+}
+
+func TestManagerUnregister(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	m := newCertificateManager()
+	first := testBlock(&seen, &mu, "a.example.com")
+	second := testBlock(&seen, &mu, "a.example.com")
+	for _, ac := range []*acmeChallenge{first, second} {
+		if err := m.register(ac); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m.start()
+	m.unregister(first)
+	if certs := m.certificates(); len(certs) != 1 || certs[0].block != second {
+		t.Errorf("certificate not taken over by the remaining block: %v", certs)
+	}
+	if m.stop == nil {
+		t.Error("scheduler stopped while a block is still registered")
+	}
+
+	m.unregister(second)
+	if m.stop != nil {
+		t.Error("scheduler still running without registered blocks")
+	}
+}
+
+func TestChallengesSharedAcrossBlocks(t *testing.T) {
+	m := newCertificateManager()
+	p := &coreDnsLegoProvider{activeChallenges: m.challenges}
+	other := &acmeChallenge{config: &config.ACMEChallengeConfig{}, challenges: m.challenges}
+
+	if err := p.Present("example.org", "", "keyauth"); err != nil {
+		t.Fatal(err)
+	}
+	if got := other.challenges.get("_acme-challenge.example.org."); len(got) != 1 {
+		t.Errorf("challenge not visible to another block: %v", got)
+	}
+}
+
+func TestManagerCheckAllBounded(t *testing.T) {
+	m := newCertificateManager()
+	ac := &acmeChallenge{
+		config:          &config.ACMEChallengeConfig{MaxConcurrentOrders: 2, Certificates: map[string]*config.ManagedCertificate{}},
+		storage:         &fakeStorage{},
+		coreDNSProvider: newTestProvider("primary"),
+	}
+	for _, n := range []string{"a", "b", "c", "d", "e", "f"} {
+		ac.config.Certificates[n] = &config.ManagedCertificate{Name: n}
+	}
+	var mu sync.Mutex
+	running, peak := 0, 0
+	ac.obtainOrRenew = func(*config.ManagedCertificate, *certificateAuthority) (bool, *storage.Resource, error) {
+		mu.Lock()
+		running++
+		peak = max(peak, running)
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return false, nil, nil
+	}
+	if err := m.register(ac); err != nil {
+		t.Fatal(err)
+	}
+
+	m.checkAll()
+
+	if peak != 2 {
+		t.Errorf("peak concurrent orders = %d, want 2", peak)
+	}
+}
+
+// certsByName is a storage returning a fixed certificate per name. A name mapped to nil fails to load.
+type certsByName map[string]*storage.Resource
+
+func (s certsByName) Save(*storage.Resource) error { return nil }
+func (s certsByName) Delete(name string) error     { delete(s, name); return nil }
+func (s certsByName) List() ([]storage.Entry, error) {
+	var entries []storage.Entry
+	for name, certs := range s {
+		if certs == nil {
+			continue
+		}
+		e := storage.Entry{Domain: name}
+		if leaf, err := parseLeafCertificate(certs.Certificate); err == nil {
+			e.Domains, e.NotBefore, e.NotAfter = leaf.DNSNames, leaf.NotBefore, leaf.NotAfter
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+func (s certsByName) Load(name string) (*storage.Resource, error) {
+	certs, ok := s[name]
+	if !ok {
+		return nil, storage.ErrNotFound
+	}
+	if certs == nil {
+		return nil, errors.New("storage unavailable")
+	}
+	return certs, nil
+}
+
+// unlistable is a storage that can't be listed.
+type unlistable struct{ fakeStorage }
+
+func (unlistable) List() ([]storage.Entry, error) { return nil, errors.New("etcd is down") }
+
+// countingLoads fails the test on every Load.
+type countingLoads struct {
+	certsByName
+	t *testing.T
+}
+
+func (s countingLoads) Load(name string) (*storage.Resource, error) {
+	s.t.Errorf("certificate %s loaded to sort the queue, want List only", name)
+	return s.certsByName.Load(name)
+}
+
+func TestManagerCheckAllRequeuesRetries(t *testing.T) {
+	m := newCertificateManager()
+	ac := &acmeChallenge{
+		config:          &config.ACMEChallengeConfig{MaxConcurrentOrders: 1, Certificates: map[string]*config.ManagedCertificate{}},
+		storage:         &fakeStorage{},
+		coreDNSProvider: newTestProvider("primary"),
+	}
+	for _, n := range []string{"a", "b"} {
+		ac.config.Certificates[n] = &config.ManagedCertificate{Name: n, RetryInterval: 50 * time.Millisecond, MaxRetryCount: 1}
+	}
+	var mu sync.Mutex
+	var attempts []string
+	ac.obtainOrRenew = func(cert *config.ManagedCertificate, _ *certificateAuthority) (bool, *storage.Resource, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts = append(attempts, cert.Name)
+		if slices.Index(attempts, cert.Name) == len(attempts)-1 {
+			return false, nil, errors.New("boom")
+		}
+		return false, nil, nil
+	}
+	if err := m.register(ac); err != nil {
+		t.Fatal(err)
+	}
+
+	m.checkAll()
+
+	// With a single worker, both first attempts run before either retry: the worker is not held
+	// while an order waits for its retryInterval.
+	sort.Strings(attempts[:2])
+	sort.Strings(attempts[2:])
+	if strings.Join(attempts, ",") != "a,b,a,b" {
+		t.Errorf("attempts = %v, want a and b, then both retried", attempts)
+	}
+}
+
+func TestSortByUrgency(t *testing.T) {
+	stored := certsByName{
+		"later":   issueTestCert(t, testCert{notAfter: time.Now().Add(60 * 24 * time.Hour)}),
+		"soon":    issueTestCert(t, testCert{notAfter: time.Now().Add(3 * 24 * time.Hour)}),
+		"expired": issueTestCert(t, testCert{notAfter: time.Now().Add(-time.Hour)}),
+		"broken":  nil,
+	}
+	ac := &acmeChallenge{storage: countingLoads{stored, t}}
+	down := &acmeChallenge{storage: &unlistable{}}
+	var queue []managedCertificate
+	queue = append(queue, managedCertificate{cert: &config.ManagedCertificate{Name: "unavailable"}, block: down})
+	for _, n := range []string{"broken", "later", "new", "soon", "expired"} {
+		queue = append(queue, managedCertificate{cert: &config.ManagedCertificate{Name: n}, block: ac})
+	}
+
+	sortByUrgency(queue)
+
+	var got []string
+	for _, mc := range queue {
+		got = append(got, mc.cert.Name)
+	}
+	// A certificate that can't be read is left out of List, so it sorts as missing.
+	if strings.Join(got, ",") != "expired,broken,new,soon,later,unavailable" {
+		t.Errorf("queue = %v, want expired,broken,new,soon,later,unavailable", got)
+	}
+}
+
+func TestManagerStorageChanged(t *testing.T) {
+	var seen []string
+	var mu sync.Mutex
+	m := newCertificateManager()
+	if err := m.register(testBlock(&seen, &mu, "example.com")); err != nil {
+		t.Fatal(err)
+	}
+
+	m.storageChanged(storage.Options{}, "other.example.com")
+	select {
+	case <-m.recheck:
+		t.Error("a certificate no block manages was checked again")
+	default:
+	}
+
+	m.storageChanged(storage.Options{}, "example.com")
+	select {
+	case <-m.recheck:
+	default:
+		t.Error("a changed certificate was not checked again")
+	}
+}
+
+func TestManagerReload(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	m := newCertificateManager()
+	old := testBlock(&seen, &mu, "example.com")
+	old.blockKeys, old.generation = "example.com:53", new(int)
+	oldOther := testBlock(&seen, &mu, "example.com")
+	oldOther.blockKeys, oldOther.generation = "example.com:853", old.generation
+	for _, ac := range []*acmeChallenge{old, oldOther} {
+		if err := m.register(ac); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.start()
+
+	// The reload adds a SAN in both blocks; the new blocks are set up before the old ones shut down.
+	generation := new(int)
+	for _, keys := range []string{"example.com:53", "example.com:853"} {
+		ac := testBlock(&seen, &mu, "example.com")
+		ac.blockKeys, ac.generation = keys, generation
+		ac.config.Certificates["example.com"].Domains = []string{"example.com", "*.example.com"}
+		if err := m.register(ac); err != nil {
+			t.Fatalf("register %s of the new generation: %v", keys, err)
+		}
+		if certs := m.certificates(); len(certs) != 1 || len(certs[0].cert.Domains) != 2 {
+			t.Errorf("after registering %s the certificate is %+v, want the new domains", keys, certs[0].cert)
+		}
+	}
+	if len(m.blocks) != 2 {
+		t.Errorf("%d blocks registered, want the old ones replaced", len(m.blocks))
+	}
+
+	m.unregister(old)
+	m.unregister(oldOther)
+	if m.stop == nil {
+		t.Error("scheduler stopped by the shutdown of the old generation")
+	}
+}
+
+func TestManagerStartRechecksOncePerGeneration(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	m := newCertificateManager()
+	// The scheduler is taken as running, so start only asks it to check again.
+	m.stop = make(chan struct{})
+	rechecked := func() bool {
+		select {
+		case <-m.recheck:
+			return true
+		default:
+			return false
+		}
+	}
+
+	for _, generation := range []*int{new(int), new(int)} {
+		for _, keys := range []string{"example.com:53", "example.com:853"} {
+			ac := testBlock(&seen, &mu, "example.com")
+			ac.blockKeys, ac.generation = keys, generation
+			if err := m.register(ac); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// Every block of the generation calls start on startup.
+		m.start()
+		if !rechecked() {
+			t.Error("the certificates of a new generation were not checked")
+		}
+		m.start()
+		if rechecked() {
+			t.Error("the certificates were checked again for the second block of a generation")
+		}
+	}
+}
@@ -2,8 +2,13 @@ package acmednschallenge
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"net/http"
 
+	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+	"github.com/go-acme/lego/v4/acme"
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
 	"github.com/go-acme/lego/v4/challenge/dns01"
@@ -11,8 +16,12 @@ import (
 	"github.com/go-acme/lego/v4/registration"
 )
 
-func (p *coreDnsLegoProvider) renewCertificate(certs *certificate.Resource) (*certificate.Resource, error) {
-	client, err := p.getAcmeClient()
+const accountDoesNotExistProblem = "urn:ietf:params:acme:error:accountDoesNotExist"
+
+func (p *coreDnsLegoProvider) renewCertificate(ca *certificateAuthority, cert *config.ManagedCertificate, certs *storage.Resource) (*storage.Resource, error) {
+	ca.orders.wait()
+
+	client, err := p.getAcmeClient(ca, cert.KeyType)
 	if err != nil {
 		return nil, err
 	}
@@ -20,69 +29,70 @@ func (p *coreDnsLegoProvider) renewCertificate(certs *certificate.Resource) (*ce
 	renewOptions := &certificate.RenewOptions{
 		Bundle:     true,
 		MustStaple: false,
+		Profile:    cert.Profile,
 	}
 
-	renewedCerts, err := client.Certificate.RenewWithOptions(*certs, renewOptions)
+	renewedCerts, err := client.Certificate.RenewWithOptions(certs.Resource, renewOptions)
 	if err != nil {
 		return nil, err
 	}
+	renewedCerts.Domain = cert.Name
 
-	return renewedCerts, nil
+	return &storage.Resource{Resource: *renewedCerts, CADirURL: ca.dirURL, Profile: cert.Profile}, nil
 }
 
-func (p *coreDnsLegoProvider) obtainNewCertificate(mainDomain string) (*certificate.Resource, error) {
-	client, err := p.getAcmeClient()
+func (p *coreDnsLegoProvider) obtainNewCertificate(ca *certificateAuthority, cert *config.ManagedCertificate) (*storage.Resource, error) {
+	ca.orders.wait()
+
+	client, err := p.getAcmeClient(ca, cert.KeyType)
 	if err != nil {
 		return nil, err
 	}
 
-	additionalSans, ok := p.managedDomains[mainDomain]
-	if !ok {
-		additionalSans = []string{}
-	}
-
-	domains := []string{mainDomain}
-	domains = append(domains, additionalSans...)
-
+	// The bundle keeps the issuer with the certificate in every storage, as the revocation check
+	// needs it and not all of them store it on its own.
 	r := certificate.ObtainRequest{
-		Domains: domains,
-		Bundle:  len(domains) > 1,
+		Domains: cert.Domains,
+		Bundle:  true,
+		Profile: cert.Profile,
 	}
 
 	certificates, err := client.Certificate.Obtain(r)
 	if err != nil {
 		return nil, err
 	}
+	certificates.Domain = cert.Name
 
-	return certificates, nil
+	return &storage.Resource{Resource: *certificates, CADirURL: ca.dirURL, Profile: cert.Profile}, nil
 }
 
-func (p *coreDnsLegoProvider) getAcmeClient() (*lego.Client, error) {
-	config := lego.NewConfig(p.acmeUser)
-	if p.customCAD != "" {
-		config.CADirURL = p.customCAD
-	} else {
-		config.CADirURL = lego.LEDirectoryProduction
-		if p.useLetsEncryptTestServer {
-			config.CADirURL = lego.LEDirectoryStaging
-		}
-	}
+// obtainCertificateForCSR orders a certificate for an externally generated CSR; the private key
+// never passes through the plugin.
+func (p *coreDnsLegoProvider) obtainCertificateForCSR(ca *certificateAuthority, csr *x509.CertificateRequest) (*certificate.Resource, error) {
+	ca.orders.wait()
 
-	config.HTTPClient.Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: p.allowInsecureCAD},
+	client, err := p.getAcmeClient(ca, certcrypto.RSA2048)
+	if err != nil {
+		return nil, err
 	}
 
-	config.Certificate.KeyType = certcrypto.RSA2048
+	return client.Certificate.ObtainForCSR(certificate.ObtainForCSRRequest{
+		CSR:    csr,
+		Bundle: true,
+	})
+}
 
-	client, err := lego.NewClient(config)
+func (p *coreDnsLegoProvider) getAcmeClient(ca *certificateAuthority, keyType certcrypto.KeyType) (*lego.Client, error) {
+	user, err := p.registeredUser(ca)
+	if err != nil {
+		return nil, err
+	}
+	client, err := newLegoClient(ca, user, keyType)
 	if err != nil {
 		return nil, err
 	}
-
-	dnsTimeout := dns01.AddDNSTimeout(p.dnsTimeout)
 
 	err = client.Challenge.SetDNS01Provider(p,
-		dnsTimeout,
 		dns01.CondOption(p.skipDnsPropagationTest, dns01.DisableAuthoritativeNssPropagationRequirement()),
 		dns01.CondOption(len(p.customNameservers) > 0, dns01.AddRecursiveNameservers(p.customNameservers)),
 	)
@@ -91,19 +101,65 @@ func (p *coreDnsLegoProvider) getAcmeClient() (*lego.Client, error) {
 		return nil, err
 	}
 
-	if p.acmeUser.alreadyExists {
+	return client, nil
+}
+
+func newLegoClient(ca *certificateAuthority, user *AcmeUser, keyType certcrypto.KeyType) (*lego.Client, error) {
+	config := lego.NewConfig(user)
+	config.CADirURL = ca.dirURL
+
+	config.HTTPClient.Transport = &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: ca.allowInsecure, RootCAs: ca.rootCAs},
+	}
+
+	config.Certificate.KeyType = keyType
+
+	return lego.NewClient(config)
+}
+
+// registeredUser returns the account of ca with its registration, resolving it with the CA the first
+// time. The user returned is never changed afterwards, so the workers ordering certificates build
+// their clients from it concurrently, without a round trip to the CA per order.
+func (p *coreDnsLegoProvider) registeredUser(ca *certificateAuthority) (*AcmeUser, error) {
+	ca.mu.Lock()
+	defer ca.mu.Unlock()
+	if ca.registered != nil {
+		return ca.registered, nil
+	}
+
+	client, err := newLegoClient(ca, ca.acmeUser, certcrypto.EC256)
+	if err != nil {
+		return nil, err
+	}
+	reg, err := p.resolveAccount(client, ca)
+	if err != nil {
+		return nil, err
+	}
+	user := *ca.acmeUser
+	user.Registration = reg
+	user.alreadyExists = true
+	ca.registered = &user
+	return ca.registered, nil
+}
+
+// resolveAccount looks up the account for the stored key and registers it when the CA does not know
+// it yet, which is the case the first time a key shared between several CAs is used against one.
+func (p *coreDnsLegoProvider) resolveAccount(client *lego.Client, ca *certificateAuthority) (*registration.Resource, error) {
+	if ca.acmeUser.alreadyExists {
 		reg, err := client.Registration.ResolveAccountByKey()
-		if err != nil {
-			return nil, err
-		}
-		p.acmeUser.Registration = reg
-	} else {
-		reg, err := client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: p.acceptedLetsEncryptToS})
-		if err != nil {
-			return nil, err
+		var problem *acme.ProblemDetails
+		if err == nil || !errors.As(err, &problem) || problem.Type != accountDoesNotExistProblem {
+			return reg, err
 		}
-		p.acmeUser.Registration = reg
+		log.Infof("account of %s is not registered with ca '%s' yet, registering it", ca.acmeUser.Email, ca.name)
 	}
 
-	return client, nil
+	if ca.eabKeyID != "" {
+		return client.Registration.RegisterWithExternalAccountBinding(registration.RegisterEABOptions{
+			TermsOfServiceAgreed: p.acceptedLetsEncryptToS,
+			Kid:                  ca.eabKeyID,
+			HmacEncoded:          ca.eabHMACKey,
+		})
+	}
+	return client.Registration.Register(registration.RegisterOptions{TermsOfServiceAgreed: p.acceptedLetsEncryptToS})
 }
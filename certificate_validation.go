@@ -1,20 +1,25 @@
 package acmednschallenge
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
 	"time"
 
-	"github.com/go-acme/lego/v4/certificate"
+	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+	"github.com/go-acme/lego/v4/certcrypto"
 )
 
-func checkIfCertIsValid(ac *acmeChallenge, certs *certificate.Resource) bool {
-	block, _ := pem.Decode(certs.Certificate)
-	if block == nil || block.Type != "CERTIFICATE" {
-		return false
-	}
-
-	cert, err := x509.ParseCertificate(block.Bytes)
+func checkIfCertIsValid(certs *storage.Resource, renewBeforeDays uint32) bool {
+	cert, err := parseLeafCertificate(certs.Certificate)
 	if err != nil {
 		return false
 	}
@@ -26,9 +31,89 @@ func checkIfCertIsValid(ac *acmeChallenge, certs *certificate.Resource) bool {
 		return false
 	}
 
-	if daysLeft < int(ac.config.RenewBeforeDays) {
+	if daysLeft < int(renewBeforeDays) {
 		return false
 	}
 
 	return true
 }
+
+// parseLeafCertificate parses the first PEM block of a certificate bundle.
+func parseLeafCertificate(bundle []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(bundle)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// certificateMismatch compares a stored certificate with the configuration it should satisfy and
+// returns why it no longer does, or "" if it still matches. cas is the CA chain of the certificate;
+// one issued by any of them is accepted, so a failed-over certificate is not reordered right away.
+func certificateMismatch(certs *storage.Resource, cert *config.ManagedCertificate, cas []*certificateAuthority) string {
+	leaf, err := parseLeafCertificate(certs.Certificate)
+	if err != nil {
+		return "unreadable certificate"
+	}
+
+	want := slices.Clone(cert.Domains)
+	have := make([]string, 0, len(leaf.DNSNames))
+	for _, n := range leaf.DNSNames {
+		have = append(have, strings.ToLower(n))
+	}
+	slices.Sort(want)
+	slices.Sort(have)
+	if !slices.Equal(slices.Compact(want), slices.Compact(have)) {
+		return fmt.Sprintf("domains %v, want %v", leaf.DNSNames, cert.Domains)
+	}
+
+	if cert.KeyType != "" && !keyMatchesType(leaf.PublicKey, cert.KeyType) {
+		return fmt.Sprintf("key is not %s", cert.KeyType)
+	}
+
+	// A certificate stored before its directory was recorded is taken as issued by the primary CA,
+	// rather than reordering all of them at once; its next renewal records the directory.
+	if certs.CADirURL != "" && !slices.ContainsFunc(cas, func(ca *certificateAuthority) bool { return ca.dirURL == certs.CADirURL }) {
+		return fmt.Sprintf("issued by %s, which is no longer configured", certs.CADirURL)
+	}
+
+	if certs.Profile != cert.Profile {
+		return fmt.Sprintf("profile '%s', want '%s'", certs.Profile, cert.Profile)
+	}
+
+	key, err := certcrypto.ParsePEMPrivateKey(certs.PrivateKey)
+	if err != nil {
+		return "unreadable private key"
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok || !publicKeysEqual(signer.Public(), leaf.PublicKey) {
+		return "private key does not match the certificate"
+	}
+
+	return ""
+}
+
+// keyMatchesType reports whether pub has the algorithm and size of keyType.
+func keyMatchesType(pub crypto.PublicKey, keyType certcrypto.KeyType) bool {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		switch keyType {
+		case certcrypto.RSA2048:
+			return k.N.BitLen() == 2048
+		case certcrypto.RSA3072:
+			return k.N.BitLen() == 3072
+		case certcrypto.RSA4096:
+			return k.N.BitLen() == 4096
+		case certcrypto.RSA8192:
+			return k.N.BitLen() == 8192
+		}
+	case *ecdsa.PublicKey:
+		switch keyType {
+		case certcrypto.EC256:
+			return k.Curve == elliptic.P256()
+		case certcrypto.EC384:
+			return k.Curve == elliptic.P384()
+		}
+	}
+	return false
+}
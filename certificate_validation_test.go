@@ -1,9 +1,11 @@
 package acmednschallenge
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
@@ -12,39 +14,65 @@ import (
 	"time"
 
 	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
 )
 
-func makeCertPEM(t *testing.T, notAfter time.Time) []byte {
+// testCert describes a certificate for issueTestCert; zero fields take the defaults.
+type testCert struct {
+	key      crypto.Signer // a new P-256 key by default
+	names    []string      // example.com by default
+	notAfter time.Time     // 60 days from now by default
+	issuer   string        // the directory URL of the CA recorded as having issued it, none by default
+}
+
+// issueTestCert returns the self-signed certificate c describes together with its private key.
+func issueTestCert(t *testing.T, c testCert) *storage.Resource {
 	t.Helper()
-	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-	if err != nil {
-		t.Fatal(err)
+	if c.key == nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.key = key
+	}
+	if len(c.names) == 0 {
+		c.names = []string{"example.com"}
+	}
+	if c.notAfter.IsZero() {
+		c.notAfter = time.Now().Add(60 * 24 * time.Hour)
 	}
 	tmpl := &x509.Certificate{
 		SerialNumber: big.NewInt(1),
-		Subject:      pkix.Name{CommonName: "example.com"},
+		Subject:      pkix.Name{CommonName: c.names[0]},
+		DNSNames:     c.names,
 		NotBefore:    time.Now().Add(-time.Hour),
-		NotAfter:     notAfter,
+		NotAfter:     c.notAfter,
 	}
-	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, c.key.Public(), c.key)
 	if err != nil {
 		t.Fatal(err)
 	}
-	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return &storage.Resource{
+		Resource: certificate.Resource{
+			Domain:      c.names[0],
+			Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+			PrivateKey:  pem.EncodeToMemory(certcrypto.PEMBlock(c.key)),
+		},
+		CADirURL: c.issuer,
+	}
 }
 
 func TestCheckIfCertIsValid(t *testing.T) {
-	ac := &acmeChallenge{config: &config.ACMEChallengeConfig{RenewBeforeDays: 10}}
-
 	tests := []struct {
 		name string
 		cert []byte
 		want bool
 	}{
-		{name: "valid with plenty of days", cert: makeCertPEM(t, time.Now().Add(30*24*time.Hour)), want: true},
-		{name: "within renew window", cert: makeCertPEM(t, time.Now().Add(5*24*time.Hour)), want: false},
-		{name: "expired", cert: makeCertPEM(t, time.Now().Add(-time.Hour)), want: false},
+		{name: "valid with plenty of days", cert: issueTestCert(t, testCert{notAfter: time.Now().Add(30 * 24 * time.Hour)}).Certificate, want: true},
+		{name: "within renew window", cert: issueTestCert(t, testCert{notAfter: time.Now().Add(5 * 24 * time.Hour)}).Certificate, want: false},
+		{name: "expired", cert: issueTestCert(t, testCert{notAfter: time.Now().Add(-time.Hour)}).Certificate, want: false},
 		{name: "not pem", cert: []byte("this is not a pem block"), want: false},
 		{name: "wrong block type", cert: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("x")}), want: false},
 		{name: "unparseable certificate", cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")}), want: false},
@@ -52,10 +80,128 @@ func TestCheckIfCertIsValid(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			certs := &certificate.Resource{Domain: "example.com", Certificate: tc.cert}
-			if got := checkIfCertIsValid(ac, certs); got != tc.want {
+			certs := &storage.Resource{Resource: certificate.Resource{Domain: "example.com", Certificate: tc.cert}}
+			if got := checkIfCertIsValid(certs, 10); got != tc.want {
 				t.Errorf("checkIfCertIsValid = %v, want %v", got, tc.want)
 			}
 		})
 	}
 }
+
+func TestCertificateMismatch(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cas := newTestProvider("primary", "secondary").cas
+	want := &config.ManagedCertificate{Name: "example.com", Domains: []string{"example.com", "*.example.com"}, KeyType: certcrypto.EC256}
+
+	const primary = "https://primary/directory"
+	names := []string{"example.com", "*.example.com"}
+
+	tests := []struct {
+		name      string
+		certs     func() *storage.Resource
+		cert      *config.ManagedCertificate
+		wantMatch bool
+	}{
+		{
+			name: "matches",
+			certs: func() *storage.Resource {
+				return issueTestCert(t, testCert{key: ecKey, names: []string{"*.example.com", "example.com"}, issuer: primary})
+			},
+			cert:      want,
+			wantMatch: true,
+		},
+		{
+			name: "issued by the failover ca",
+			certs: func() *storage.Resource {
+				return issueTestCert(t, testCert{key: ecKey, names: names, issuer: "https://secondary/directory"})
+			},
+			cert:      want,
+			wantMatch: true,
+		},
+		{
+			name:  "san added",
+			certs: func() *storage.Resource { return issueTestCert(t, testCert{key: ecKey, issuer: primary}) },
+			cert:  want,
+		},
+		{
+			name: "key type changed",
+			certs: func() *storage.Resource {
+				return issueTestCert(t, testCert{key: rsaKey, names: names, issuer: primary})
+			},
+			cert: want,
+		},
+		{
+			name: "rsa size matches",
+			certs: func() *storage.Resource {
+				return issueTestCert(t, testCert{key: rsaKey, names: names, issuer: primary})
+			},
+			cert:      &config.ManagedCertificate{Domains: want.Domains, KeyType: certcrypto.RSA2048},
+			wantMatch: true,
+		},
+		{
+			name: "rsa size changed",
+			certs: func() *storage.Resource {
+				return issueTestCert(t, testCert{key: rsaKey, names: names, issuer: primary})
+			},
+			cert: &config.ManagedCertificate{Domains: want.Domains, KeyType: certcrypto.RSA4096},
+		},
+		{
+			name: "directory no longer configured",
+			certs: func() *storage.Resource {
+				return issueTestCert(t, testCert{key: ecKey, names: names, issuer: "https://staging/directory"})
+			},
+			cert: want,
+		},
+		{
+			name:      "directory not recorded",
+			certs:     func() *storage.Resource { return issueTestCert(t, testCert{key: ecKey, names: names}) },
+			cert:      want,
+			wantMatch: true,
+		},
+		{
+			name:  "profile changed",
+			certs: func() *storage.Resource { return issueTestCert(t, testCert{key: ecKey, names: names, issuer: primary}) },
+			cert:  &config.ManagedCertificate{Domains: want.Domains, KeyType: certcrypto.EC256, Profile: "shortlived"},
+		},
+		{
+			name: "private key does not match",
+			certs: func() *storage.Resource {
+				r := issueTestCert(t, testCert{key: ecKey, names: names, issuer: primary})
+				r.PrivateKey = pem.EncodeToMemory(certcrypto.PEMBlock(otherKey))
+				return r
+			},
+			cert: want,
+		},
+		{
+			name: "private key missing",
+			certs: func() *storage.Resource {
+				r := issueTestCert(t, testCert{key: ecKey, names: names, issuer: primary})
+				r.PrivateKey = nil
+				return r
+			},
+			cert: want,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			reason := certificateMismatch(tc.certs(), tc.cert, cas)
+			if tc.wantMatch && reason != "" {
+				t.Errorf("unexpected mismatch: %s", reason)
+			}
+			if !tc.wantMatch && reason == "" {
+				t.Error("expected a mismatch, got none")
+			}
+		})
+	}
+}
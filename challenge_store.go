@@ -0,0 +1,49 @@
+package acmednschallenge
+
+import (
+	"slices"
+	"sync"
+)
+
+// challengeStore holds the TXT values of the DNS-01 challenges in flight, keyed by FQDN. It is shared
+// by every server block, so any block can answer a challenge of any certificate being ordered.
+type challengeStore struct {
+	mu     sync.RWMutex
+	values map[string][]string
+}
+
+func newChallengeStore() *challengeStore {
+	return &challengeStore{values: make(map[string][]string)}
+}
+
+func (s *challengeStore) add(fqdn, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[fqdn] = append(s.values[fqdn], value)
+}
+
+// remove removes value from the values of fqdn, leaving those other orders presented for the same
+// name, such as one for example.org and one for *.example.org.
+func (s *challengeStore) remove(fqdn, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// A new slice, as get hands out the current one.
+	values := slices.DeleteFunc(slices.Clone(s.values[fqdn]), func(v string) bool { return v == value })
+	if len(values) == 0 {
+		delete(s.values, fqdn)
+		return
+	}
+	s.values[fqdn] = values
+}
+
+func (s *challengeStore) get(fqdn string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.values[fqdn]
+}
+
+func (s *challengeStore) len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.values)
+}
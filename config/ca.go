@@ -0,0 +1,155 @@
+package config
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/mail"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/go-acme/lego/v4/lego"
+)
+
+const defaultCAName = "default"
+
+// parseCA parses 'ca NAME DIRECTORY [{ ... }]'.
+func parseCA(c *caddy.Controller) (CAConfig, error) {
+	args := c.RemainingArgs()
+	if len(args) != 2 {
+		return CAConfig{}, c.Err("ca requires 'NAME DIRECTORY_URL [{ ... }]'")
+	}
+	ca := CAConfig{Name: args[0], DirURL: args[1]}
+
+	u, err := url.Parse(ca.DirURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return CAConfig{}, c.Errf("ca '%s' directory must be an http(s) URL but the value is: %v", ca.Name, ca.DirURL)
+	}
+
+	var accountSet bool
+	err = parseSubBlock(c, func(directive string) error {
+		switch directive {
+		case "eab":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return c.Err("eab requires 'KEY_ID HMAC_KEY'")
+			}
+			ca.EABKeyID = args[0]
+			ca.EABHMACKey = args[1]
+		case "email":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			if _, err := mail.ParseAddress(c.Val()); err != nil {
+				return c.Errf("invalid email for ca '%s': %v", ca.Name, c.Val())
+			}
+			ca.Email = c.Val()
+		case "caBundle":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			if err := checkCABundle(c.Val()); err != nil {
+				return c.Errf("invalid caBundle for ca '%s': %v", ca.Name, err)
+			}
+			ca.CABundle = c.Val()
+		case "allowInsecureCAD":
+			if c.NextArg() {
+				return c.ArgErr()
+			}
+			ca.AllowInsecure = true
+		case "orderLimit":
+			limit, interval, err := parseOrderLimit(c)
+			if err != nil {
+				return err
+			}
+			ca.OrderLimit = limit
+			ca.OrderLimitInterval = interval
+		case "accountStorageDisk", "accountStorageKubernetes", "accountStorageVault", "accountStorageS3", "accountStorageEtcd", "accountStorageSQL", "accountStorageAwsSecretsManager":
+			if accountSet {
+				return c.Errf("only one account storage backend may be set for ca '%s'", ca.Name)
+			}
+			accountSet = true
+			return parseAccountStorage(c, &ca.Account)
+		default:
+			return c.Errf("unknown property '%s' in ca '%s'", directive, ca.Name)
+		}
+		return nil
+	})
+	if err != nil {
+		return CAConfig{}, err
+	}
+	return ca, nil
+}
+
+// parseOrderLimit parses 'orderLimit ORDERS INTERVAL'.
+func parseOrderLimit(c *caddy.Controller) (uint32, time.Duration, error) {
+	args := c.RemainingArgs()
+	if len(args) != 2 {
+		return 0, 0, c.Err("orderLimit requires 'ORDERS INTERVAL'")
+	}
+	limit, err := strconv.ParseUint(args[0], 10, 32)
+	if err != nil || limit < 1 {
+		return 0, 0, c.Errf("invalid orderLimit, the number of orders must be an integer >= 1 but the value is: %v", args[0])
+	}
+	interval, err := time.ParseDuration(args[1])
+	if err != nil || interval <= 0 {
+		return 0, 0, c.Errf("invalid orderLimit interval: %v", args[1])
+	}
+	return uint32(limit), interval, nil
+}
+
+// defaultCA is the single CA used when no 'ca' block is configured, built from the block-level
+// customCAD, useLetsEncryptTestServer and allowInsecureCAD directives.
+func defaultCA(cfg *ACMEChallengeConfig) CAConfig {
+	dirURL := lego.LEDirectoryProduction
+	if cfg.CustomCAD != "" {
+		dirURL = cfg.CustomCAD
+	} else if cfg.UseLetsEncryptTestServer {
+		dirURL = lego.LEDirectoryStaging
+	}
+	return CAConfig{
+		Name:          defaultCAName,
+		DirURL:        dirURL,
+		AllowInsecure: cfg.AllowInsecureCAD,
+	}
+}
+
+// checkCABundle verifies that path holds at least one PEM encoded certificate.
+func checkCABundle(path string) error {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if !x509.NewCertPool().AppendCertsFromPEM(pemBytes) {
+		return errors.New("no PEM encoded certificates found")
+	}
+	return nil
+}
+
+// checkCASelection verifies that useCA and domainCA only name defined CAs and managed domains.
+func checkCASelection(c *caddy.Controller, cfg *ACMEChallengeConfig) error {
+	defined := make(map[string]bool, len(cfg.CAs))
+	for _, ca := range cfg.CAs {
+		defined[ca.Name] = true
+	}
+	for _, name := range cfg.DefaultCAs {
+		if !defined[name] {
+			return c.Errf("useCA names the undefined ca '%s'", name)
+		}
+	}
+	for domain, names := range cfg.DomainCAs {
+		_, isCertificate := cfg.Certificates[domain]
+		if !isCertificate && !slices.Contains(cfg.Zones, domain) {
+			return c.Errf("domainCA domain '%s' is neither a zone nor a certificate of this block", domain)
+		}
+		for _, name := range names {
+			if !defined[name] {
+				return c.Errf("domainCA for '%s' names the undefined ca '%s'", domain, name)
+			}
+		}
+	}
+	return nil
+}
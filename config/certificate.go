@@ -0,0 +1,240 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coredns/caddy"
+	"github.com/go-acme/lego/v4/certcrypto"
+)
+
+var validCertificateName = regexp.MustCompile(`^(?i)[a-z0-9*_][a-z0-9*._-]*$`)
+
+var keyTypes = map[string]certcrypto.KeyType{
+	"rsa2048": certcrypto.RSA2048,
+	"rsa3072": certcrypto.RSA3072,
+	"rsa4096": certcrypto.RSA4096,
+	"rsa8192": certcrypto.RSA8192,
+	"ec256":   certcrypto.EC256,
+	"ec384":   certcrypto.EC384,
+}
+
+func parseKeyType(s string) (certcrypto.KeyType, error) {
+	keyType, ok := keyTypes[strings.ToLower(s)]
+	if !ok {
+		return "", fmt.Errorf("invalid keyType '%s', supported: rsa2048, rsa3072, rsa4096, rsa8192, ec256, ec384", s)
+	}
+	return keyType, nil
+}
+
+// certificateBlock is a parsed 'certificate' block; set records the settings it overrides so the
+// others can be inherited from its zone once the server block is fully parsed.
+type certificateBlock struct {
+	cert *ManagedCertificate
+	set  map[string]bool
+}
+
+// parseCertificate parses 'certificate NAME { ... }'.
+func parseCertificate(c *caddy.Controller, zones []string) (*certificateBlock, error) {
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	name := c.Val()
+	if !validCertificateName.MatchString(name) {
+		return nil, c.Errf("certificate name '%s' may only contain letters, digits, '*', '.', '_' and '-'", name)
+	}
+
+	b := &certificateBlock{cert: &ManagedCertificate{Name: name}, set: map[string]bool{}}
+	var mainDomain string
+	err := parseSubBlock(c, func(directive string) error {
+		switch directive {
+		case "domains":
+			domains := c.RemainingArgs()
+			if len(domains) == 0 {
+				return c.ArgErr()
+			}
+			for _, d := range domains {
+				b.cert.Domains = append(b.cert.Domains, strings.TrimSuffix(strings.ToLower(d), "."))
+			}
+		case "mainDomain":
+			if !c.NextArg() {
+				return c.ArgErr()
+			}
+			mainDomain = strings.TrimSuffix(strings.ToLower(c.Val()), ".")
+		default:
+			ok, err := parseCertificateSetting(c, directive, b.cert)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return c.Errf("unknown property '%s' in certificate '%s'", directive, name)
+			}
+		}
+		b.set[directive] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b.cert.Domains) == 0 {
+		return nil, c.Errf("certificate '%s' requires 'domains'", name)
+	}
+	if mainDomain != "" {
+		b.cert.Domains = slices.DeleteFunc(b.cert.Domains, func(d string) bool { return d == mainDomain })
+		b.cert.Domains = append([]string{mainDomain}, b.cert.Domains...)
+	}
+
+	for _, d := range b.cert.Domains {
+		if ZoneOf(d, zones) == "" {
+			return nil, c.Errf("domain '%s' of certificate '%s' must be a subdomain of one of the zones %v", d, name, zones)
+		}
+	}
+	b.cert.Zone = ZoneOf(b.cert.Domains[0], zones)
+
+	return b, nil
+}
+
+// combineCertificates merges the per-zone certificates into one SAN certificate, named after and with
+// the common name mainDomain, or the first zone if mainDomain is empty.
+func combineCertificates(blocks []*certificateBlock, mainDomain string, zones []string) *certificateBlock {
+	if mainDomain == "" {
+		mainDomain = zones[0]
+	}
+	domains := []string{mainDomain}
+	for _, b := range blocks {
+		for _, d := range b.cert.Domains {
+			if !slices.Contains(domains, d) {
+				domains = append(domains, d)
+			}
+		}
+	}
+	return &certificateBlock{cert: &ManagedCertificate{Name: mainDomain, Zone: ZoneOf(mainDomain, zones), Domains: domains}}
+}
+
+// checkCombinedZones rejects the overrides of zone blocks the combined certificate of combineZones
+// can't honour: it is ordered with the settings and CAs of the zone of its main domain, so another
+// zone may only override a setting to the same value.
+func checkCombinedZones(c *caddy.Controller, combined *ManagedCertificate, zones []string, zoneBlocks map[string]*zoneBlock, domainCAs map[string][]string) error {
+	cas, ok := domainCAs[combined.Name]
+	if !ok {
+		cas = domainCAs[combined.Zone]
+	}
+	for _, z := range zones {
+		if z == combined.Zone {
+			continue
+		}
+		var conflict string
+		if names, ok := domainCAs[z]; ok && !slices.Equal(names, cas) {
+			conflict = "its ca with useCA or domainCA"
+		}
+		if b := zoneBlocks[z]; b != nil {
+			switch d := b.defaults; {
+			case b.set["keyType"] && d.KeyType != combined.KeyType:
+				conflict = "keyType"
+			case b.set["profile"] && d.Profile != combined.Profile:
+				conflict = "profile"
+			case b.set["renewBeforeDays"] && d.RenewBeforeDays != combined.RenewBeforeDays:
+				conflict = "renewBeforeDays"
+			case b.set["retryInterval"] && d.RetryInterval != combined.RetryInterval:
+				conflict = "retryInterval"
+			case b.set["maxRetryCount"] && d.MaxRetryCount != combined.MaxRetryCount:
+				conflict = "maxRetryCount"
+			case b.set["storage"] && d.Storage != combined.Storage:
+				conflict = "the certificate storage"
+			}
+		}
+		if conflict != "" {
+			return c.Errf("zone '%s' overrides %s, but combineZones orders one certificate '%s' with the settings of zone '%s'; set it on the block level or to the same value in zone '%s'", z, conflict, combined.Name, combined.Zone, combined.Zone)
+		}
+	}
+	return nil
+}
+
+// parseCertificateSetting parses the settings shared by 'certificate' and 'zone' blocks into cert. It
+// reports false for any other directive.
+func parseCertificateSetting(c *caddy.Controller, directive string, cert *ManagedCertificate) (bool, error) {
+	switch directive {
+	case "keyType":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		keyType, err := parseKeyType(c.Val())
+		if err != nil {
+			return true, c.Err(err.Error())
+		}
+		cert.KeyType = keyType
+	case "profile":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		cert.Profile = c.Val()
+	case "renewBeforeDays":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		days, err := strconv.ParseUint(c.Val(), 10, 32)
+		if err != nil || days < 1 {
+			return true, c.Errf("invalid renewBeforeDays it must be an integer >= 1 but the value is: %v", c.Val())
+		}
+		cert.RenewBeforeDays = uint32(days)
+	case "retryInterval":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		d, err := time.ParseDuration(c.Val())
+		if err != nil || d < 0 {
+			return true, c.Errf("invalid retryInterval: %v", c.Val())
+		}
+		cert.RetryInterval = d
+	case "maxRetryCount":
+		if !c.NextArg() {
+			return true, c.ArgErr()
+		}
+		n, err := strconv.ParseUint(c.Val(), 10, 32)
+		if err != nil {
+			return true, c.Errf("invalid maxRetryCount, it must be a non-negative integer but the value is: %v", c.Val())
+		}
+		cert.MaxRetryCount = uint32(n)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// inheritSettings fills every setting of cert that set does not mark as overridden from defaults.
+func inheritSettings(cert *ManagedCertificate, set map[string]bool, defaults *ManagedCertificate) {
+	if !set["keyType"] {
+		cert.KeyType = defaults.KeyType
+	}
+	if !set["profile"] {
+		cert.Profile = defaults.Profile
+	}
+	if !set["renewBeforeDays"] {
+		cert.RenewBeforeDays = defaults.RenewBeforeDays
+	}
+	if !set["retryInterval"] {
+		cert.RetryInterval = defaults.RetryInterval
+	}
+	if !set["maxRetryCount"] {
+		cert.MaxRetryCount = defaults.MaxRetryCount
+	}
+	if !set["storage"] {
+		cert.Storage = defaults.Storage
+	}
+}
+
+// ZoneOf returns the most specific zone name is inside of, or "" if there is none.
+func ZoneOf(name string, zones []string) string {
+	zone := ""
+	for _, z := range zones {
+		if IsSubdomainOf(name, z) && len(z) > len(zone) {
+			zone = z
+		}
+	}
+	return zone
+}
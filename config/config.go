@@ -5,6 +5,7 @@ import (
 
 	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/go-acme/lego/v4/certcrypto"
 )
 
 const pluginName = "acmednschallenge"
@@ -15,16 +16,31 @@ const defaultCertSavePath = "/var/lib/coredns/certs"
 const defaultUserDataPath = "/var/lib/coredns/acme-user"
 const defaultRenewBeforeDays = 10
 const defaultMaxRetryCount = 3
+const defaultCAFailoverBeforeDays = 5
+const defaultCSRInboxInterval = time.Minute
+const defaultMaxConcurrentOrders = 4
+const defaultPruneGracePeriod = 24 * time.Hour
+
+// What pruneOrphans does with stored certificates no configured certificate uses any more.
+const (
+	PruneDelete  = "delete"
+	PruneArchive = "archive"
+)
 
 type ACMEChallengeConfig struct {
 	Storage                  storage.Options
 	Account                  storage.Options
-	ManagedDomains           map[string][]string
+	Zones                    []string
+	Certificates             map[string]*ManagedCertificate
+	AdditionalSans           []string
+	KeyType                  certcrypto.KeyType
+	Profile                  string
 	RenewBeforeDays          uint32
 	UseLetsEncryptTestServer bool
 	Email                    string
 	AcceptedLetsEncryptToS   bool
 	SkipDnsPropagationTest   bool
+	SkipRevocationCheck      bool
 	CustomCAD                string
 	AllowInsecureCAD         bool
 	CustomNameservers        []string
@@ -33,4 +49,47 @@ type ACMEChallengeConfig struct {
 	CertValidationInterval   time.Duration
 	RetryInterval            time.Duration
 	MaxRetryCount            uint32
+	CAs                      []CAConfig
+	CAFailoverBeforeDays     uint32
+	DefaultCAs               []string
+	DomainCAs                map[string][]string
+	CSRInbox                 string
+	CSRInboxInterval         time.Duration
+	MaxConcurrentOrders      uint32
+	OrderLimit               uint32
+	OrderLimitInterval       time.Duration
+	PruneOrphans             string        // "" (keep), PruneDelete or PruneArchive
+	PruneArchivePath         string        // where PruneArchive copies certificates to before deleting them
+	PruneGracePeriod         time.Duration // certificates issued more recently than this are never pruned
+}
+
+// ManagedCertificate is one certificate the plugin orders and keeps renewed. Without 'certificate'
+// blocks there is one per zone, named after the zone. Settings a 'certificate' or 'zone' block does not
+// override are inherited from the zone and then the server block.
+type ManagedCertificate struct {
+	Name            string   // storage name
+	Zone            string   // zone of the main name
+	Domains         []string // Domains[0] is the main name
+	KeyType         certcrypto.KeyType
+	Profile         string // ACME profile to order, "" for the CA's default
+	RenewBeforeDays uint32
+	RetryInterval   time.Duration
+	MaxRetryCount   uint32
+	Storage         storage.Options
+}
+
+// CAConfig is one ACME directory certificates may be ordered from. CAs are tried in the order they
+// are configured; the first one is the primary.
+type CAConfig struct {
+	Name          string
+	DirURL        string
+	Email         string
+	EABKeyID      string
+	EABHMACKey    string
+	AllowInsecure bool
+	CABundle      string
+	Account       storage.Options
+
+	OrderLimit         uint32 // orders per OrderLimitInterval, 0 means no limit
+	OrderLimitInterval time.Duration
 }
@@ -1,11 +1,23 @@
 package config
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+	"github.com/go-acme/lego/v4/certcrypto"
 )
 
 func TestParseConfigAdditionalSans(t *testing.T) {
@@ -177,6 +189,7 @@ func TestParseConfigStorage(t *testing.T) {
 		shouldErr       bool
 		wantType        string
 		wantDiskPath    string
+		wantDiskLayout  string
 		wantKeyMode     os.FileMode
 		wantGid         int
 		wantNamespace   string
@@ -229,6 +242,27 @@ func TestParseConfigStorage(t *testing.T) {
 			wantAccountType: "disk",
 			wantAccountPath: defaultUserDataPath,
 		},
+		{
+			name:            "certificateStorageDisk with layout",
+			config:          "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\ncertificateStorageDisk /etc/letsencrypt 640 3000 {\nlayout certbot\n}\n}",
+			wantType:        "disk",
+			wantDiskPath:    "/etc/letsencrypt",
+			wantDiskLayout:  "certbot",
+			wantKeyMode:     0640,
+			wantGid:         3000,
+			wantAccountType: "disk",
+			wantAccountPath: defaultUserDataPath,
+		},
+		{
+			name:      "certificateStorageDisk unknown layout",
+			config:    "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\ncertificateStorageDisk /srv/certs {\nlayout acme.sh\n}\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "certificateStorageDisk too many arguments",
+			config:    "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\ncertificateStorageDisk /srv/certs 640 3000 extra\n}",
+			shouldErr: true,
+		},
 		{
 			name:      "certificateStorageDisk group rejected without group mode bit",
 			config:    "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\ncertificateStorageDisk /srv/certs 600 3000\n}",
@@ -368,6 +402,9 @@ func TestParseConfigStorage(t *testing.T) {
 			if cfg.Storage.DiskPath != tc.wantDiskPath {
 				t.Errorf("storage.DiskPath = %q, want %q", cfg.Storage.DiskPath, tc.wantDiskPath)
 			}
+			if cfg.Storage.DiskLayout != tc.wantDiskLayout {
+				t.Errorf("storage.DiskLayout = %q, want %q", cfg.Storage.DiskLayout, tc.wantDiskLayout)
+			}
 			if tc.wantGid != 0 && cfg.Storage.Gid != tc.wantGid {
 				t.Errorf("storage.Gid = %d, want %d", cfg.Storage.Gid, tc.wantGid)
 			}
@@ -422,3 +459,1034 @@ func TestIsValidNameserver(t *testing.T) {
 		}
 	}
 }
+
+func TestParseConfigCA(t *testing.T) {
+	const base = "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\n"
+	tests := []struct {
+		name         string
+		config       string
+		shouldErr    bool
+		wantNames    []string
+		wantDirs     []string
+		wantAccounts []string
+		wantEAB      string
+		wantFailover uint32
+	}{
+		{
+			name:         "default is lets encrypt production",
+			config:       base + "}",
+			wantNames:    []string{"default"},
+			wantDirs:     []string{"https://acme-v02.api.letsencrypt.org/directory"},
+			wantAccounts: []string{defaultUserDataPath},
+			wantFailover: defaultCAFailoverBeforeDays,
+		},
+		{
+			name:         "customCAD becomes the default ca",
+			config:       base + "customCAD https://localhost:14000/dir\n}",
+			wantNames:    []string{"default"},
+			wantDirs:     []string{"https://localhost:14000/dir"},
+			wantAccounts: []string{defaultUserDataPath},
+			wantFailover: defaultCAFailoverBeforeDays,
+		},
+		{
+			name: "ordered ca list",
+			config: base + "caFailoverBeforeDays 3\n" +
+				"ca le https://acme-v02.api.letsencrypt.org/directory\n" +
+				"ca zerossl https://acme.zerossl.com/v2/DV90 {\neab kid hmac\naccountStorageDisk /srv/zerossl\n}\n" +
+				"accountStorageDisk /srv/acme\n}",
+			wantNames:    []string{"le", "zerossl"},
+			wantDirs:     []string{"https://acme-v02.api.letsencrypt.org/directory", "https://acme.zerossl.com/v2/DV90"},
+			wantAccounts: []string{"/srv/acme", "/srv/zerossl"},
+			wantEAB:      "kid",
+			wantFailover: 3,
+		},
+		{
+			name:      "duplicate ca name rejected",
+			config:    base + "ca a https://a.example/dir\nca a https://b.example/dir\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "ca without url rejected",
+			config:    base + "ca a\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "ca with invalid url rejected",
+			config:    base + "ca a not-a-url\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "ca combined with customCAD rejected",
+			config:    base + "customCAD https://x.example/dir\nca a https://a.example/dir\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "unknown property in ca block rejected",
+			config:    base + "ca a https://a.example/dir {\nnope\n}\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "eab with missing hmac rejected",
+			config:    base + "ca a https://a.example/dir {\neab kid\n}\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "two account backends in ca rejected",
+			config:    base + "ca a https://a.example/dir {\naccountStorageDisk /a\naccountStorageKubernetes ns\n}\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "invalid caFailoverBeforeDays rejected",
+			config:    base + "caFailoverBeforeDays soon\n}",
+			shouldErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.config)
+			c.ServerBlockKeys = []string{"example.com"}
+			cfg, err := ParseConfig(c)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(cfg.CAs) != len(tc.wantNames) {
+				t.Fatalf("got %d CAs, want %d", len(cfg.CAs), len(tc.wantNames))
+			}
+			for i, ca := range cfg.CAs {
+				if ca.Name != tc.wantNames[i] {
+					t.Errorf("CAs[%d].Name = %q, want %q", i, ca.Name, tc.wantNames[i])
+				}
+				if ca.DirURL != tc.wantDirs[i] {
+					t.Errorf("CAs[%d].DirURL = %q, want %q", i, ca.DirURL, tc.wantDirs[i])
+				}
+				if ca.Account.DiskPath != tc.wantAccounts[i] {
+					t.Errorf("CAs[%d].Account.DiskPath = %q, want %q", i, ca.Account.DiskPath, tc.wantAccounts[i])
+				}
+			}
+			if tc.wantEAB != "" && cfg.CAs[len(cfg.CAs)-1].EABKeyID != tc.wantEAB {
+				t.Errorf("EABKeyID = %q, want %q", cfg.CAs[len(cfg.CAs)-1].EABKeyID, tc.wantEAB)
+			}
+			if cfg.CAFailoverBeforeDays != tc.wantFailover {
+				t.Errorf("caFailoverBeforeDays = %d, want %d", cfg.CAFailoverBeforeDays, tc.wantFailover)
+			}
+		})
+	}
+}
+
+func TestParseConfigCASelection(t *testing.T) {
+	const base = "acmednschallenge {\nacceptedLetsEncryptToS\n"
+	const cas = "ca le https://acme-v02.api.letsencrypt.org/directory\nca step https://step.internal/acme/acme/directory {\nemail pki@example.com\n}\n"
+	tests := []struct {
+		name        string
+		config      string
+		shouldErr   bool
+		wantDefault []string
+		wantDomain  []string
+	}{
+		{
+			name:        "useCA and domainCA",
+			config:      base + "email a@b.com\n" + cas + "useCA le\ndomainCA internal.example.com step\n}",
+			wantDefault: []string{"le"},
+			wantDomain:  []string{"step"},
+		},
+		{
+			name:      "block email required when a ca has none",
+			config:    base + cas + "}",
+			shouldErr: true,
+		},
+		{
+			name:   "block email optional when every ca has one",
+			config: base + "ca step https://step.internal/dir {\nemail pki@example.com\n}\n}",
+		},
+		{
+			name:      "invalid ca email rejected",
+			config:    base + "email a@b.com\nca step https://step.internal/dir {\nemail nope\n}\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "useCA with undefined ca rejected",
+			config:    base + "email a@b.com\n" + cas + "useCA zerossl\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "domainCA with undefined ca rejected",
+			config:    base + "email a@b.com\n" + cas + "domainCA example.com zerossl\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "domainCA for unmanaged domain rejected",
+			config:    base + "email a@b.com\n" + cas + "domainCA example.org le\n}",
+			shouldErr: true,
+		},
+		{
+			name:      "missing caBundle file rejected",
+			config:    base + "email a@b.com\nca step https://step.internal/dir {\ncaBundle /does/not/exist.pem\n}\n}",
+			shouldErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.config)
+			c.ServerBlockKeys = []string{"example.com", "internal.example.com"}
+			cfg, err := ParseConfig(c)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if strings.Join(cfg.DefaultCAs, ",") != strings.Join(tc.wantDefault, ",") {
+				t.Errorf("DefaultCAs = %v, want %v", cfg.DefaultCAs, tc.wantDefault)
+			}
+			if strings.Join(cfg.DomainCAs["internal.example.com"], ",") != strings.Join(tc.wantDomain, ",") {
+				t.Errorf("DomainCAs[internal.example.com] = %v, want %v", cfg.DomainCAs["internal.example.com"], tc.wantDomain)
+			}
+			for _, ca := range cfg.CAs {
+				if ca.Email == "" {
+					t.Errorf("ca '%s' has no email", ca.Name)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckCABundle(t *testing.T) {
+	dir := t.TempDir()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "root"}, NotAfter: time.Now().Add(time.Hour), IsCA: true}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := filepath.Join(dir, "good.pem")
+	if err := os.WriteFile(good, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	bad := filepath.Join(dir, "bad.pem")
+	if err := os.WriteFile(bad, []byte("not pem"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkCABundle(good); err != nil {
+		t.Errorf("checkCABundle(good) = %v, want nil", err)
+	}
+	if err := checkCABundle(bad); err == nil {
+		t.Error("checkCABundle(bad) = nil, want error")
+	}
+	if err := checkCABundle(filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("checkCABundle(missing) = nil, want error")
+	}
+}
+
+func TestParseConfigCSRInbox(t *testing.T) {
+	const base = "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\n"
+	tests := []struct {
+		name         string
+		config       string
+		shouldErr    bool
+		wantInbox    string
+		wantInterval time.Duration
+	}{
+		{name: "disabled by default", config: base + "}"},
+		{name: "default interval", config: base + "csrInbox /srv/csr\n}", wantInbox: "/srv/csr", wantInterval: defaultCSRInboxInterval},
+		{name: "custom interval", config: base + "csrInbox /srv/csr 10s\n}", wantInbox: "/srv/csr", wantInterval: 10 * time.Second},
+		{name: "relative path rejected", config: base + "csrInbox csr\n}", shouldErr: true},
+		{name: "invalid interval rejected", config: base + "csrInbox /srv/csr soon\n}", shouldErr: true},
+		{name: "missing path rejected", config: base + "csrInbox\n}", shouldErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.config)
+			c.ServerBlockKeys = []string{"example.com"}
+			cfg, err := ParseConfig(c)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.CSRInbox != tc.wantInbox {
+				t.Errorf("CSRInbox = %q, want %q", cfg.CSRInbox, tc.wantInbox)
+			}
+			if cfg.CSRInboxInterval != tc.wantInterval {
+				t.Errorf("CSRInboxInterval = %v, want %v", cfg.CSRInboxInterval, tc.wantInterval)
+			}
+		})
+	}
+}
+
+func TestParseConfigCertificate(t *testing.T) {
+	const base = "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\nrenewBeforeDays 20\n"
+	tests := []struct {
+		name        string
+		config      string
+		shouldErr   bool
+		wantCerts   map[string]string
+		wantKeyType certcrypto.KeyType
+		wantRenew   uint32
+	}{
+		{
+			name:        "implicit certificate per zone",
+			config:      base + "}",
+			wantCerts:   map[string]string{"example.com": "example.com", "example.org": "example.org"},
+			wantKeyType: certcrypto.RSA2048,
+			wantRenew:   20,
+		},
+		{
+			name:        "block keyType is inherited",
+			config:      base + "keyType ec256\n}",
+			wantCerts:   map[string]string{"example.com": "example.com", "example.org": "example.org"},
+			wantKeyType: certcrypto.EC256,
+			wantRenew:   20,
+		},
+		{
+			name:        "named certificates replace the implicit ones",
+			config:      base + "certificate api {\ndomains www.example.com api.example.com api.example.org\nmainDomain api.example.com\nkeyType ec384\nretryInterval 1m\n}\n}",
+			wantCerts:   map[string]string{"api": "api.example.com,www.example.com,api.example.org"},
+			wantKeyType: certcrypto.EC384,
+			wantRenew:   20,
+		},
+		{
+			name:        "certificate overrides renewBeforeDays",
+			config:      base + "certificate wildcard {\ndomains *.example.com\nrenewBeforeDays 5\n}\n}",
+			wantCerts:   map[string]string{"wildcard": "*.example.com"},
+			wantKeyType: certcrypto.RSA2048,
+			wantRenew:   5,
+		},
+		{name: "domain outside zones rejected", config: base + "certificate api {\ndomains api.example.net\n}\n}", shouldErr: true},
+		{name: "missing domains rejected", config: base + "certificate api {\nkeyType ec256\n}\n}", shouldErr: true},
+		{name: "duplicate name rejected", config: base + "certificate api {\ndomains api.example.com\n}\ncertificate api {\ndomains www.example.com\n}\n}", shouldErr: true},
+		{name: "invalid keyType rejected", config: base + "certificate api {\ndomains api.example.com\nkeyType dsa\n}\n}", shouldErr: true},
+		{name: "invalid name rejected", config: base + "certificate a/b {\ndomains api.example.com\n}\n}", shouldErr: true},
+		{name: "unknown property rejected", config: base + "certificate api {\ndomains api.example.com\nfoo bar\n}\n}", shouldErr: true},
+		{name: "additionalSans with certificate rejected", config: base + "additionalSans www.example.com\ncertificate api {\ndomains api.example.com\n}\n}", shouldErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.config)
+			c.ServerBlockKeys = []string{"example.com", "example.org"}
+			cfg, err := ParseConfig(c)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(cfg.Certificates) != len(tc.wantCerts) {
+				t.Fatalf("Certificates = %v, want %v", cfg.Certificates, tc.wantCerts)
+			}
+			for name, domains := range tc.wantCerts {
+				cert, ok := cfg.Certificates[name]
+				if !ok {
+					t.Fatalf("certificate '%s' missing", name)
+				}
+				if strings.Join(cert.Domains, ",") != domains {
+					t.Errorf("%s: Domains = %v, want %s", name, cert.Domains, domains)
+				}
+				if cert.KeyType != tc.wantKeyType {
+					t.Errorf("%s: KeyType = %s, want %s", name, cert.KeyType, tc.wantKeyType)
+				}
+				if cert.RenewBeforeDays != tc.wantRenew {
+					t.Errorf("%s: RenewBeforeDays = %d, want %d", name, cert.RenewBeforeDays, tc.wantRenew)
+				}
+				if ZoneOf(cert.Domains[0], cfg.Zones) != cert.Zone {
+					t.Errorf("%s: Zone = %s, want the zone of %s", name, cert.Zone, cert.Domains[0])
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfigZone(t *testing.T) {
+	const base = "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\nrenewBeforeDays 20\n"
+	tests := []struct {
+		name      string
+		config    string
+		shouldErr bool
+		check     func(t *testing.T, cfg *ACMEChallengeConfig)
+	}{
+		{
+			name:   "additionalSans per zone",
+			config: base + "zone example.org {\nadditionalSans *.example.org\n}\nzone example.net {\nadditionalSans *.example.net www.example.net\n}\n}",
+			check: func(t *testing.T, cfg *ACMEChallengeConfig) {
+				if got := strings.Join(cfg.Certificates["example.org"].Domains, ","); got != "example.org,*.example.org" {
+					t.Errorf("example.org Domains = %s", got)
+				}
+				if got := strings.Join(cfg.Certificates["example.net"].Domains, ","); got != "example.net,*.example.net,www.example.net" {
+					t.Errorf("example.net Domains = %s", got)
+				}
+			},
+		},
+		{
+			name:   "additionalSans normalized",
+			config: base + "additionalSans WWW.Example.org api.example.org.\nzone example.net {\nadditionalSans *.EXAMPLE.net www.example.net.\n}\n}",
+			check: func(t *testing.T, cfg *ACMEChallengeConfig) {
+				if got := strings.Join(cfg.Certificates["example.org"].Domains, ","); got != "example.org,www.example.org,api.example.org" {
+					t.Errorf("example.org Domains = %s", got)
+				}
+				if got := strings.Join(cfg.Certificates["example.net"].Domains, ","); got != "example.net,*.example.net,www.example.net" {
+					t.Errorf("example.net Domains = %s", got)
+				}
+			},
+		},
+		{
+			name:   "block additionalSans overridden where they do not fit",
+			config: base + "additionalSans *.example.org\nzone example.net {\nadditionalSans *.example.net\n}\n}",
+			check: func(t *testing.T, cfg *ACMEChallengeConfig) {
+				if got := strings.Join(cfg.Certificates["example.org"].Domains, ","); got != "example.org,*.example.org" {
+					t.Errorf("example.org Domains = %s", got)
+				}
+				if got := strings.Join(cfg.Certificates["example.net"].Domains, ","); got != "example.net,*.example.net" {
+					t.Errorf("example.net Domains = %s", got)
+				}
+			},
+		},
+		{
+			name:   "settings overridden and inherited",
+			config: base + "keyType ec256\nzone example.net {\nrenewBeforeDays 5\ncertificateStorageKubernetes net-certs\nuseCA default\n}\n}",
+			check: func(t *testing.T, cfg *ACMEChallengeConfig) {
+				org, net := cfg.Certificates["example.org"], cfg.Certificates["example.net"]
+				if org.RenewBeforeDays != 20 || net.RenewBeforeDays != 5 {
+					t.Errorf("RenewBeforeDays = %d/%d, want 20/5", org.RenewBeforeDays, net.RenewBeforeDays)
+				}
+				if org.KeyType != certcrypto.EC256 || net.KeyType != certcrypto.EC256 {
+					t.Errorf("KeyType = %s/%s, want the block keyType for both", org.KeyType, net.KeyType)
+				}
+				if org.Storage != cfg.Storage {
+					t.Errorf("example.org Storage = %+v, want the block storage", org.Storage)
+				}
+				if net.Storage.Type != "kubernetesSecrets" || net.Storage.Namespace != "net-certs" {
+					t.Errorf("example.net Storage = %+v, want kubernetes net-certs", net.Storage)
+				}
+				if strings.Join(cfg.DomainCAs["example.net"], ",") != "default" {
+					t.Errorf("DomainCAs[example.net] = %v, want default", cfg.DomainCAs["example.net"])
+				}
+			},
+		},
+		{
+			name:   "certificate inherits from its zone",
+			config: base + "zone example.net {\nkeyType ec384\n}\ncertificate api {\ndomains api.example.net\n}\n}",
+			check: func(t *testing.T, cfg *ACMEChallengeConfig) {
+				if cert := cfg.Certificates["api"]; cert.KeyType != certcrypto.EC384 || cert.RenewBeforeDays != 20 {
+					t.Errorf("api = %s/%d, want ec384/20", cert.KeyType, cert.RenewBeforeDays)
+				}
+			},
+		},
+		{name: "block additionalSans not fitting a zone rejected", config: base + "additionalSans *.example.org\n}", shouldErr: true},
+		{name: "zone additionalSans outside the zone rejected", config: base + "zone example.net {\nadditionalSans *.example.org\n}\n}", shouldErr: true},
+		{name: "unknown zone rejected", config: base + "zone example.com {\nkeyType ec256\n}\n}", shouldErr: true},
+		{name: "duplicate zone rejected", config: base + "zone example.net {\nkeyType ec256\n}\nzone example.net {\nrenewBeforeDays 5\n}\n}", shouldErr: true},
+		{name: "unknown property rejected", config: base + "zone example.net {\nemail x@y.com\n}\n}", shouldErr: true},
+		{name: "two storages rejected", config: base + "zone example.net {\ncertificateStorageKubernetes a\ncertificateStorageDisk /tmp/b\n}\n}", shouldErr: true},
+		{name: "useCA with domainCA for the zone rejected", config: base + "domainCA example.net default\nzone example.net {\nuseCA default\n}\n}", shouldErr: true},
+		{name: "useCA with undefined ca rejected", config: base + "zone example.net {\nuseCA step\n}\n}", shouldErr: true},
+		{name: "zone additionalSans with certificate rejected", config: base + "zone example.net {\nadditionalSans www.example.net\n}\ncertificate api {\ndomains api.example.net\n}\n}", shouldErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.config)
+			c.ServerBlockKeys = []string{"example.org", "example.net"}
+			cfg, err := ParseConfig(c)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			tc.check(t, cfg)
+		})
+	}
+}
+
+func TestParseConfigCombineZones(t *testing.T) {
+	const base = "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\n"
+	const cas = "ca a https://a.example/dir\nca b https://b.example/dir\n"
+	tests := []struct {
+		name        string
+		config      string
+		shouldErr   bool
+		wantName    string
+		wantDomains string
+		wantKeyType certcrypto.KeyType
+	}{
+		{
+			name:        "first zone is the main name",
+			config:      base + "combineZones\n}",
+			wantName:    "example.org",
+			wantDomains: "example.org,example.com,example.net",
+		},
+		{
+			name:        "configured main name with zone sans",
+			config:      base + "combineZones www.example.com\nzone example.org {\nadditionalSans *.example.org\n}\n}",
+			wantName:    "www.example.com",
+			wantDomains: "www.example.com,example.org,*.example.org,example.com,example.net",
+		},
+		{
+			name:        "main name that is a zone is not repeated",
+			config:      base + "combineZones example.net\n}",
+			wantName:    "example.net",
+			wantDomains: "example.net,example.org,example.com",
+		},
+		{
+			name:        "block-level sans of any zone",
+			config:      base + "combineZones\nadditionalSans *.example.org www.example.net\n}",
+			wantName:    "example.org",
+			wantDomains: "example.org,*.example.org,www.example.net,example.com,example.net",
+		},
+		{
+			name:        "settings of the main zone apply",
+			config:      base + "combineZones\nzone example.org {\nkeyType ec256\n}\n}",
+			wantName:    "example.org",
+			wantDomains: "example.org,example.com,example.net",
+			wantKeyType: certcrypto.EC256,
+		},
+		{
+			name:        "same override in another zone",
+			config:      base + "combineZones\nzone example.org {\nkeyType ec256\n}\nzone example.com {\nkeyType ec256\n}\n}",
+			wantName:    "example.org",
+			wantDomains: "example.org,example.com,example.net",
+			wantKeyType: certcrypto.EC256,
+		},
+		{
+			name:        "same ca in another zone",
+			config:      base + cas + "combineZones\ndomainCA example.org b\ndomainCA example.com b\n}",
+			wantName:    "example.org",
+			wantDomains: "example.org,example.com,example.net",
+		},
+		{name: "keyType of another zone rejected", config: base + "combineZones\nzone example.com {\nkeyType ec256\n}\n}", shouldErr: true},
+		{name: "renewBeforeDays of another zone rejected", config: base + "combineZones\nzone example.com {\nrenewBeforeDays 20\n}\n}", shouldErr: true},
+		{name: "storage of another zone rejected", config: base + "combineZones\nzone example.net {\ncertificateStorageDisk /srv/net\n}\n}", shouldErr: true},
+		{name: "useCA of another zone rejected", config: base + cas + "combineZones\nzone example.com {\nuseCA b\n}\n}", shouldErr: true},
+		{name: "domainCA of another zone rejected", config: base + cas + "combineZones\ndomainCA example.org a\ndomainCA example.net b\n}", shouldErr: true},
+		{name: "block-level san outside the zones rejected", config: base + "combineZones\nadditionalSans www.example.io\n}", shouldErr: true},
+		{name: "zone san of another zone rejected", config: base + "combineZones\nzone example.org {\nadditionalSans www.example.net\n}\n}", shouldErr: true},
+		{name: "main name outside the zones rejected", config: base + "combineZones example.io\n}", shouldErr: true},
+		{name: "extra argument rejected", config: base + "combineZones example.org example.com\n}", shouldErr: true},
+		{name: "certificate blocks rejected", config: base + "combineZones\ncertificate api {\ndomains api.example.org\n}\n}", shouldErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.config)
+			c.ServerBlockKeys = []string{"example.org", "example.com", "example.net"}
+			cfg, err := ParseConfig(c)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if len(cfg.Certificates) != 1 {
+				t.Fatalf("Certificates = %v, want one combined certificate", cfg.Certificates)
+			}
+			cert, ok := cfg.Certificates[tc.wantName]
+			if !ok {
+				t.Fatalf("combined certificate not stored as '%s': %v", tc.wantName, cfg.Certificates)
+			}
+			if got := strings.Join(cert.Domains, ","); got != tc.wantDomains {
+				t.Errorf("Domains = %s, want %s", got, tc.wantDomains)
+			}
+			if tc.wantKeyType != "" && cert.KeyType != tc.wantKeyType {
+				t.Errorf("KeyType = %s, want %s", cert.KeyType, tc.wantKeyType)
+			}
+		})
+	}
+}
+
+func TestParseConfigOrderLimits(t *testing.T) {
+	const base = "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\n"
+	tests := []struct {
+		name         string
+		config       string
+		shouldErr    bool
+		wantWorkers  uint32
+		wantLimits   map[string]uint32
+		wantInterval time.Duration
+	}{
+		{name: "defaults", config: base + "}", wantWorkers: defaultMaxConcurrentOrders, wantLimits: map[string]uint32{"default": 0}},
+		{name: "workers", config: base + "maxConcurrentOrders 8\n}", wantWorkers: 8, wantLimits: map[string]uint32{"default": 0}},
+		{
+			name:         "block limit applies to the default ca",
+			config:       base + "orderLimit 300 3h\n}",
+			wantWorkers:  defaultMaxConcurrentOrders,
+			wantLimits:   map[string]uint32{"default": 300},
+			wantInterval: 3 * time.Hour,
+		},
+		{
+			name:         "ca limit overrides the block limit",
+			config:       base + "orderLimit 300 3h\nca le https://le.example/dir\nca step https://step.example/dir {\norderLimit 10 3h\n}\n}",
+			wantWorkers:  defaultMaxConcurrentOrders,
+			wantLimits:   map[string]uint32{"le": 300, "step": 10},
+			wantInterval: 3 * time.Hour,
+		},
+		{name: "zero workers rejected", config: base + "maxConcurrentOrders 0\n}", shouldErr: true},
+		{name: "zero orders rejected", config: base + "orderLimit 0 1h\n}", shouldErr: true},
+		{name: "missing interval rejected", config: base + "orderLimit 10\n}", shouldErr: true},
+		{name: "invalid interval rejected", config: base + "orderLimit 10 soon\n}", shouldErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.config)
+			c.ServerBlockKeys = []string{"example.com"}
+			cfg, err := ParseConfig(c)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.MaxConcurrentOrders != tc.wantWorkers {
+				t.Errorf("MaxConcurrentOrders = %d, want %d", cfg.MaxConcurrentOrders, tc.wantWorkers)
+			}
+			for _, ca := range cfg.CAs {
+				if ca.OrderLimit != tc.wantLimits[ca.Name] {
+					t.Errorf("ca '%s' OrderLimit = %d, want %d", ca.Name, ca.OrderLimit, tc.wantLimits[ca.Name])
+				}
+				if ca.OrderLimit > 0 && ca.OrderLimitInterval != tc.wantInterval {
+					t.Errorf("ca '%s' OrderLimitInterval = %s, want %s", ca.Name, ca.OrderLimitInterval, tc.wantInterval)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfigProfile(t *testing.T) {
+	c := caddy.NewTestController("dns", "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\nprofile tlsserver\ncertificate short {\ndomains www.example.com\nprofile shortlived\n}\ncertificate api {\ndomains api.example.com\n}\n}")
+	c.ServerBlockKeys = []string{"example.com"}
+	cfg, err := ParseConfig(c)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := cfg.Certificates["short"].Profile; got != "shortlived" {
+		t.Errorf("short Profile = %q, want shortlived", got)
+	}
+	if got := cfg.Certificates["api"].Profile; got != "tlsserver" {
+		t.Errorf("api Profile = %q, want the block profile", got)
+	}
+}
+
+func TestParseConfigPruneOrphans(t *testing.T) {
+	const base = "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\n"
+	tests := []struct {
+		name        string
+		config      string
+		shouldErr   bool
+		wantPrune   string
+		wantArchive string
+		wantGrace   time.Duration
+	}{
+		{name: "off by default", config: base + "}", wantGrace: 24 * time.Hour},
+		{name: "delete", config: base + "pruneOrphans delete\n}", wantPrune: PruneDelete, wantGrace: 24 * time.Hour},
+		{name: "archive", config: base + "pruneOrphans archive /srv/archive\n}", wantPrune: PruneArchive, wantArchive: "/srv/archive", wantGrace: 24 * time.Hour},
+		{name: "archive without path rejected", config: base + "pruneOrphans archive\n}", shouldErr: true},
+		{name: "relative archive path rejected", config: base + "pruneOrphans archive archive\n}", shouldErr: true},
+		{name: "unknown policy rejected", config: base + "pruneOrphans keep\n}", shouldErr: true},
+		{name: "extra argument rejected", config: base + "pruneOrphans delete now\n}", shouldErr: true},
+		{name: "grace period", config: base + "pruneOrphans delete\npruneGracePeriod 1h\n}", wantPrune: PruneDelete, wantGrace: time.Hour},
+		{name: "no grace period", config: base + "pruneOrphans delete\npruneGracePeriod 0s\n}", wantPrune: PruneDelete},
+		{name: "negative grace period rejected", config: base + "pruneGracePeriod -1h\n}", shouldErr: true},
+		{name: "invalid grace period rejected", config: base + "pruneGracePeriod soon\n}", shouldErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.config)
+			c.ServerBlockKeys = []string{"example.com"}
+			cfg, err := ParseConfig(c)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.PruneOrphans != tc.wantPrune || cfg.PruneArchivePath != tc.wantArchive {
+				t.Errorf("pruneOrphans = %q %q, want %q %q", cfg.PruneOrphans, cfg.PruneArchivePath, tc.wantPrune, tc.wantArchive)
+			}
+			if cfg.PruneGracePeriod != tc.wantGrace {
+				t.Errorf("pruneGracePeriod = %v, want %v", cfg.PruneGracePeriod, tc.wantGrace)
+			}
+		})
+	}
+}
+
+func TestParseConfigEncryption(t *testing.T) {
+	const base = "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\n"
+	tests := []struct {
+		name      string
+		config    string
+		shouldErr bool
+		wantTypes []string
+	}{
+		{name: "off by default", config: base + "}"},
+		{
+			name:      "rotation",
+			config:    base + "encryptPrivateKeys {\nfile /etc/coredns/new.key\nage age1abc /etc/coredns/age.txt\nvaultTransit transit acme kubernetes coredns\n}\n}",
+			wantTypes: []string{"file", "age", "vaultTransit"},
+		},
+		{name: "empty block rejected", config: base + "encryptPrivateKeys {\n}\n}", shouldErr: true},
+		{name: "relative key file rejected", config: base + "encryptPrivateKeys {\nfile new.key\n}\n}", shouldErr: true},
+		{name: "age without identity rejected", config: base + "encryptPrivateKeys {\nage age1abc\n}\n}", shouldErr: true},
+		{name: "bad vault auth rejected", config: base + "encryptPrivateKeys {\nvaultTransit transit acme kubernetes\n}\n}", shouldErr: true},
+		{name: "unknown provider rejected", config: base + "encryptPrivateKeys {\nkms arn\n}\n}", shouldErr: true},
+		{name: "too many providers rejected", config: base + "encryptPrivateKeys {\nfile /a\nfile /b\nfile /c\nfile /d\nfile /e\n}\n}", shouldErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.config)
+			c.ServerBlockKeys = []string{"example.com"}
+			cfg, err := ParseConfig(c)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			// Every storage holding private keys is encrypted alike.
+			all := []storage.Options{cfg.Storage, cfg.Account, cfg.CAs[0].Account, cfg.Certificates["example.com"].Storage}
+			for _, o := range all {
+				var types []string
+				for _, k := range o.Encryption {
+					if k.Type != "" {
+						types = append(types, k.Type)
+					}
+				}
+				if !slices.Equal(types, tc.wantTypes) {
+					t.Errorf("%s storage encryption = %v, want %v", o.Type, types, tc.wantTypes)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfigS3(t *testing.T) {
+	const base = "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\n"
+	tests := []struct {
+		name        string
+		config      string
+		shouldErr   bool
+		wantStorage storage.Options
+		wantAccount storage.Options
+	}{
+		{
+			name:        "certificates on AWS",
+			config:      base + "certificateStorageS3 my-bucket coredns/certs\n}",
+			wantStorage: storage.Options{Type: "s3", DiskPath: defaultCertSavePath, KeyMode: 0600, S3Bucket: "my-bucket", S3Prefix: "coredns/certs"},
+			wantAccount: storage.Options{Type: "disk", DiskPath: defaultUserDataPath},
+		},
+		{
+			name: "minio with settings",
+			config: base + "certificateStorageS3 certs coredns {\nendpoint https://minio.local:9000\nregion eu-1\npathStyle\ncredentialsFile /etc/coredns/s3\nsse aws:kms alias/acme\n}\n" +
+				"accountStorageS3 certs accounts {\nsse AES256\n}\n}",
+			wantStorage: storage.Options{Type: "s3", DiskPath: defaultCertSavePath, KeyMode: 0600, S3Bucket: "certs", S3Prefix: "coredns", S3Endpoint: "https://minio.local:9000", S3Region: "eu-1",
+				S3PathStyle: true, S3CredentialsFile: "/etc/coredns/s3", S3SSE: "aws:kms", S3KMSKeyID: "alias/acme"},
+			wantAccount: storage.Options{Type: "s3", DiskPath: defaultUserDataPath, S3Bucket: "certs", S3Prefix: "accounts", S3SSE: "AES256"},
+		},
+		{name: "missing prefix rejected", config: base + "certificateStorageS3 certs\n}", shouldErr: true},
+		{name: "endpoint without scheme rejected", config: base + "certificateStorageS3 certs p {\nendpoint minio.local\n}\n}", shouldErr: true},
+		{name: "relative credentials file rejected", config: base + "accountStorageS3 certs p {\ncredentialsFile s3\n}\n}", shouldErr: true},
+		{name: "unknown sse rejected", config: base + "certificateStorageS3 certs p {\nsse aws:kms:dsse\n}\n}", shouldErr: true},
+		{name: "AES256 with key rejected", config: base + "certificateStorageS3 certs p {\nsse AES256 alias/acme\n}\n}", shouldErr: true},
+		{name: "unknown setting rejected", config: base + "certificateStorageS3 certs p {\nacl private\n}\n}", shouldErr: true},
+		{name: "disk and s3 backends rejected", config: base + "certificateStorageDisk /srv/certs\ncertificateStorageS3 certs p\n}", shouldErr: true},
+		{name: "vault and s3 accounts rejected", config: base + "accountStorageVault secret p\naccountStorageS3 certs p\n}", shouldErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.config)
+			c.ServerBlockKeys = []string{"example.com"}
+			cfg, err := ParseConfig(c)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.Storage != tc.wantStorage {
+				t.Errorf("storage = %+v, want %+v", cfg.Storage, tc.wantStorage)
+			}
+			if cfg.Account != tc.wantAccount {
+				t.Errorf("account = %+v, want %+v", cfg.Account, tc.wantAccount)
+			}
+		})
+	}
+}
+
+func TestParseConfigEtcd(t *testing.T) {
+	const base = "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\n"
+	tests := []struct {
+		name        string
+		config      string
+		shouldErr   bool
+		wantStorage storage.Options
+		wantAccount storage.Options
+	}{
+		{
+			name:        "local etcd",
+			config:      base + "certificateStorageEtcd /coredns/certs\n}",
+			wantStorage: storage.Options{Type: "etcd", DiskPath: defaultCertSavePath, KeyMode: 0600, EtcdPrefix: "/coredns/certs"},
+			wantAccount: storage.Options{Type: "disk", DiskPath: defaultUserDataPath},
+		},
+		{
+			name: "cluster with client certificate",
+			config: base + "certificateStorageEtcd /coredns/certs {\nendpoint https://etcd-0:2379 https://etcd-1:2379\ntls /etc/etcd/client.crt /etc/etcd/client.key /etc/etcd/ca.crt\n}\n" +
+				"accountStorageEtcd /coredns/accounts {\ncredentials coredns secret\ntls /etc/etcd/ca.crt\n}\n}",
+			wantStorage: storage.Options{Type: "etcd", DiskPath: defaultCertSavePath, KeyMode: 0600, EtcdPrefix: "/coredns/certs",
+				EtcdEndpoints: "https://etcd-0:2379 https://etcd-1:2379", EtcdTLS: true, EtcdTLSArgs: [3]string{"/etc/etcd/client.crt", "/etc/etcd/client.key", "/etc/etcd/ca.crt"}},
+			wantAccount: storage.Options{Type: "etcd", DiskPath: defaultUserDataPath, EtcdPrefix: "/coredns/accounts",
+				EtcdUsername: "coredns", EtcdPassword: "secret", EtcdTLS: true, EtcdTLSArgs: [3]string{"/etc/etcd/ca.crt"}},
+		},
+		{name: "missing prefix rejected", config: base + "certificateStorageEtcd\n}", shouldErr: true},
+		{name: "endpoint without address rejected", config: base + "certificateStorageEtcd /p {\nendpoint\n}\n}", shouldErr: true},
+		{name: "credentials without password rejected", config: base + "accountStorageEtcd /p {\ncredentials coredns\n}\n}", shouldErr: true},
+		{name: "relative tls file rejected", config: base + "certificateStorageEtcd /p {\ntls client.crt client.key\n}\n}", shouldErr: true},
+		{name: "too many tls files rejected", config: base + "certificateStorageEtcd /p {\ntls /a /b /c /d\n}\n}", shouldErr: true},
+		{name: "s3 and etcd backends rejected", config: base + "certificateStorageS3 certs p\ncertificateStorageEtcd /p\n}", shouldErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.config)
+			c.ServerBlockKeys = []string{"example.com"}
+			cfg, err := ParseConfig(c)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.Storage != tc.wantStorage {
+				t.Errorf("storage = %+v, want %+v", cfg.Storage, tc.wantStorage)
+			}
+			if cfg.Account != tc.wantAccount {
+				t.Errorf("account = %+v, want %+v", cfg.Account, tc.wantAccount)
+			}
+		})
+	}
+}
+
+func TestParseConfigSQL(t *testing.T) {
+	const base = "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\n"
+	tests := []struct {
+		name        string
+		config      string
+		shouldErr   bool
+		wantStorage storage.Options
+		wantAccount storage.Options
+	}{
+		{
+			name:        "postgres certificates, sqlite account",
+			config:      base + "certificateStorageSQL postgres postgres://coredns@db/acme?sslmode=verify-full\naccountStorageSQL sqlite /var/lib/coredns/acme.db\n}",
+			wantStorage: storage.Options{Type: "sql", DiskPath: defaultCertSavePath, KeyMode: 0600, SQLDriver: "postgres", SQLDSN: "postgres://coredns@db/acme?sslmode=verify-full"},
+			wantAccount: storage.Options{Type: "sql", DiskPath: defaultUserDataPath, SQLDriver: "sqlite", SQLDSN: "/var/lib/coredns/acme.db"},
+		},
+		{name: "missing dsn rejected", config: base + "certificateStorageSQL postgres\n}", shouldErr: true},
+		{name: "unknown database rejected", config: base + "certificateStorageSQL mysql user@/acme\n}", shouldErr: true},
+		{name: "relative sqlite path rejected", config: base + "accountStorageSQL sqlite acme.db\n}", shouldErr: true},
+		{name: "etcd and sql backends rejected", config: base + "certificateStorageEtcd /p\ncertificateStorageSQL sqlite /acme.db\n}", shouldErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.config)
+			c.ServerBlockKeys = []string{"example.com"}
+			cfg, err := ParseConfig(c)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.Storage != tc.wantStorage {
+				t.Errorf("storage = %+v, want %+v", cfg.Storage, tc.wantStorage)
+			}
+			if cfg.Account != tc.wantAccount {
+				t.Errorf("account = %+v, want %+v", cfg.Account, tc.wantAccount)
+			}
+		})
+	}
+}
+
+func TestParseConfigSecretsManager(t *testing.T) {
+	const base = "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\n"
+	tests := []struct {
+		name        string
+		config      string
+		shouldErr   bool
+		wantStorage storage.Options
+		wantAccount storage.Options
+	}{
+		{
+			name:        "prefix only",
+			config:      base + "certificateStorageAwsSecretsManager coredns/certs\naccountStorageAwsSecretsManager coredns/accounts\n}",
+			wantStorage: storage.Options{Type: "awsSecretsManager", DiskPath: defaultCertSavePath, KeyMode: 0600, SecretsManagerPrefix: "coredns/certs"},
+			wantAccount: storage.Options{Type: "awsSecretsManager", DiskPath: defaultUserDataPath, SecretsManagerPrefix: "coredns/accounts"},
+		},
+		{
+			name: "all settings",
+			config: base + "certificateStorageAwsSecretsManager coredns/certs {\nregion eu-west-1\nendpoint http://localhost:4566\n" +
+				"credentialsFile /etc/coredns/aws\nkmsKeyId alias/coredns\ntag team dns\ntag env prod\n}\n}",
+			wantStorage: storage.Options{
+				Type: "awsSecretsManager", DiskPath: defaultCertSavePath, KeyMode: 0600,
+				SecretsManagerPrefix: "coredns/certs", SecretsManagerRegion: "eu-west-1", SecretsManagerEndpoint: "http://localhost:4566",
+				SecretsManagerCredentialsFile: "/etc/coredns/aws", SecretsManagerKMSKeyID: "alias/coredns", SecretsManagerTags: "env=prod&team=dns",
+			},
+			wantAccount: storage.Options{Type: "disk", DiskPath: defaultUserDataPath},
+		},
+		{name: "missing prefix rejected", config: base + "certificateStorageAwsSecretsManager\n}", shouldErr: true},
+		{name: "relative credentials file rejected", config: base + "certificateStorageAwsSecretsManager p {\ncredentialsFile aws\n}\n}", shouldErr: true},
+		{name: "invalid endpoint rejected", config: base + "certificateStorageAwsSecretsManager p {\nendpoint localhost:4566\n}\n}", shouldErr: true},
+		{name: "tag without value rejected", config: base + "certificateStorageAwsSecretsManager p {\ntag team\n}\n}", shouldErr: true},
+		{name: "reserved tag rejected", config: base + "certificateStorageAwsSecretsManager p {\ntag aws:owner me\n}\n}", shouldErr: true},
+		{name: "duplicate tag rejected", config: base + "certificateStorageAwsSecretsManager p {\ntag team a\ntag team b\n}\n}", shouldErr: true},
+		{name: "unknown setting rejected", config: base + "certificateStorageAwsSecretsManager p {\nsse AES256\n}\n}", shouldErr: true},
+		{name: "s3 and secrets manager backends rejected", config: base + "certificateStorageS3 b p\ncertificateStorageAwsSecretsManager p\n}", shouldErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.config)
+			c.ServerBlockKeys = []string{"example.com"}
+			cfg, err := ParseConfig(c)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.Storage != tc.wantStorage {
+				t.Errorf("storage = %+v, want %+v", cfg.Storage, tc.wantStorage)
+			}
+			if cfg.Account != tc.wantAccount {
+				t.Errorf("account = %+v, want %+v", cfg.Account, tc.wantAccount)
+			}
+		})
+	}
+}
+
+func TestParseConfigKubernetes(t *testing.T) {
+	const base = "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\n"
+	tests := []struct {
+		name        string
+		config      string
+		shouldErr   bool
+		wantStorage storage.Options
+		wantAccount storage.Options
+	}{
+		{
+			name:        "replicated to namespaces and a selector",
+			config:      base + "certificateStorageKubernetes certs {\nreplicate ingress-a ingress-b\nreplicate ingress-c\nreplicateSelector tls=wildcard,env!=dev\n}\naccountStorageKubernetes acme\n}",
+			wantStorage: storage.Options{Type: "kubernetesSecrets", DiskPath: defaultCertSavePath, KeyMode: 0600, Namespace: "certs", ReplicateNamespaces: "ingress-a ingress-b ingress-c", ReplicateSelector: "tls=wildcard,env!=dev"},
+			wantAccount: storage.Options{Type: "kubernetesSecrets", DiskPath: defaultUserDataPath, Namespace: "acme"},
+		},
+		{name: "replicate without namespaces rejected", config: base + "certificateStorageKubernetes certs {\nreplicate\n}\n}", shouldErr: true},
+		{name: "invalid namespace rejected", config: base + "certificateStorageKubernetes certs {\nreplicate Ingress_A\n}\n}", shouldErr: true},
+		{name: "invalid selector rejected", config: base + "certificateStorageKubernetes certs {\nreplicateSelector tls in (a\n}\n}", shouldErr: true},
+		{name: "replicated account rejected", config: base + "accountStorageKubernetes acme {\nreplicate other\n}\n}", shouldErr: true},
+		{
+			name: "secret layout",
+			config: base + "certificateStorageKubernetes certs {\nname tls-{{.Name}}\nlabel team dns\nlabel app.kubernetes.io/part-of edge\n" +
+				"annotation reflector.v1.k8s.emberstack.com/reflection-allowed true\ncertManagerAnnotations\ncaCert\nformat combinedPEM\nformat pkcs12 changeit\n}\n" +
+				"accountStorageKubernetes acme {\nlabel team dns\n}\n}",
+			wantStorage: storage.Options{
+				Type: "kubernetesSecrets", DiskPath: defaultCertSavePath, KeyMode: 0600, Namespace: "certs",
+				SecretName: "tls-{{.Name}}", SecretLabels: "app.kubernetes.io%2Fpart-of=edge&team=dns",
+				SecretAnnotations: "reflector.v1.k8s.emberstack.com%2Freflection-allowed=true", SecretCertManager: true, SecretCACert: true,
+				SecretFormats: "combinedPEM pkcs12", SecretPKCS12Password: "changeit",
+			},
+			wantAccount: storage.Options{Type: "kubernetesSecrets", DiskPath: defaultUserDataPath, Namespace: "acme", SecretLabels: "team=dns"},
+		},
+		{
+			name:        "adopt",
+			config:      base + "certificateStorageKubernetes certs {\nadopt\n}\naccountStorageKubernetes acme {\nadopt\n}\n}",
+			wantStorage: storage.Options{Type: "kubernetesSecrets", DiskPath: defaultCertSavePath, KeyMode: 0600, Namespace: "certs", SecretAdopt: true},
+			wantAccount: storage.Options{Type: "kubernetesSecrets", DiskPath: defaultUserDataPath, Namespace: "acme", SecretAdopt: true},
+		},
+		{name: "adopt with argument rejected", config: base + "certificateStorageKubernetes certs {\nadopt helm\n}\n}", shouldErr: true},
+		{
+			name:        "event object",
+			config:      base + "certificateStorageKubernetes certs {\neventObject Deployment coredns kube-system\n}\naccountStorageKubernetes acme\n}",
+			wantStorage: storage.Options{Type: "kubernetesSecrets", DiskPath: defaultCertSavePath, KeyMode: 0600, Namespace: "certs", EventKind: "Deployment", EventName: "coredns", EventNamespace: "kube-system"},
+			wantAccount: storage.Options{Type: "kubernetesSecrets", DiskPath: defaultUserDataPath, Namespace: "acme"},
+		},
+		{name: "event object of unknown kind rejected", config: base + "certificateStorageKubernetes certs {\neventObject Service coredns\n}\n}", shouldErr: true},
+		{name: "event object without name rejected", config: base + "certificateStorageKubernetes certs {\neventObject Deployment\n}\n}", shouldErr: true},
+		{name: "account event object rejected", config: base + "accountStorageKubernetes acme {\neventObject Deployment coredns\n}\n}", shouldErr: true},
+		{name: "constant name rejected", config: base + "certificateStorageKubernetes certs {\nname tls\n}\n}", shouldErr: true},
+		{name: "invalid name template rejected", config: base + "certificateStorageKubernetes certs {\nname {{.Name\n}\n}", shouldErr: true},
+		{name: "account name rejected", config: base + "accountStorageKubernetes acme {\nname {{.Name}}\n}\n}", shouldErr: true},
+		{name: "reserved label rejected", config: base + "certificateStorageKubernetes certs {\nlabel app.kubernetes.io/managed-by helm\n}\n}", shouldErr: true},
+		{name: "invalid label value rejected", config: base + "certificateStorageKubernetes certs {\nlabel team a/b\n}\n}", shouldErr: true},
+		{name: "reserved annotation rejected", config: base + "certificateStorageKubernetes certs {\nannotation acmednschallenge/domain x\n}\n}", shouldErr: true},
+		{name: "pkcs12 without password rejected", config: base + "certificateStorageKubernetes certs {\nformat pkcs12\n}\n}", shouldErr: true},
+		{name: "unknown format rejected", config: base + "certificateStorageKubernetes certs {\nformat jks\n}\n}", shouldErr: true},
+		{name: "duplicate format rejected", config: base + "certificateStorageKubernetes certs {\nformat der\nformat der\n}\n}", shouldErr: true},
+		{
+			name:      "format with encrypted keys rejected",
+			config:    base + "certificateStorageKubernetes certs {\nformat der\n}\nencryptPrivateKeys {\nfile /etc/coredns/keys/a\n}\n}",
+			shouldErr: true,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := caddy.NewTestController("dns", tc.config)
+			c.ServerBlockKeys = []string{"example.com"}
+			cfg, err := ParseConfig(c)
+			if tc.shouldErr {
+				if err == nil {
+					t.Fatalf("expected error, got none")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if cfg.Storage != tc.wantStorage {
+				t.Errorf("storage = %+v, want %+v", cfg.Storage, tc.wantStorage)
+			}
+			if cfg.Account != tc.wantAccount {
+				t.Errorf("account = %+v, want %+v", cfg.Account, tc.wantAccount)
+			}
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"path/filepath"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+)
+
+// parseEncryption parses the encryptPrivateKeys block: one key provider per line, the one encrypting
+// new keys first, followed by retired ones still needed to decrypt older keys.
+func parseEncryption(c *caddy.Controller) ([storage.MaxEncryptionKeys]storage.KeyOptions, error) {
+	var keys [storage.MaxEncryptionKeys]storage.KeyOptions
+	n := 0
+	err := parseSubBlock(c, func(directive string) error {
+		if n == len(keys) {
+			return c.Errf("encryptPrivateKeys takes at most %d key providers", len(keys))
+		}
+		args := c.RemainingArgs()
+		k := &keys[n]
+		switch directive {
+		case "file":
+			if len(args) != 1 {
+				return c.Err("encryptPrivateKeys 'file' requires the key file: file <path>")
+			}
+			if !filepath.IsAbs(args[0]) {
+				return c.Errf("encryptPrivateKeys key file must be an absolute path: %v", args[0])
+			}
+			k.Type = "file"
+			k.Path = args[0]
+		case "age":
+			if len(args) != 2 {
+				return c.Err("encryptPrivateKeys 'age' requires a recipient and an identity file: age <recipient> <identityFile>")
+			}
+			if !filepath.IsAbs(args[1]) {
+				return c.Errf("encryptPrivateKeys age identity file must be an absolute path: %v", args[1])
+			}
+			k.Type = "age"
+			k.AgeRecipient = args[0]
+			k.AgeIdentity = args[1]
+		case "vaultTransit":
+			if len(args) < 2 {
+				return c.Err("encryptPrivateKeys 'vaultTransit' requires '<mount> <key> [token | kubernetes <role>]'")
+			}
+			auth, role, err := parseVaultAuth(c, args[2:])
+			if err != nil {
+				return err
+			}
+			k.Type = "vaultTransit"
+			k.VaultMount = args[0]
+			k.VaultKey = args[1]
+			k.VaultAuth = auth
+			k.VaultRole = role
+		default:
+			return c.Errf("unknown key provider '%s', supported: file, age, vaultTransit", directive)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return keys, err
+	}
+	if n == 0 {
+		return keys, c.Err("encryptPrivateKeys requires at least one key provider")
+	}
+	return keys, nil
+}
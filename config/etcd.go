@@ -0,0 +1,55 @@
+package config
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+)
+
+// parseEtcdOptions parses 'PREFIX [{ ... }]' of the certificateStorageEtcd and accountStorageEtcd
+// directives. The settings are those of the etcd plugin.
+func parseEtcdOptions(c *caddy.Controller, o *storage.Options) error {
+	directive := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.Errf("%s requires '<prefix>'", directive)
+	}
+	o.Type = "etcd"
+	o.EtcdPrefix = args[0]
+	o.EtcdEndpoints = ""
+	o.EtcdUsername = ""
+	o.EtcdPassword = ""
+	o.EtcdTLS = false
+	o.EtcdTLSArgs = [3]string{}
+	return parseSubBlock(c, func(setting string) error {
+		args := c.RemainingArgs()
+		switch setting {
+		case "endpoint":
+			if len(args) == 0 {
+				return c.ArgErr()
+			}
+			o.EtcdEndpoints = strings.Join(args, " ")
+		case "credentials":
+			if len(args) != 2 {
+				return c.Errf("%s credentials requires 2 arguments, username and password", directive)
+			}
+			o.EtcdUsername, o.EtcdPassword = args[0], args[1]
+		case "tls":
+			if len(args) > len(o.EtcdTLSArgs) {
+				return c.Errf("%s tls takes at most the arguments CERT KEY CACERT", directive)
+			}
+			for i, a := range args {
+				if !filepath.IsAbs(a) {
+					return c.Errf("%s tls files must be absolute paths: %v", directive, a)
+				}
+				o.EtcdTLSArgs[i] = a
+			}
+			o.EtcdTLS = true
+		default:
+			return c.Errf("unknown %s setting '%s'", directive, setting)
+		}
+		return nil
+	})
+}
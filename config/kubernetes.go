@@ -0,0 +1,152 @@
+package config
+
+import (
+	"maps"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// parseKubernetesOptions parses 'NAMESPACE [{ ... }]' of the certificateStorageKubernetes and
+// accountStorageKubernetes directives.
+func parseKubernetesOptions(c *caddy.Controller, o *storage.Options) error {
+	directive := c.Val()
+	if !c.NextArg() {
+		return c.ArgErr()
+	}
+	o.Type = "kubernetesSecrets"
+	o.Namespace = c.Val()
+	o.ReplicateNamespaces = ""
+	o.ReplicateSelector = ""
+	o.SecretName = ""
+	o.SecretCertManager = false
+	o.SecretCACert = false
+	o.SecretFormats = ""
+	o.SecretPKCS12Password = ""
+	o.SecretAdopt = false
+	o.EventKind = ""
+	o.EventName = ""
+	o.EventNamespace = ""
+	certificates := directive == "certificateStorageKubernetes"
+	secretLabels, secretAnnotations := url.Values{}, url.Values{}
+	err := parseSubBlock(c, func(setting string) error {
+		args := c.RemainingArgs()
+		switch {
+		case setting == "replicate" && certificates:
+			if len(args) == 0 {
+				return c.ArgErr()
+			}
+			for _, ns := range args {
+				if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+					return c.Errf("%s replicate namespace %s is invalid: %s", directive, ns, strings.Join(errs, ", "))
+				}
+			}
+			o.ReplicateNamespaces = strings.Join(append(strings.Fields(o.ReplicateNamespaces), args...), " ")
+		case setting == "replicateSelector" && certificates:
+			if len(args) == 0 {
+				return c.ArgErr()
+			}
+			// Set-based requirements such as 'env in (a, b)' may contain spaces.
+			selector := strings.Join(args, " ")
+			if _, err := labels.Parse(selector); err != nil {
+				return c.Errf("%s replicateSelector is invalid: %v", directive, err)
+			}
+			o.ReplicateSelector = selector
+		case setting == "name" && certificates:
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			if err := storage.CheckSecretName(args[0]); err != nil {
+				return c.Errf("%s name template %s is invalid: %v", directive, args[0], err)
+			}
+			o.SecretName = args[0]
+		case setting == "label":
+			if len(args) != 2 {
+				return c.Errf("%s label requires 2 arguments, key and value", directive)
+			}
+			errs := append(validation.IsQualifiedName(args[0]), validation.IsValidLabelValue(args[1])...)
+			if len(errs) > 0 {
+				return c.Errf("%s label %s=%s is invalid: %s", directive, args[0], args[1], strings.Join(errs, ", "))
+			}
+			if args[0] == "app.kubernetes.io/managed-by" || strings.HasPrefix(args[0], "acmednschallenge/") {
+				return c.Errf("%s label %s is reserved", directive, args[0])
+			}
+			secretLabels.Set(args[0], args[1])
+		case setting == "annotation":
+			if len(args) != 2 {
+				return c.Errf("%s annotation requires 2 arguments, key and value", directive)
+			}
+			if errs := validation.IsQualifiedName(args[0]); len(errs) > 0 {
+				return c.Errf("%s annotation %s is invalid: %s", directive, args[0], strings.Join(errs, ", "))
+			}
+			if strings.HasPrefix(args[0], "acmednschallenge/") {
+				return c.Errf("%s annotation %s is reserved", directive, args[0])
+			}
+			secretAnnotations.Set(args[0], args[1])
+		case setting == "certManagerAnnotations" && certificates:
+			if len(args) != 0 {
+				return c.ArgErr()
+			}
+			o.SecretCertManager = true
+		case setting == "caCert" && certificates:
+			if len(args) != 0 {
+				return c.ArgErr()
+			}
+			o.SecretCACert = true
+		case setting == "format" && certificates:
+			switch {
+			case len(args) == 1 && (args[0] == storage.FormatCombinedPEM || args[0] == storage.FormatDER):
+			case len(args) == 2 && args[0] == storage.FormatPKCS12:
+				o.SecretPKCS12Password = args[1]
+			default:
+				return c.Errf("%s format must be '%s', '%s' or '%s PASSWORD'", directive, storage.FormatCombinedPEM, storage.FormatDER, storage.FormatPKCS12)
+			}
+			if slices.Contains(strings.Fields(o.SecretFormats), args[0]) {
+				return c.Errf("%s format %s set twice", directive, args[0])
+			}
+			o.SecretFormats = strings.Join(append(strings.Fields(o.SecretFormats), args[0]), " ")
+		case setting == "eventObject" && certificates:
+			if len(args) != 2 && len(args) != 3 {
+				return c.Errf("%s eventObject requires KIND NAME [NAMESPACE]", directive)
+			}
+			if _, ok := storage.EventObjectKinds[args[0]]; !ok {
+				kinds := slices.Sorted(maps.Keys(storage.EventObjectKinds))
+				return c.Errf("%s eventObject kind must be one of %s", directive, strings.Join(kinds, ", "))
+			}
+			errs := validation.IsDNS1123Subdomain(args[1])
+			if len(args) == 3 {
+				errs = append(errs, validation.IsDNS1123Label(args[2])...)
+				o.EventNamespace = args[2]
+			}
+			if len(errs) > 0 {
+				return c.Errf("%s eventObject %s is invalid: %s", directive, strings.Join(args[1:], " "), strings.Join(errs, ", "))
+			}
+			o.EventKind, o.EventName = args[0], args[1]
+		case setting == "adopt":
+			if len(args) != 0 {
+				return c.ArgErr()
+			}
+			o.SecretAdopt = true
+		default:
+			return c.Errf("unknown %s setting '%s'", directive, setting)
+		}
+		return nil
+	})
+	o.SecretLabels = secretLabels.Encode()
+	o.SecretAnnotations = secretAnnotations.Encode()
+	return err
+}
+
+// checkKubernetesFormats rejects further formats of the private key in Kubernetes Secrets together
+// with encryptPrivateKeys, as they could only hold the encrypted key.
+func checkKubernetesFormats(c *caddy.Controller, o storage.Options, encryption [storage.MaxEncryptionKeys]storage.KeyOptions) error {
+	if o.Type == "kubernetesSecrets" && o.SecretFormats != "" && encryption[0].Type != "" {
+		return c.Errf("certificateStorageKubernetes format can't be combined with encryptPrivateKeys")
+	}
+	return nil
+}
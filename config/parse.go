@@ -4,12 +4,14 @@ import (
 	"net/mail"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+	"github.com/go-acme/lego/v4/certcrypto"
 )
 
 func ParseConfig(c *caddy.Controller) (*ACMEChallengeConfig, error) {
@@ -32,6 +34,10 @@ func ParseConfig(c *caddy.Controller) (*ACMEChallengeConfig, error) {
 		CertValidationInterval:   24 * time.Hour,
 		DnsTimeout:               60 * time.Second,
 		MaxRetryCount:            defaultMaxRetryCount,
+		KeyType:                  certcrypto.RSA2048,
+		CAFailoverBeforeDays:     defaultCAFailoverBeforeDays,
+		MaxConcurrentOrders:      defaultMaxConcurrentOrders,
+		PruneGracePeriod:         defaultPruneGracePeriod,
 	}
 
 	zones := c.ServerBlockKeys
@@ -55,85 +61,91 @@ func ParseConfig(c *caddy.Controller) (*ACMEChallengeConfig, error) {
 		zones[i] = z
 	}
 
-	cfg.ManagedDomains = make(map[string][]string)
-	for _, z := range zones {
-		cfg.ManagedDomains[z] = []string{}
-	}
+	cfg.Zones = zones
+	cfg.Certificates = make(map[string]*ManagedCertificate)
+	cfg.DomainCAs = make(map[string][]string)
+	var certificateBlocks []*certificateBlock
+	zoneBlocks := make(map[string]*zoneBlock)
+	var combineZones bool
+	var combinedMainDomain string
 
-	var certificateStorageDiskSet, certificateStorageKubernetesSet, certificateStorageVaultSet bool
-	var userDiskSet, userKubernetesSet, accountStorageVaultSet bool
+	var certificateStorageDiskSet, certificateStorageKubernetesSet, certificateStorageVaultSet, certificateStorageS3Set, certificateStorageEtcdSet, certificateStorageSQLSet, certificateStorageAwsSecretsManagerSet bool
+	var userDiskSet, userKubernetesSet, accountStorageVaultSet, accountStorageS3Set, accountStorageEtcdSet, accountStorageSQLSet, accountStorageAwsSecretsManagerSet bool
+	var encryption [storage.MaxEncryptionKeys]storage.KeyOptions
 
 	c.Next()
 	for c.NextBlock() {
 		switch c.Val() {
 		case "certificateStorageDisk":
-			if !c.NextArg() {
-				return nil, c.ArgErr()
-			}
-			p := c.Val()
-			if !filepath.IsAbs(p) {
-				return nil, c.Errf("certificateStorageDisk path must be an absolute path: %v", p)
+			if err := parseCertificateStorage(c, &cfg.Storage); err != nil {
+				return nil, err
 			}
-			cfg.Storage.Type = "disk"
-			cfg.Storage.DiskPath = p
 			certificateStorageDiskSet = true
-			if c.NextArg() {
-				switch c.Val() {
-				case "600":
-					cfg.Storage.KeyMode = os.FileMode(0600)
-				case "640":
-					cfg.Storage.KeyMode = os.FileMode(0640)
-				case "644":
-					cfg.Storage.KeyMode = os.FileMode(0644)
-				default:
-					return nil, c.Errf("certificateStorageDisk file mode must be 600, 640 or 644 but the value is: %v", c.Val())
-				}
-			}
-			if c.NextArg() {
-				if cfg.Storage.KeyMode&0o070 == 0 {
-					return nil, c.Errf("certificateStorageDisk group can only be set when the file mode grants group access (640 or 644), but the mode is %#o", cfg.Storage.KeyMode.Perm())
-				}
-				gid, err := lookupGid(c.Val())
-				if err != nil {
-					return nil, c.Errf("certificateStorageDisk group must be an existing group name or numeric gid: %v", err)
-				}
-				cfg.Storage.Gid = gid
-			}
 		case "certificateStorageKubernetes":
-			if !c.NextArg() {
-				return nil, c.ArgErr()
+			if err := parseCertificateStorage(c, &cfg.Storage); err != nil {
+				return nil, err
 			}
-			cfg.Storage.Type = "kubernetesSecrets"
-			cfg.Storage.Namespace = c.Val()
 			certificateStorageKubernetesSet = true
 		case "accountStorageDisk":
-			if !c.NextArg() {
-				return nil, c.ArgErr()
-			}
-			p := c.Val()
-			if !filepath.IsAbs(p) {
-				return nil, c.Errf("accountStorageDisk path must be an absolute path: %v", p)
+			if err := parseAccountStorage(c, &cfg.Account); err != nil {
+				return nil, err
 			}
-			cfg.Account.Type = "disk"
-			cfg.Account.DiskPath = p
 			userDiskSet = true
 		case "accountStorageKubernetes":
-			if !c.NextArg() {
-				return nil, c.ArgErr()
+			if err := parseAccountStorage(c, &cfg.Account); err != nil {
+				return nil, err
 			}
-			cfg.Account.Type = "kubernetesSecrets"
-			cfg.Account.Namespace = c.Val()
 			userKubernetesSet = true
 		case "certificateStorageVault":
-			if err := parseVaultOptions(c, &cfg.Storage); err != nil {
+			if err := parseCertificateStorage(c, &cfg.Storage); err != nil {
 				return nil, err
 			}
 			certificateStorageVaultSet = true
 		case "accountStorageVault":
-			if err := parseVaultOptions(c, &cfg.Account); err != nil {
+			if err := parseAccountStorage(c, &cfg.Account); err != nil {
 				return nil, err
 			}
 			accountStorageVaultSet = true
+		case "certificateStorageS3":
+			if err := parseCertificateStorage(c, &cfg.Storage); err != nil {
+				return nil, err
+			}
+			certificateStorageS3Set = true
+		case "accountStorageS3":
+			if err := parseAccountStorage(c, &cfg.Account); err != nil {
+				return nil, err
+			}
+			accountStorageS3Set = true
+		case "certificateStorageEtcd":
+			if err := parseCertificateStorage(c, &cfg.Storage); err != nil {
+				return nil, err
+			}
+			certificateStorageEtcdSet = true
+		case "accountStorageEtcd":
+			if err := parseAccountStorage(c, &cfg.Account); err != nil {
+				return nil, err
+			}
+			accountStorageEtcdSet = true
+		case "certificateStorageSQL":
+			if err := parseCertificateStorage(c, &cfg.Storage); err != nil {
+				return nil, err
+			}
+			certificateStorageSQLSet = true
+		case "accountStorageSQL":
+			if err := parseAccountStorage(c, &cfg.Account); err != nil {
+				return nil, err
+			}
+			accountStorageSQLSet = true
+		case "certificateStorageAwsSecretsManager":
+			if err := parseCertificateStorage(c, &cfg.Storage); err != nil {
+				return nil, err
+			}
+			certificateStorageAwsSecretsManagerSet = true
+		case "accountStorageAwsSecretsManager":
+			if err := parseAccountStorage(c, &cfg.Account); err != nil {
+				return nil, err
+			}
+			accountStorageAwsSecretsManagerSet = true
 		case "renewBeforeDays":
 			if !c.NextArg() {
 				return nil, c.ArgErr()
@@ -163,21 +175,58 @@ func ParseConfig(c *caddy.Controller) (*ACMEChallengeConfig, error) {
 		case "additionalSans":
 			var sans []string
 			for c.NextArg() {
-				sans = append(sans, c.Val())
+				sans = append(sans, strings.TrimSuffix(strings.ToLower(c.Val()), "."))
 			}
 
 			if sans == nil {
 				return nil, c.ArgErr()
 			}
-
-			for _, z := range zones {
-				for _, san := range sans {
-					if !isSubdomainOf(san, z) {
-						return nil, c.Errf("additionalSans '%s' must be a subdomain of the managed domain '%s'", san, z)
-					}
+			cfg.AdditionalSans = sans
+		case "keyType":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			keyType, err := parseKeyType(c.Val())
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			cfg.KeyType = keyType
+		case "profile":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			cfg.Profile = c.Val()
+		case "certificate":
+			block, err := parseCertificate(c, zones)
+			if err != nil {
+				return nil, err
+			}
+			for _, existing := range certificateBlocks {
+				if existing.cert.Name == block.cert.Name {
+					return nil, c.Errf("certificate '%s' is defined more than once", block.cert.Name)
+				}
+			}
+			certificateBlocks = append(certificateBlocks, block)
+		case "combineZones":
+			combineZones = true
+			if c.NextArg() {
+				combinedMainDomain = strings.TrimSuffix(strings.ToLower(c.Val()), ".")
+				if ZoneOf(combinedMainDomain, zones) == "" {
+					return nil, c.Errf("combineZones main domain '%s' must be a subdomain of one of the zones %v", combinedMainDomain, zones)
 				}
-				cfg.ManagedDomains[z] = sans
 			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+		case "zone":
+			block, err := parseZone(c, zones)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := zoneBlocks[block.name]; ok {
+				return nil, c.Errf("zone '%s' is configured more than once", block.name)
+			}
+			zoneBlocks[block.name] = block
 		case "useLetsEncryptTestServer":
 			if c.NextArg() {
 				return nil, c.ArgErr()
@@ -188,6 +237,11 @@ func ParseConfig(c *caddy.Controller) (*ACMEChallengeConfig, error) {
 				return nil, c.ArgErr()
 			}
 			cfg.SkipDnsPropagationTest = true
+		case "skipRevocationCheck":
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			cfg.SkipRevocationCheck = true
 		case "acceptedLetsEncryptToS":
 			if c.NextArg() {
 				return nil, c.ArgErr()
@@ -275,20 +329,131 @@ func ParseConfig(c *caddy.Controller) (*ACMEChallengeConfig, error) {
 				return nil, c.Errf("invalid maxRetryCount, it must be a non-negative integer but the value is: %v", c.Val())
 			}
 			cfg.MaxRetryCount = uint32(n)
+		case "ca":
+			ca, err := parseCA(c)
+			if err != nil {
+				return nil, err
+			}
+			for _, existing := range cfg.CAs {
+				if existing.Name == ca.Name {
+					return nil, c.Errf("ca '%s' is defined more than once", ca.Name)
+				}
+			}
+			cfg.CAs = append(cfg.CAs, ca)
+		case "useCA":
+			names := c.RemainingArgs()
+			if len(names) == 0 {
+				return nil, c.ArgErr()
+			}
+			cfg.DefaultCAs = names
+		case "domainCA":
+			args := c.RemainingArgs()
+			if len(args) < 2 {
+				return nil, c.Err("domainCA requires 'DOMAIN CA_NAME...'")
+			}
+			domain := strings.TrimSuffix(strings.ToLower(args[0]), ".")
+			cfg.DomainCAs[domain] = args[1:]
+		case "encryptPrivateKeys":
+			keys, err := parseEncryption(c)
+			if err != nil {
+				return nil, err
+			}
+			encryption = keys
+		case "csrInbox":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			p := c.Val()
+			if !filepath.IsAbs(p) {
+				return nil, c.Errf("csrInbox path must be an absolute path: %v", p)
+			}
+			cfg.CSRInbox = p
+			cfg.CSRInboxInterval = defaultCSRInboxInterval
+			if c.NextArg() {
+				d, err := time.ParseDuration(c.Val())
+				if err != nil || d <= 0 {
+					return nil, c.Errf("invalid csrInbox interval: %v", c.Val())
+				}
+				cfg.CSRInboxInterval = d
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+		case "maxConcurrentOrders":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			n, err := strconv.ParseUint(c.Val(), 10, 32)
+			if err != nil || n < 1 {
+				return nil, c.Errf("invalid maxConcurrentOrders, it must be an integer >= 1 but the value is: %v", c.Val())
+			}
+			cfg.MaxConcurrentOrders = uint32(n)
+		case "orderLimit":
+			limit, interval, err := parseOrderLimit(c)
+			if err != nil {
+				return nil, err
+			}
+			cfg.OrderLimit = limit
+			cfg.OrderLimitInterval = interval
+		case "pruneOrphans":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			switch c.Val() {
+			case PruneDelete:
+				cfg.PruneOrphans = PruneDelete
+			case PruneArchive:
+				if !c.NextArg() {
+					return nil, c.Err("pruneOrphans archive requires the archive path")
+				}
+				p := c.Val()
+				if !filepath.IsAbs(p) {
+					return nil, c.Errf("pruneOrphans archive path must be an absolute path: %v", p)
+				}
+				cfg.PruneOrphans = PruneArchive
+				cfg.PruneArchivePath = p
+			default:
+				return nil, c.Errf("pruneOrphans must be %s or %s but the value is: %v", PruneDelete, PruneArchive, c.Val())
+			}
+			if c.NextArg() {
+				return nil, c.ArgErr()
+			}
+		case "pruneGracePeriod":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			duration := c.Val()
+			d, err := time.ParseDuration(duration)
+			if err != nil {
+				return nil, c.Errf("invalid pruneGracePeriod: %v", duration)
+			}
+			if d < 0 {
+				return nil, c.Errf("pruneGracePeriod must not be negative: %v", duration)
+			}
+			cfg.PruneGracePeriod = d
+		case "caFailoverBeforeDays":
+			if !c.NextArg() {
+				return nil, c.ArgErr()
+			}
+			days, err := strconv.ParseUint(c.Val(), 10, 32)
+			if err != nil {
+				return nil, c.Errf("invalid caFailoverBeforeDays, it must be a non-negative integer but the value is: %v", c.Val())
+			}
+			cfg.CAFailoverBeforeDays = uint32(days)
 		default:
 			return nil, c.Errf("unknown property '%s'", c.Val())
 		}
 	}
 
-	if countTrue(certificateStorageDiskSet, certificateStorageKubernetesSet, certificateStorageVaultSet) > 1 {
-		return nil, c.Err("only one certificate storage backend may be set (certificateStorageDisk, certificateStorageKubernetes, certificateStorageVault)")
+	if countTrue(certificateStorageDiskSet, certificateStorageKubernetesSet, certificateStorageVaultSet, certificateStorageS3Set, certificateStorageEtcdSet, certificateStorageSQLSet, certificateStorageAwsSecretsManagerSet) > 1 {
+		return nil, c.Err("only one certificate storage backend may be set (certificateStorageDisk, certificateStorageKubernetes, certificateStorageVault, certificateStorageS3, certificateStorageEtcd, certificateStorageSQL, certificateStorageAwsSecretsManager)")
 	}
 
-	if countTrue(userDiskSet, userKubernetesSet, accountStorageVaultSet) > 1 {
-		return nil, c.Err("only one account storage backend may be set (accountStorageDisk, accountStorageKubernetes, accountStorageVault)")
+	if countTrue(userDiskSet, userKubernetesSet, accountStorageVaultSet, accountStorageS3Set, accountStorageEtcdSet, accountStorageSQLSet, accountStorageAwsSecretsManagerSet) > 1 {
+		return nil, c.Err("only one account storage backend may be set (accountStorageDisk, accountStorageKubernetes, accountStorageVault, accountStorageS3, accountStorageEtcd, accountStorageSQL, accountStorageAwsSecretsManager)")
 	}
 
-	if cfg.Email == "" {
+	if cfg.Email == "" && !allCAsHaveEmail(cfg.CAs) {
 		return nil, c.Err("you must provide an email that will be used for acme")
 	}
 
@@ -300,5 +465,235 @@ func ParseConfig(c *caddy.Controller) (*ACMEChallengeConfig, error) {
 		return nil, c.Err("you must agree to the Let's Encrypt Terms of Service by setting 'acceptedLetsEncryptToS'")
 	}
 
+	blockDefaults := &ManagedCertificate{
+		KeyType:         cfg.KeyType,
+		Profile:         cfg.Profile,
+		RenewBeforeDays: cfg.RenewBeforeDays,
+		RetryInterval:   cfg.RetryInterval,
+		MaxRetryCount:   cfg.MaxRetryCount,
+		Storage:         cfg.Storage,
+	}
+	zoneDefaults := make(map[string]*ManagedCertificate, len(zones))
+	zoneSans := make(map[string][]string, len(zones))
+	for _, z := range zones {
+		zoneDefaults[z] = blockDefaults
+		zoneSans[z] = cfg.AdditionalSans
+	}
+	for z, b := range zoneBlocks {
+		inheritSettings(b.defaults, b.set, blockDefaults)
+		zoneDefaults[z] = b.defaults
+		if b.set["additionalSans"] {
+			zoneSans[z] = b.additionalSans
+		}
+		if b.useCA != nil {
+			if _, ok := cfg.DomainCAs[z]; ok {
+				return nil, c.Errf("the ca of zone '%s' is set by both 'domainCA' and 'useCA' in its zone block", z)
+			}
+			cfg.DomainCAs[z] = b.useCA
+		}
+	}
+
+	if len(certificateBlocks) > 0 && combineZones {
+		return nil, c.Err("combineZones can't be combined with 'certificate' blocks, list all names in one certificate instead")
+	}
+	if len(certificateBlocks) > 0 {
+		for _, z := range zones {
+			if zoneSans[z] != nil {
+				return nil, c.Errf("additionalSans of zone '%s' applies to the per-zone certificate and can't be combined with 'certificate' blocks, list the names in 'domains' instead", z)
+			}
+		}
+	}
+	if len(certificateBlocks) == 0 {
+		for _, z := range zones {
+			zb, ok := zoneBlocks[z]
+			blockLevel := !ok || !zb.set["additionalSans"]
+			for _, san := range zoneSans[z] {
+				// The combined certificate covers the block-level SANs of every zone, so they may
+				// belong to any of them.
+				if combineZones && blockLevel {
+					if !slices.ContainsFunc(zones, func(zone string) bool { return IsSubdomainOf(san, zone) }) {
+						return nil, c.Errf("additionalSans '%s' must be a subdomain of one of the managed domains %v", san, zones)
+					}
+					continue
+				}
+				if !IsSubdomainOf(san, z) {
+					return nil, c.Errf("additionalSans '%s' must be a subdomain of the managed domain '%s', override it in a 'zone %s' block", san, z, z)
+				}
+			}
+			certificateBlocks = append(certificateBlocks, &certificateBlock{
+				cert: &ManagedCertificate{Name: z, Zone: z, Domains: append([]string{z}, zoneSans[z]...)},
+			})
+		}
+	}
+	if combineZones {
+		certificateBlocks = []*certificateBlock{combineCertificates(certificateBlocks, combinedMainDomain, zones)}
+	}
+	for _, b := range certificateBlocks {
+		inheritSettings(b.cert, b.set, zoneDefaults[b.cert.Zone])
+		if combineZones {
+			if err := checkCombinedZones(c, b.cert, zones, zoneBlocks, cfg.DomainCAs); err != nil {
+				return nil, err
+			}
+		}
+		if err := checkKubernetesFormats(c, b.cert.Storage, encryption); err != nil {
+			return nil, err
+		}
+		b.cert.Storage.Encryption = encryption
+		cfg.Certificates[b.cert.Name] = b.cert
+	}
+	cfg.Storage.Encryption = encryption
+	cfg.Account.Encryption = encryption
+
+	if len(cfg.CAs) == 0 {
+		cfg.CAs = []CAConfig{defaultCA(cfg)}
+	} else if cfg.UseLetsEncryptTestServer || cfg.CustomCAD != "" || cfg.AllowInsecureCAD {
+		return nil, c.Err("customCAD, useLetsEncryptTestServer and allowInsecureCAD can't be combined with 'ca', configure the directory in the 'ca' block instead")
+	}
+
+	for i := range cfg.CAs {
+		if cfg.CAs[i].Account.Type == "" {
+			cfg.CAs[i].Account = cfg.Account
+		}
+		cfg.CAs[i].Account.Encryption = encryption
+		if cfg.CAs[i].Email == "" {
+			cfg.CAs[i].Email = cfg.Email
+		}
+		if cfg.CAs[i].OrderLimit == 0 {
+			cfg.CAs[i].OrderLimit = cfg.OrderLimit
+			cfg.CAs[i].OrderLimitInterval = cfg.OrderLimitInterval
+		}
+	}
+
+	if err := checkCASelection(c, cfg); err != nil {
+		return nil, err
+	}
+
 	return cfg, nil
 }
+
+// parseCertificateStorage parses one of the certificateStorage* directives into o.
+func parseCertificateStorage(c *caddy.Controller, o *storage.Options) error {
+	switch c.Val() {
+	case "certificateStorageDisk":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		p := c.Val()
+		if !filepath.IsAbs(p) {
+			return c.Errf("certificateStorageDisk path must be an absolute path: %v", p)
+		}
+		o.Type = "disk"
+		o.DiskPath = p
+		o.DiskLayout = ""
+		o.Gid = 0
+		o.KeyMode = os.FileMode(0600)
+		args := c.RemainingArgs()
+		if len(args) > 2 {
+			return c.ArgErr()
+		}
+		if len(args) > 0 {
+			switch args[0] {
+			case "600":
+				o.KeyMode = os.FileMode(0600)
+			case "640":
+				o.KeyMode = os.FileMode(0640)
+			case "644":
+				o.KeyMode = os.FileMode(0644)
+			default:
+				return c.Errf("certificateStorageDisk file mode must be 600, 640 or 644 but the value is: %v", args[0])
+			}
+		}
+		if len(args) > 1 {
+			if o.KeyMode&0o070 == 0 {
+				return c.Errf("certificateStorageDisk group can only be set when the file mode grants group access (640 or 644), but the mode is %#o", o.KeyMode.Perm())
+			}
+			gid, err := lookupGid(args[1])
+			if err != nil {
+				return c.Errf("certificateStorageDisk group must be an existing group name or numeric gid: %v", err)
+			}
+			o.Gid = gid
+		}
+		return parseSubBlock(c, func(directive string) error {
+			switch directive {
+			case "layout":
+				if !c.NextArg() {
+					return c.ArgErr()
+				}
+				switch c.Val() {
+				case storage.DiskLayoutPlugin, storage.DiskLayoutCertbot, storage.DiskLayoutLego:
+					o.DiskLayout = c.Val()
+				default:
+					return c.Errf("certificateStorageDisk layout must be %s, %s or %s but the value is: %v", storage.DiskLayoutPlugin, storage.DiskLayoutCertbot, storage.DiskLayoutLego, c.Val())
+				}
+			default:
+				return c.Errf("unknown certificateStorageDisk setting '%s'", directive)
+			}
+			return nil
+		})
+	case "certificateStorageKubernetes":
+		return parseKubernetesOptions(c, o)
+	case "certificateStorageVault":
+		return parseVaultOptions(c, o)
+	case "certificateStorageS3":
+		return parseS3Options(c, o)
+	case "certificateStorageEtcd":
+		return parseEtcdOptions(c, o)
+	case "certificateStorageSQL":
+		return parseSQLOptions(c, o)
+	case "certificateStorageAwsSecretsManager":
+		return parseSecretsManagerOptions(c, o)
+	default:
+		return c.Errf("unknown certificate storage '%s'", c.Val())
+	}
+}
+
+// parseAccountStorage parses one of the accountStorage* directives into o.
+func parseAccountStorage(c *caddy.Controller, o *storage.Options) error {
+	switch c.Val() {
+	case "accountStorageDisk":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		p := c.Val()
+		if !filepath.IsAbs(p) {
+			return c.Errf("accountStorageDisk path must be an absolute path: %v", p)
+		}
+		o.Type = "disk"
+		o.DiskPath = p
+	case "accountStorageKubernetes":
+		return parseKubernetesOptions(c, o)
+	case "accountStorageVault":
+		return parseVaultOptions(c, o)
+	case "accountStorageS3":
+		return parseS3Options(c, o)
+	case "accountStorageEtcd":
+		return parseEtcdOptions(c, o)
+	case "accountStorageSQL":
+		return parseSQLOptions(c, o)
+	case "accountStorageAwsSecretsManager":
+		return parseSecretsManagerOptions(c, o)
+	default:
+		return c.Errf("unknown account storage '%s'", c.Val())
+	}
+	return nil
+}
+
+// parseSubBlock consumes an optional "{ ... }" block opened on the current line and calls fn with
+// every directive inside it. fn reads the directive's arguments from c as usual.
+func parseSubBlock(c *caddy.Controller, fn func(directive string) error) error {
+	if !c.NextArg() {
+		return nil
+	}
+	if c.Val() != "{" {
+		return c.ArgErr()
+	}
+	for c.Next() {
+		if c.Val() == "}" {
+			return nil
+		}
+		if err := fn(c.Val()); err != nil {
+			return err
+		}
+	}
+	return c.EOFErr()
+}
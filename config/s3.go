@@ -0,0 +1,74 @@
+package config
+
+import (
+	"net/url"
+	"path/filepath"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+)
+
+// parseS3Options parses 'BUCKET PREFIX [{ ... }]' of the certificateStorageS3 and accountStorageS3
+// directives.
+func parseS3Options(c *caddy.Controller, o *storage.Options) error {
+	directive := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 2 {
+		return c.Errf("%s requires '<bucket> <prefix>'", directive)
+	}
+	o.Type = "s3"
+	o.S3Bucket = args[0]
+	o.S3Prefix = args[1]
+	o.S3Endpoint = ""
+	o.S3Region = ""
+	o.S3PathStyle = false
+	o.S3CredentialsFile = ""
+	o.S3SSE = ""
+	o.S3KMSKeyID = ""
+	return parseSubBlock(c, func(setting string) error {
+		args := c.RemainingArgs()
+		switch setting {
+		case "endpoint":
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			u, err := url.Parse(args[0])
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return c.Errf("%s endpoint must be an http or https URL: %v", directive, args[0])
+			}
+			o.S3Endpoint = args[0]
+		case "region":
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			o.S3Region = args[0]
+		case "pathStyle":
+			if len(args) != 0 {
+				return c.ArgErr()
+			}
+			o.S3PathStyle = true
+		case "credentialsFile":
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			if !filepath.IsAbs(args[0]) {
+				return c.Errf("%s credentialsFile must be an absolute path: %v", directive, args[0])
+			}
+			o.S3CredentialsFile = args[0]
+		case "sse":
+			switch {
+			case len(args) == 1 && args[0] == "AES256":
+			case len(args) >= 1 && len(args) <= 2 && args[0] == "aws:kms":
+				if len(args) == 2 {
+					o.S3KMSKeyID = args[1]
+				}
+			default:
+				return c.Errf("%s sse must be 'AES256' or 'aws:kms [KEY_ID]'", directive)
+			}
+			o.S3SSE = args[0]
+		default:
+			return c.Errf("unknown %s setting '%s'", directive, setting)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,75 @@
+package config
+
+import (
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+)
+
+// parseSecretsManagerOptions parses 'PREFIX [{ ... }]' of the certificateStorageAwsSecretsManager and
+// accountStorageAwsSecretsManager directives.
+func parseSecretsManagerOptions(c *caddy.Controller, o *storage.Options) error {
+	directive := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return c.Errf("%s requires '<prefix>'", directive)
+	}
+	o.Type = "awsSecretsManager"
+	o.SecretsManagerPrefix = args[0]
+	o.SecretsManagerRegion = ""
+	o.SecretsManagerEndpoint = ""
+	o.SecretsManagerCredentialsFile = ""
+	o.SecretsManagerKMSKeyID = ""
+	tags := url.Values{}
+	err := parseSubBlock(c, func(setting string) error {
+		args := c.RemainingArgs()
+		switch setting {
+		case "endpoint":
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			u, err := url.Parse(args[0])
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return c.Errf("%s endpoint must be an http or https URL: %v", directive, args[0])
+			}
+			o.SecretsManagerEndpoint = args[0]
+		case "region":
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			o.SecretsManagerRegion = args[0]
+		case "credentialsFile":
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			if !filepath.IsAbs(args[0]) {
+				return c.Errf("%s credentialsFile must be an absolute path: %v", directive, args[0])
+			}
+			o.SecretsManagerCredentialsFile = args[0]
+		case "kmsKeyId":
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			o.SecretsManagerKMSKeyID = args[0]
+		case "tag":
+			if len(args) != 2 {
+				return c.Errf("%s tag requires 2 arguments, key and value", directive)
+			}
+			if args[0] == "managed-by" || strings.HasPrefix(strings.ToLower(args[0]), "aws:") {
+				return c.Errf("%s tag key is reserved: %v", directive, args[0])
+			}
+			if tags.Has(args[0]) {
+				return c.Errf("%s tag %s set twice", directive, args[0])
+			}
+			tags.Set(args[0], args[1])
+		default:
+			return c.Errf("unknown %s setting '%s'", directive, setting)
+		}
+		return nil
+	})
+	o.SecretsManagerTags = tags.Encode()
+	return err
+}
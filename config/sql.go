@@ -0,0 +1,31 @@
+package config
+
+import (
+	"path/filepath"
+
+	"github.com/coredns/caddy"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+)
+
+// parseSQLOptions parses 'postgres DSN | sqlite PATH' of the certificateStorageSQL and
+// accountStorageSQL directives.
+func parseSQLOptions(c *caddy.Controller, o *storage.Options) error {
+	directive := c.Val()
+	args := c.RemainingArgs()
+	if len(args) != 2 {
+		return c.Errf("%s requires 'postgres <dsn>' or 'sqlite <path>'", directive)
+	}
+	switch args[0] {
+	case storage.SQLPostgres:
+	case storage.SQLSQLite:
+		if !filepath.IsAbs(args[1]) {
+			return c.Errf("%s sqlite database must be an absolute path: %v", directive, args[1])
+		}
+	default:
+		return c.Errf("%s database must be %s or %s but the value is: %v", directive, storage.SQLPostgres, storage.SQLSQLite, args[0])
+	}
+	o.Type = "sql"
+	o.SQLDriver = args[0]
+	o.SQLDSN = args[1]
+	return nil
+}
@@ -30,7 +30,20 @@ func countTrue(bools ...bool) int {
 	return n
 }
 
-func isSubdomainOf(san, zone string) bool {
+func allCAsHaveEmail(cas []CAConfig) bool {
+	if len(cas) == 0 {
+		return false
+	}
+	for _, ca := range cas {
+		if ca.Email == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// IsSubdomainOf reports whether san, optionally a wildcard, is zone itself or a name below it.
+func IsSubdomainOf(san, zone string) bool {
 	san = strings.TrimSuffix(strings.ToLower(san), ".")
 	san = strings.TrimPrefix(san, "*.")
 	zone = strings.ToLower(zone)
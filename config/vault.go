@@ -13,23 +13,30 @@ func parseVaultOptions(c *caddy.Controller, o *storage.Options) error {
 	o.Type = "vault"
 	o.VaultMount = args[0]
 	o.VaultPrefix = args[1]
-	o.VaultAuth = "token"
-	o.VaultRole = ""
+	auth, role, err := parseVaultAuth(c, args[2:])
+	if err != nil {
+		return err
+	}
+	o.VaultAuth = auth
+	o.VaultRole = role
+	return nil
+}
 
-	switch rest := args[2:]; {
-	case len(rest) == 0:
-	case rest[0] == "token":
-		if len(rest) != 1 {
-			return c.Err("vault 'token' auth takes no extra arguments")
+// parseVaultAuth parses the optional '[token | kubernetes <role>]' arguments of the vault directives.
+func parseVaultAuth(c *caddy.Controller, args []string) (auth, role string, err error) {
+	switch {
+	case len(args) == 0:
+	case args[0] == "token":
+		if len(args) != 1 {
+			return "", "", c.Err("vault 'token' auth takes no extra arguments")
 		}
-	case rest[0] == "kubernetes":
-		if len(rest) != 2 {
-			return c.Err("vault 'kubernetes' auth requires a role: kubernetes <role>")
+	case args[0] == "kubernetes":
+		if len(args) != 2 {
+			return "", "", c.Err("vault 'kubernetes' auth requires a role: kubernetes <role>")
 		}
-		o.VaultAuth = "kubernetes"
-		o.VaultRole = rest[1]
+		return "kubernetes", args[1], nil
 	default:
-		return c.Errf("unknown vault auth method '%s', supported: token, kubernetes", rest[0])
+		return "", "", c.Errf("unknown vault auth method '%s', supported: token, kubernetes", args[0])
 	}
-	return nil
+	return "token", "", nil
 }
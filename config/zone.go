@@ -0,0 +1,73 @@
+package config
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/coredns/caddy"
+)
+
+// zoneBlock is a parsed 'zone' block. defaults holds the settings the certificates of the zone start
+// from; like certificateBlock, set records which of them the block overrides.
+type zoneBlock struct {
+	name           string
+	defaults       *ManagedCertificate
+	additionalSans []string
+	useCA          []string
+	set            map[string]bool
+}
+
+// parseZone parses 'zone NAME { ... }'.
+func parseZone(c *caddy.Controller, zones []string) (*zoneBlock, error) {
+	if !c.NextArg() {
+		return nil, c.ArgErr()
+	}
+	name := strings.TrimSuffix(strings.ToLower(c.Val()), ".")
+	if !slices.Contains(zones, name) {
+		return nil, c.Errf("zone '%s' is not a zone of this server block %v", name, zones)
+	}
+
+	b := &zoneBlock{name: name, defaults: &ManagedCertificate{}, set: map[string]bool{}}
+	err := parseSubBlock(c, func(directive string) error {
+		switch directive {
+		case "additionalSans":
+			sans := c.RemainingArgs()
+			if len(sans) == 0 {
+				return c.ArgErr()
+			}
+			for i, san := range sans {
+				sans[i] = strings.TrimSuffix(strings.ToLower(san), ".")
+				if !IsSubdomainOf(sans[i], name) {
+					return c.Errf("additionalSans '%s' must be a subdomain of the managed domain '%s'", san, name)
+				}
+			}
+			b.additionalSans = sans
+		case "useCA":
+			names := c.RemainingArgs()
+			if len(names) == 0 {
+				return c.ArgErr()
+			}
+			b.useCA = names
+		case "certificateStorageDisk", "certificateStorageKubernetes", "certificateStorageVault", "certificateStorageS3", "certificateStorageEtcd", "certificateStorageSQL", "certificateStorageAwsSecretsManager":
+			if b.set["storage"] {
+				return c.Errf("only one certificate storage backend may be set for zone '%s'", name)
+			}
+			b.set["storage"] = true
+			return parseCertificateStorage(c, &b.defaults.Storage)
+		default:
+			ok, err := parseCertificateSetting(c, directive, b.defaults)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return c.Errf("unknown property '%s' in zone '%s'", directive, name)
+			}
+		}
+		b.set[directive] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,222 @@
+package acmednschallenge
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+)
+
+const (
+	csrExtension = ".csr"
+	crtExtension = ".crt"
+
+	// csrMaxBackoff is the longest a CSR whose order or certificate write failed waits before the next
+	// attempt; the wait starts at the csrInbox interval and doubles with every failure.
+	csrMaxBackoff = 24 * time.Hour
+)
+
+// errCSRRejected marks CSRs that are unacceptable in themselves. They are only looked at again once
+// they are replaced.
+var errCSRRejected = errors.New("CSR rejected")
+
+// csrFailure tracks the failed attempts of a CSR.
+type csrFailure struct {
+	modTime  time.Time // of the CSR, a replaced CSR starts afresh
+	failures int
+	next     time.Time // when the CSR is attempted again
+	pending  []byte    // a certificate obtained but not written yet
+}
+
+// watchCSRInbox processes the CSR inbox dir every interval until stop is closed. Several server blocks
+// may configure the same directory; it is processed once, with the settings of the first of them.
+func (m *certificateManager) watchCSRInbox(dir string, interval time.Duration, stop <-chan struct{}) {
+	log.Infof("watching csrInbox %s", dir)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if ac := m.csrInboxBlock(dir); ac != nil {
+			ac.processCSRInbox()
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// processCSRInbox obtains or renews a certificate for every <name>.csr in the inbox directory and
+// writes the signed chain next to it as <name>.crt. The private key never leaves whoever created the
+// CSR, and renewals reuse the same CSR.
+func (ac *acmeChallenge) processCSRInbox() {
+	entries, err := os.ReadDir(ac.config.CSRInbox)
+	if err != nil {
+		log.Errorf("could not read csrInbox %s: %v", ac.config.CSRInbox, err)
+		return
+	}
+
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != csrExtension {
+			continue
+		}
+		csrPath := filepath.Join(ac.config.CSRInbox, e.Name())
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		// Rejected CSRs are only looked at again once they are replaced.
+		if rejectedAt, ok := ac.rejectedCSRs[csrPath]; ok && rejectedAt.Equal(info.ModTime()) {
+			continue
+		}
+		failure, ok := ac.failedCSRs[csrPath]
+		if !ok || !failure.modTime.Equal(info.ModTime()) {
+			failure = &csrFailure{modTime: info.ModTime()}
+		}
+		if time.Now().Before(failure.next) {
+			continue
+		}
+		err = ac.processCSR(csrPath, failure)
+		if errors.Is(err, errCSRRejected) {
+			log.Errorf("rejected CSR %s: %v", csrPath, err)
+			ac.rejectedCSRs[csrPath] = info.ModTime()
+			delete(ac.failedCSRs, csrPath)
+			continue
+		}
+		delete(ac.rejectedCSRs, csrPath)
+		if err != nil {
+			ac.failedCSRs[csrPath] = failure
+			failure.failures++
+			backoff := ac.csrBackoff(failure.failures)
+			failure.next = time.Now().Add(backoff)
+			log.Errorf("%v, trying again in %s", err, backoff)
+			continue
+		}
+		delete(ac.failedCSRs, csrPath)
+	}
+}
+
+// csrBackoff returns the wait after the given number of failures of a CSR.
+func (ac *acmeChallenge) csrBackoff(failures int) time.Duration {
+	backoff := ac.config.CSRInboxInterval
+	if backoff <= 0 {
+		backoff = time.Minute
+	}
+	for i := 1; i < failures && backoff < csrMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, csrMaxBackoff)
+}
+
+// processCSR obtains a certificate for the CSR at csrPath when needed and writes it. An unacceptable
+// CSR fails with errCSRRejected. A failed order or write fails with any other error; a certificate
+// obtained but not written is kept in failure, the record of the failed attempts of the CSR.
+func (ac *acmeChallenge) processCSR(csrPath string, failure *csrFailure) error {
+	csrPEM, err := os.ReadFile(csrPath)
+	if err != nil {
+		return fmt.Errorf("could not read CSR %s: %w", csrPath, err)
+	}
+	csr, err := certcrypto.PemDecodeTox509CSR(csrPEM)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errCSRRejected, err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return fmt.Errorf("%w: invalid CSR signature: %w", errCSRRejected, err)
+	}
+
+	names := csrNames(csr)
+	if len(names) == 0 {
+		return fmt.Errorf("%w: CSR contains no names", errCSRRejected)
+	}
+	zone, err := ac.zoneForNames(names)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errCSRRejected, err)
+	}
+
+	crtPath := strings.TrimSuffix(csrPath, csrExtension) + crtExtension
+	if failure.pending != nil {
+		if err := storage.WriteFileAtomic(crtPath, failure.pending, 0644, 0); err != nil {
+			return fmt.Errorf("could not write certificate for CSR %s: %w", csrPath, err)
+		}
+		return nil
+	}
+	existing, _ := os.ReadFile(crtPath)
+	if existing != nil {
+		current := &storage.Resource{Resource: certificate.Resource{Domain: names[0], Certificate: existing}}
+		if cert, err := parseLeafCertificate(existing); err == nil && publicKeysEqual(cert.PublicKey, csr.PublicKey) && namesEqual(cert.DNSNames, names) && checkIfCertIsValid(current, ac.config.RenewBeforeDays) {
+			return nil
+		}
+	}
+
+	cas := ac.coreDNSProvider.caChain(&config.ManagedCertificate{Name: zone, Zone: zone})
+	for i, ca := range cas {
+		log.Infof("obtaining certificate for CSR %s from ca '%s'", csrPath, ca.name)
+		certs, err := ac.obtainForCSR(ca, csr)
+		if err == nil {
+			if err := storage.WriteFileAtomic(crtPath, certs.Certificate, 0644, 0); err != nil {
+				// Written on the next attempt rather than ordered again.
+				failure.pending = certs.Certificate
+				return fmt.Errorf("could not write certificate for CSR %s: %w", csrPath, err)
+			}
+			return nil
+		}
+
+		if i == len(cas)-1 || (existing != nil && !ac.closeToExpiry(existing)) {
+			return fmt.Errorf("could not obtain certificate for CSR %s from ca '%s': %w", csrPath, ca.name, err)
+		}
+		log.Errorf("could not obtain certificate for CSR %s from ca '%s': %v", csrPath, ca.name, err)
+	}
+	return nil
+}
+
+// zoneForNames checks that every name is inside a managed zone and returns the zone of the first.
+func (ac *acmeChallenge) zoneForNames(names []string) (string, error) {
+	for _, name := range names {
+		if config.ZoneOf(name, ac.config.Zones) == "" {
+			return "", fmt.Errorf("name '%s' is not inside a managed zone", name)
+		}
+	}
+	return config.ZoneOf(names[0], ac.config.Zones), nil
+}
+
+func csrNames(csr *x509.CertificateRequest) []string {
+	var names []string
+	if csr.Subject.CommonName != "" {
+		names = append(names, csr.Subject.CommonName)
+	}
+	for _, n := range csr.DNSNames {
+		if n != csr.Subject.CommonName {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// namesEqual reports whether a and b hold the same DNS names, ignoring case, order and duplicates.
+func namesEqual(a, b []string) bool {
+	lower := func(names []string) []string {
+		l := make([]string, 0, len(names))
+		for _, n := range names {
+			l = append(l, strings.ToLower(n))
+		}
+		slices.Sort(l)
+		return slices.Compact(l)
+	}
+	return slices.Equal(lower(a), lower(b))
+}
+
+func publicKeysEqual(a, b crypto.PublicKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && k.Equal(b)
+}
@@ -0,0 +1,212 @@
+package acmednschallenge
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+)
+
+func writeTestCSR(t *testing.T, path string, names ...string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: names[0]},
+		DNSNames: names,
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// signCSR stands in for the CA: it issues a certificate for the CSR's key and names.
+func signCSR(t *testing.T, csr *x509.CertificateRequest, validFor time.Duration) []byte {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      csr.Subject,
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validFor),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, csr.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestProcessCSRInbox(t *testing.T) {
+	dir := t.TempDir()
+	writeTestCSR(t, filepath.Join(dir, "api.csr"), "api.example.com", "www.example.com")
+	writeTestCSR(t, filepath.Join(dir, "evil.csr"), "evil.org")
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("ignored"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var orders []string
+	ac := &acmeChallenge{
+		config: &config.ACMEChallengeConfig{
+			CSRInbox:             dir,
+			RenewBeforeDays:      10,
+			CAFailoverBeforeDays: 5,
+			Zones:                []string{"example.com"},
+		},
+		coreDNSProvider: newTestProvider("primary"),
+		rejectedCSRs:    map[string]time.Time{},
+		failedCSRs:      map[string]*csrFailure{},
+	}
+	ac.obtainForCSR = func(ca *certificateAuthority, csr *x509.CertificateRequest) (*certificate.Resource, error) {
+		orders = append(orders, csr.Subject.CommonName)
+		return &certificate.Resource{Domain: csr.Subject.CommonName, Certificate: signCSR(t, csr, 90*24*time.Hour)}, nil
+	}
+
+	ac.processCSRInbox()
+
+	if len(orders) != 1 || orders[0] != "api.example.com" {
+		t.Fatalf("orders = %v, want only api.example.com", orders)
+	}
+	crt, err := os.ReadFile(filepath.Join(dir, "api.crt"))
+	if err != nil {
+		t.Fatalf("expected api.crt next to the CSR: %v", err)
+	}
+	if _, err := parseLeafCertificate(crt); err != nil {
+		t.Errorf("api.crt is not a certificate: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.crt")); !os.IsNotExist(err) {
+		t.Error("a certificate was written for a CSR outside the managed zones")
+	}
+
+	// The certificate is still valid and the rejected CSR is unchanged, so nothing is ordered.
+	ac.processCSRInbox()
+	if len(orders) != 1 {
+		t.Errorf("orders = %v, want no new order on the second pass", orders)
+	}
+
+	// The same key with other names, for example a SAN added to the CSR, needs a new certificate too.
+	csrPEM, err := os.ReadFile(filepath.Join(dir, "api.csr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := certcrypto.PemDecodeTox509CSR(csrPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr.DNSNames = []string{"api.example.com"}
+	if err := os.WriteFile(filepath.Join(dir, "api.crt"), signCSR(t, csr, 90*24*time.Hour), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ac.processCSRInbox()
+	if len(orders) != 2 {
+		t.Fatalf("orders = %v, want a new order for a certificate missing a name of the CSR", orders)
+	}
+
+	// A new key in the CSR means the stored certificate no longer matches it.
+	writeTestCSR(t, filepath.Join(dir, "api.csr"), "api.example.com")
+	ac.processCSRInbox()
+	if len(orders) != 3 {
+		t.Errorf("orders = %v, want a new order after the CSR changed", orders)
+	}
+}
+
+func TestZoneForNames(t *testing.T) {
+	ac := &acmeChallenge{config: &config.ACMEChallengeConfig{
+		Zones: []string{"example.com", "internal.example.com"},
+	}}
+
+	if zone, err := ac.zoneForNames([]string{"a.internal.example.com", "www.example.com"}); err != nil || zone != "internal.example.com" {
+		t.Errorf("zoneForNames = %q, %v; want internal.example.com", zone, err)
+	}
+	if _, err := ac.zoneForNames([]string{"www.example.com", "example.org"}); err == nil {
+		t.Error("expected an error for a name outside the managed zones")
+	}
+}
+
+func TestProcessCSRInboxBackoff(t *testing.T) {
+	dir := t.TempDir()
+	csrPath := filepath.Join(dir, "api.csr")
+	writeTestCSR(t, csrPath, "api.example.com")
+
+	var orders int
+	var orderErr error
+	ac := &acmeChallenge{
+		config: &config.ACMEChallengeConfig{
+			CSRInbox:         dir,
+			CSRInboxInterval: time.Minute,
+			RenewBeforeDays:  10,
+			Zones:            []string{"example.com"},
+		},
+		coreDNSProvider: newTestProvider("primary"),
+		rejectedCSRs:    map[string]time.Time{},
+		failedCSRs:      map[string]*csrFailure{},
+	}
+	ac.obtainForCSR = func(ca *certificateAuthority, csr *x509.CertificateRequest) (*certificate.Resource, error) {
+		orders++
+		if orderErr != nil {
+			return nil, orderErr
+		}
+		return &certificate.Resource{Domain: csr.Subject.CommonName, Certificate: signCSR(t, csr, 90*24*time.Hour)}, nil
+	}
+	retryNow := func() { ac.failedCSRs[csrPath].next = time.Now() }
+
+	// A failed order is not placed again before its backoff, which doubles with every failure.
+	orderErr = errors.New("rateLimited")
+	ac.processCSRInbox()
+	ac.processCSRInbox()
+	if orders != 1 {
+		t.Fatalf("orders = %d, want 1 within the backoff", orders)
+	}
+	retryNow()
+	ac.processCSRInbox()
+	if f := ac.failedCSRs[csrPath]; orders != 2 || f.failures != 2 || time.Until(f.next) <= time.Minute {
+		t.Fatalf("after the second failure orders = %d, failure = %+v; want a backoff of 2m", orders, f)
+	}
+
+	// A certificate that can't be written is kept and written on the next attempt, without an order.
+	orderErr = nil
+	crtPath := filepath.Join(dir, "api.crt")
+	if err := os.Mkdir(crtPath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	retryNow()
+	ac.processCSRInbox()
+	if orders != 3 || ac.failedCSRs[csrPath].pending == nil {
+		t.Fatalf("orders = %d, failure = %+v; want the obtained certificate kept", orders, ac.failedCSRs[csrPath])
+	}
+	if err := os.Remove(crtPath); err != nil {
+		t.Fatal(err)
+	}
+	retryNow()
+	ac.processCSRInbox()
+	if orders != 3 {
+		t.Errorf("orders = %d, want the kept certificate written instead of a new order", orders)
+	}
+	if _, err := os.ReadFile(crtPath); err != nil {
+		t.Errorf("api.crt not written: %v", err)
+	}
+	if _, ok := ac.failedCSRs[csrPath]; ok {
+		t.Error("failure kept after the certificate was written")
+	}
+}
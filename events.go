@@ -0,0 +1,105 @@
+package acmednschallenge
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+	"github.com/go-acme/lego/v4/acme"
+)
+
+// Reasons of the events published for certificates by storages that record them, such as the
+// Kubernetes Secrets.
+const (
+	reasonIssued        = "Issued"
+	reasonRenewed       = "Renewed"
+	reasonRenewalFailed = "RenewalFailed"
+	reasonExpiring      = "Expiring"
+	reasonStorageError  = "StorageError"
+	reasonRevoked       = "Revoked"
+)
+
+// recordEvent publishes an event of cert through its storage, when the storage records them.
+func (ac *acmeChallenge) recordEvent(cert *config.ManagedCertificate, warning bool, reason, format string, args ...any) {
+	if r, ok := storage.RecorderOf(ac.storageFor(cert)); ok {
+		r.Record(cert.Name, warning, reason, fmt.Sprintf(format, args...))
+	}
+}
+
+// savedReason returns the reason of the event for storing a newly obtained certificate of cert:
+// Renewed when one is stored already, Issued otherwise. It is only looked up for storages recording
+// events.
+func (ac *acmeChallenge) savedReason(cert *config.ManagedCertificate) string {
+	s := ac.storageFor(cert)
+	if _, ok := storage.RecorderOf(s); !ok {
+		return ""
+	}
+	if _, err := s.Load(cert.Name); err == nil {
+		return reasonRenewed
+	}
+	return reasonIssued
+}
+
+// recordSaved publishes the Issued or Renewed event of certs, obtained for cert from ca.
+func (ac *acmeChallenge) recordSaved(cert *config.ManagedCertificate, reason string, ca *certificateAuthority, certs *storage.Resource) {
+	if reason == "" {
+		return
+	}
+	verb := "issued"
+	if reason == reasonRenewed {
+		verb = "renewed"
+	}
+	leaf, err := parseLeafCertificate(certs.Certificate)
+	if err != nil {
+		ac.recordEvent(cert, false, reason, "certificate for %v %s by ca '%s'", cert.Domains, verb, ca.name)
+		return
+	}
+	ac.recordEvent(cert, false, reason, "certificate for %v %s by ca '%s', valid until %s", cert.Domains, verb, ca.name, leaf.NotAfter.UTC().Format(time.RFC3339))
+}
+
+// recordFailed publishes the RenewalFailed event of cert for err of ca, naming the ACME problem type.
+func (ac *acmeChallenge) recordFailed(cert *config.ManagedCertificate, ca *certificateAuthority, err error) {
+	if problem := acmeProblemType(err); problem != "" {
+		ac.recordEvent(cert, true, reasonRenewalFailed, "ca '%s' failed with %s: %v", ca.name, problem, err)
+		return
+	}
+	ac.recordEvent(cert, true, reasonRenewalFailed, "ca '%s' failed: %v", ca.name, err)
+}
+
+// recordExpiring publishes the Expiring event of cert when no CA renewed it and the stored certificate
+// is due for renewal or expired.
+func (ac *acmeChallenge) recordExpiring(cert *config.ManagedCertificate) {
+	s := ac.storageFor(cert)
+	if _, ok := storage.RecorderOf(s); !ok {
+		return
+	}
+	certs, err := s.Load(cert.Name)
+	if err != nil {
+		return
+	}
+	leaf, err := parseLeafCertificate(certs.Certificate)
+	if err != nil {
+		return
+	}
+	left := time.Until(leaf.NotAfter)
+	if left >= time.Duration(cert.RenewBeforeDays)*24*time.Hour {
+		return
+	}
+	if left <= 0 {
+		ac.recordEvent(cert, true, reasonExpiring, "certificate expired at %s and could not be renewed", leaf.NotAfter.UTC().Format(time.RFC3339))
+		return
+	}
+	ac.recordEvent(cert, true, reasonExpiring, "certificate expires at %s, in %d days, and could not be renewed", leaf.NotAfter.UTC().Format(time.RFC3339), int(left.Hours()/24))
+}
+
+// acmeProblemType returns the type of the ACME problem err reports, such as
+// urn:ietf:params:acme:error:rateLimited, or "" when it reports none.
+func acmeProblemType(err error) string {
+	var problem *acme.ProblemDetails
+	if errors.As(err, &problem) {
+		return problem.Type
+	}
+	return ""
+}
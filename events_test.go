@@ -0,0 +1,94 @@
+package acmednschallenge
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+	"github.com/go-acme/lego/v4/acme"
+)
+
+// recordingStorage is a fakeStorage recording events.
+type recordingStorage struct {
+	fakeStorage
+	saveErr error
+	events  []string
+}
+
+func (r *recordingStorage) Save(certs *storage.Resource) error {
+	if r.saveErr != nil {
+		return r.saveErr
+	}
+	return r.fakeStorage.Save(certs)
+}
+
+func (r *recordingStorage) Record(domain string, warning bool, reason, message string) {
+	r.events = append(r.events, fmt.Sprintf("%s %v %s: %s", domain, warning, reason, message))
+}
+
+func TestUpdateCertificateEvents(t *testing.T) {
+	rateLimited := &acme.RateLimitedError{ProblemDetails: &acme.ProblemDetails{Type: "urn:ietf:params:acme:error:rateLimited", Detail: "too many certificates", HTTPStatus: 429}}
+	tests := []struct {
+		name       string
+		stored     *storage.Resource
+		loadErr    error
+		saveErr    error
+		obtainErr  error
+		wantEvents []string // prefixes
+	}{
+		{name: "issued", wantEvents: []string{"example.com false Issued: certificate for [example.com] issued by ca 'primary', valid until "}},
+		{name: "renewed", stored: issueTestCert(t, testCert{notAfter: time.Now().Add(2 * 24 * time.Hour)}), wantEvents: []string{"example.com false Renewed: certificate for [example.com] renewed by ca 'primary'"}},
+		{
+			name:      "renewal failed close to expiry",
+			stored:    issueTestCert(t, testCert{notAfter: time.Now().Add(2 * 24 * time.Hour)}),
+			obtainErr: fmt.Errorf("error: one or more domains had a problem:\n%w", errors.Join(fmt.Errorf("example.com: %w", rateLimited))),
+			wantEvents: []string{
+				"example.com true RenewalFailed: ca 'primary' failed with urn:ietf:params:acme:error:rateLimited: ",
+				"example.com true Expiring: certificate expires at ",
+			},
+		},
+		{
+			name:       "renewal failed far from expiry",
+			stored:     issueTestCert(t, testCert{notAfter: time.Now().Add(20 * 24 * time.Hour)}),
+			obtainErr:  errors.New("dns: timeout"),
+			wantEvents: []string{"example.com true RenewalFailed: ca 'primary' failed: dns: timeout"},
+		},
+		{name: "load failed", loadErr: errors.New("etcd is down"), wantEvents: []string{"example.com true StorageError: could not load the certificate: "}},
+		{name: "save failed", saveErr: errors.New("etcd is down"), wantEvents: []string{"example.com true StorageError: could not save the certificate obtained from ca 'primary': etcd is down"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &recordingStorage{fakeStorage: fakeStorage{stored: tc.stored, loadErr: tc.loadErr}, saveErr: tc.saveErr}
+			ac := &acmeChallenge{
+				config:          &config.ACMEChallengeConfig{},
+				storage:         store,
+				coreDNSProvider: newTestProvider("primary"),
+			}
+			ac.obtainOrRenew = func(cert *config.ManagedCertificate, _ *certificateAuthority) (bool, *storage.Resource, error) {
+				if _, err := store.Load(cert.Name); err != nil && !errors.Is(err, storage.ErrNotFound) {
+					return false, nil, fmt.Errorf("%w: %w", errStorageFailed, err)
+				}
+				if tc.obtainErr != nil {
+					return false, nil, tc.obtainErr
+				}
+				return true, issueTestCert(t, testCert{notAfter: time.Now().Add(90 * 24 * time.Hour)}), nil
+			}
+
+			ac.updateCertificate(&config.ManagedCertificate{Name: "example.com", Domains: []string{"example.com"}, RenewBeforeDays: 5}, orderState{})
+
+			if len(store.events) != len(tc.wantEvents) {
+				t.Fatalf("events = %q, want %q", store.events, tc.wantEvents)
+			}
+			for i, want := range tc.wantEvents {
+				if !strings.HasPrefix(store.events[i], want) {
+					t.Errorf("event %d = %q, want %q...", i, store.events[i], want)
+				}
+			}
+		})
+	}
+}
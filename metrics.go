@@ -0,0 +1,26 @@
+package acmednschallenge
+
+import (
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// revokedCertificates counts stored certificates found revoked by their CA.
+	revokedCertificates = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: name,
+		Name:      "revoked_certificates_total",
+		Help:      "The count of stored certificates found revoked by their CA.",
+	}, []string{"certificate", "method"})
+
+	// storageErrors counts failed reads and writes of the certificate storage.
+	storageErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: name,
+		Name:      "storage_errors_total",
+		Help:      "The count of failed certificate storage operations.",
+	}, []string{"certificate", "operation"})
+)
@@ -0,0 +1,40 @@
+package acmednschallenge
+
+import (
+	"sync"
+	"time"
+)
+
+// orderLimiter allows at most limit orders in any window of interval. Callers over the limit block
+// until the oldest order in the window has aged out. A nil orderLimiter does not limit.
+type orderLimiter struct {
+	limit    int
+	interval time.Duration
+
+	mu     sync.Mutex
+	recent []time.Time
+}
+
+func newOrderLimiter(limit uint32, interval time.Duration) *orderLimiter {
+	if limit == 0 {
+		return nil
+	}
+	return &orderLimiter{limit: int(limit), interval: interval}
+}
+
+// wait blocks until another order may be placed and records it.
+func (l *orderLimiter) wait() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.recent) >= l.limit {
+		if d := time.Until(l.recent[0].Add(l.interval)); d > 0 {
+			time.Sleep(d)
+		}
+		l.recent = l.recent[1:]
+	}
+	l.recent = append(l.recent, time.Now())
+}
@@ -0,0 +1,31 @@
+package acmednschallenge
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOrderLimiter(t *testing.T) {
+	l := newOrderLimiter(2, 100*time.Millisecond)
+
+	start := time.Now()
+	l.wait()
+	l.wait()
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("orders within the limit waited %s", elapsed)
+	}
+	l.wait()
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("third order placed after %s, want it to wait for the window", elapsed)
+	}
+}
+
+func TestOrderLimiterDisabled(t *testing.T) {
+	l := newOrderLimiter(0, time.Hour)
+	if l != nil {
+		t.Fatalf("newOrderLimiter(0) = %v, want nil", l)
+	}
+	for i := 0; i < 10; i++ {
+		l.wait()
+	}
+}
@@ -0,0 +1,88 @@
+package acmednschallenge
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+)
+
+// pruneTarget is a storage to prune, with the block whose pruneOrphans policy applies to it.
+type pruneTarget struct {
+	options storage.Options
+	storage storage.CertStorage
+	block   *acmeChallenge
+}
+
+// prune removes the certificates no registered block manages any more from the storages of the blocks
+// that set pruneOrphans. A certificate counts as managed when any block, pruning or not, stores it
+// there, so blocks sharing a storage never prune each other's certificates. Only the blocks of this
+// process are known: a replica still running an older Corefile would see the certificates a replica
+// with the new one just issued as orphans, so certificates issued within pruneGracePeriod are kept.
+func (m *certificateManager) prune() {
+	m.mu.Lock()
+	managed := make(map[certificateKey]bool)
+	for _, mc := range m.certificatesLocked() {
+		managed[certificateKey{mc.cert.Storage, mc.cert.Name}] = true
+	}
+	var targets []pruneTarget
+	seen := make(map[storage.Options]bool)
+	for _, ac := range m.blocks {
+		if ac.config.PruneOrphans == "" {
+			continue
+		}
+		for o, s := range ac.storages {
+			if !seen[o] {
+				seen[o] = true
+				targets = append(targets, pruneTarget{options: o, storage: s, block: ac})
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, t := range targets {
+		entries, err := t.storage.List()
+		if err != nil {
+			log.Errorf("could not list certificates to prune: %v", err)
+			continue
+		}
+		for _, e := range entries {
+			if managed[certificateKey{t.options, e.Domain}] {
+				continue
+			}
+			if time.Since(e.NotBefore) < t.block.config.PruneGracePeriod {
+				log.Debugf("not pruning certificate '%s' yet, issued %s", e.Domain, e.NotBefore.Format(time.RFC3339))
+				continue
+			}
+			pruneCertificate(t.storage, t.options, e, t.block.config)
+		}
+	}
+}
+
+// pruneCertificate deletes the certificate of e from s, copying it to the archive first when cfg asks
+// for it. The archive encrypts private keys like o does. A certificate that can't be archived is kept.
+func pruneCertificate(s storage.CertStorage, o storage.Options, e storage.Entry, cfg *config.ACMEChallengeConfig) {
+	if cfg.PruneOrphans == config.PruneArchive {
+		certs, err := s.Load(e.Domain)
+		if err != nil {
+			log.Errorf("could not load certificate '%s' to archive it: %v", e.Domain, err)
+			return
+		}
+		dir := filepath.Join(cfg.PruneArchivePath, time.Now().UTC().Format("20060102T150405Z"))
+		archive, err := storage.New(storage.Options{Type: "disk", DiskPath: dir, KeyMode: 0600, Encryption: o.Encryption})
+		if err == nil {
+			err = archive.Save(certs)
+		}
+		if err != nil {
+			log.Errorf("could not archive certificate '%s', keeping it: %v", e.Domain, err)
+			return
+		}
+		log.Infof("archived certificate '%s' to %s", e.Domain, dir)
+	}
+	if err := s.Delete(e.Domain); err != nil {
+		log.Errorf("could not delete certificate '%s': %v", e.Domain, err)
+		return
+	}
+	log.Infof("pruned certificate '%s', no longer configured (expires %s)", e.Domain, e.NotAfter.Format(time.RFC3339))
+}
@@ -0,0 +1,91 @@
+package acmednschallenge
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+)
+
+func TestManagerPrune(t *testing.T) {
+	tests := []struct {
+		name        string
+		prune       string
+		grace       time.Duration
+		wantKept    []string
+		wantArchive bool
+	}{
+		{name: "off", prune: "", wantKept: []string{"example.com", "old.example.com", "shared.example.com"}},
+		{name: "delete", prune: config.PruneDelete, wantKept: []string{"example.com", "shared.example.com"}},
+		{name: "archive", prune: config.PruneArchive, wantKept: []string{"example.com", "shared.example.com"}, wantArchive: true},
+		// The certificates were issued an hour ago, maybe by a replica running a newer Corefile.
+		{name: "issued within grace period", prune: config.PruneDelete, grace: 2 * time.Hour, wantKept: []string{"example.com", "old.example.com", "shared.example.com"}},
+		{name: "issued before grace period", prune: config.PruneDelete, grace: 30 * time.Minute, wantKept: []string{"example.com", "shared.example.com"}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			stored := certsByName{}
+			for _, name := range []string{"example.com", "old.example.com", "shared.example.com"} {
+				stored[name] = issueTestCert(t, testCert{notAfter: time.Now().Add(30 * 24 * time.Hour)})
+				stored[name].Domain = name
+			}
+			archive := t.TempDir()
+			block := func(name, prune string) *acmeChallenge {
+				return &acmeChallenge{
+					config: &config.ACMEChallengeConfig{
+						Certificates:     map[string]*config.ManagedCertificate{name: {Name: name, Domains: []string{name}}},
+						PruneOrphans:     prune,
+						PruneArchivePath: archive,
+						PruneGracePeriod: tc.grace,
+					},
+					storage:  stored,
+					storages: map[storage.Options]storage.CertStorage{{}: stored},
+				}
+			}
+
+			m := newCertificateManager()
+			// The second block doesn't prune, but its certificate in the shared storage is kept.
+			for _, ac := range []*acmeChallenge{block("example.com", tc.prune), block("shared.example.com", "")} {
+				if err := m.register(ac); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			m.prune()
+
+			var kept []string
+			for name := range stored {
+				kept = append(kept, name)
+			}
+			slices.Sort(kept)
+			if !slices.Equal(kept, tc.wantKept) {
+				t.Errorf("kept %v, want %v", kept, tc.wantKept)
+			}
+
+			archived, _ := filepath.Glob(filepath.Join(archive, "*", "certs", "old.example.com.json"))
+			if got := len(archived) == 1; got != tc.wantArchive {
+				t.Errorf("archived = %v, want %v", archived, tc.wantArchive)
+			}
+		})
+	}
+}
+
+func TestPruneKeepsCertificateThatCannotBeArchived(t *testing.T) {
+	stored := certsByName{"old.example.com": issueTestCert(t, testCert{notAfter: time.Now().Add(30 * 24 * time.Hour)})}
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The archive path is a file, so the archive directory can't be created.
+	pruneCertificate(stored, storage.Options{}, storage.Entry{Domain: "old.example.com"}, &config.ACMEChallengeConfig{PruneOrphans: config.PruneArchive, PruneArchivePath: file})
+
+	if _, ok := stored["old.example.com"]; !ok {
+		t.Error("certificate was deleted although archiving it failed")
+	}
+}
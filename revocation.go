@@ -0,0 +1,182 @@
+package acmednschallenge
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	maxRevocationResponseSize = 10 << 20
+	// revocationClockSkew is how far ThisUpdate of a response may lie in the future, or NextUpdate in
+	// the past, before the response is rejected as not current.
+	revocationClockSkew = 5 * time.Minute
+)
+
+var revocationHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// crlCache holds the CRLs fetched and verified, by URL, until their NextUpdate, so a CRL shared by
+// many certificates is downloaded once per update rather than once per certificate and check.
+var crlCache = struct {
+	sync.Mutex
+	crls map[string]cachedCRL
+}{crls: map[string]cachedCRL{}}
+
+// cachedCRL is a CRL together with the issuer it was verified against.
+type cachedCRL struct {
+	crl    *x509.RevocationList
+	issuer []byte
+}
+
+// checkRevocation asks the CA whether the stored certificate is revoked, over OCSP when the certificate
+// names a responder and through its CRL distribution point otherwise, or when the responder fails or
+// doesn't know the certificate. method is "ocsp" or "crl", whichever answered.
+func checkRevocation(certs *storage.Resource) (revoked bool, method string, err error) {
+	leaf, err := parseLeafCertificate(certs.Certificate)
+	if err != nil {
+		return false, "", err
+	}
+	issuer, err := issuerCertificate(certs)
+	if err != nil {
+		return false, "", err
+	}
+
+	var ocspErr error
+	if len(leaf.OCSPServer) > 0 {
+		revoked, err := checkOCSP(leaf, issuer, leaf.OCSPServer[0])
+		if err == nil || len(leaf.CRLDistributionPoints) == 0 {
+			return revoked, "ocsp", err
+		}
+		ocspErr = err
+	}
+	if len(leaf.CRLDistributionPoints) > 0 {
+		revoked, err := checkCRL(leaf, issuer, leaf.CRLDistributionPoints[0])
+		if err != nil && ocspErr != nil {
+			err = fmt.Errorf("%w, and the CRL failed too: %w", ocspErr, err)
+		}
+		return revoked, "crl", err
+	}
+	return false, "", errors.New("certificate names neither an OCSP responder nor a CRL distribution point")
+}
+
+// checkCurrent fails when a revocation response issued at thisUpdate, to be replaced at nextUpdate,
+// is not current. A zero nextUpdate means newer information is always available and isn't checked.
+func checkCurrent(thisUpdate, nextUpdate time.Time) error {
+	now := time.Now()
+	if thisUpdate.After(now.Add(revocationClockSkew)) {
+		return fmt.Errorf("issued in the future, at %s", thisUpdate.UTC().Format(time.RFC3339))
+	}
+	if !nextUpdate.IsZero() && nextUpdate.Before(now.Add(-revocationClockSkew)) {
+		return fmt.Errorf("stale, superseded at %s", nextUpdate.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// issuerCertificate returns the issuer lego stored separately, or else the second certificate of the
+// bundle.
+func issuerCertificate(certs *storage.Resource) (*x509.Certificate, error) {
+	if len(certs.IssuerCertificate) > 0 {
+		return parseLeafCertificate(certs.IssuerCertificate)
+	}
+	_, rest := pem.Decode(certs.Certificate)
+	if issuer, err := parseLeafCertificate(rest); err == nil {
+		return issuer, nil
+	}
+	return nil, errors.New("no issuer certificate stored")
+}
+
+func checkOCSP(leaf, issuer *x509.Certificate, responder string) (bool, error) {
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return false, err
+	}
+	body, err := fetchRevocationData(http.MethodPost, responder, "application/ocsp-request", req)
+	if err != nil {
+		return false, err
+	}
+	resp, err := ocsp.ParseResponseForCert(body, leaf, issuer)
+	if err != nil {
+		return false, fmt.Errorf("invalid OCSP response from %s: %w", responder, err)
+	}
+	if err := checkCurrent(resp.ThisUpdate, resp.NextUpdate); err != nil {
+		return false, fmt.Errorf("OCSP response from %s is %w", responder, err)
+	}
+	if resp.Status == ocsp.Unknown {
+		return false, fmt.Errorf("OCSP responder %s doesn't know the certificate", responder)
+	}
+	return resp.Status == ocsp.Revoked, nil
+}
+
+func checkCRL(leaf, issuer *x509.Certificate, url string) (bool, error) {
+	crl, err := fetchCRL(url, issuer)
+	if err != nil {
+		return false, err
+	}
+	if err := checkCurrent(crl.ThisUpdate, crl.NextUpdate); err != nil {
+		return false, fmt.Errorf("CRL from %s is %w", url, err)
+	}
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(leaf.SerialNumber) == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// fetchCRL returns the CRL at url signed by issuer, from crlCache while it is current.
+func fetchCRL(url string, issuer *x509.Certificate) (*x509.RevocationList, error) {
+	crlCache.Lock()
+	cached, ok := crlCache.crls[url]
+	crlCache.Unlock()
+	if ok && bytes.Equal(cached.issuer, issuer.Raw) && time.Now().Before(cached.crl.NextUpdate) {
+		return cached.crl, nil
+	}
+
+	body, err := fetchRevocationData(http.MethodGet, url, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	crl, err := x509.ParseRevocationList(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRL from %s: %w", url, err)
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("CRL from %s is not signed by the issuer: %w", url, err)
+	}
+	crlCache.Lock()
+	if time.Now().Before(crl.NextUpdate) {
+		crlCache.crls[url] = cachedCRL{crl: crl, issuer: issuer.Raw}
+	} else {
+		delete(crlCache.crls, url)
+	}
+	crlCache.Unlock()
+	return crl, nil
+}
+
+func fetchRevocationData(method, url, contentType string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := revocationHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxRevocationResponseSize))
+}
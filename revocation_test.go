@@ -0,0 +1,315 @@
+package acmednschallenge
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/crypto/ocsp"
+)
+
+type testIssuer struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test Issuer"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testIssuer{cert: cert, key: key}
+}
+
+// issue returns a stored leaf signed by the issuer, pointing at the given OCSP responder or CRL.
+func (i *testIssuer) issue(t *testing.T, serial int64, ocspServer, crl string) *storage.Resource {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	if ocspServer != "" {
+		tmpl.OCSPServer = []string{ocspServer}
+	}
+	if crl != "" {
+		tmpl.CRLDistributionPoints = []string{crl}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, i.cert, key.Public(), i.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &storage.Resource{Resource: certificate.Resource{
+		Domain:            "example.com",
+		Certificate:       pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		IssuerCertificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: i.cert.Raw}),
+	}}
+}
+
+// ocspResponder answers every OCSP request with status for the requested serial.
+func (i *testIssuer) ocspResponder(t *testing.T, revoked map[int64]bool) *httptest.Server {
+	return i.ocspResponderFunc(t, func(serial *big.Int) ocsp.Response {
+		tmpl := ocsp.Response{
+			SerialNumber: serial,
+			Status:       ocsp.Good,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		if revoked[serial.Int64()] {
+			tmpl.Status = ocsp.Revoked
+			tmpl.RevokedAt = time.Now().Add(-time.Minute)
+		}
+		return tmpl
+	})
+}
+
+// ocspResponderFunc answers every OCSP request with the response respond returns for the serial.
+func (i *testIssuer) ocspResponderFunc(t *testing.T, respond func(serial *big.Int) ocsp.Response) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req, err := ocsp.ParseRequest(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := ocsp.CreateResponse(i.cert, i.cert, respond(req.SerialNumber), i.key)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(resp)
+	}))
+}
+
+// crlServer serves a CRL revoking the given serials, signed by signer.
+func (i *testIssuer) crlServer(t *testing.T, signer *testIssuer, revoked ...int64) *httptest.Server {
+	return i.crlServerAt(t, signer, time.Now().Add(-time.Minute), time.Now().Add(time.Hour), nil, revoked...)
+}
+
+// crlServerAt serves a CRL issued at thisUpdate and superseded at nextUpdate, counting the downloads
+// in hits unless it is nil.
+func (i *testIssuer) crlServerAt(t *testing.T, signer *testIssuer, thisUpdate, nextUpdate time.Time, hits *atomic.Int32, revoked ...int64) *httptest.Server {
+	var entries []x509.RevocationListEntry
+	for _, serial := range revoked {
+		entries = append(entries, x509.RevocationListEntry{SerialNumber: big.NewInt(serial), RevocationTime: time.Now().Add(-time.Minute)})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:                    big.NewInt(1),
+		ThisUpdate:                thisUpdate,
+		NextUpdate:                nextUpdate,
+		RevokedCertificateEntries: entries,
+	}, signer.cert, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hits != nil {
+			hits.Add(1)
+		}
+		w.Write(der)
+	}))
+}
+
+func TestCheckRevocationOCSP(t *testing.T) {
+	issuer := newTestIssuer(t)
+	responder := issuer.ocspResponder(t, map[int64]bool{13: true})
+	defer responder.Close()
+
+	revoked, method, err := checkRevocation(issuer.issue(t, 13, responder.URL, ""))
+	if err != nil || !revoked || method != "ocsp" {
+		t.Errorf("revoked certificate: revoked = %v, method = %q, err = %v", revoked, method, err)
+	}
+	revoked, _, err = checkRevocation(issuer.issue(t, 14, responder.URL, ""))
+	if err != nil || revoked {
+		t.Errorf("good certificate: revoked = %v, err = %v", revoked, err)
+	}
+}
+
+func TestCheckRevocationCRL(t *testing.T) {
+	issuer := newTestIssuer(t)
+	crl := issuer.crlServer(t, issuer, 13)
+	defer crl.Close()
+
+	revoked, method, err := checkRevocation(issuer.issue(t, 13, "", crl.URL))
+	if err != nil || !revoked || method != "crl" {
+		t.Errorf("revoked certificate: revoked = %v, method = %q, err = %v", revoked, method, err)
+	}
+	revoked, _, err = checkRevocation(issuer.issue(t, 14, "", crl.URL))
+	if err != nil || revoked {
+		t.Errorf("good certificate: revoked = %v, err = %v", revoked, err)
+	}
+}
+
+func TestCheckRevocationErrors(t *testing.T) {
+	issuer := newTestIssuer(t)
+	forged := issuer.crlServer(t, newTestIssuer(t), 13)
+	defer forged.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+
+	tests := []struct {
+		name  string
+		certs *storage.Resource
+	}{
+		{name: "crl signed by another issuer", certs: issuer.issue(t, 13, "", forged.URL)},
+		{name: "responder unavailable", certs: issuer.issue(t, 13, down.URL, "")},
+		{name: "no revocation endpoint", certs: issuer.issue(t, 13, "", "")},
+		{name: "no issuer", certs: func() *storage.Resource {
+			r := issuer.issue(t, 13, down.URL, "")
+			r.IssuerCertificate = nil
+			return r
+		}()},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if revoked, _, err := checkRevocation(tc.certs); err == nil || revoked {
+				t.Errorf("revoked = %v, err = %v; want an error and not revoked", revoked, err)
+			}
+		})
+	}
+}
+
+func TestCheckRevocationFallsBackToCRL(t *testing.T) {
+	issuer := newTestIssuer(t)
+	crl := issuer.crlServer(t, issuer, 13)
+	defer crl.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+	respond := func(status int, thisUpdate, nextUpdate time.Time) *httptest.Server {
+		return issuer.ocspResponderFunc(t, func(serial *big.Int) ocsp.Response {
+			return ocsp.Response{SerialNumber: serial, Status: status, ThisUpdate: thisUpdate, NextUpdate: nextUpdate}
+		})
+	}
+	unknown := respond(ocsp.Unknown, time.Now().Add(-time.Minute), time.Now().Add(time.Hour))
+	defer unknown.Close()
+	stale := respond(ocsp.Good, time.Now().Add(-48*time.Hour), time.Now().Add(-24*time.Hour))
+	defer stale.Close()
+	future := respond(ocsp.Good, time.Now().Add(time.Hour), time.Now().Add(2*time.Hour))
+	defer future.Close()
+
+	for name, responder := range map[string]string{"unavailable": down.URL, "unknown": unknown.URL, "stale": stale.URL, "from the future": future.URL} {
+		t.Run(name, func(t *testing.T) {
+			revoked, method, err := checkRevocation(issuer.issue(t, 13, responder, crl.URL))
+			if err != nil || !revoked || method != "crl" {
+				t.Errorf("revoked = %v, method = %q, err = %v; want revoked by the CRL", revoked, method, err)
+			}
+			// Without a CRL to fall back to, the answer of the responder is an error.
+			if revoked, _, err := checkRevocation(issuer.issue(t, 13, responder, "")); err == nil || revoked {
+				t.Errorf("without a CRL: revoked = %v, err = %v; want an error", revoked, err)
+			}
+		})
+	}
+}
+
+func TestCheckRevocationCRLCurrent(t *testing.T) {
+	issuer := newTestIssuer(t)
+	var hits atomic.Int32
+	crl := issuer.crlServerAt(t, issuer, time.Now().Add(-time.Minute), time.Now().Add(time.Hour), &hits, 13)
+	defer crl.Close()
+	var staleHits atomic.Int32
+	stale := issuer.crlServerAt(t, issuer, time.Now().Add(-48*time.Hour), time.Now().Add(-24*time.Hour), &staleHits, 13)
+	defer stale.Close()
+
+	for range 3 {
+		if revoked, _, err := checkRevocation(issuer.issue(t, 13, "", crl.URL)); err != nil || !revoked {
+			t.Errorf("revoked = %v, err = %v; want revoked", revoked, err)
+		}
+		if revoked, _, err := checkRevocation(issuer.issue(t, 13, "", stale.URL)); err == nil || revoked {
+			t.Errorf("stale CRL: revoked = %v, err = %v; want an error", revoked, err)
+		}
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("CRL downloaded %d times, want once until its nextUpdate", n)
+	}
+	if n := staleHits.Load(); n != 3 {
+		t.Errorf("stale CRL downloaded %d times, want every time", n)
+	}
+}
+
+func TestCheckRevocationAfterStorage(t *testing.T) {
+	issuer := newTestIssuer(t)
+	responder := issuer.ocspResponder(t, map[int64]bool{13: true})
+	defer responder.Close()
+
+	// SQL keeps only the certificate, not the issuer on its own.
+	s, err := storage.New(storage.Options{Type: "sql", SQLDriver: storage.SQLSQLite, SQLDSN: filepath.Join(t.TempDir(), "acme.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// As obtained with the bundle, the certificate is followed by its issuer.
+	certs := issuer.issue(t, 13, responder.URL, "")
+	certs.Certificate = append(certs.Certificate, certs.IssuerCertificate...)
+	if err := s.Save(certs); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := s.Load("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revoked, _, err := checkRevocation(loaded); err != nil || !revoked {
+		t.Errorf("revoked = %v, err = %v; want the certificate loaded from sql revoked", revoked, err)
+	}
+}
+
+func TestIsRevokedCountsMetric(t *testing.T) {
+	issuer := newTestIssuer(t)
+	responder := issuer.ocspResponder(t, map[int64]bool{13: true})
+	defer responder.Close()
+
+	store := &recordingStorage{}
+	ac := &acmeChallenge{storage: store}
+	cert := &config.ManagedCertificate{Name: "revoked.example.com"}
+	counter := revokedCertificates.WithLabelValues(cert.Name, "ocsp")
+	before := testutil.ToFloat64(counter)
+
+	if !ac.isRevoked(cert, issuer.issue(t, 13, responder.URL, "")) {
+		t.Fatal("isRevoked = false for a revoked certificate")
+	}
+	if got := testutil.ToFloat64(counter); got != before+1 {
+		t.Errorf("revoked_certificates_total = %v, want %v", got, before+1)
+	}
+	if want := "revoked.example.com true Revoked: certificate was revoked by its CA (checked over ocsp), obtaining a new one"; len(store.events) != 1 || store.events[0] != want {
+		t.Errorf("events = %q, want %q", store.events, want)
+	}
+}
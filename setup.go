@@ -2,6 +2,8 @@ package acmednschallenge
 
 import (
 	"errors"
+	"strings"
+	"sync"
 
 	"github.com/coredns/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
@@ -11,7 +13,13 @@ import (
 
 const name = "acmednschallenge"
 
-var registeredForBlock []int
+// registeredForBlock holds the server blocks the plugin is set up in by the caddy instance
+// registeredIn. A reload sets up a new instance, which starts over.
+var (
+	registeredMu       sync.Mutex
+	registeredIn       caddy.Context
+	registeredForBlock []int
+)
 
 func init() { plugin.Register(name, setup) }
 
@@ -24,27 +32,48 @@ func contains(slice []int, value int) bool {
 	return false
 }
 
-func setup(c *caddy.Controller) error {
-	blockIdx := c.ServerBlockIndex
-
-	if contains(registeredForBlock, blockIdx) {
-		return plugin.Error(name, errors.New("only one acmechallenge per server block is allowed"))
+// registerBlock fails when the plugin is already set up in the server block of c by the same instance.
+func registerBlock(c *caddy.Controller) error {
+	registeredMu.Lock()
+	defer registeredMu.Unlock()
+	if registeredIn != c.Context() {
+		registeredIn = c.Context()
+		registeredForBlock = nil
+	}
+	if contains(registeredForBlock, c.ServerBlockIndex) {
+		return errors.New("only one acmechallenge per server block is allowed")
 	}
-
 	registeredForBlock = append(registeredForBlock, c.ServerBlockIndex)
+	return nil
+}
+
+func setup(c *caddy.Controller) error {
+	if err := registerBlock(c); err != nil {
+		return plugin.Error(name, err)
+	}
 
 	cfg, err := config.ParseConfig(c)
 	if err != nil {
 		return plugin.Error(name, err)
 	}
 
-	ac, err := newAcmeChallenge(cfg)
+	manager := getManager()
+	ac, err := newAcmeChallenge(cfg, manager)
 	if err != nil {
 		return plugin.Error(name, err)
 	}
+	ac.blockKeys = strings.Join(c.ServerBlockKeys, " ")
+	ac.generation = c.Context()
+	if err := manager.register(ac); err != nil {
+		return plugin.Error(name, err)
+	}
 
 	c.OnStartup(func() error {
-		go ac.start()
+		manager.start()
+		return nil
+	})
+	c.OnShutdown(func() error {
+		manager.unregister(ac)
 		return nil
 	})
 
@@ -0,0 +1,40 @@
+package acmednschallenge
+
+import (
+	"testing"
+
+	"github.com/coredns/caddy"
+)
+
+func TestSetupReload(t *testing.T) {
+	manager := getManager()
+	managerMu.Lock()
+	sharedManager = newCertificateManager()
+	managerMu.Unlock()
+	t.Cleanup(func() {
+		managerMu.Lock()
+		sharedManager = manager
+		managerMu.Unlock()
+	})
+
+	input := "acmednschallenge {\nemail a@b.com\nacceptedLetsEncryptToS\ncertificateStorageDisk " + t.TempDir() +
+		"\naccountStorageDisk " + t.TempDir() + "\n}"
+	controller := func() *caddy.Controller {
+		c := caddy.NewTestController("dns", input)
+		c.ServerBlockKeys = []string{"example.com"}
+		return c
+	}
+
+	c := controller()
+	if err := setup(c); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	if err := setup(c); err == nil {
+		t.Error("the plugin was set up twice in the same server block")
+	}
+
+	// A reload sets the same server block up again, by a new instance.
+	if err := setup(controller()); err != nil {
+		t.Errorf("setup after a reload: %v", err)
+	}
+}
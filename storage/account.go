@@ -2,19 +2,48 @@ package storage
 
 import "fmt"
 
+// AccountStorage stores the ACME account keys. LoadAccountKey returns ErrNotFound only when the
+// backend answered and holds no key for the email; a new account must not be created on any other error.
 type AccountStorage interface {
 	SaveAccountKey(email string, keyPEM []byte) error
-	LoadAccountKey(email string) []byte
+	LoadAccountKey(email string) ([]byte, error)
+	// ListAccounts returns the emails of every stored account key.
+	ListAccounts() ([]string, error)
+	// DeleteAccountKey removes the account key of email. Deleting a key that isn't stored is not an error.
+	DeleteAccountKey(email string) error
 }
 
 func NewAccount(o Options) (AccountStorage, error) {
+	a, err := newAccountBackend(o)
+	if err != nil {
+		return nil, err
+	}
+	e, err := newEnvelope(o.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	if e != nil {
+		return &encryptedAccount{AccountStorage: a, envelope: e, stale: make(map[string]bool)}, nil
+	}
+	return a, nil
+}
+
+func newAccountBackend(o Options) (AccountStorage, error) {
 	switch o.Type {
 	case "disk":
 		return NewDiskAccount(o.DiskPath), nil
 	case "kubernetesSecrets":
-		return NewSecretsAccount(o.Namespace)
+		return NewSecretsAccount(o)
 	case "vault":
 		return NewVaultAccount(o)
+	case "s3":
+		return NewS3Account(o)
+	case "etcd":
+		return NewEtcdAccount(o)
+	case "sql":
+		return NewSQLAccount(o)
+	case "awsSecretsManager":
+		return NewSecretsManagerAccount(o)
 	default:
 		return nil, fmt.Errorf("unknown storage type: %s", o.Type)
 	}
@@ -0,0 +1,33 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+)
+
+// loadAWSConfig loads the standard AWS configuration: the AWS_* environment variables, the shared
+// credentials and config files, or the instance role. A region or credentials file overrides it.
+func loadAWSConfig(region, credentialsFile, endpoint string) (aws.Config, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	var opts []func(*awsconfig.LoadOptions) error
+	if region != "" {
+		opts = append(opts, awsconfig.WithRegion(region))
+	}
+	if credentialsFile != "" {
+		opts = append(opts, awsconfig.WithSharedCredentialsFiles([]string{credentialsFile}))
+	}
+	cfg, err := awsconfig.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("could not load AWS configuration: %w", err)
+	}
+	if cfg.Region == "" && endpoint != "" {
+		// Compatible services and stand-ins ignore the region, but requests must be signed for one.
+		cfg.Region = "us-east-1"
+	}
+	return cfg, nil
+}
@@ -2,8 +2,10 @@ package storage
 
 import (
 	"bytes"
+	"crypto"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/fs"
 	"os"
@@ -11,38 +13,119 @@ import (
 	"strings"
 
 	clog "github.com/coredns/coredns/plugin/pkg/log"
-	"github.com/go-acme/lego/v4/certificate"
+	"github.com/go-acme/lego/v4/certcrypto"
 	"golang.org/x/net/idna"
 )
 
 var log = clog.NewWithPlugin("acmednschallenge")
 
+// On-disk layouts of the certificate files, so tooling written for other ACME clients can read them.
+const (
+	// DiskLayoutPlugin writes certs/<domain>.key, .pem (full chain and key), .issuer.pem and .json.
+	DiskLayoutPlugin = "plugin"
+	// DiskLayoutCertbot writes live/<domain>/{cert,chain,fullchain,privkey}.pem like certbot, plus
+	// the renewal metadata in live/<domain>/acme.json.
+	DiskLayoutCertbot = "certbot"
+	// DiskLayoutLego writes certificates/<domain>.crt, .issuer.crt, .key and .json like the lego CLI,
+	// so PATH is used in place of its .lego directory.
+	DiskLayoutLego = "lego"
+)
+
 type Disk struct {
-	certsPath string
-	keyMode   fs.FileMode
-	gid       int // group to own cert files; <= 0 means leave unchanged
+	dataPath string
+	layout   string
+	keyMode  fs.FileMode
+	gid      int // group to own cert files; <= 0 means leave unchanged
 }
 
-func NewDisk(dataPath string, keyMode fs.FileMode, gid int) (*Disk, error) {
-	certsPath := filepath.Join(dataPath, "certs")
-	if err := os.MkdirAll(certsPath, os.ModePerm); err != nil {
-		return nil, fmt.Errorf("could not create certificates directory at %s: %w", certsPath, err)
+// diskFiles are the paths of the files of one certificate. Files a layout doesn't use are empty.
+type diskFiles struct {
+	dir       string
+	meta      string // the Resource as JSON, written last so a certificate only exists once complete
+	key       string
+	fullChain string
+	cert      string // the leaf only
+	chain     string // the issuer chain only
+	combined  string // full chain followed by the key
+	lock      string // held while the files are read or written, see acquireLock
+}
+
+func NewDisk(dataPath, layout string, keyMode fs.FileMode, gid int) (*Disk, error) {
+	d := &Disk{dataPath: dataPath, layout: layout, keyMode: keyMode, gid: gid}
+	var base string
+	switch layout {
+	case "", DiskLayoutPlugin:
+		d.layout = DiskLayoutPlugin
+		base = filepath.Join(dataPath, "certs")
+	case DiskLayoutCertbot:
+		base = filepath.Join(dataPath, "live")
+	case DiskLayoutLego:
+		base = filepath.Join(dataPath, "certificates")
+	default:
+		return nil, fmt.Errorf("unknown disk layout: %s", layout)
 	}
-	if gid > 0 {
-		if err := os.Chown(certsPath, -1, gid); err != nil {
-			return nil, fmt.Errorf("could not set group %d on %s: %w", gid, certsPath, err)
+	if err := d.mkdir(base); err != nil {
+		return nil, fmt.Errorf("could not create certificates directory at %s: %w", base, err)
+	}
+	return d, nil
+}
+
+func (d *Disk) files(domain string) diskFiles {
+	name := sanitizedDomain(domain)
+	switch d.layout {
+	case DiskLayoutCertbot:
+		dir := filepath.Join(d.dataPath, "live", name)
+		return diskFiles{
+			dir:       dir,
+			meta:      filepath.Join(dir, "acme.json"),
+			key:       filepath.Join(dir, "privkey.pem"),
+			fullChain: filepath.Join(dir, "fullchain.pem"),
+			cert:      filepath.Join(dir, "cert.pem"),
+			chain:     filepath.Join(dir, "chain.pem"),
+			lock:      dir + ".lock",
+		}
+	case DiskLayoutLego:
+		dir := filepath.Join(d.dataPath, "certificates")
+		return diskFiles{
+			dir:       dir,
+			meta:      filepath.Join(dir, name+".json"),
+			key:       filepath.Join(dir, name+".key"),
+			fullChain: filepath.Join(dir, name+".crt"),
+			chain:     filepath.Join(dir, name+".issuer.crt"),
+			lock:      filepath.Join(dir, name+".lock"),
+		}
+	default:
+		dir := filepath.Join(d.dataPath, "certs")
+		return diskFiles{
+			dir:      dir,
+			meta:     filepath.Join(dir, name+".json"),
+			key:      filepath.Join(dir, name+".key"),
+			chain:    filepath.Join(dir, name+".issuer.pem"),
+			combined: filepath.Join(dir, name+".pem"),
+			lock:     filepath.Join(dir, name+".lock"),
 		}
 	}
-	return &Disk{certsPath: certsPath, keyMode: keyMode, gid: gid}, nil
 }
 
-func (d *Disk) Save(certs *certificate.Resource) error {
-	if err := d.writeFile(certs.Domain, ".key", certs.PrivateKey); err != nil {
-		return fmt.Errorf("unable to save key file: %w", err)
+// Save and Delete hold the lock of the domain, so instances sharing the directory, for example over
+// NFS, never write each other's files half. Load reads without it, see Load.
+func (d *Disk) Save(certs *Resource) error {
+	f := d.files(certs.Domain)
+	return withLock(f.lock, defaultLockTimeout, func() error { return d.save(f, certs) })
+}
+
+func (d *Disk) save(f diskFiles, certs *Resource) error {
+	if err := d.mkdir(f.dir); err != nil {
+		return fmt.Errorf("could not create directory %s: %w", f.dir, err)
 	}
 
-	if err := d.writeFile(certs.Domain, ".pem", bytes.Join([][]byte{certs.Certificate, certs.PrivateKey}, nil)); err != nil {
-		return fmt.Errorf("unable to save PEM file: %w", err)
+	leaf, chain := splitChain(certs.Certificate)
+	if len(certs.IssuerCertificate) > 0 {
+		chain = certs.IssuerCertificate
+	}
+	fullChain := certs.Certificate
+	if len(chain) > 0 && bytes.Equal(fullChain, leaf) {
+		fullChain = bytes.Join([][]byte{leaf, chain}, nil)
 	}
 
 	jsonBytes, err := json.MarshalIndent(certs, "", "\t")
@@ -50,69 +133,228 @@ func (d *Disk) Save(certs *certificate.Resource) error {
 		return fmt.Errorf("unable to marshal CertResource for domain %s: %w", certs.Domain, err)
 	}
 
-	if err := d.writeFile(certs.Domain, ".json", jsonBytes); err != nil {
-		return fmt.Errorf("unable to save CertResource for domain %s: %w", certs.Domain, err)
+	for _, file := range []struct {
+		path string
+		data []byte
+	}{
+		{f.key, certs.PrivateKey},
+		{f.cert, leaf},
+		{f.chain, chain},
+		{f.fullChain, fullChain},
+		{f.combined, bytes.Join([][]byte{fullChain, certs.PrivateKey}, nil)},
+		{f.meta, jsonBytes},
+	} {
+		if file.path == "" {
+			continue
+		}
+		if err := WriteFileAtomic(file.path, file.data, d.keyMode, d.gid); err != nil {
+			return fmt.Errorf("unable to save %s for domain %s: %w", filepath.Base(file.path), certs.Domain, err)
+		}
 	}
-
 	return nil
 }
 
-func (d *Disk) Load(domain string) *certificate.Resource {
-	raw, err := d.readFile(domain, ".json")
+// Load reads without the lock, since every file is replaced atomically, so readers never wait for each
+// other and a read-only directory can be read. A Save or Delete running meanwhile can still be seen
+// half done, as a file missing or a key not matching the certificate; only then are the files read
+// again under the lock, when it can be taken.
+func (d *Disk) Load(domain string) (*Resource, error) {
+	f := d.files(domain)
+	resource, err := d.load(f, domain)
+	if errors.Is(err, ErrNotFound) || (err == nil && !halfWritten(resource)) {
+		return resource, err
+	}
+	l, lockErr := acquireLock(f.lock, defaultLockTimeout)
+	if lockErr != nil {
+		return resource, err
+	}
+	defer l.release()
+	return d.load(f, domain)
+}
+
+// halfWritten reports whether the key of certs doesn't belong to its certificate. A key or certificate
+// that can't be parsed, such as an encrypted key, tells nothing.
+func halfWritten(certs *Resource) bool {
+	leaf := leafOf(certs)
+	if leaf == nil {
+		return false
+	}
+	key, err := certcrypto.ParsePEMPrivateKey(certs.PrivateKey)
+	if err != nil {
+		return false
+	}
+	signer, ok := key.(crypto.Signer)
+	pub, hasEqual := leaf.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && hasEqual && !pub.Equal(signer.Public())
+}
+
+func (d *Disk) load(f diskFiles, domain string) (*Resource, error) {
+	raw, err := os.ReadFile(f.meta)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("unable to read CertResource for domain %s: %w", domain, err)
 	}
-	var resource certificate.Resource
+	var resource Resource
 	if err = json.Unmarshal(raw, &resource); err != nil {
-		return nil
+		return nil, fmt.Errorf("unable to unmarshal CertResource for domain %s: %w", domain, err)
 	}
 
-	content, err := d.readFile(domain, ".pem")
-	if err != nil {
-		return nil
+	if resource.PrivateKey, err = os.ReadFile(f.key); err != nil {
+		return nil, fmt.Errorf("unable to read key file for domain %s: %w", domain, err)
 	}
 
-	var certBytes, keyBytes []byte
+	if f.fullChain != "" {
+		if resource.Certificate, err = os.ReadFile(f.fullChain); err != nil {
+			return nil, fmt.Errorf("unable to read certificate file for domain %s: %w", domain, err)
+		}
+	} else {
+		content, err := os.ReadFile(f.combined)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read PEM file for domain %s: %w", domain, err)
+		}
+		resource.Certificate = pemBlocksOfType(content, "CERTIFICATE")
+	}
 
-	block, _ := pem.Decode(content)
-	if block == nil {
-		return nil
+	// Certificates saved before the issuer was written on its own have no chain file.
+	issuer, err := os.ReadFile(f.chain)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read issuer file for domain %s: %w", domain, err)
 	}
+	resource.IssuerCertificate = issuer
 
-	switch block.Type {
-	case "CERTIFICATE":
-		certBytes = pem.EncodeToMemory(block)
-	case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
-		keyBytes = pem.EncodeToMemory(block)
+	return &resource, nil
+}
+
+func (d *Disk) List() ([]Entry, error) {
+	var pattern string
+	switch d.layout {
+	case DiskLayoutCertbot:
+		pattern = filepath.Join(d.dataPath, "live", "*", "acme.json")
+	case DiskLayoutLego:
+		pattern = filepath.Join(d.dataPath, "certificates", "*.json")
+	default:
+		pattern = filepath.Join(d.dataPath, "certs", "*.json")
+	}
+	metas, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
 	}
 
-	resource.Certificate = certBytes
-	resource.PrivateKey = keyBytes
+	var entries []Entry
+	for _, meta := range metas {
+		raw, err := os.ReadFile(meta)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read %s: %w", meta, err)
+		}
+		var resource Resource
+		if err := json.Unmarshal(raw, &resource); err != nil || resource.Domain == "" {
+			log.Warningf("skipping %s: not a certificate resource", meta)
+			continue
+		}
+		certs, err := d.Load(resource.Domain)
+		if err != nil {
+			log.Warningf("skipping certificate '%s': %v", resource.Domain, err)
+			continue
+		}
+		entries = append(entries, entryOf(certs))
+	}
+	return entries, nil
+}
 
-	return &resource
+func (d *Disk) Delete(domain string) error {
+	f := d.files(domain)
+	return withLock(f.lock, defaultLockTimeout, func() error { return d.delete(f, domain) })
 }
 
-func (d *Disk) readFile(domain, extension string) ([]byte, error) {
-	return os.ReadFile(filepath.Join(d.certsPath, getFileName(domain, extension)))
+func (d *Disk) delete(f diskFiles, domain string) error {
+	// The metadata goes first, so a delete cut short leaves no certificate that looks complete.
+	for _, name := range []string{f.meta, f.key, f.fullChain, f.cert, f.chain, f.combined} {
+		if name == "" {
+			continue
+		}
+		if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("unable to delete certificate for domain %s: %w", domain, err)
+		}
+	}
+	if d.layout == DiskLayoutCertbot {
+		if err := os.Remove(f.dir); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("unable to delete certificate for domain %s: %w", domain, err)
+		}
+	}
+	return nil
 }
 
-func (d *Disk) writeFile(domain, extension string, data []byte) error {
-	path := filepath.Join(d.certsPath, getFileName(domain, extension))
-	if err := os.WriteFile(path, data, d.keyMode); err != nil {
+func (d *Disk) mkdir(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 		return err
 	}
 	if d.gid > 0 {
-		// os.Chown with uid -1 leaves the owner untouched, so a non-root CoreDNS
-		// (the file owner) can still CRUD while the configured group gets access.
-		if err := os.Chown(path, -1, d.gid); err != nil {
-			return fmt.Errorf("could not set group %d on %s: %w", d.gid, path, err)
+		if err := os.Chown(dir, -1, d.gid); err != nil {
+			return fmt.Errorf("could not set group %d on %s: %w", d.gid, dir, err)
 		}
 	}
 	return nil
 }
 
-func getFileName(domain, extension string) string {
-	return sanitizedDomain(domain) + extension
+// WriteFileAtomic writes data to a temporary file next to path and renames it into place, so readers
+// see either the old or the new content and never a partially written file.
+func WriteFileAtomic(path string, data []byte, mode fs.FileMode, gid int) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if gid > 0 {
+		// Chown with uid -1 leaves the owner untouched, so a non-root CoreDNS
+		// (the file owner) can still CRUD while the configured group gets access.
+		if err := tmp.Chown(-1, gid); err != nil {
+			tmp.Close()
+			return fmt.Errorf("could not set group %d on %s: %w", gid, path, err)
+		}
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// splitChain splits a PEM bundle into its first certificate and the certificates after it.
+func splitChain(bundle []byte) (leaf, chain []byte) {
+	block, rest := pem.Decode(bundle)
+	if block == nil {
+		return nil, nil
+	}
+	return pem.EncodeToMemory(block), pemBlocksOfType(rest, "CERTIFICATE")
+}
+
+// pemBlocksOfType returns the PEM blocks of type typ in content, re-encoded.
+func pemBlocksOfType(content []byte, typ string) []byte {
+	var out []byte
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			return out
+		}
+		if block.Type == typ {
+			out = append(out, pem.EncodeToMemory(block)...)
+		}
+	}
 }
 
 func sanitizedDomain(domain string) string {
@@ -136,21 +378,60 @@ func (d *DiskAccount) keyPath(email string) string {
 	return filepath.Join(d.dataPath, "users", email, "key.pem")
 }
 
+func (d *DiskAccount) lockPath(email string) string {
+	return filepath.Join(d.dataPath, "users", email+".lock")
+}
+
 func (d *DiskAccount) SaveAccountKey(email string, keyPEM []byte) error {
+	return withLock(d.lockPath(email), defaultLockTimeout, func() error { return d.saveAccountKey(email, keyPEM) })
+}
+
+func (d *DiskAccount) saveAccountKey(email string, keyPEM []byte) error {
 	keyFile := d.keyPath(email)
 	if err := os.MkdirAll(filepath.Dir(keyFile), os.ModePerm); err != nil {
 		return fmt.Errorf("could not create account key directory: %w", err)
 	}
-	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+	if err := WriteFileAtomic(keyFile, keyPEM, 0600, 0); err != nil {
 		return fmt.Errorf("could not write account key: %w", err)
 	}
 	return nil
 }
 
-func (d *DiskAccount) LoadAccountKey(email string) []byte {
+func (d *DiskAccount) ListAccounts() ([]string, error) {
+	keys, err := filepath.Glob(filepath.Join(d.dataPath, "users", "*", "key.pem"))
+	if err != nil {
+		return nil, err
+	}
+	var emails []string
+	for _, key := range keys {
+		emails = append(emails, filepath.Base(filepath.Dir(key)))
+	}
+	return emails, nil
+}
+
+func (d *DiskAccount) DeleteAccountKey(email string) error {
+	return withLock(d.lockPath(email), defaultLockTimeout, func() error { return d.deleteAccountKey(email) })
+}
+
+func (d *DiskAccount) deleteAccountKey(email string) error {
+	keyFile := d.keyPath(email)
+	if err := os.Remove(keyFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not delete account key: %w", err)
+	}
+	if err := os.Remove(filepath.Dir(keyFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("could not delete account key directory: %w", err)
+	}
+	return nil
+}
+
+// LoadAccountKey reads without the lock, as the key is a single file replaced atomically.
+func (d *DiskAccount) LoadAccountKey(email string) ([]byte, error) {
 	keyPEM, err := os.ReadFile(d.keyPath(email))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("could not read account key: %w", err)
 	}
-	return keyPEM
+	return keyPEM, nil
 }
@@ -0,0 +1,483 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"filippo.io/age"
+	bao "github.com/openbao/openbao/api/v2"
+)
+
+// MaxEncryptionKeys is how many key providers can be configured at once: the current one and the
+// retired ones still needed to decrypt keys written before a rotation.
+const MaxEncryptionKeys = 4
+
+// encryptedKeyType is the PEM type of an encrypted private key. The block's bytes are the nonce and
+// the AES-256-GCM ciphertext of the plaintext PEM under a random data key; the headers name the key
+// provider and carry the data key wrapped by it.
+const encryptedKeyType = "ACMEDNSCHALLENGE ENCRYPTED PRIVATE KEY"
+
+// KeyOptions configures one key provider for the envelope encryption of private keys.
+type KeyOptions struct {
+	Type string // "file", "age" or "vaultTransit"
+
+	Path string // file: the key file, 32 bytes raw, hex or base64
+
+	AgeRecipient string // age: the public key data keys are encrypted to
+	AgeIdentity  string // age: the identity file decrypting them
+
+	VaultMount string // vaultTransit: the mount of the transit engine
+	VaultKey   string // vaultTransit: the name of the transit key
+	VaultAuth  string
+	VaultRole  string
+}
+
+// keyProvider wraps and unwraps the data keys of encrypted private keys.
+type keyProvider interface {
+	// id identifies the provider in the encrypted keys it wrapped.
+	id() string
+	wrap(dek []byte) ([]byte, error)
+	unwrap(wrapped []byte) ([]byte, error)
+}
+
+// envelope encrypts private keys with the first of its providers and decrypts them with whichever
+// provider wrapped them.
+type envelope struct {
+	providers []keyProvider
+}
+
+func newEnvelope(keys [MaxEncryptionKeys]KeyOptions) (*envelope, error) {
+	e := &envelope{}
+	for _, k := range keys {
+		if k.Type == "" {
+			continue
+		}
+		p, err := newKeyProvider(k)
+		if err != nil {
+			return nil, err
+		}
+		e.providers = append(e.providers, p)
+	}
+	if len(e.providers) == 0 {
+		return nil, nil
+	}
+	return e, nil
+}
+
+func newKeyProvider(k KeyOptions) (keyProvider, error) {
+	switch k.Type {
+	case "file":
+		return newFileKeyProvider(k.Path)
+	case "age":
+		return newAgeKeyProvider(k.AgeRecipient, k.AgeIdentity)
+	case "vaultTransit":
+		client, err := newVaultClient(Options{VaultAuth: k.VaultAuth, VaultRole: k.VaultRole})
+		if err != nil {
+			return nil, err
+		}
+		return &vaultTransitKeyProvider{client: client, mount: k.VaultMount, key: k.VaultKey}, nil
+	default:
+		return nil, fmt.Errorf("unknown key provider: %s", k.Type)
+	}
+}
+
+// isEncrypted reports whether keyPEM is an encrypted private key.
+func isEncrypted(keyPEM []byte) bool {
+	block, _ := pem.Decode(keyPEM)
+	return block != nil && block.Type == encryptedKeyType
+}
+
+func (e *envelope) encrypt(keyPEM []byte) ([]byte, error) {
+	if len(keyPEM) == 0 || isEncrypted(keyPEM) {
+		return keyPEM, nil
+	}
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	sealed, err := sealGCM(dek, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	p := e.providers[0]
+	wrapped, err := p.wrap(dek)
+	if err != nil {
+		return nil, fmt.Errorf("could not wrap data key with %s: %w", p.id(), err)
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type: encryptedKeyType,
+		Headers: map[string]string{
+			"Provider":    p.id(),
+			"Wrapped-Key": base64.StdEncoding.EncodeToString(wrapped),
+		},
+		Bytes: sealed,
+	}), nil
+}
+
+// decrypt returns the plaintext of keyPEM, and whether it should be encrypted again because it is
+// plaintext or was encrypted by a retired provider.
+func (e *envelope) decrypt(keyPEM []byte) (plain []byte, stale bool, err error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil || block.Type != encryptedKeyType {
+		return keyPEM, len(keyPEM) > 0, nil
+	}
+	id := block.Headers["Provider"]
+	for i, p := range e.providers {
+		if p.id() != id {
+			continue
+		}
+		wrapped, err := base64.StdEncoding.DecodeString(block.Headers["Wrapped-Key"])
+		if err != nil {
+			return nil, false, fmt.Errorf("malformed wrapped data key: %w", err)
+		}
+		dek, err := p.unwrap(wrapped)
+		if err != nil {
+			return nil, false, fmt.Errorf("could not unwrap data key with %s: %w", id, err)
+		}
+		plain, err := openGCM(dek, block.Bytes)
+		if err != nil {
+			return nil, false, err
+		}
+		return plain, i > 0, nil
+	}
+	return nil, false, fmt.Errorf("private key was encrypted with %s, which is not configured", id)
+}
+
+func sealGCM(key, plaintext []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openGCM(key, sealed []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted data is too short")
+	}
+	plain, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt: %w", err)
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// fileKeyProvider wraps data keys with AES-256-GCM under a key read from a local file.
+type fileKeyProvider struct {
+	key   []byte
+	keyID string
+}
+
+func newFileKeyProvider(p string) (*fileKeyProvider, error) {
+	raw, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("could not read encryption key file: %w", err)
+	}
+	key, err := decodeKeyFile(raw)
+	if err != nil {
+		return nil, fmt.Errorf("encryption key file %s: %w", p, err)
+	}
+	sum := sha256.Sum256(key)
+	return &fileKeyProvider{key: key, keyID: "file:" + hex.EncodeToString(sum[:4])}, nil
+}
+
+// decodeKeyFile accepts a 32-byte key hex or base64 encoded, or raw. The encodings are tried first, and
+// a raw key is only taken when the file is not text, so that an encoded key of the wrong length that
+// happens to be 32 characters long is rejected rather than used as a raw key.
+func decodeKeyFile(raw []byte) ([]byte, error) {
+	text := string(bytes.TrimSpace(raw))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return key, nil
+	}
+	if len(raw) == 32 && !isText(raw) {
+		return raw, nil
+	}
+	return nil, errors.New("must hold a 32 byte key, raw, hex or base64 encoded")
+}
+
+// isText reports whether b only holds printable ASCII and whitespace.
+func isText(b []byte) bool {
+	for _, c := range b {
+		if (c < ' ' || c > '~') && c != '\n' && c != '\r' && c != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fileKeyProvider) id() string                      { return f.keyID }
+func (f *fileKeyProvider) wrap(dek []byte) ([]byte, error) { return sealGCM(f.key, dek) }
+func (f *fileKeyProvider) unwrap(w []byte) ([]byte, error) { return openGCM(f.key, w) }
+
+// ageKeyProvider encrypts data keys to an age recipient.
+type ageKeyProvider struct {
+	recipient  *age.X25519Recipient
+	identities []age.Identity
+}
+
+func newAgeKeyProvider(recipient, identityFile string) (*ageKeyProvider, error) {
+	r, err := age.ParseX25519Recipient(recipient)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age recipient: %w", err)
+	}
+	f, err := os.Open(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read age identity file: %w", err)
+	}
+	defer f.Close()
+	identities, err := age.ParseIdentities(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid age identity file %s: %w", identityFile, err)
+	}
+	return &ageKeyProvider{recipient: r, identities: identities}, nil
+}
+
+func (a *ageKeyProvider) id() string { return "age:" + a.recipient.String() }
+
+func (a *ageKeyProvider) wrap(dek []byte) ([]byte, error) {
+	var out bytes.Buffer
+	w, err := age.Encrypt(&out, a.recipient)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(dek); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (a *ageKeyProvider) unwrap(wrapped []byte) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(wrapped), a.identities...)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// vaultTransitKeyProvider has Vault's transit engine wrap data keys, so the key encrypting them
+// never leaves Vault. Rotating the transit key is handled by Vault.
+type vaultTransitKeyProvider struct {
+	client *bao.Client
+	mount  string
+	key    string
+}
+
+func (v *vaultTransitKeyProvider) id() string { return "vaultTransit:" + path.Join(v.mount, v.key) }
+
+func (v *vaultTransitKeyProvider) wrap(dek []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	secret, err := v.client.Logical().WriteWithContext(ctx, path.Join(v.mount, "encrypt", v.key),
+		map[string]interface{}{"plaintext": base64.StdEncoding.EncodeToString(dek)})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("vault transit returned no ciphertext")
+	}
+	ciphertext, _ := secret.Data["ciphertext"].(string)
+	if !strings.HasPrefix(ciphertext, "vault:") {
+		return nil, errors.New("vault transit returned no ciphertext")
+	}
+	return []byte(ciphertext), nil
+}
+
+func (v *vaultTransitKeyProvider) unwrap(wrapped []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	secret, err := v.client.Logical().WriteWithContext(ctx, path.Join(v.mount, "decrypt", v.key),
+		map[string]interface{}{"ciphertext": string(wrapped)})
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, errors.New("vault transit returned no plaintext")
+	}
+	plaintext, _ := secret.Data["plaintext"].(string)
+	return base64.StdEncoding.DecodeString(plaintext)
+}
+
+// encryptedCerts encrypts the private keys of certificates before its CertStorage writes them. Load
+// notes a key found in plaintext or encrypted with a retired provider, and Reencrypt writes it again,
+// encrypted with the current one.
+type encryptedCerts struct {
+	CertStorage
+	envelope *envelope
+
+	mu    sync.Mutex
+	stale map[string]bool // domains whose key Load found stale
+}
+
+func (s *encryptedCerts) Save(certs *Resource) error {
+	keyPEM, err := s.envelope.encrypt(certs.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("could not encrypt private key for domain %s: %w", certs.Domain, err)
+	}
+	encrypted := *certs
+	encrypted.PrivateKey = keyPEM
+	if err := s.CertStorage.Save(&encrypted); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.stale, certs.Domain)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *encryptedCerts) Load(domain string) (*Resource, error) {
+	certs, _, err := s.load(domain)
+	return certs, err
+}
+
+// load is Load, also reporting whether the key is stale.
+func (s *encryptedCerts) load(domain string) (*Resource, bool, error) {
+	certs, err := s.CertStorage.Load(domain)
+	if err != nil {
+		return nil, false, err
+	}
+	plain, stale, err := s.envelope.decrypt(certs.PrivateKey)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not decrypt private key for domain %s: %w", domain, err)
+	}
+	certs.PrivateKey = plain
+	s.mu.Lock()
+	if stale {
+		s.stale[domain] = true
+	} else {
+		delete(s.stale, domain)
+	}
+	s.mu.Unlock()
+	return certs, stale, nil
+}
+
+// Reencrypt loads every certificate whose key Load found stale and saves it again, which encrypts the
+// key with the current provider.
+func (s *encryptedCerts) Reencrypt() {
+	s.mu.Lock()
+	domains := slices.Sorted(maps.Keys(s.stale))
+	s.mu.Unlock()
+	for _, domain := range domains {
+		certs, stale, err := s.load(domain)
+		if err == nil && !stale {
+			continue
+		}
+		if err == nil {
+			err = s.Save(certs)
+		}
+		if err != nil {
+			log.Warningf("could not re-encrypt private key for domain %s: %v", domain, err)
+			continue
+		}
+		log.Infof("re-encrypted private key for domain %s with %s", domain, s.envelope.providers[0].id())
+	}
+}
+
+// encryptedAccount is encryptedCerts for account keys.
+type encryptedAccount struct {
+	AccountStorage
+	envelope *envelope
+
+	mu    sync.Mutex
+	stale map[string]bool // emails whose key LoadAccountKey found stale
+}
+
+func (a *encryptedAccount) SaveAccountKey(email string, keyPEM []byte) error {
+	encrypted, err := a.envelope.encrypt(keyPEM)
+	if err != nil {
+		return fmt.Errorf("could not encrypt account key for %s: %w", email, err)
+	}
+	if err := a.AccountStorage.SaveAccountKey(email, encrypted); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	delete(a.stale, email)
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *encryptedAccount) LoadAccountKey(email string) ([]byte, error) {
+	keyPEM, _, err := a.loadAccountKey(email)
+	return keyPEM, err
+}
+
+// loadAccountKey is LoadAccountKey, also reporting whether the key is stale.
+func (a *encryptedAccount) loadAccountKey(email string) ([]byte, bool, error) {
+	keyPEM, err := a.AccountStorage.LoadAccountKey(email)
+	if err != nil {
+		return nil, false, err
+	}
+	plain, stale, err := a.envelope.decrypt(keyPEM)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not decrypt account key for %s: %w", email, err)
+	}
+	a.mu.Lock()
+	if stale {
+		a.stale[email] = true
+	} else {
+		delete(a.stale, email)
+	}
+	a.mu.Unlock()
+	return plain, stale, nil
+}
+
+// Reencrypt saves every account key LoadAccountKey found stale again, encrypted with the current
+// provider.
+func (a *encryptedAccount) Reencrypt() {
+	a.mu.Lock()
+	emails := slices.Sorted(maps.Keys(a.stale))
+	a.mu.Unlock()
+	for _, email := range emails {
+		keyPEM, stale, err := a.loadAccountKey(email)
+		if err == nil && !stale {
+			continue
+		}
+		if err == nil {
+			err = a.SaveAccountKey(email, keyPEM)
+		}
+		if err != nil {
+			log.Warningf("could not re-encrypt account key for %s: %v", email, err)
+			continue
+		}
+		log.Infof("re-encrypted account key for %s with %s", email, a.envelope.providers[0].id())
+	}
+}
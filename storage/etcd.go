@@ -0,0 +1,398 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	mwtls "github.com/coredns/coredns/plugin/pkg/tls"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	defaultEtcdEndpoint = "http://localhost:2379"
+	etcdDialTimeout     = 5 * time.Second
+	// etcdKeepAliveTime is how often an idle connection is probed, so a dead member is noticed.
+	etcdKeepAliveTime = 30 * time.Second
+	// etcdRewatchDelay is the pause before a watch that ended, for example after a compaction, is
+	// started again.
+	etcdRewatchDelay = 5 * time.Second
+)
+
+func newEtcdClient(o Options) (*clientv3.Client, error) {
+	endpoints := strings.Fields(o.EtcdEndpoints)
+	if len(endpoints) == 0 {
+		endpoints = []string{defaultEtcdEndpoint}
+	}
+	cfg := clientv3.Config{
+		Endpoints:         endpoints,
+		DialTimeout:       etcdDialTimeout,
+		DialKeepAliveTime: etcdKeepAliveTime,
+		Username:          o.EtcdUsername,
+		Password:          o.EtcdPassword,
+	}
+	if o.EtcdTLS {
+		var args []string
+		for _, a := range o.EtcdTLSArgs {
+			if a != "" {
+				args = append(args, a)
+			}
+		}
+		tlsConfig, err := mwtls.NewTLSConfigFromArgs(args...)
+		if err != nil {
+			return nil, fmt.Errorf("could not load etcd TLS configuration: %w", err)
+		}
+		cfg.TLS = tlsConfig
+	}
+	client, err := clientv3.New(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("could not create etcd client: %w", err)
+	}
+	return client, nil
+}
+
+// etcdGet returns the value and modification revision of key, or ErrNotFound.
+func etcdGet(client *clientv3.Client, key string) ([]byte, int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	resp, err := client.Get(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, ErrNotFound
+	}
+	return resp.Kvs[0].Value, resp.Kvs[0].ModRevision, nil
+}
+
+// etcdList returns the values of the keys directly below prefix by their last path element, leaving
+// out deeper keys.
+func etcdList(client *clientv3.Client, prefix string) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	dir := strings.TrimSuffix(prefix, "/") + "/"
+	resp, err := client.Get(ctx, dir, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string][]byte)
+	for _, kv := range resp.Kvs {
+		name := strings.TrimPrefix(string(kv.Key), dir)
+		if name != "" && !strings.Contains(name, "/") {
+			values[name] = kv.Value
+		}
+	}
+	return values, nil
+}
+
+// etcdKeys remembers what this instance read from and wrote to its keys.
+type etcdKeys struct {
+	mu   sync.Mutex
+	read map[string]int64     // the modification revision of every key when last read or written, 0 if absent
+	own  map[string]etcdWrite // the last write of every key by this instance
+}
+
+// etcdWrite is a put of value, or a delete.
+type etcdWrite struct {
+	value   string
+	deleted bool
+}
+
+func newEtcdKeys() *etcdKeys {
+	return &etcdKeys{read: make(map[string]int64), own: make(map[string]etcdWrite)}
+}
+
+func (k *etcdKeys) seen(key string, rev int64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.read[key] = rev
+}
+
+func (k *etcdKeys) lastRead(key string) int64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.read[key]
+}
+
+// writing records a write before it is sent, as its watch event may arrive before its response.
+func (k *etcdKeys) writing(key string, w etcdWrite) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.own[key] = w
+}
+
+// isOwn tells whether ev is the last write of this instance to its key. A write of someone else
+// replaces it, so that their following delete is not taken for one of this instance.
+func (k *etcdKeys) isOwn(ev *clientv3.Event) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key := string(ev.Kv.Key)
+	w, ok := k.own[key]
+	if ev.Type == mvccpb.DELETE {
+		return ok && w.deleted
+	}
+	if ok && !w.deleted && w.value == string(ev.Kv.Value) {
+		return true
+	}
+	delete(k.own, key)
+	return false
+}
+
+// etcdPut writes value to key when the key is unchanged since this instance last read it, and returns
+// ErrConflict when someone else changed it in the meantime.
+func etcdPut(client *clientv3.Client, keys *etcdKeys, key string, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	keys.writing(key, etcdWrite{value: string(value)})
+	resp, err := client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", keys.lastRead(key))).
+		Then(clientv3.OpPut(key, string(value))).
+		Commit()
+	if err != nil {
+		return err
+	}
+	if !resp.Succeeded {
+		return ErrConflict
+	}
+	keys.seen(key, resp.Header.Revision)
+	return nil
+}
+
+// etcdDelete deletes key. Deleting a key that doesn't exist is not an error.
+func etcdDelete(client *clientv3.Client, keys *etcdKeys, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	keys.writing(key, etcdWrite{deleted: true})
+	if _, err := client.Delete(ctx, key); err != nil {
+		return err
+	}
+	keys.seen(key, 0)
+	return nil
+}
+
+// EtcdCerts stores every certificate as the key PREFIX/<domain>, holding the fields of a Vault entry
+// as JSON. Writes are compare-and-swap transactions against the revision this instance last read, so
+// two instances renewing the same certificate can't overwrite each other.
+type EtcdCerts struct {
+	client *clientv3.Client
+	prefix string
+	keys   *etcdKeys
+}
+
+func NewEtcdCerts(o Options) (*EtcdCerts, error) {
+	client, err := newEtcdClient(o)
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdCerts{client: client, prefix: o.EtcdPrefix, keys: newEtcdKeys()}, nil
+}
+
+func (e *EtcdCerts) key(domain string) string {
+	return path.Join(e.prefix, sanitizedDomain(domain))
+}
+
+// Save writes certs only when its key is unchanged since this instance last loaded it. Otherwise
+// another instance stored a certificate in the meantime, and ErrConflict is returned.
+func (e *EtcdCerts) Save(certs *Resource) error {
+	data, err := certToVaultData(certs)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("unable to marshal certificate for domain %s: %w", certs.Domain, err)
+	}
+	if err := etcdPut(e.client, e.keys, e.key(certs.Domain), value); err != nil {
+		return fmt.Errorf("unable to save certificate for domain %s to etcd: %w", certs.Domain, err)
+	}
+	return nil
+}
+
+func (e *EtcdCerts) Load(domain string) (*Resource, error) {
+	key := e.key(domain)
+	value, rev, err := etcdGet(e.client, key)
+	if errors.Is(err, ErrNotFound) {
+		e.keys.seen(key, 0)
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate for domain %s from etcd: %w", domain, err)
+	}
+	e.keys.seen(key, rev)
+	return etcdValueToCert(value)
+}
+
+// List reads every key below the prefix. Account keys sharing the prefix are left out, as they have
+// no acme.json.
+func (e *EtcdCerts) List() ([]Entry, error) {
+	values, err := etcdList(e.client, e.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list certificates in etcd: %w", err)
+	}
+	var entries []Entry
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		certs, err := etcdValueToCert(values[name])
+		if err != nil {
+			log.Debugf("skipping etcd key %s: %v", name, err)
+			continue
+		}
+		entries = append(entries, entryOf(certs))
+	}
+	return entries, nil
+}
+
+func (e *EtcdCerts) Delete(domain string) error {
+	if err := etcdDelete(e.client, e.keys, e.key(domain)); err != nil {
+		return fmt.Errorf("unable to delete certificate for domain %s from etcd: %w", domain, err)
+	}
+	return nil
+}
+
+// Watch reports the certificates another instance writes or deletes below the prefix. Writes of this
+// instance are not reported.
+func (e *EtcdCerts) Watch(stop <-chan struct{}, changed func(domain string)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	dir := strings.TrimSuffix(e.prefix, "/") + "/"
+	for ctx.Err() == nil {
+		for resp := range e.client.Watch(clientv3.WithRequireLeader(ctx), dir, clientv3.WithPrefix(), clientv3.WithPrevKV()) {
+			if err := resp.Err(); err != nil {
+				log.Warningf("etcd watch of %s ended: %v", dir, err)
+				break
+			}
+			for _, ev := range resp.Events {
+				if domain, ok := e.changedBySomeoneElse(ev); ok {
+					changed(domain)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(etcdRewatchDelay):
+		}
+	}
+}
+
+// changedBySomeoneElse returns the domain of the certificate ev wrote or deleted, unless this instance
+// made the change or the key holds no certificate.
+func (e *EtcdCerts) changedBySomeoneElse(ev *clientv3.Event) (string, bool) {
+	if e.keys.isOwn(ev) {
+		return "", false
+	}
+	value := ev.Kv.Value
+	if ev.Type == mvccpb.DELETE {
+		if ev.PrevKv == nil {
+			return "", false
+		}
+		value = ev.PrevKv.Value
+	}
+	certs, err := etcdValueToCert(value)
+	if err != nil {
+		return "", false
+	}
+	return certs.Domain, true
+}
+
+func etcdValueToCert(value []byte) (*Resource, error) {
+	var data map[string]interface{}
+	if err := json.Unmarshal(value, &data); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal etcd value: %w", err)
+	}
+	return vaultDataToCert(data)
+}
+
+// EtcdAccount stores every account key as the key PREFIX/<email>, holding the fields of a Vault entry
+// as JSON. Like certificates, keys are written with compare-and-swap, so of two instances starting at
+// once only one registers its account.
+type EtcdAccount struct {
+	client *clientv3.Client
+	prefix string
+	keys   *etcdKeys
+}
+
+func NewEtcdAccount(o Options) (*EtcdAccount, error) {
+	client, err := newEtcdClient(o)
+	if err != nil {
+		return nil, err
+	}
+	return &EtcdAccount{client: client, prefix: o.EtcdPrefix, keys: newEtcdKeys()}, nil
+}
+
+func (a *EtcdAccount) key(email string) string {
+	return path.Join(a.prefix, strings.ToLower(email))
+}
+
+func (a *EtcdAccount) SaveAccountKey(email string, keyPEM []byte) error {
+	value, err := json.Marshal(map[string]string{vaultAccountKeyField: string(keyPEM)})
+	if err != nil {
+		return err
+	}
+	if err := etcdPut(a.client, a.keys, a.key(email), value); err != nil {
+		return fmt.Errorf("unable to save account key for %s to etcd: %w", email, err)
+	}
+	return nil
+}
+
+func (a *EtcdAccount) LoadAccountKey(email string) ([]byte, error) {
+	key := a.key(email)
+	value, rev, err := etcdGet(a.client, key)
+	if errors.Is(err, ErrNotFound) {
+		a.keys.seen(key, 0)
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read account key for %s from etcd: %w", email, err)
+	}
+	a.keys.seen(key, rev)
+	return etcdValueToAccountKey(value, email)
+}
+
+// ListAccounts returns the keys below the prefix holding an account key.
+func (a *EtcdAccount) ListAccounts() ([]string, error) {
+	values, err := etcdList(a.client, a.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list account keys in etcd: %w", err)
+	}
+	var emails []string
+	for _, name := range slices.Sorted(maps.Keys(values)) {
+		if _, err := etcdValueToAccountKey(values[name], name); err == nil {
+			emails = append(emails, name)
+		}
+	}
+	return emails, nil
+}
+
+func (a *EtcdAccount) DeleteAccountKey(email string) error {
+	if err := etcdDelete(a.client, a.keys, a.key(email)); err != nil {
+		return fmt.Errorf("unable to delete account key for %s from etcd: %w", email, err)
+	}
+	return nil
+}
+
+func etcdValueToAccountKey(value []byte, email string) ([]byte, error) {
+	var data map[string]string
+	if err := json.Unmarshal(value, &data); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal etcd value of %s: %w", email, err)
+	}
+	if data[vaultAccountKeyField] == "" {
+		return nil, fmt.Errorf("etcd key of %s has no %s", email, vaultAccountKeyField)
+	}
+	return []byte(data[vaultAccountKeyField]), nil
+}
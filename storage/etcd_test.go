@@ -0,0 +1,218 @@
+package storage
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"go.etcd.io/etcd/server/v3/embed"
+)
+
+// newTestEtcd starts an embedded single-node etcd server and returns the options to reach it.
+func newTestEtcd(t *testing.T) Options {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	local, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls = []url.URL{*local}
+	cfg.AdvertiseClientUrls = []url.URL{*local}
+	cfg.ListenPeerUrls = []url.URL{*local}
+	cfg.AdvertisePeerUrls = []url.URL{*local}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatal("etcd did not start")
+	}
+	return Options{Type: "etcd", EtcdEndpoints: e.Clients[0].Addr().String(), EtcdPrefix: "/coredns/acme"}
+}
+
+func TestEtcdCertsRoundTrip(t *testing.T) {
+	o := newTestEtcd(t)
+	s, err := New(o)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if _, err := s.Load("*.example.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Load of a missing certificate = %v, want ErrNotFound", err)
+	}
+	in := &Resource{
+		Resource: certificate.Resource{Domain: "*.example.com", Certificate: []byte("cert"), PrivateKey: []byte("key")},
+		CADirURL: "https://ca.example/directory",
+	}
+	if err := s.Save(in); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	out, err := s.Load("*.example.com")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if string(out.Certificate) != "cert" || string(out.PrivateKey) != "key" || out.CADirURL != in.CADirURL {
+		t.Errorf("Load = %+v, want %+v", out, in)
+	}
+
+	list, err := s.List()
+	if err != nil || len(list) != 1 || list[0].Domain != "*.example.com" {
+		t.Errorf("List = %v, %v; want *.example.com", list, err)
+	}
+	if err := s.Delete("*.example.com"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Load("*.example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Load after Delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestEtcdCertsCompareAndSwap(t *testing.T) {
+	o := newTestEtcd(t)
+	a, err := NewEtcdCerts(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewEtcdCerts(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := func(content string) *Resource {
+		return &Resource{Resource: certificate.Resource{Domain: "example.com", Certificate: []byte(content), PrivateKey: []byte("key")}}
+	}
+
+	// Both instances find no certificate and order one; the second to save loses.
+	for _, s := range []*EtcdCerts{a, b} {
+		if _, err := s.Load("example.com"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("Load = %v, want ErrNotFound", err)
+		}
+	}
+	if err := a.Save(cert("a")); err != nil {
+		t.Fatalf("Save of a: %v", err)
+	}
+	if err := b.Save(cert("b")); !errors.Is(err, ErrConflict) {
+		t.Fatalf("Save of b = %v, want ErrConflict", err)
+	}
+
+	// Once b has loaded the certificate of a it may replace it, and a may not.
+	if out, err := b.Load("example.com"); err != nil || string(out.Certificate) != "a" {
+		t.Fatalf("Load = %v, %v; want the certificate of a", out, err)
+	}
+	if err := b.Save(cert("b")); err != nil {
+		t.Fatalf("Save of b after Load: %v", err)
+	}
+	if err := a.Save(cert("a2")); !errors.Is(err, ErrConflict) {
+		t.Errorf("Save of a = %v, want ErrConflict", err)
+	}
+}
+
+func TestEtcdCertsWatch(t *testing.T) {
+	o := newTestEtcd(t)
+	a, err := NewEtcdCerts(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewEtcdCerts(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account, err := NewEtcdAccount(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changed := make(chan string, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go a.Watch(stop, func(domain string) { changed <- domain })
+	time.Sleep(200 * time.Millisecond) // let the watch start
+
+	own := &Resource{Resource: certificate.Resource{Domain: "own.example.com", Certificate: []byte("cert"), PrivateKey: []byte("key")}}
+	if err := a.Save(own); err != nil {
+		t.Fatal(err)
+	}
+	if err := account.SaveAccountKey("me@test.com", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	other := &Resource{Resource: certificate.Resource{Domain: "*.example.com", Certificate: []byte("cert"), PrivateKey: []byte("key")}}
+	if err := b.Save(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Delete("*.example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The own write and the account key are not reported.
+	for _, want := range []string{"*.example.com", "*.example.com"} {
+		select {
+		case got := <-changed:
+			if got != want {
+				t.Errorf("changed %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no change reported, want %q", want)
+		}
+	}
+	select {
+	case got := <-changed:
+		t.Errorf("unexpected change of %q", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestEtcdAccountRoundTrip(t *testing.T) {
+	o := newTestEtcd(t)
+	a, err := NewAccount(o)
+	if err != nil {
+		t.Fatalf("NewAccount: %v", err)
+	}
+	b, err := NewAccount(o)
+	if err != nil {
+		t.Fatalf("NewAccount: %v", err)
+	}
+
+	for _, acc := range []AccountStorage{a, b} {
+		if _, err := acc.LoadAccountKey("me@test.com"); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("LoadAccountKey of a missing key = %v, want ErrNotFound", err)
+		}
+	}
+	if err := a.SaveAccountKey("Me@Test.com", []byte("key-a")); err != nil {
+		t.Fatalf("SaveAccountKey: %v", err)
+	}
+	// An instance that also found no key doesn't replace the one registered meanwhile.
+	if err := b.SaveAccountKey("me@test.com", []byte("key-b")); !errors.Is(err, ErrConflict) {
+		t.Errorf("SaveAccountKey of the second instance = %v, want ErrConflict", err)
+	}
+	if key, err := b.LoadAccountKey("me@test.com"); err != nil || string(key) != "key-a" {
+		t.Errorf("LoadAccountKey = %q, %v; want key-a", key, err)
+	}
+	if emails, err := a.ListAccounts(); err != nil || len(emails) != 1 || emails[0] != "me@test.com" {
+		t.Errorf("ListAccounts = %v, %v; want me@test.com", emails, err)
+	}
+	if err := a.DeleteAccountKey("me@test.com"); err != nil {
+		t.Fatalf("DeleteAccountKey: %v", err)
+	}
+	if _, err := a.LoadAccountKey("me@test.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LoadAccountKey after delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestWatcherOfEncrypted(t *testing.T) {
+	o := newTestEtcd(t)
+	o.Encryption = encryptionOptions(KeyOptions{Type: "file", Path: writeKeyFile(t, 1)})
+	s, err := New(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := WatcherOf(s); !ok {
+		t.Error("the etcd storage is not a Watcher behind encryption")
+	}
+	if _, ok := WatcherOf(&Disk{}); ok {
+		t.Error("the disk storage is a Watcher")
+	}
+}
@@ -0,0 +1,265 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	coreinformers "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// cacheSyncTimeout is how long the first read waits for the initial list of the cache. Until it is
+// done, reads go to the API server.
+const cacheSyncTimeout = 10 * time.Second
+
+// secretCache keeps the Secrets of a namespace managed by the plugin in memory, kept current by a
+// watch, and reports the changes someone else makes to them. It is started by its first use and kept
+// for the life of the process, like the storages.
+type secretCache struct {
+	client    kubernetes.Interface
+	namespace string
+	informer  cache.SharedIndexInformer
+	synced    chan struct{} // closed once the initial list is done
+
+	startOnce sync.Once
+	waitOnce  sync.Once
+
+	mu          sync.Mutex
+	own         map[string]secretWrite   // the last write of every Secret by this instance
+	read        map[string]secretVersion // the version of every Secret when this instance last read or wrote it
+	stale       map[string]bool          // the Secrets whose last write conflicted, read next from the API server
+	subscribers map[int]func(secret *corev1.Secret)
+	next        int
+}
+
+// secretWrite is a write of data, or a delete.
+type secretWrite struct {
+	data    map[string][]byte
+	deleted bool
+}
+
+// secretVersion is the resourceVersion of a Secret, or its absence.
+type secretVersion struct {
+	resourceVersion string
+	absent          bool
+}
+
+func newSecretCache(client kubernetes.Interface, namespace string) *secretCache {
+	informer := coreinformers.NewFilteredSecretInformer(client, namespace, 0, cache.Indexers{}, func(o *metav1.ListOptions) {
+		o.LabelSelector = managedByLabel + "=" + managedByValue
+	})
+	return &secretCache{
+		client:      client,
+		namespace:   namespace,
+		informer:    informer,
+		synced:      make(chan struct{}),
+		own:         map[string]secretWrite{},
+		read:        map[string]secretVersion{},
+		stale:       map[string]bool{},
+		subscribers: map[int]func(*corev1.Secret){},
+	}
+}
+
+// start runs the informer, the first time it is called.
+func (c *secretCache) start() {
+	c.startOnce.Do(func() {
+		_ = c.informer.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+			log.Warningf("watch of secrets in %s failed, retrying: %v", c.namespace, err)
+		})
+		_, _ = c.informer.AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+			AddFunc: func(obj any, isInInitialList bool) {
+				if !isInInitialList {
+					c.changed(obj, false)
+				}
+			},
+			UpdateFunc: func(oldObj, newObj any) {
+				// A relist reports every Secret as updated, also those that didn't change.
+				old, _ := oldObj.(*corev1.Secret)
+				secret, _ := newObj.(*corev1.Secret)
+				if old != nil && secret != nil && maps.EqualFunc(old.Data, secret.Data, bytes.Equal) {
+					return
+				}
+				c.changed(newObj, false)
+			},
+			DeleteFunc: func(obj any) {
+				c.changed(obj, true)
+			},
+		})
+		// Never stopped, as the storages are kept for the life of the process.
+		go c.informer.Run(make(chan struct{}))
+		go func() {
+			if cache.WaitForCacheSync(nil, c.informer.HasSynced) {
+				close(c.synced)
+			}
+		}()
+	})
+}
+
+// ready starts the cache and reports whether it is synced. Only the first call waits for it, up to
+// cacheSyncTimeout.
+func (c *secretCache) ready(ctx context.Context) bool {
+	c.start()
+	c.waitOnce.Do(func() {
+		select {
+		case <-c.synced:
+		case <-ctx.Done():
+		case <-time.After(cacheSyncTimeout):
+			log.Warningf("secrets in %s are not cached yet, reading them from the API server", c.namespace)
+		}
+	})
+	select {
+	case <-c.synced:
+		return true
+	default:
+		return false
+	}
+}
+
+// get returns the Secret name from the cache. A Secret missing from it, one this instance just wrote
+// and the cache doesn't show yet, one whose last write conflicted, and any Secret before the cache is
+// synced are read from the API server instead, so that a Secret not labelled as the plugin's is still
+// found and a conflict is not repeated with a stale copy.
+func (c *secretCache) get(ctx context.Context, name string) (*corev1.Secret, error) {
+	if c.ready(ctx) && !c.reload(name) {
+		obj, ok, err := c.informer.GetStore().GetByKey(c.namespace + "/" + name)
+		if secret, isSecret := obj.(*corev1.Secret); err == nil && ok && isSecret && c.current(secret) {
+			return secret, nil
+		}
+	}
+	return c.client.CoreV1().Secrets(c.namespace).Get(ctx, name, metav1.GetOptions{})
+}
+
+// current tells whether the cached secret reflects the last write of this instance.
+func (c *secretCache) current(secret *corev1.Secret) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w, ok := c.own[secret.Name]
+	return !ok || !w.deleted && maps.EqualFunc(w.data, secret.Data, bytes.Equal)
+}
+
+// writing records a write before it is sent, as its watch event may arrive before its response.
+func (c *secretCache) writing(name string, w secretWrite) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.own[name] = w
+}
+
+// seen records secret as the version of name this instance last read or wrote, nil when there is none.
+func (c *secretCache) seen(name string, secret *corev1.Secret) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if secret == nil {
+		c.read[name] = secretVersion{absent: true}
+		return
+	}
+	c.read[name] = secretVersion{resourceVersion: secret.ResourceVersion}
+}
+
+// lastRead returns the version of name this instance last read or wrote, nil when it never did.
+func (c *secretCache) lastRead(name string) *secretVersion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.read[name]
+	if !ok {
+		return nil
+	}
+	return &v
+}
+
+// written forgets the write of name when it failed, so no event will confirm it. After a conflict the
+// next read of name goes to the API server, as the cache may not show the change yet.
+func (c *secretCache) written(name string, err error) {
+	if err == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.own, name)
+	if errors.Is(err, ErrConflict) {
+		c.stale[name] = true
+	}
+}
+
+// reload tells whether name is to be read from the API server once, after a conflict.
+func (c *secretCache) reload(name string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stale := c.stale[name]
+	delete(c.stale, name)
+	return stale
+}
+
+// isOwn tells whether secret, written or deleted as given, is the last write of this instance. A write
+// of someone else replaces it, so that their following delete is not taken for one of this instance.
+func (c *secretCache) isOwn(secret *corev1.Secret, deleted bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w, ok := c.own[secret.Name]
+	if deleted {
+		return ok && w.deleted
+	}
+	if ok && !w.deleted && maps.EqualFunc(w.data, secret.Data, bytes.Equal) {
+		return true
+	}
+	delete(c.own, secret.Name)
+	return false
+}
+
+// changed passes a Secret someone else wrote or deleted to the subscribers.
+func (c *secretCache) changed(obj any, deleted bool) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	secret, ok := obj.(*corev1.Secret)
+	if !ok || c.isOwn(secret, deleted) {
+		return
+	}
+	c.mu.Lock()
+	subscribers := make([]func(*corev1.Secret), 0, len(c.subscribers))
+	for _, f := range c.subscribers {
+		subscribers = append(subscribers, f)
+	}
+	c.mu.Unlock()
+	for _, f := range subscribers {
+		f(secret)
+	}
+}
+
+// subscribe calls f with every Secret someone else writes or deletes, until stop is closed.
+func (c *secretCache) subscribe(stop <-chan struct{}, f func(secret *corev1.Secret)) {
+	c.start()
+	c.mu.Lock()
+	id := c.next
+	c.next++
+	c.subscribers[id] = f
+	c.mu.Unlock()
+
+	<-stop
+	c.mu.Lock()
+	delete(c.subscribers, id)
+	c.mu.Unlock()
+}
+
+// domainOf returns the domain of the certificate Secret secret, or false when it holds none, such as
+// an account key or a copy of a Secret of another namespace.
+func domainOf(secret *corev1.Secret) (string, bool) {
+	if secret.Type != corev1.SecretTypeTLS || secret.Labels[replicaOfLabel] != "" {
+		return "", false
+	}
+	if domain := secret.Annotations[domainAnnotation]; domain != "" {
+		return domain, true
+	}
+	var resource Resource
+	if err := json.Unmarshal(secret.Data[acmeResourceKey], &resource); err != nil || resource.Domain == "" {
+		return "", false
+	}
+	return resource.Domain, true
+}
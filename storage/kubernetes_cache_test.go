@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certificate"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// watching returns a client whose channel is closed once a watch of Secrets is started.
+func watching() (*fake.Clientset, <-chan struct{}) {
+	client := fake.NewClientset()
+	started := make(chan struct{})
+	var once sync.Once
+	client.PrependWatchReactor("secrets", func(k8stesting.Action) (bool, watch.Interface, error) {
+		once.Do(func() { close(started) })
+		return false, nil, nil
+	})
+	return client, started
+}
+
+// waitFor waits until cond holds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestSecretsCache(t *testing.T) {
+	client, started := watching()
+	s := newTestSecrets(t, client, Options{Namespace: "ns"})
+	in := &Resource{Resource: certificate.Resource{Domain: "example.com", Certificate: []byte("CERT"), PrivateKey: []byte("KEY")}}
+	if err := s.Save(in); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := s.Load("example.com"); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	<-started
+	waitFor(t, "the cache to hold the secret", func() bool {
+		_, ok, _ := s.cache.informer.GetStore().GetByKey("ns/example.com")
+		return ok
+	})
+
+	// Loads are served from memory once the cache holds the Secret.
+	var down atomic.Bool
+	down.Store(true)
+	client.PrependReactor("get", "secrets", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if down.Load() {
+			return true, nil, apierrors.NewServiceUnavailable("etcd is down")
+		}
+		return false, nil, nil
+	})
+	out, err := s.Load("example.com")
+	if err != nil {
+		t.Fatalf("Load from the cache: %v", err)
+	}
+	if string(out.Certificate) != "CERT" {
+		t.Errorf("Load = %q, want CERT from the cache", out.Certificate)
+	}
+
+	// A Secret this instance just wrote is read from the API server until the cache shows it.
+	down.Store(false)
+	in.Certificate = []byte("CERT2")
+	if err := s.Save(in); err != nil {
+		t.Fatalf("second Save: %v", err)
+	}
+	if out, err := s.Load("example.com"); err != nil || string(out.Certificate) != "CERT2" {
+		t.Errorf("Load after Save = %v, %v; want CERT2", out, err)
+	}
+}
+
+func TestSecretsWatch(t *testing.T) {
+	client, started := watching()
+	s := newTestSecrets(t, client, Options{Namespace: "ns"})
+	account := newTestSecretsAccount(t, client, Options{Namespace: "ns"})
+
+	changed := make(chan string, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.Watch(stop, func(domain string) { changed <- domain })
+	<-started
+
+	own := &Resource{Resource: certificate.Resource{Domain: "own.example.com", Certificate: []byte("cert"), PrivateKey: []byte("key")}}
+	if err := s.Save(own); err != nil {
+		t.Fatal(err)
+	}
+	if err := account.SaveAccountKey("me@test.com", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	other := &Resource{Resource: certificate.Resource{Domain: "*.example.com", Certificate: []byte("cert"), PrivateKey: []byte("key")}}
+	if err := s.Save(other); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the cache to hold the secret", func() bool {
+		_, ok, _ := s.cache.informer.GetStore().GetByKey("ns/wildcard.example.com")
+		return ok
+	})
+
+	// Someone edits the Secret, then deletes it.
+	ctx := context.Background()
+	secret, err := client.CoreV1().Secrets("ns").Get(ctx, "wildcard.example.com", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret.Data[corev1.TLSCertKey] = []byte("edited")
+	if _, err := client.CoreV1().Secrets("ns").Update(ctx, secret, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CoreV1().Secrets("ns").Delete(ctx, "wildcard.example.com", metav1.DeleteOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The own writes and the account key are not reported.
+	for _, want := range []string{"*.example.com", "*.example.com"} {
+		select {
+		case got := <-changed:
+			if got != want {
+				t.Errorf("changed %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no change reported, want %q", want)
+		}
+	}
+	select {
+	case got := <-changed:
+		t.Errorf("unexpected change of %q", got)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	if _, err := s.Load("*.example.com"); err != ErrNotFound {
+		t.Errorf("Load of the deleted secret: err = %v, want ErrNotFound", err)
+	}
+}
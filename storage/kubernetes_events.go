@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Reasons of the Events recorded on Secrets.
+const (
+	ReasonNotOwned = "NotOwned"
+)
+
+// Kinds of objects certificate Events can be recorded on instead of the Secret, by their API version.
+var EventObjectKinds = map[string]string{
+	"DaemonSet":   "apps/v1",
+	"Deployment":  "apps/v1",
+	"Pod":         "v1",
+	"StatefulSet": "apps/v1",
+}
+
+const (
+	// eventComponent is the source of the Events the plugin records.
+	eventComponent = "coredns-acmednschallenge"
+
+	// eventRepeatInterval is how long the same Event on the same object isn't recorded again, so a
+	// condition found on every validation cycle doesn't flood the namespace.
+	eventRepeatInterval = time.Hour
+
+	// maxEventMessage is the longest Event message recorded, like client-go's recorder allows.
+	maxEventMessage = 1024
+)
+
+// eventRecorder records Events on Secrets and other objects.
+type eventRecorder struct {
+	client kubernetes.Interface
+	host   string
+
+	mu     sync.Mutex
+	recent map[string]time.Time // by object, reason and message
+}
+
+func newEventRecorder(client kubernetes.Interface) *eventRecorder {
+	host, _ := os.Hostname()
+	return &eventRecorder{client: client, host: host, recent: map[string]time.Time{}}
+}
+
+// record records an Event of type eventType on the object obj, unless it did so within
+// eventRepeatInterval. Failures are only logged, so an Event never fails the operation it reports on.
+func (r *eventRecorder) record(ctx context.Context, obj corev1.ObjectReference, eventType, reason, message string) {
+	if len(message) > maxEventMessage {
+		message = message[:maxEventMessage-3] + "..."
+	}
+	key := obj.Kind + "/" + obj.Namespace + "/" + obj.Name + "\x00" + reason + "\x00" + message
+	now := time.Now()
+	r.mu.Lock()
+	if now.Sub(r.recent[key]) < eventRepeatInterval {
+		r.mu.Unlock()
+		return
+	}
+	// Entries past the interval no longer suppress anything, so they are dropped, keeping the map
+	// as small as the Events of the last interval.
+	maps.DeleteFunc(r.recent, func(_ string, at time.Time) bool { return now.Sub(at) >= eventRepeatInterval })
+	r.recent[key] = now
+	r.mu.Unlock()
+
+	event := &corev1.Event{
+		// Named like those of client-go's recorder.
+		ObjectMeta:          metav1.ObjectMeta{Name: fmt.Sprintf("%s.%x", obj.Name, now.UnixNano()), Namespace: obj.Namespace},
+		InvolvedObject:      obj,
+		Reason:              reason,
+		Message:             message,
+		Type:                eventType,
+		Source:              corev1.EventSource{Component: eventComponent, Host: r.host},
+		FirstTimestamp:      metav1.NewTime(now),
+		LastTimestamp:       metav1.NewTime(now),
+		Count:               1,
+		ReportingController: eventComponent,
+		ReportingInstance:   r.host,
+	}
+	if _, err := r.client.CoreV1().Events(obj.Namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		log.Warningf("could not record event %s on %s %s/%s: %v", reason, obj.Kind, obj.Namespace, obj.Name, err)
+	}
+}
+
+// secretRef returns the reference of secret in Events.
+func secretRef(secret *corev1.Secret) corev1.ObjectReference {
+	return corev1.ObjectReference{
+		APIVersion:      "v1",
+		Kind:            "Secret",
+		Namespace:       secret.Namespace,
+		Name:            secret.Name,
+		UID:             secret.UID,
+		ResourceVersion: secret.ResourceVersion,
+	}
+}
+
+// objectRef returns the reference of the object kind namespace/name in Events. Without its UID, which
+// is only known when the object can be read, kubectl describe doesn't show the Events.
+func (r *eventRecorder) objectRef(ctx context.Context, kind, namespace, name string) corev1.ObjectReference {
+	ref := corev1.ObjectReference{APIVersion: EventObjectKinds[kind], Kind: kind, Namespace: namespace, Name: name}
+	var obj metav1.Object
+	var err error
+	switch kind {
+	case "DaemonSet":
+		obj, err = r.client.AppsV1().DaemonSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	case "Deployment":
+		obj, err = r.client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+	case "Pod":
+		obj, err = r.client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+	case "StatefulSet":
+		obj, err = r.client.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+	default:
+		err = fmt.Errorf("unknown kind %s", kind)
+	}
+	if err != nil {
+		log.Warningf("could not read %s %s/%s to record events on: %v", kind, namespace, name, err)
+		return ref
+	}
+	ref.UID = obj.GetUID()
+	return ref
+}
+
+// notOwned records a NotOwned Event on secret, which the plugin doesn't manage, and returns the error
+// refusing to use it.
+func (r *eventRecorder) notOwned(ctx context.Context, secret *corev1.Secret) error {
+	owner := secret.Labels[managedByLabel]
+	if owner == "" {
+		owner = "nobody"
+	}
+	message := fmt.Sprintf("Secret is managed by %s, not %s; set adopt to let the plugin take it over", owner, managedByValue)
+	r.record(ctx, secretRef(secret), corev1.EventTypeWarning, ReasonNotOwned, message)
+	return fmt.Errorf("%w: secret %s/%s is managed by %s, set adopt to take it over", ErrNotOwned, secret.Namespace, secret.Name, owner)
+}
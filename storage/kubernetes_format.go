@@ -0,0 +1,159 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// Further formats of the private key and certificate a certificate Secret can hold.
+const (
+	FormatCombinedPEM = "combinedPEM" // tls-combined.pem: the private key followed by the chain
+	FormatDER         = "der"         // key.der: the private key in DER
+	FormatPKCS12      = "pkcs12"      // keystore.p12: the private key and chain, password protected
+)
+
+// Extra keys of a certificate Secret, named like those cert-manager writes.
+const (
+	caCertKey      = "ca.crt"
+	combinedPEMKey = "tls-combined.pem"
+	derKeyKey      = "key.der"
+	keystorePKCS12 = "keystore.p12"
+
+	certManagerAnnotationPrefix = "cert-manager.io/"
+)
+
+// secretNameData is what a Secret name template is executed with.
+type secretNameData struct {
+	Domain string // the domain in lower case, such as *.example.com
+	Name   string // the default name, such as wildcard.example.com
+}
+
+// parseSecretName parses the Secret name template tmpl.
+func parseSecretName(tmpl string) (*template.Template, error) {
+	return template.New("name").Option("missingkey=error").Parse(tmpl)
+}
+
+// executeSecretName returns the Secret name of domain by t, which must be a DNS subdomain.
+func executeSecretName(t *template.Template, domain string) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, secretNameData{Domain: strings.ToLower(domain), Name: secretName(domain)}); err != nil {
+		return "", err
+	}
+	if errs := validation.IsDNS1123Subdomain(b.String()); len(errs) > 0 {
+		return "", fmt.Errorf("secret name %q of domain %s is invalid: %s", b.String(), domain, strings.Join(errs, ", "))
+	}
+	return b.String(), nil
+}
+
+// CheckSecretName reports whether tmpl is a Secret name template giving valid names, and different
+// ones for different domains.
+func CheckSecretName(tmpl string) error {
+	t, err := parseSecretName(tmpl)
+	if err != nil {
+		return err
+	}
+	a, err := executeSecretName(t, "*.example.com")
+	if err != nil {
+		return err
+	}
+	b, err := executeSecretName(t, "example.org")
+	if err != nil {
+		return err
+	}
+	if a == b {
+		return fmt.Errorf("gives every domain the name %q, use {{.Name}} or {{.Domain}}", a)
+	}
+	return nil
+}
+
+// parseSecretMeta decodes labels or annotations encoded as a URL query.
+func parseSecretMeta(query string) (map[string]string, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	meta := make(map[string]string, len(values))
+	for k := range values {
+		meta[k] = values.Get(k)
+	}
+	return meta, nil
+}
+
+// addFormats adds the keys of ca.crt and of formats to the data of the certificate Secret of certs.
+func addFormats(data map[string][]byte, certs *Resource, caCert bool, formats []string, pkcs12Password string) error {
+	chain, err := certcrypto.ParsePEMBundle(certs.Certificate)
+	if err != nil {
+		return fmt.Errorf("unable to parse the certificate: %w", err)
+	}
+	if caCert {
+		var ca bytes.Buffer
+		for _, c := range chain[1:] {
+			_ = pem.Encode(&ca, &pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})
+		}
+		if ca.Len() == 0 {
+			ca.Write(certs.IssuerCertificate)
+		}
+		data[caCertKey] = ca.Bytes()
+	}
+	if len(formats) == 0 {
+		return nil
+	}
+	block, _ := pem.Decode(certs.PrivateKey)
+	if block == nil {
+		return fmt.Errorf("the private key is not PEM encoded")
+	}
+	for _, format := range formats {
+		switch format {
+		case FormatCombinedPEM:
+			data[combinedPEMKey] = append(append([]byte{}, certs.PrivateKey...), certs.Certificate...)
+		case FormatDER:
+			data[derKeyKey] = block.Bytes
+		case FormatPKCS12:
+			key, err := certcrypto.ParsePEMPrivateKey(certs.PrivateKey)
+			if err != nil {
+				return fmt.Errorf("unable to parse the private key: %w", err)
+			}
+			p12, err := pkcs12.Modern.Encode(key, chain[0], chain[1:], pkcs12Password)
+			if err != nil {
+				return fmt.Errorf("unable to encode %s: %w", keystorePKCS12, err)
+			}
+			data[keystorePKCS12] = p12
+		default:
+			return fmt.Errorf("unknown format %s", format)
+		}
+	}
+	return nil
+}
+
+// certManagerAnnotations returns the annotations cert-manager sets on the Secrets it issues, for
+// the certificate of certs stored as the Secret name.
+func certManagerAnnotations(certs *Resource, name string) map[string]string {
+	annotations := map[string]string{
+		certManagerAnnotationPrefix + "certificate-name": name,
+		certManagerAnnotationPrefix + "issuer-name":      managedByValue,
+	}
+	leaf := leafOf(certs)
+	if leaf == nil {
+		return annotations
+	}
+	var ips, uris []string
+	for _, ip := range leaf.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	for _, uri := range leaf.URIs {
+		uris = append(uris, uri.String())
+	}
+	annotations[certManagerAnnotationPrefix+"common-name"] = leaf.Subject.CommonName
+	annotations[certManagerAnnotationPrefix+"alt-names"] = strings.Join(leaf.DNSNames, ",")
+	annotations[certManagerAnnotationPrefix+"ip-sans"] = strings.Join(ips, ",")
+	annotations[certManagerAnnotationPrefix+"uri-sans"] = strings.Join(uris, ",")
+	return annotations
+}
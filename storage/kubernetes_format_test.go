@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certificate"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+func TestSecretsLayout(t *testing.T) {
+	client := fake.NewClientset()
+	s := newTestSecrets(t, client, Options{
+		Namespace:            "ns",
+		SecretName:           "tls-{{.Name}}",
+		SecretLabels:         "team=dns",
+		SecretAnnotations:    "reflector.v1.k8s.emberstack.com%2Freflection-allowed=true",
+		SecretCertManager:    true,
+		SecretCACert:         true,
+		SecretFormats:        "combinedPEM der pkcs12",
+		SecretPKCS12Password: "changeit",
+	})
+	chain, key := newTestCert(t, testCert{names: []string{"example.com", "www.example.com"}, issuer: "Test CA"})
+	in := &Resource{Resource: certificate.Resource{Domain: "*.example.com", Certificate: chain, PrivateKey: key}}
+	if err := s.Save(in); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	secret, err := client.CoreV1().Secrets("ns").Get(context.Background(), "tls-wildcard.example.com", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected secret named tls-wildcard.example.com: %v", err)
+	}
+	if secret.Labels["team"] != "dns" || secret.Labels[managedByLabel] != managedByValue {
+		t.Errorf("labels = %v", secret.Labels)
+	}
+	for k, want := range map[string]string{
+		"reflector.v1.k8s.emberstack.com/reflection-allowed": "true",
+		"acmednschallenge/domain":                            "*.example.com",
+		"cert-manager.io/common-name":                        "example.com",
+		"cert-manager.io/alt-names":                          "example.com,www.example.com",
+		"cert-manager.io/certificate-name":                   "tls-wildcard.example.com",
+	} {
+		if secret.Annotations[k] != want {
+			t.Errorf("annotation %s = %q, want %q", k, secret.Annotations[k], want)
+		}
+	}
+
+	caPEM := chain[bytes.Index(chain[1:], []byte("-----BEGIN"))+1:]
+	if !bytes.Equal(secret.Data["ca.crt"], caPEM) {
+		t.Errorf("ca.crt = %q, want the CA certificate", secret.Data["ca.crt"])
+	}
+	if want := append(append([]byte{}, key...), chain...); !bytes.Equal(secret.Data["tls-combined.pem"], want) {
+		t.Errorf("tls-combined.pem = %q, want the key followed by the chain", secret.Data["tls-combined.pem"])
+	}
+	if block, _ := pem.Decode(key); !bytes.Equal(secret.Data["key.der"], block.Bytes) {
+		t.Error("key.der is not the DER of the private key")
+	}
+	p12Key, p12Cert, p12CAs, err := pkcs12.DecodeChain(secret.Data["keystore.p12"], "changeit")
+	if err != nil {
+		t.Fatalf("keystore.p12: %v", err)
+	}
+	if p12Key == nil || p12Cert.Subject.CommonName != "example.com" || len(p12CAs) != 1 || p12CAs[0].Subject.CommonName != "Test CA" {
+		t.Errorf("keystore.p12 holds %v, %v and %v", p12Key, p12Cert.Subject, p12CAs)
+	}
+
+	out, err := s.Load("*.example.com")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !bytes.Equal(out.Certificate, chain) || !bytes.Equal(out.PrivateKey, key) {
+		t.Errorf("Load = %+v, want the saved certificate", out)
+	}
+	if list, err := s.List(); err != nil || len(list) != 1 || list[0].Domain != "*.example.com" {
+		t.Errorf("List = %v, %v; want *.example.com", list, err)
+	}
+	if err := s.Delete("*.example.com"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := client.CoreV1().Secrets("ns").Get(context.Background(), "tls-wildcard.example.com", metav1.GetOptions{}); err == nil {
+		t.Error("secret kept after Delete")
+	}
+}
+
+func TestCheckSecretName(t *testing.T) {
+	tests := []struct {
+		tmpl      string
+		shouldErr bool
+	}{
+		{tmpl: "{{.Name}}"},
+		{tmpl: "tls-{{.Name}}"},
+		{tmpl: `{{.Domain | printf "%.3s"}}x-{{.Name}}`, shouldErr: true}, // "*.e" is not a valid name
+		{tmpl: "{{.Name}}-tls"},
+		{tmpl: "wildcard", shouldErr: true},
+		{tmpl: "{{.Namespace}}-{{.Name}}", shouldErr: true},
+		{tmpl: "{{.Name", shouldErr: true},
+		{tmpl: "TLS-{{.Name}}", shouldErr: true},
+	}
+	for _, tc := range tests {
+		if err := CheckSecretName(tc.tmpl); (err != nil) != tc.shouldErr {
+			t.Errorf("CheckSecretName(%q) = %v, want error %v", tc.tmpl, err, tc.shouldErr)
+		}
+	}
+}
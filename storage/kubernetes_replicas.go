@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// replicaOfLabel marks a copy of a certificate Secret with the namespace of the original.
+	replicaOfLabel = "acmednschallenge/replica-of"
+
+	// replicaSyncInterval is how often the copies of all certificates are reconciled, so that copies a
+	// failed Save missed and namespaces that start or stop matching are caught up with.
+	replicaSyncInterval = time.Minute
+)
+
+// replicas copies the certificate Secrets of a namespace into other namespaces: a fixed list, and
+// the namespaces matching a label selector. Save syncs the copies of the Secret it writes, and a
+// reconcile loop, started with the first read or write, syncs those of every Secret periodically.
+type replicas struct {
+	client     kubernetes.Interface
+	source     string
+	namespaces []string
+	selector   string
+	adopt      bool
+	events     *eventRecorder
+
+	startOnce sync.Once
+}
+
+func newReplicas(client kubernetes.Interface, events *eventRecorder, o Options) *replicas {
+	return &replicas{
+		client:     client,
+		source:     o.Namespace,
+		namespaces: strings.Fields(o.ReplicateNamespaces),
+		selector:   o.ReplicateSelector,
+		adopt:      o.SecretAdopt,
+		events:     events,
+	}
+}
+
+// start runs the reconcile loop, the first time it is called. It is never stopped, as the storages
+// are kept for the life of the process.
+func (r *replicas) start() {
+	r.startOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(replicaSyncInterval)
+			defer ticker.Stop()
+			for range ticker.C {
+				r.reconcile()
+			}
+		}()
+	})
+}
+
+// reconcile syncs the copies of every certificate Secret of the source namespace.
+func (r *replicas) reconcile() {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	list, err := r.client.CoreV1().Secrets(r.source).List(ctx, metav1.ListOptions{
+		LabelSelector: managedByLabel + "=" + managedByValue + ",!" + replicaOfLabel,
+		FieldSelector: "type=" + string(corev1.SecretTypeTLS),
+	})
+	if err != nil {
+		log.Warningf("could not list the secrets in %s to copy: %v", r.source, err)
+		return
+	}
+	for i := range list.Items {
+		r.sync(&list.Items[i])
+	}
+}
+
+// targets returns the namespaces the copies belong in, never the source namespace.
+func (r *replicas) targets(ctx context.Context) (map[string]bool, error) {
+	targets := map[string]bool{}
+	for _, ns := range r.namespaces {
+		targets[ns] = true
+	}
+	if r.selector != "" {
+		list, err := r.client.CoreV1().Namespaces().List(ctx, metav1.ListOptions{LabelSelector: r.selector})
+		if err != nil {
+			return nil, fmt.Errorf("unable to list namespaces matching %s: %w", r.selector, err)
+		}
+		for _, ns := range list.Items {
+			if ns.DeletionTimestamp == nil {
+				targets[ns.Name] = true
+			}
+		}
+	}
+	delete(targets, r.source)
+	return targets, nil
+}
+
+// copies returns the copies of the Secret name by namespace.
+func (r *replicas) copies(ctx context.Context, name string) (map[string]*corev1.Secret, error) {
+	list, err := r.client.CoreV1().Secrets(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: managedByLabel + "=" + managedByValue + "," + replicaOfLabel + "=" + r.source,
+		FieldSelector: "metadata.name=" + name,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list the copies of secret %s/%s: %w", r.source, name, err)
+	}
+	copies := map[string]*corev1.Secret{}
+	for i, secret := range list.Items {
+		if secret.Name == name {
+			copies[secret.Namespace] = &list.Items[i]
+		}
+	}
+	return copies, nil
+}
+
+// sync writes secret into every target namespace whose copy differs, and deletes the copies in
+// namespaces that are no longer targets. Failures are logged and retried by the next reconcile.
+func (r *replicas) sync(secret *corev1.Secret) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	targets, err := r.targets(ctx)
+	if err != nil {
+		log.Warningf("could not copy secret %s/%s: %v", r.source, secret.Name, err)
+		return
+	}
+	copies, err := r.copies(ctx, secret.Name)
+	if err != nil {
+		log.Warningf("could not copy secret %s/%s: %v", r.source, secret.Name, err)
+		return
+	}
+	for _, ns := range slices.Sorted(maps.Keys(targets)) {
+		existing, ok := copies[ns]
+		replica := replicaOf(secret, ns, r.source)
+		if ok && existing.Type == replica.Type && maps.EqualFunc(existing.Data, replica.Data, bytes.Equal) &&
+			maps.Equal(existing.Labels, replica.Labels) && maps.Equal(existing.Annotations, replica.Annotations) {
+			continue
+		}
+		if ok {
+			replica.ResourceVersion = existing.ResourceVersion
+			_, err = r.client.CoreV1().Secrets(ns).Update(ctx, replica, metav1.UpdateOptions{})
+		} else {
+			_, err = r.client.CoreV1().Secrets(ns).Create(ctx, replica, metav1.CreateOptions{})
+			if apierrors.IsAlreadyExists(err) {
+				err = r.overwrite(ctx, replica)
+			}
+		}
+		if errors.Is(err, ErrNotOwned) {
+			log.Warningf("not copying secret %s/%s to namespace %s: %v", r.source, secret.Name, ns, err)
+			continue
+		}
+		if err != nil {
+			log.Warningf("could not copy secret %s/%s to namespace %s: %v", r.source, secret.Name, ns, err)
+			continue
+		}
+		log.Infof("copied secret %s/%s to namespace %s", r.source, secret.Name, ns)
+	}
+	if err := r.deleteCopies(ctx, copies, targets); err != nil {
+		log.Warningf("could not delete a copy of secret %s/%s: %v", r.source, secret.Name, err)
+	}
+}
+
+// overwrite writes replica over a Secret of the same name that isn't a copy, which is only done when
+// adopting, and never when it is a certificate the plugin stores in that namespace itself.
+func (r *replicas) overwrite(ctx context.Context, replica *corev1.Secret) error {
+	existing, err := r.client.CoreV1().Secrets(replica.Namespace).Get(ctx, replica.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if managedByPlugin(existing) && existing.Labels[replicaOfLabel] != r.source {
+		return fmt.Errorf("%w: secret %s/%s is not a copy of namespace %s", ErrNotOwned, existing.Namespace, existing.Name, r.source)
+	}
+	_, err = putSecret(ctx, r.client, r.events, replica, r.adopt, nil)
+	return err
+}
+
+// prune deletes every copy of the Secret name.
+func (r *replicas) prune(ctx context.Context, name string) error {
+	copies, err := r.copies(ctx, name)
+	if err != nil {
+		return err
+	}
+	return r.deleteCopies(ctx, copies, nil)
+}
+
+// deleteCopies deletes the copies outside the namespaces keep. A copy is only deleted as it was listed:
+// one that was replaced by a Secret of someone else, or changed since, is left alone.
+func (r *replicas) deleteCopies(ctx context.Context, copies map[string]*corev1.Secret, keep map[string]bool) error {
+	for ns, secret := range copies {
+		if keep[ns] {
+			continue
+		}
+		if !managedByPlugin(secret) || secret.Labels[replicaOfLabel] != r.source {
+			return fmt.Errorf("%w: secret %s/%s is not a copy of namespace %s", ErrNotOwned, ns, secret.Name, r.source)
+		}
+		err := r.client.CoreV1().Secrets(ns).Delete(ctx, secret.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &secret.UID, ResourceVersion: &secret.ResourceVersion},
+		})
+		if apierrors.IsConflict(err) {
+			return fmt.Errorf("unable to delete secret %s/%s: %w: %w", ns, secret.Name, ErrConflict, err)
+		}
+		if err != nil && !apierrors.IsNotFound(err) {
+			return fmt.Errorf("unable to delete secret %s/%s: %w", ns, secret.Name, err)
+		}
+		log.Infof("deleted the copy of secret %s/%s in namespace %s", r.source, secret.Name, ns)
+	}
+	return nil
+}
+
+// replicaOf returns the copy of secret in namespace ns.
+func replicaOf(secret *corev1.Secret, ns, source string) *corev1.Secret {
+	replica := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        secret.Name,
+			Namespace:   ns,
+			Labels:      maps.Clone(secret.Labels),
+			Annotations: maps.Clone(secret.Annotations),
+		},
+		Type: secret.Type,
+		Data: secret.Data,
+	}
+	if replica.Labels == nil {
+		replica.Labels = map[string]string{}
+	}
+	replica.Labels[replicaOfLabel] = source
+	return replica
+}
@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certificate"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func namespace(name string, labels map[string]string) *corev1.Namespace {
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels}}
+}
+
+// secretIn returns the Secret name in ns, or nil when there is none.
+func secretIn(t *testing.T, client *fake.Clientset, ns, name string) *corev1.Secret {
+	t.Helper()
+	secret, err := client.CoreV1().Secrets(ns).Get(context.Background(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestSecretsReplicate(t *testing.T) {
+	client := fake.NewClientset(
+		namespace("certs", nil),
+		namespace("ingress-a", map[string]string{"tls": "wildcard"}),
+		namespace("ingress-b", map[string]string{"tls": "wildcard"}),
+		namespace("other", nil),
+		// A Secret of the same name the plugin didn't copy is left alone.
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "wildcard.example.com", Namespace: "ingress-b"}, Data: map[string][]byte{"tls.crt": []byte("theirs")}},
+	)
+	s := newTestSecrets(t, client, Options{Namespace: "certs", ReplicateNamespaces: "static", ReplicateSelector: "tls=wildcard"})
+
+	in := &Resource{Resource: certificate.Resource{Domain: "*.example.com", Certificate: []byte("CERT"), PrivateKey: []byte("KEY")}}
+	if err := s.Save(in); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	for _, ns := range []string{"static", "ingress-a"} {
+		replica := secretIn(t, client, ns, "wildcard.example.com")
+		if replica == nil {
+			t.Fatalf("no copy in namespace %s", ns)
+		}
+		if string(replica.Data["tls.crt"]) != "CERT" || replica.Type != corev1.SecretTypeTLS || replica.Labels[replicaOfLabel] != "certs" {
+			t.Errorf("copy in %s = %+v", ns, replica)
+		}
+	}
+	if theirs := secretIn(t, client, "ingress-b", "wildcard.example.com"); string(theirs.Data["tls.crt"]) != "theirs" {
+		t.Errorf("secret not copied by the plugin was overwritten: %+v", theirs)
+	}
+	if secretIn(t, client, "other", "wildcard.example.com") != nil {
+		t.Error("copied to a namespace not matching the selector")
+	}
+
+	// Copies are neither listed nor loaded as certificates of their namespace.
+	if list, err := newTestSecrets(t, client, Options{Namespace: "static"}).List(); err != nil || len(list) != 0 {
+		t.Errorf("List in a namespace with a copy = %v, %v; want none", list, err)
+	}
+
+	// A renewal updates the copies.
+	in.Certificate = []byte("CERT2")
+	if err := s.Save(in); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if replica := secretIn(t, client, "ingress-a", "wildcard.example.com"); string(replica.Data["tls.crt"]) != "CERT2" {
+		t.Errorf("copy after renewal has %q, want CERT2", replica.Data["tls.crt"])
+	}
+
+	// A namespace that stops matching loses its copy with the next reconcile, one that starts
+	// matching gets one. Loading the certificate doesn't touch the copies.
+	if _, err := client.CoreV1().Namespaces().Update(context.Background(), namespace("ingress-a", nil), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoreV1().Namespaces().Update(context.Background(), namespace("other", map[string]string{"tls": "wildcard"}), metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Load("*.example.com"); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if secretIn(t, client, "ingress-a", "wildcard.example.com") == nil {
+		t.Error("copy deleted by a Load")
+	}
+	if secretIn(t, client, "other", "wildcard.example.com") != nil {
+		t.Error("copy created by a Load")
+	}
+	s.replicas.reconcile()
+	if secretIn(t, client, "ingress-a", "wildcard.example.com") != nil {
+		t.Error("copy kept in a namespace no longer matching the selector")
+	}
+	if secretIn(t, client, "other", "wildcard.example.com") == nil {
+		t.Error("no copy in a namespace that started matching the selector")
+	}
+
+	if err := s.Delete("*.example.com"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	for _, ns := range []string{"certs", "static", "other"} {
+		if secretIn(t, client, ns, "wildcard.example.com") != nil {
+			t.Errorf("secret in %s kept after Delete", ns)
+		}
+	}
+	if secretIn(t, client, "ingress-b", "wildcard.example.com") == nil {
+		t.Error("secret not copied by the plugin deleted")
+	}
+	if _, err := s.Load("*.example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Load after Delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestReplicasDeleteCopies(t *testing.T) {
+	copyOf := func(ns string, labels map[string]string) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "example.com", Namespace: ns, UID: types.UID("uid-" + ns), ResourceVersion: "7", Labels: labels}}
+	}
+	replica := copyOf("ingress", map[string]string{managedByLabel: managedByValue, replicaOfLabel: "certs"})
+	theirs := copyOf("other", map[string]string{managedByLabel: managedByValue, replicaOfLabel: "elsewhere"})
+	client := fake.NewClientset(replica, theirs)
+	var preconditions []*metav1.Preconditions
+	client.PrependReactor("delete", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		preconditions = append(preconditions, action.(k8stesting.DeleteAction).GetDeleteOptions().Preconditions)
+		return false, nil, nil
+	})
+	r := newReplicas(client, newEventRecorder(client), Options{Namespace: "certs", ReplicateNamespaces: "ingress"})
+
+	if err := r.deleteCopies(context.Background(), map[string]*corev1.Secret{"ingress": replica}, nil); err != nil {
+		t.Fatalf("deleteCopies: %v", err)
+	}
+	if secretIn(t, client, "ingress", "example.com") != nil {
+		t.Error("copy not deleted")
+	}
+	if len(preconditions) != 1 || preconditions[0] == nil || *preconditions[0].UID != replica.UID || *preconditions[0].ResourceVersion != "7" {
+		t.Errorf("delete preconditions = %+v, want the UID and resourceVersion of the listed copy", preconditions)
+	}
+
+	// A Secret that isn't a copy of the source namespace is never deleted.
+	if err := r.deleteCopies(context.Background(), map[string]*corev1.Secret{"other": theirs}, nil); !errors.Is(err, ErrNotOwned) {
+		t.Errorf("deleteCopies of a copy of another namespace = %v, want ErrNotOwned", err)
+	}
+	if secretIn(t, client, "other", "example.com") == nil {
+		t.Error("copy of another namespace deleted")
+	}
+}
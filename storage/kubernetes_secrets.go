@@ -4,11 +4,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"maps"
 	"regexp"
 	"strings"
-	"time"
+	"text/template"
 
-	"github.com/go-acme/lego/v4/certificate"
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -21,15 +21,29 @@ const (
 	acmeResourceKey = "acme.json"
 	managedByLabel  = "app.kubernetes.io/managed-by"
 	managedByValue  = "coredns-acmednschallenge"
-	k8sTimeout      = 30 * time.Second
+
+	accountEmailAnnotation = "acmednschallenge/email"
+	domainAnnotation       = "acmednschallenge/domain"
 )
 
 type Secrets struct {
-	client    kubernetes.Interface
-	namespace string
+	client      kubernetes.Interface
+	namespace   string
+	replicas    *replicas          // nil without replication
+	name        *template.Template // nil means secretName
+	labels      map[string]string
+	annotations map[string]string
+	certManager bool // add cert-manager's annotations
+	caCert      bool
+	formats     []string
+	pkcs12Pass  string
+	adopt       bool // take over existing Secrets not managed by the plugin
+	events      *eventRecorder
+	eventObject *corev1.ObjectReference // the object certificate Events are recorded on, nil means the Secret
+	cache       *secretCache
 }
 
-func NewSecrets(namespace string) (*Secrets, error) {
+func NewSecrets(o Options) (*Secrets, error) {
 	cfg, err := restConfig()
 	if err != nil {
 		return nil, fmt.Errorf("could not build kubernetes client config: %w", err)
@@ -38,11 +52,62 @@ func NewSecrets(namespace string) (*Secrets, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not create kubernetes client: %w", err)
 	}
-	return newSecrets(client, namespace), nil
+	return newSecrets(client, o)
 }
 
-func newSecrets(client kubernetes.Interface, namespace string) *Secrets {
-	return &Secrets{client: client, namespace: namespace}
+func newSecrets(client kubernetes.Interface, o Options) (*Secrets, error) {
+	s := &Secrets{
+		client:      client,
+		namespace:   o.Namespace,
+		certManager: o.SecretCertManager,
+		caCert:      o.SecretCACert,
+		formats:     strings.Fields(o.SecretFormats),
+		pkcs12Pass:  o.SecretPKCS12Password,
+		adopt:       o.SecretAdopt,
+		events:      newEventRecorder(client),
+		cache:       newSecretCache(client, o.Namespace),
+	}
+	if o.EventKind != "" {
+		ns := o.EventNamespace
+		if ns == "" {
+			ns = o.Namespace
+		}
+		s.eventObject = &corev1.ObjectReference{Kind: o.EventKind, Namespace: ns, Name: o.EventName}
+	}
+	if o.ReplicateNamespaces != "" || o.ReplicateSelector != "" {
+		s.replicas = newReplicas(client, s.events, o)
+	}
+	if o.SecretName != "" {
+		t, err := parseSecretName(o.SecretName)
+		if err != nil {
+			return nil, fmt.Errorf("invalid secret name template: %w", err)
+		}
+		s.name = t
+	}
+	var err error
+	if s.labels, s.annotations, err = secretMeta(o); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// secretMeta returns the labels and annotations of o added to every Secret.
+func secretMeta(o Options) (labels, annotations map[string]string, err error) {
+	if labels, err = parseSecretMeta(o.SecretLabels); err != nil {
+		return nil, nil, fmt.Errorf("invalid secret labels: %w", err)
+	}
+	if annotations, err = parseSecretMeta(o.SecretAnnotations); err != nil {
+		return nil, nil, fmt.Errorf("invalid secret annotations: %w", err)
+	}
+	return labels, annotations, nil
+}
+
+// secretName returns the name of the Secret of domain.
+func (s *Secrets) secretName(domain string) (string, error) {
+	if s.name == nil {
+		return secretName(domain), nil
+	}
+	return executeSecretName(s.name, domain)
 }
 
 func restConfig() (*rest.Config, error) {
@@ -55,18 +120,22 @@ func restConfig() (*rest.Config, error) {
 	).ClientConfig()
 }
 
-func (s *Secrets) Save(certs *certificate.Resource) error {
+func (s *Secrets) Save(certs *Resource) error {
 	meta, err := json.Marshal(certs)
 	if err != nil {
 		return fmt.Errorf("unable to marshal CertResource for domain %s: %w", certs.Domain, err)
 	}
+	name, err := s.secretName(certs.Domain)
+	if err != nil {
+		return err
+	}
 
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:        secretName(certs.Domain),
+			Name:        name,
 			Namespace:   s.namespace,
-			Labels:      map[string]string{managedByLabel: managedByValue},
-			Annotations: map[string]string{"acmednschallenge/domain": certs.Domain},
+			Labels:      withEntries(s.labels, map[string]string{managedByLabel: managedByValue}),
+			Annotations: withEntries(s.annotations, map[string]string{domainAnnotation: certs.Domain}),
 		},
 		Type: corev1.SecretTypeTLS,
 		Data: map[string][]byte{
@@ -75,57 +144,278 @@ func (s *Secrets) Save(certs *certificate.Resource) error {
 			acmeResourceKey:         meta,
 		},
 	}
+	if s.certManager {
+		secret.Annotations = withEntries(secret.Annotations, certManagerAnnotations(certs, name))
+	}
+	if s.caCert || len(s.formats) > 0 {
+		if err := addFormats(secret.Data, certs, s.caCert, s.formats, s.pkcs12Pass); err != nil {
+			return fmt.Errorf("unable to build the secret for domain %s: %w", certs.Domain, err)
+		}
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), k8sTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
 	defer cancel()
 
-	api := s.client.CoreV1().Secrets(s.namespace)
-	_, err = api.Update(ctx, secret, metav1.UpdateOptions{})
-	if apierrors.IsNotFound(err) {
-		_, err = api.Create(ctx, secret, metav1.CreateOptions{})
-	}
+	s.cache.writing(name, secretWrite{data: secret.Data})
+	stored, err := putSecret(ctx, s.client, s.events, secret, s.adopt, s.cache.lastRead(name))
+	s.cache.written(name, err)
 	if err != nil {
 		return fmt.Errorf("unable to save secret for domain %s: %w", certs.Domain, err)
 	}
+	s.cache.seen(name, stored)
+	if s.replicas != nil {
+		s.replicas.start()
+		s.replicas.sync(secret)
+	}
 	return nil
 }
 
-func (s *Secrets) Load(domain string) *certificate.Resource {
-	ctx, cancel := context.WithTimeout(context.Background(), k8sTimeout)
-	defer cancel()
+// putSecret writes secret over the Secret of the same name, creating it when there is none, and returns
+// the stored Secret. An existing Secret must be managed by the plugin unless adopt is set. When read is
+// not nil, the Secret must be unchanged since this instance read that version of it, and the write is
+// conditional on it, so a change made in the meantime fails with ErrConflict instead of being lost.
+func putSecret(ctx context.Context, client kubernetes.Interface, events *eventRecorder, secret *corev1.Secret, adopt bool, read *secretVersion) (*corev1.Secret, error) {
+	api := client.CoreV1().Secrets(secret.Namespace)
+	existing, err := api.Get(ctx, secret.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if read != nil && !read.absent {
+			return nil, fmt.Errorf("%w: secret %s/%s was deleted since it was read", ErrConflict, secret.Namespace, secret.Name)
+		}
+		stored, err := api.Create(ctx, secret, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return nil, fmt.Errorf("%w: %w", ErrConflict, err)
+		}
+		return stored, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !managedByPlugin(existing) {
+		if !adopt {
+			return nil, events.notOwned(ctx, existing)
+		}
+		log.Infof("adopting secret %s/%s, managed by %q", existing.Namespace, existing.Name, existing.Labels[managedByLabel])
+	}
+	if err := changedSince(existing, read); err != nil {
+		return nil, err
+	}
 
-	secret, err := s.client.CoreV1().Secrets(s.namespace).Get(ctx, secretName(domain), metav1.GetOptions{})
+	var stored *corev1.Secret
+	if existing.Type != secret.Type {
+		// The type of a Secret can't be changed, only an adopted one can have another.
+		err = api.Delete(ctx, existing.Name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &existing.UID, ResourceVersion: &existing.ResourceVersion}})
+		if err == nil {
+			stored, err = api.Create(ctx, secret, metav1.CreateOptions{})
+		}
+	} else {
+		secret.ResourceVersion = existing.ResourceVersion
+		stored, err = api.Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) || apierrors.IsNotFound(err) {
+		return nil, fmt.Errorf("%w: %w", ErrConflict, err)
+	}
+	return stored, err
+}
+
+// changedSince returns ErrConflict when existing is not the version read, unless read is nil.
+func changedSince(existing *corev1.Secret, read *secretVersion) error {
+	if read == nil || !read.absent && read.resourceVersion == existing.ResourceVersion {
+		return nil
+	}
+	return fmt.Errorf("%w: secret %s/%s was changed since it was read", ErrConflict, existing.Namespace, existing.Name)
+}
+
+// deleteSecret deletes the Secret name when it is managed by the plugin and, unless read is nil, is
+// still the version this instance read. The delete is conditional on the UID and
+// resourceVersion, so a Secret replaced or changed in the meantime is kept and ErrConflict returned.
+// Deleting a Secret that doesn't exist is not an error.
+func deleteSecret(ctx context.Context, client kubernetes.Interface, namespace, name string, read *secretVersion) error {
+	api := client.CoreV1().Secrets(namespace)
+	existing, err := api.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
 	if err != nil {
+		return err
+	}
+	if !managedByPlugin(existing) {
+		return fmt.Errorf("%w: secret %s/%s is managed by %q, not deleting it", ErrNotOwned, namespace, name, existing.Labels[managedByLabel])
+	}
+	if err := changedSince(existing, read); err != nil {
+		return err
+	}
+	err = api.Delete(ctx, name, metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &existing.UID, ResourceVersion: &existing.ResourceVersion}})
+	if apierrors.IsNotFound(err) {
 		return nil
 	}
+	if apierrors.IsConflict(err) {
+		return fmt.Errorf("%w: %w", ErrConflict, err)
+	}
+	return err
+}
+
+func managedByPlugin(secret *corev1.Secret) bool {
+	return secret.Labels[managedByLabel] == managedByValue
+}
+
+func (s *Secrets) Load(domain string) (*Resource, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	name, err := s.secretName(domain)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := s.cache.get(ctx, name)
+	if apierrors.IsNotFound(err) {
+		s.cache.seen(name, nil)
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read secret for domain %s: %w", domain, err)
+	}
+	s.cache.seen(name, secret)
+	if !managedByPlugin(secret) {
+		if !s.adopt {
+			return nil, fmt.Errorf("unable to read secret for domain %s: %w", domain, s.events.notOwned(ctx, secret))
+		}
+		if _, ok := secret.Data[acmeResourceKey]; !ok {
+			// Obtained anew and stored over it.
+			return nil, ErrNotFound
+		}
+	}
 
 	meta, ok := secret.Data[acmeResourceKey]
 	if !ok {
-		return nil
+		return nil, fmt.Errorf("secret %s/%s has no %s", s.namespace, secret.Name, acmeResourceKey)
 	}
 
-	var resource certificate.Resource
+	var resource Resource
 	if err := json.Unmarshal(meta, &resource); err != nil {
-		return nil
+		return nil, fmt.Errorf("unable to unmarshal %s of secret %s/%s: %w", acmeResourceKey, s.namespace, secret.Name, err)
+	}
+	if s.replicas != nil {
+		s.replicas.start()
 	}
 
 	resource.Certificate = secret.Data[corev1.TLSCertKey]
 	resource.PrivateKey = secret.Data[corev1.TLSPrivateKeyKey]
-	return &resource
+	return &resource, nil
+}
+
+func (s *Secrets) List() ([]Entry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	list, err := s.client.CoreV1().Secrets(s.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: managedByLabel + "=" + managedByValue + ",!" + replicaOfLabel,
+		FieldSelector: "type=" + string(corev1.SecretTypeTLS),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list secrets in %s: %w", s.namespace, err)
+	}
+
+	var entries []Entry
+	for _, secret := range list.Items {
+		var resource Resource
+		if err := json.Unmarshal(secret.Data[acmeResourceKey], &resource); err != nil || resource.Domain == "" {
+			log.Warningf("skipping secret %s/%s: no readable %s", s.namespace, secret.Name, acmeResourceKey)
+			continue
+		}
+		resource.Certificate = secret.Data[corev1.TLSCertKey]
+		entries = append(entries, entryOf(&resource))
+	}
+	return entries, nil
+}
+
+func (s *Secrets) Delete(domain string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	name, err := s.secretName(domain)
+	if err != nil {
+		return err
+	}
+	s.cache.writing(name, secretWrite{deleted: true})
+	err = deleteSecret(ctx, s.client, s.namespace, name, s.cache.lastRead(name))
+	s.cache.written(name, err)
+	if err != nil {
+		return fmt.Errorf("unable to delete secret for domain %s: %w", domain, err)
+	}
+	s.cache.seen(name, nil)
+	if s.replicas != nil {
+		if err := s.replicas.prune(ctx, name); err != nil {
+			return fmt.Errorf("unable to delete the copies of the secret for domain %s: %w", domain, err)
+		}
+	}
+	return nil
+}
+
+// Watch reports the certificate Secrets someone else writes or deletes in the namespace, such as
+// another instance or a person. Writes of this instance and copies are not reported.
+func (s *Secrets) Watch(stop <-chan struct{}, changed func(domain string)) {
+	s.cache.subscribe(stop, func(secret *corev1.Secret) {
+		if domain, ok := domainOf(secret); ok {
+			changed(domain)
+		}
+	})
+}
+
+// Record records an Event on the Secret of domain, or on the configured object naming the domain.
+// The Secret may not exist yet, as when its first certificate can't be obtained; the Event then has
+// no UID, so kubectl lists it with get events but not with describe.
+func (s *Secrets) Record(domain string, warning bool, reason, message string) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	eventType := corev1.EventTypeNormal
+	if warning {
+		eventType = corev1.EventTypeWarning
+	}
+	if s.eventObject != nil {
+		ref := s.events.objectRef(ctx, s.eventObject.Kind, s.eventObject.Namespace, s.eventObject.Name)
+		s.events.record(ctx, ref, eventType, reason, fmt.Sprintf("certificate %s: %s", domain, message))
+		return
+	}
+	name, err := s.secretName(domain)
+	if err != nil {
+		log.Warningf("could not record event %s for domain %s: %v", reason, domain, err)
+		return
+	}
+	ref := corev1.ObjectReference{APIVersion: "v1", Kind: "Secret", Namespace: s.namespace, Name: name}
+	if secret, err := s.cache.get(ctx, name); err == nil {
+		ref = secretRef(secret)
+	}
+	s.events.record(ctx, ref, eventType, reason, message)
 }
 
 func secretName(domain string) string {
 	return strings.NewReplacer("*", "wildcard", ":", "-").Replace(strings.ToLower(domain))
 }
 
+// withEntries returns a copy of base with the entries of m added.
+func withEntries(base, m map[string]string) map[string]string {
+	out := maps.Clone(base)
+	if out == nil {
+		out = make(map[string]string, len(m))
+	}
+	maps.Copy(out, m)
+	return out
+}
+
 const accountKeyDataKey = "key.pem"
 
 type SecretsAccount struct {
-	client    kubernetes.Interface
-	namespace string
+	client      kubernetes.Interface
+	namespace   string
+	labels      map[string]string
+	annotations map[string]string
+	adopt       bool // take over an existing Secret not managed by the plugin
+	events      *eventRecorder
+	cache       *secretCache
 }
 
-func NewSecretsAccount(namespace string) (*SecretsAccount, error) {
+func NewSecretsAccount(o Options) (*SecretsAccount, error) {
 	cfg, err := restConfig()
 	if err != nil {
 		return nil, fmt.Errorf("could not build kubernetes client config: %w", err)
@@ -134,7 +424,23 @@ func NewSecretsAccount(namespace string) (*SecretsAccount, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not create kubernetes client: %w", err)
 	}
-	return &SecretsAccount{client: client, namespace: namespace}, nil
+	return newSecretsAccount(client, o)
+}
+
+func newSecretsAccount(client kubernetes.Interface, o Options) (*SecretsAccount, error) {
+	labels, annotations, err := secretMeta(o)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretsAccount{
+		client:      client,
+		namespace:   o.Namespace,
+		labels:      labels,
+		annotations: annotations,
+		adopt:       o.SecretAdopt,
+		events:      newEventRecorder(client),
+		cache:       newSecretCache(client, o.Namespace),
+	}, nil
 }
 
 func (s *SecretsAccount) SaveAccountKey(email string, keyPEM []byte) error {
@@ -142,36 +448,89 @@ func (s *SecretsAccount) SaveAccountKey(email string, keyPEM []byte) error {
 		ObjectMeta: metav1.ObjectMeta{
 			Name:        accountSecretName(email),
 			Namespace:   s.namespace,
-			Labels:      map[string]string{managedByLabel: managedByValue},
-			Annotations: map[string]string{"acmednschallenge/email": email},
+			Labels:      withEntries(s.labels, map[string]string{managedByLabel: managedByValue}),
+			Annotations: withEntries(s.annotations, map[string]string{accountEmailAnnotation: email}),
 		},
 		Type: corev1.SecretTypeOpaque,
 		Data: map[string][]byte{accountKeyDataKey: keyPEM},
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), k8sTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
 	defer cancel()
 
-	api := s.client.CoreV1().Secrets(s.namespace)
-	_, err := api.Update(ctx, secret, metav1.UpdateOptions{})
-	if apierrors.IsNotFound(err) {
-		_, err = api.Create(ctx, secret, metav1.CreateOptions{})
-	}
+	s.cache.writing(secret.Name, secretWrite{data: secret.Data})
+	stored, err := putSecret(ctx, s.client, s.events, secret, s.adopt, s.cache.lastRead(secret.Name))
+	s.cache.written(secret.Name, err)
 	if err != nil {
 		return fmt.Errorf("unable to save account key secret for %s: %w", email, err)
 	}
+	s.cache.seen(secret.Name, stored)
 	return nil
 }
 
-func (s *SecretsAccount) LoadAccountKey(email string) []byte {
-	ctx, cancel := context.WithTimeout(context.Background(), k8sTimeout)
+func (s *SecretsAccount) LoadAccountKey(email string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
 	defer cancel()
 
-	secret, err := s.client.CoreV1().Secrets(s.namespace).Get(ctx, accountSecretName(email), metav1.GetOptions{})
+	name := accountSecretName(email)
+	secret, err := s.cache.get(ctx, name)
+	if apierrors.IsNotFound(err) {
+		s.cache.seen(name, nil)
+		return nil, ErrNotFound
+	}
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("unable to read account key secret for %s: %w", email, err)
+	}
+	s.cache.seen(name, secret)
+	if !managedByPlugin(secret) {
+		if !s.adopt {
+			return nil, fmt.Errorf("unable to read account key secret for %s: %w", email, s.events.notOwned(ctx, secret))
+		}
+		if _, ok := secret.Data[accountKeyDataKey]; !ok {
+			return nil, ErrNotFound
+		}
 	}
-	return secret.Data[accountKeyDataKey]
+	key, ok := secret.Data[accountKeyDataKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s has no %s", s.namespace, secret.Name, accountKeyDataKey)
+	}
+	return key, nil
+}
+
+func (s *SecretsAccount) ListAccounts() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	list, err := s.client.CoreV1().Secrets(s.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: managedByLabel + "=" + managedByValue,
+		FieldSelector: "type=" + string(corev1.SecretTypeOpaque),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list account key secrets in %s: %w", s.namespace, err)
+	}
+
+	var emails []string
+	for _, secret := range list.Items {
+		if email := secret.Annotations[accountEmailAnnotation]; email != "" {
+			emails = append(emails, email)
+		}
+	}
+	return emails, nil
+}
+
+func (s *SecretsAccount) DeleteAccountKey(email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	name := accountSecretName(email)
+	s.cache.writing(name, secretWrite{deleted: true})
+	err := deleteSecret(ctx, s.client, s.namespace, name, s.cache.lastRead(name))
+	s.cache.written(name, err)
+	if err != nil {
+		return fmt.Errorf("unable to delete account key secret for %s: %w", email, err)
+	}
+	s.cache.seen(name, nil)
+	return nil
 }
 
 var invalidSecretNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
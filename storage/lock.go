@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	defaultLockTimeout = 30 * time.Second
+	// A lock older than this is stale even when its owner can't be checked, as on another host.
+	// Disk operations hold a lock for milliseconds, so only a crashed owner leaves one this old.
+	lockStaleAfter = 5 * time.Minute
+	lockPollMax    = time.Second
+)
+
+// lockInfo is the content of a lock file, identifying its owner.
+type lockInfo struct {
+	PID      int       `json:"pid"`
+	Hostname string    `json:"hostname"`
+	Created  time.Time `json:"created"`
+	Token    string    `json:"token"`
+}
+
+// LockTimeoutError is returned when a lock is still held by someone else after the lock timeout.
+type LockTimeoutError struct {
+	Path   string
+	Waited time.Duration
+	Owner  lockInfo
+}
+
+func (e *LockTimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s waiting for lock %s held by pid %d on %s since %s",
+		e.Waited, e.Path, e.Owner.PID, e.Owner.Hostname, e.Owner.Created.Format(time.RFC3339))
+}
+
+// fileLock is an advisory lock held as a file created with O_EXCL, which unlike flock also works
+// between hosts sharing the directory over NFS.
+type fileLock struct {
+	path  string
+	token string
+}
+
+// acquireLock takes the lock at path, waiting at most timeout for its owner to release it. Locks
+// whose owner died on this host, or that are older than lockStaleAfter, are broken.
+func acquireLock(path string, timeout time.Duration) (*fileLock, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("could not create lock directory: %w", err)
+	}
+
+	hostname, _ := os.Hostname()
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	info := lockInfo{PID: os.Getpid(), Hostname: hostname, Token: hex.EncodeToString(token)}
+
+	start := time.Now()
+	poll := 10 * time.Millisecond
+	for {
+		info.Created = time.Now()
+		created, err := createLockFile(path, info)
+		if err != nil {
+			return nil, fmt.Errorf("could not create lock %s: %w", path, err)
+		}
+		if created {
+			return &fileLock{path: path, token: info.Token}, nil
+		}
+
+		owner, err := readLockFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue // released in the meantime
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not read lock %s: %w", path, err)
+		}
+		if reason := staleReason(owner, hostname); reason != "" {
+			log.Warningf("breaking stale lock %s held by pid %d on %s: %s", path, owner.PID, owner.Hostname, reason)
+			if err := breakLock(path, owner, info.Token); err != nil {
+				return nil, fmt.Errorf("could not break stale lock %s: %w", path, err)
+			}
+			continue
+		}
+
+		waited := time.Since(start)
+		if waited >= timeout {
+			return nil, &LockTimeoutError{Path: path, Waited: waited.Round(time.Millisecond), Owner: owner}
+		}
+		time.Sleep(min(poll, timeout-waited))
+		poll = min(2*poll, lockPollMax)
+	}
+}
+
+// breakLock removes the stale lock at path held by owner. Another waiter may have broken it and taken
+// the lock since owner was read, so the lock is first renamed to a name of this waiter, token, and only
+// removed when it still is the one of owner; a lock taken in the meantime is put back.
+func breakLock(path string, owner lockInfo, token string) error {
+	broken := path + ".broken-" + token
+	if err := os.Rename(path, broken); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil // broken by another waiter
+		}
+		return err
+	}
+	if current, err := readLockFile(broken); err != nil || !sameOwner(current, owner) {
+		// A link fails instead of replacing a lock taken after the rename.
+		if err := os.Link(broken, path); err != nil {
+			log.Warningf("could not put back lock %s taken by another instance: %v", path, err)
+		}
+	}
+	return os.Remove(broken)
+}
+
+// sameOwner tells whether a and b identify the same holder of a lock.
+func sameOwner(a, b lockInfo) bool {
+	return a.Token == b.Token && a.PID == b.PID && a.Hostname == b.Hostname && a.Created.Equal(b.Created)
+}
+
+// release removes the lock, unless it was broken as stale and taken by someone else meanwhile.
+func (l *fileLock) release() {
+	owner, err := readLockFile(l.path)
+	if err != nil {
+		log.Warningf("could not release lock %s: %v", l.path, err)
+		return
+	}
+	if owner.Token != l.token {
+		log.Warningf("lock %s was taken over by pid %d on %s before it was released", l.path, owner.PID, owner.Hostname)
+		return
+	}
+	if err := os.Remove(l.path); err != nil {
+		log.Warningf("could not release lock %s: %v", l.path, err)
+	}
+}
+
+func createLockFile(path string, info lockInfo) (bool, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, fs.ErrExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = json.NewEncoder(f).Encode(info)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return false, err
+	}
+	return true, nil
+}
+
+// readLockFile returns the owner of the lock at path. A lock file that can't be parsed is being
+// written right now or was left half-written by a crash; it is returned without an owner, dated by
+// its modification time, so its age tells which.
+func readLockFile(path string) (lockInfo, error) {
+	var info lockInfo
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return info, err
+	}
+	if json.Unmarshal(raw, &info) != nil || info.Created.IsZero() {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return info, err
+		}
+		return lockInfo{Created: fi.ModTime()}, nil
+	}
+	return info, nil
+}
+
+// staleReason returns why the lock of owner is stale, or "" when it is held.
+func staleReason(owner lockInfo, hostname string) string {
+	if age := time.Since(owner.Created); age > lockStaleAfter {
+		return fmt.Sprintf("it is %s old", age.Round(time.Second))
+	}
+	if owner.PID > 0 && owner.Hostname == hostname && owner.PID != os.Getpid() && !processAlive(owner.PID) {
+		return "the process is gone"
+	}
+	return ""
+}
+
+// withLock runs fn holding the lock at path.
+func withLock(path string, timeout time.Duration, fn func() error) error {
+	l, err := acquireLock(path, timeout)
+	if err != nil {
+		return err
+	}
+	defer l.release()
+	return fn()
+}
@@ -0,0 +1,217 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certificate"
+)
+
+func writeLock(t *testing.T, path string, info lockInfo) {
+	t.Helper()
+	raw, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockExcludes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.com.lock")
+
+	var mu sync.Mutex
+	inside, peak := 0, 0
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := withLock(path, 10*time.Second, func() error {
+				mu.Lock()
+				inside++
+				peak = max(peak, inside)
+				mu.Unlock()
+				time.Sleep(5 * time.Millisecond)
+				mu.Lock()
+				inside--
+				mu.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak != 1 {
+		t.Errorf("%d holders at once, want 1", peak)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lock file left behind: %v", err)
+	}
+}
+
+func TestLockTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.com.lock")
+	writeLock(t, path, lockInfo{PID: 4242, Hostname: "other-host", Created: time.Now(), Token: "x"})
+
+	_, err := acquireLock(path, 50*time.Millisecond)
+	var timeout *LockTimeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("err = %v, want a LockTimeoutError", err)
+	}
+	if !strings.Contains(err.Error(), "pid 4242 on other-host") {
+		t.Errorf("error %q does not name the owner", err)
+	}
+}
+
+func TestLockBreaksStale(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		age     time.Duration
+	}{
+		{name: "old lock of another host", content: []byte(`{"pid":4242,"hostname":"other-host","created":"2020-01-01T00:00:00Z","token":"x"}`)},
+		{name: "old half-written lock", content: []byte(`{"pid":42`), age: time.Hour},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "example.com.lock")
+			if err := os.WriteFile(path, tc.content, 0600); err != nil {
+				t.Fatal(err)
+			}
+			if tc.age > 0 {
+				old := time.Now().Add(-tc.age)
+				if err := os.Chtimes(path, old, old); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			l, err := acquireLock(path, 50*time.Millisecond)
+			if err != nil {
+				t.Fatalf("acquireLock: %v", err)
+			}
+			l.release()
+		})
+	}
+}
+
+func TestLockStaleRace(t *testing.T) {
+	dir := t.TempDir()
+	for round := 0; round < 20; round++ {
+		path := filepath.Join(dir, "example.com.lock")
+		writeLock(t, path, lockInfo{PID: 4242, Hostname: "other-host", Created: time.Now().Add(-time.Hour), Token: "stale"})
+
+		// The waiters all find the stale lock, and each breaks it unless another one took it already.
+		var mu sync.Mutex
+		inside, peak := 0, 0
+		start := make(chan struct{})
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				err := withLock(path, 10*time.Second, func() error {
+					mu.Lock()
+					inside++
+					peak = max(peak, inside)
+					mu.Unlock()
+					time.Sleep(20 * time.Millisecond)
+					mu.Lock()
+					inside--
+					mu.Unlock()
+					return nil
+				})
+				if err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if peak != 1 {
+			t.Fatalf("round %d: %d holders at once after breaking a stale lock, want 1", round, peak)
+		}
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "*")); len(left) != 0 {
+		t.Errorf("files left behind: %v", left)
+	}
+}
+
+func TestLockReleaseKeepsLockTakenOver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.com.lock")
+	l, err := acquireLock(path, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another instance broke our lock as stale and holds it now.
+	writeLock(t, path, lockInfo{PID: 4242, Hostname: "other-host", Created: time.Now(), Token: "theirs"})
+
+	l.release()
+
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("the other instance's lock was removed: %v", err)
+	}
+}
+
+func TestDiskSaveWaitsForLock(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDisk(dir, "", 0600, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lock := s.files("example.com").lock
+	writeLock(t, lock, lockInfo{PID: 4242, Hostname: "other-host", Created: time.Now(), Token: "x"})
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		os.Remove(lock)
+	}()
+
+	start := time.Now()
+	if err := s.Save(&Resource{Resource: certificate.Resource{Domain: "example.com"}}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("Save did not wait for the lock")
+	}
+}
+
+func TestDiskLoadDoesNotWaitForLock(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewDisk(dir, "", 0600, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(&Resource{Resource: certificate.Resource{Domain: "example.com", PrivateKey: []byte("k")}}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	a := &DiskAccount{dataPath: dir}
+	if err := a.SaveAccountKey("me@example.com", []byte("k")); err != nil {
+		t.Fatalf("SaveAccountKey: %v", err)
+	}
+	// Held by a writer on another host for the whole test.
+	writeLock(t, s.files("example.com").lock, lockInfo{PID: 4242, Hostname: "other-host", Created: time.Now(), Token: "x"})
+	writeLock(t, a.lockPath("me@example.com"), lockInfo{PID: 4242, Hostname: "other-host", Created: time.Now(), Token: "x"})
+
+	start := time.Now()
+	if _, err := s.Load("example.com"); err != nil {
+		t.Errorf("Load: %v", err)
+	}
+	if _, err := a.LoadAccountKey("me@example.com"); err != nil {
+		t.Errorf("LoadAccountKey: %v", err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("reads waited %s for the lock of a writer", waited)
+	}
+}
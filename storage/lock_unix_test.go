@@ -0,0 +1,27 @@
+//go:build unix
+
+package storage
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockBreaksLockOfDeadProcess(t *testing.T) {
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skipf("cannot run true: %v", err)
+	}
+	hostname, _ := os.Hostname()
+	path := filepath.Join(t.TempDir(), "example.com.lock")
+	writeLock(t, path, lockInfo{PID: cmd.Process.Pid, Hostname: hostname, Created: time.Now(), Token: "x"})
+
+	l, err := acquireLock(path, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("acquireLock: %v", err)
+	}
+	l.release()
+}
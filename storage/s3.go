@@ -0,0 +1,263 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// Objects of one certificate, named like the fields of the Vault entries.
+const (
+	s3CertObject     = "tls.crt"
+	s3KeyObject      = "tls.key"
+	s3MetaObject     = "acme.json"
+	s3AccountKeyName = "key.pem"
+)
+
+// s3Bucket is a prefix in an S3 bucket, with the server-side encryption applied to every write.
+type s3Bucket struct {
+	client   *s3.Client
+	bucket   string
+	prefix   string
+	sse      types.ServerSideEncryption
+	kmsKeyID string
+}
+
+// newS3Bucket creates a client from the standard AWS configuration.
+func newS3Bucket(o Options) (*s3Bucket, error) {
+	cfg, err := loadAWSConfig(o.S3Region, o.S3CredentialsFile, o.S3Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	client := s3.NewFromConfig(cfg, func(so *s3.Options) {
+		if o.S3Endpoint != "" {
+			so.BaseEndpoint = aws.String(o.S3Endpoint)
+		}
+		so.UsePathStyle = o.S3PathStyle
+	})
+	return &s3Bucket{
+		client:   client,
+		bucket:   o.S3Bucket,
+		prefix:   o.S3Prefix,
+		sse:      types.ServerSideEncryption(o.S3SSE),
+		kmsKeyID: o.S3KMSKeyID,
+	}, nil
+}
+
+func (b *s3Bucket) key(dir, name string) string {
+	return path.Join(b.prefix, dir, name)
+}
+
+func (b *s3Bucket) put(key string, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	in := &s3.PutObjectInput{Bucket: aws.String(b.bucket), Key: aws.String(key), Body: bytes.NewReader(data)}
+	if b.sse != "" {
+		in.ServerSideEncryption = b.sse
+	}
+	if b.kmsKeyID != "" {
+		in.SSEKMSKeyId = aws.String(b.kmsKeyID)
+	}
+	_, err := b.client.PutObject(ctx, in)
+	return err
+}
+
+// get returns the object at key, or ErrNotFound.
+func (b *s3Bucket) get(key string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	out, err := b.client.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String(b.bucket), Key: aws.String(key)})
+	if isS3NotFound(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return io.ReadAll(out.Body)
+}
+
+func (b *s3Bucket) delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := b.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(b.bucket), Key: aws.String(key)})
+	if isS3NotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// dirsWith returns the directories below the prefix holding an object called name.
+func (b *s3Bucket) dirsWith(name string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	prefix := ""
+	if b.prefix != "" {
+		prefix = strings.TrimSuffix(b.prefix, "/") + "/"
+	}
+	var dirs []string
+	pages := s3.NewListObjectsV2Paginator(b.client, &s3.ListObjectsV2Input{Bucket: aws.String(b.bucket), Prefix: aws.String(prefix)})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			dir, file := path.Split(strings.TrimPrefix(aws.ToString(obj.Key), prefix))
+			if file == name && dir != "" && !strings.Contains(strings.TrimSuffix(dir, "/"), "/") {
+				dirs = append(dirs, strings.TrimSuffix(dir, "/"))
+			}
+		}
+	}
+	return dirs, nil
+}
+
+func isS3NotFound(err error) bool {
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return true
+	}
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && (apiErr.ErrorCode() == "NoSuchKey" || apiErr.ErrorCode() == "NotFound")
+}
+
+// S3Certs stores every certificate as the objects PREFIX/<domain>/tls.crt, tls.key and acme.json.
+type S3Certs struct {
+	bucket *s3Bucket
+}
+
+func NewS3Certs(o Options) (*S3Certs, error) {
+	b, err := newS3Bucket(o)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Certs{bucket: b}, nil
+}
+
+// Save writes acme.json last, so a certificate only exists once all of its objects do.
+func (s *S3Certs) Save(certs *Resource) error {
+	meta, err := json.Marshal(certs)
+	if err != nil {
+		return fmt.Errorf("unable to marshal CertResource for domain %s: %w", certs.Domain, err)
+	}
+	dir := sanitizedDomain(certs.Domain)
+	for _, obj := range []struct {
+		name string
+		data []byte
+	}{
+		{s3CertObject, certs.Certificate},
+		{s3KeyObject, certs.PrivateKey},
+		{s3MetaObject, meta},
+	} {
+		if err := s.bucket.put(s.bucket.key(dir, obj.name), obj.data); err != nil {
+			return fmt.Errorf("unable to save %s for domain %s to s3: %w", obj.name, certs.Domain, err)
+		}
+	}
+	return nil
+}
+
+func (s *S3Certs) Load(domain string) (*Resource, error) {
+	dir := sanitizedDomain(domain)
+	meta, err := s.bucket.get(s.bucket.key(dir, s3MetaObject))
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate for domain %s from s3: %w", domain, err)
+	}
+	var resource Resource
+	if err := json.Unmarshal(meta, &resource); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal %s of domain %s: %w", s3MetaObject, domain, err)
+	}
+	if resource.Certificate, err = s.bucket.get(s.bucket.key(dir, s3CertObject)); err != nil {
+		return nil, fmt.Errorf("unable to read %s for domain %s from s3: %w", s3CertObject, domain, err)
+	}
+	if resource.PrivateKey, err = s.bucket.get(s.bucket.key(dir, s3KeyObject)); err != nil {
+		return nil, fmt.Errorf("unable to read %s for domain %s from s3: %w", s3KeyObject, domain, err)
+	}
+	return &resource, nil
+}
+
+func (s *S3Certs) List() ([]Entry, error) {
+	dirs, err := s.bucket.dirsWith(s3MetaObject)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list certificates in s3: %w", err)
+	}
+	var entries []Entry
+	for _, dir := range dirs {
+		certs, err := s.Load(dir)
+		if err != nil {
+			log.Warningf("skipping s3 certificate %s: %v", dir, err)
+			continue
+		}
+		entries = append(entries, entryOf(certs))
+	}
+	return entries, nil
+}
+
+func (s *S3Certs) Delete(domain string) error {
+	dir := sanitizedDomain(domain)
+	for _, name := range []string{s3MetaObject, s3KeyObject, s3CertObject} {
+		if err := s.bucket.delete(s.bucket.key(dir, name)); err != nil {
+			return fmt.Errorf("unable to delete certificate for domain %s from s3: %w", domain, err)
+		}
+	}
+	return nil
+}
+
+// S3Account stores every account key as the object PREFIX/<email>/key.pem.
+type S3Account struct {
+	bucket *s3Bucket
+}
+
+func NewS3Account(o Options) (*S3Account, error) {
+	b, err := newS3Bucket(o)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Account{bucket: b}, nil
+}
+
+func (a *S3Account) SaveAccountKey(email string, keyPEM []byte) error {
+	if err := a.bucket.put(a.bucket.key(strings.ToLower(email), s3AccountKeyName), keyPEM); err != nil {
+		return fmt.Errorf("unable to save account key for %s to s3: %w", email, err)
+	}
+	return nil
+}
+
+func (a *S3Account) LoadAccountKey(email string) ([]byte, error) {
+	keyPEM, err := a.bucket.get(a.bucket.key(strings.ToLower(email), s3AccountKeyName))
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, fmt.Errorf("unable to read account key for %s from s3: %w", email, err)
+	}
+	return keyPEM, err
+}
+
+func (a *S3Account) ListAccounts() ([]string, error) {
+	emails, err := a.bucket.dirsWith(s3AccountKeyName)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list account keys in s3: %w", err)
+	}
+	return emails, nil
+}
+
+func (a *S3Account) DeleteAccountKey(email string) error {
+	if err := a.bucket.delete(a.bucket.key(strings.ToLower(email), s3AccountKeyName)); err != nil {
+		return fmt.Errorf("unable to delete account key for %s from s3: %w", email, err)
+	}
+	return nil
+}
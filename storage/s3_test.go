@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-acme/lego/v4/certificate"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+// newTestS3 starts an in-process S3 server with the bucket "certs" and returns the options to reach it
+// with static credentials from a credentials file.
+func newTestS3(t *testing.T) (Options, gofakes3.Backend) {
+	t.Helper()
+	backend := s3mem.New()
+	if err := backend.CreateBucket("certs"); err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(gofakes3.New(backend).Server())
+	t.Cleanup(srv.Close)
+
+	creds := filepath.Join(t.TempDir(), "credentials")
+	if err := os.WriteFile(creds, []byte("[default]\naws_access_key_id = test\naws_secret_access_key = test\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	return Options{Type: "s3", S3Bucket: "certs", S3Prefix: "coredns", S3Endpoint: srv.URL, S3PathStyle: true, S3CredentialsFile: creds}, backend
+}
+
+func TestS3CertsRoundTrip(t *testing.T) {
+	o, backend := newTestS3(t)
+	s, err := New(o)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if _, err := s.Load("example.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Load of a missing certificate = %v, want ErrNotFound", err)
+	}
+
+	in := &Resource{
+		Resource: certificate.Resource{Domain: "*.example.com", Certificate: []byte("cert"), PrivateKey: []byte("key")},
+		CADirURL: "https://ca.example/directory",
+	}
+	if err := s.Save(in); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	for _, name := range []string{"tls.crt", "tls.key", "acme.json"} {
+		if _, err := backend.HeadObject("certs", "coredns/_.example.com/"+name); err != nil {
+			t.Errorf("object %s: %v", name, err)
+		}
+	}
+
+	out, err := s.Load("*.example.com")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !bytes.Equal(out.Certificate, in.Certificate) || !bytes.Equal(out.PrivateKey, in.PrivateKey) || out.CADirURL != in.CADirURL {
+		t.Errorf("Load = %+v, want %+v", out, in)
+	}
+}
+
+func TestS3CertsListDelete(t *testing.T) {
+	o, backend := newTestS3(t)
+	s, err := New(o)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for _, domain := range []string{"a.example.com", "b.example.com"} {
+		if err := s.Save(&Resource{Resource: certificate.Resource{Domain: domain, Certificate: []byte("cert"), PrivateKey: []byte("key")}}); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	// Objects outside the layout are ignored.
+	if _, err := backend.PutObject("certs", "coredns/acme.json", nil, bytes.NewReader(nil), 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(list) != 2 || list[0].Domain != "a.example.com" || list[1].Domain != "b.example.com" {
+		t.Errorf("List = %v, want a.example.com and b.example.com", list)
+	}
+
+	if err := s.Delete("a.example.com"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := s.Delete("a.example.com"); err != nil {
+		t.Errorf("Delete of a deleted certificate: %v", err)
+	}
+	if _, err := s.Load("a.example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Load after Delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestS3AccountRoundTrip(t *testing.T) {
+	o, _ := newTestS3(t)
+	a, err := NewAccount(o)
+	if err != nil {
+		t.Fatalf("NewAccount: %v", err)
+	}
+
+	if _, err := a.LoadAccountKey("me@test.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("LoadAccountKey of a missing key = %v, want ErrNotFound", err)
+	}
+	if err := a.SaveAccountKey("Me@Test.com", []byte("key")); err != nil {
+		t.Fatalf("SaveAccountKey: %v", err)
+	}
+	if key, err := a.LoadAccountKey("me@test.com"); err != nil || string(key) != "key" {
+		t.Errorf("LoadAccountKey = %q, %v; want key", key, err)
+	}
+	if emails, err := a.ListAccounts(); err != nil || len(emails) != 1 || emails[0] != "me@test.com" {
+		t.Errorf("ListAccounts = %v, %v; want me@test.com", emails, err)
+	}
+	if err := a.DeleteAccountKey("me@test.com"); err != nil {
+		t.Fatalf("DeleteAccountKey: %v", err)
+	}
+	if _, err := a.LoadAccountKey("me@test.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LoadAccountKey after delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestS3Unreachable(t *testing.T) {
+	o, _ := newTestS3(t)
+	o.S3Endpoint = "http://127.0.0.1:1"
+	t.Setenv("AWS_MAX_ATTEMPTS", "1")
+	s, err := New(o)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := s.Load("example.com"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Load from an unreachable endpoint = %v, want a storage error", err)
+	}
+}
@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager/types"
+	"github.com/aws/smithy-go"
+)
+
+const (
+	// Staging labels Secrets Manager moves on every new version: the new one becomes AWSCURRENT and the
+	// one it replaces AWSPREVIOUS.
+	awsCurrent  = "AWSCURRENT"
+	awsPrevious = "AWSPREVIOUS"
+
+	// secretsManagerTag marks the secrets the plugin created, like managedByLabel on Kubernetes.
+	secretsManagerTag = "managed-by"
+)
+
+// secretsManager is a name prefix in AWS Secrets Manager, with the KMS key and tags of the secrets
+// created below it.
+type secretsManager struct {
+	client   *secretsmanager.Client
+	prefix   string
+	kmsKeyID string
+	tags     []types.Tag
+}
+
+func newSecretsManager(o Options) (*secretsManager, error) {
+	cfg, err := loadAWSConfig(o.SecretsManagerRegion, o.SecretsManagerCredentialsFile, o.SecretsManagerEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	client := secretsmanager.NewFromConfig(cfg, func(so *secretsmanager.Options) {
+		if o.SecretsManagerEndpoint != "" {
+			so.BaseEndpoint = aws.String(o.SecretsManagerEndpoint)
+		}
+	})
+	values, err := url.ParseQuery(o.SecretsManagerTags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secrets manager tags: %w", err)
+	}
+	tags := []types.Tag{{Key: aws.String(secretsManagerTag), Value: aws.String(managedByValue)}}
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		tags = append(tags, types.Tag{Key: aws.String(key), Value: aws.String(values.Get(key))})
+	}
+	return &secretsManager{client: client, prefix: o.SecretsManagerPrefix, kmsKeyID: o.SecretsManagerKMSKeyID, tags: tags}, nil
+}
+
+func (m *secretsManager) name(key string) string {
+	return path.Join(m.prefix, key)
+}
+
+// put stores value as the new AWSCURRENT version of the secret name, creating the secret when it
+// doesn't exist and restoring it when it is scheduled for deletion. A secret the plugin didn't create,
+// one without its managed-by tag, is never written and ErrNotOwned is returned.
+func (m *secretsManager) put(name string, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	for attempt := 0; ; attempt++ {
+		secret, err := m.client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(name)})
+		if isSecretsManagerError(err, "ResourceNotFoundException") && attempt == 0 {
+			_, err = m.client.CreateSecret(ctx, &secretsmanager.CreateSecretInput{
+				Name:         aws.String(name),
+				Description:  aws.String("Managed by the CoreDNS acmednschallenge plugin"),
+				SecretString: aws.String(string(value)),
+				KmsKeyId:     m.kmsKeyIDOrNil(),
+				Tags:         m.tags,
+			})
+			if !isSecretsManagerError(err, "ResourceExistsException") {
+				return err
+			}
+			continue // created in the meantime; add our version to it when it is the plugin's
+		}
+		if err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(secret.Tags, func(tag types.Tag) bool {
+			return aws.ToString(tag.Key) == secretsManagerTag && aws.ToString(tag.Value) == managedByValue
+		}) {
+			return fmt.Errorf("%w: secret %s is not tagged %s=%s", ErrNotOwned, name, secretsManagerTag, managedByValue)
+		}
+		if secret.DeletedDate != nil {
+			if _, err := m.client.RestoreSecret(ctx, &secretsmanager.RestoreSecretInput{SecretId: aws.String(name)}); err != nil {
+				return err
+			}
+		}
+		_, err = m.client.PutSecretValue(ctx, &secretsmanager.PutSecretValueInput{
+			SecretId:      aws.String(name),
+			SecretString:  aws.String(string(value)),
+			VersionStages: []string{awsCurrent},
+		})
+		return err
+	}
+}
+
+func (m *secretsManager) kmsKeyIDOrNil() *string {
+	if m.kmsKeyID == "" {
+		return nil
+	}
+	return aws.String(m.kmsKeyID)
+}
+
+// get passes the AWSCURRENT version of the secret name to parse. When parse rejects it, for example
+// after someone else wrote a value of their own, the AWSPREVIOUS version is passed instead, and the
+// error of the current one is returned when that fails too. ErrNotFound is returned when there is no
+// secret or it is scheduled for deletion.
+func (m *secretsManager) get(name string, parse func(value []byte) error) error {
+	value, err := m.getStage(name, awsCurrent)
+	if err != nil {
+		return err
+	}
+	currentErr := parse(value)
+	if currentErr == nil {
+		return nil
+	}
+	if value, err = m.getStage(name, awsPrevious); err != nil || parse(value) != nil {
+		return currentErr
+	}
+	log.Warningf("could not read the %s version of secret %s, using %s: %v", awsCurrent, name, awsPrevious, currentErr)
+	return nil
+}
+
+// getStage returns the version of the secret name labelled stage.
+func (m *secretsManager) getStage(name, stage string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	out, err := m.client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId:     aws.String(name),
+		VersionStage: aws.String(stage),
+	})
+	if isSecretsManagerError(err, "ResourceNotFoundException") {
+		return nil, ErrNotFound
+	}
+	if isSecretsManagerError(err, "InvalidRequestException") && m.scheduledForDeletion(ctx, name) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(aws.ToString(out.SecretString)), nil
+}
+
+func (m *secretsManager) scheduledForDeletion(ctx context.Context, name string) bool {
+	out, err := m.client.DescribeSecret(ctx, &secretsmanager.DescribeSecretInput{SecretId: aws.String(name)})
+	return err == nil && out.DeletedDate != nil
+}
+
+// delete schedules the secret name for deletion after the default recovery window, so it can still
+// be restored. Deleting a secret that doesn't exist is not an error.
+func (m *secretsManager) delete(name string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := m.client.DeleteSecret(ctx, &secretsmanager.DeleteSecretInput{SecretId: aws.String(name)})
+	if isSecretsManagerError(err, "ResourceNotFoundException") || (isSecretsManagerError(err, "InvalidRequestException") && m.scheduledForDeletion(ctx, name)) {
+		return nil
+	}
+	return err
+}
+
+// list returns the names below the prefix, relative to it, of the secrets the plugin created. Secrets
+// scheduled for deletion are left out.
+func (m *secretsManager) list() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	dir := ""
+	filters := []types.Filter{{Key: types.FilterNameStringTypeTagKey, Values: []string{secretsManagerTag}}}
+	if m.prefix != "" {
+		dir = strings.TrimSuffix(m.prefix, "/") + "/"
+		filters = append(filters, types.Filter{Key: types.FilterNameStringTypeName, Values: []string{dir}})
+	}
+	var names []string
+	pages := secretsmanager.NewListSecretsPaginator(m.client, &secretsmanager.ListSecretsInput{Filters: filters})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, secret := range page.SecretList {
+			name, ok := strings.CutPrefix(aws.ToString(secret.Name), dir)
+			if ok && name != "" && !strings.Contains(name, "/") && secret.DeletedDate == nil {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+func isSecretsManagerError(err error, code string) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorCode() == code
+}
+
+// SecretsManagerCerts stores every certificate as the secret PREFIX/<domain>, holding the fields of a
+// Vault entry as JSON. Every save adds a version, and the one it replaces stays as AWSPREVIOUS.
+type SecretsManagerCerts struct {
+	secrets *secretsManager
+}
+
+func NewSecretsManagerCerts(o Options) (*SecretsManagerCerts, error) {
+	m, err := newSecretsManager(o)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretsManagerCerts{secrets: m}, nil
+}
+
+func (s *SecretsManagerCerts) Save(certs *Resource) error {
+	data, err := certToVaultData(certs)
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("unable to marshal certificate for domain %s: %w", certs.Domain, err)
+	}
+	if err := s.secrets.put(s.secrets.name(sanitizedDomain(certs.Domain)), value); err != nil {
+		return fmt.Errorf("unable to save certificate for domain %s to secrets manager: %w", certs.Domain, err)
+	}
+	return nil
+}
+
+func (s *SecretsManagerCerts) Load(domain string) (*Resource, error) {
+	var certs *Resource
+	err := s.secrets.get(s.secrets.name(sanitizedDomain(domain)), func(value []byte) error {
+		var data map[string]interface{}
+		if err := json.Unmarshal(value, &data); err != nil {
+			return fmt.Errorf("unable to unmarshal secret of domain %s: %w", domain, err)
+		}
+		var err error
+		certs, err = vaultDataToCert(data)
+		return err
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate for domain %s from secrets manager: %w", domain, err)
+	}
+	return certs, nil
+}
+
+// List reads every secret below the prefix. Account keys sharing the prefix are left out, as they
+// have no acme.json.
+func (s *SecretsManagerCerts) List() ([]Entry, error) {
+	names, err := s.secrets.list()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list certificates in secrets manager: %w", err)
+	}
+	var entries []Entry
+	for _, name := range names {
+		certs, err := s.Load(name)
+		if err != nil {
+			log.Debugf("skipping secret %s: %v", name, err)
+			continue
+		}
+		entries = append(entries, entryOf(certs))
+	}
+	return entries, nil
+}
+
+func (s *SecretsManagerCerts) Delete(domain string) error {
+	if err := s.secrets.delete(s.secrets.name(sanitizedDomain(domain))); err != nil {
+		return fmt.Errorf("unable to delete certificate for domain %s from secrets manager: %w", domain, err)
+	}
+	return nil
+}
+
+// SecretsManagerAccount stores every account key as the secret PREFIX/<email>, holding the fields of
+// a Vault entry as JSON.
+type SecretsManagerAccount struct {
+	secrets *secretsManager
+}
+
+func NewSecretsManagerAccount(o Options) (*SecretsManagerAccount, error) {
+	m, err := newSecretsManager(o)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretsManagerAccount{secrets: m}, nil
+}
+
+func (a *SecretsManagerAccount) SaveAccountKey(email string, keyPEM []byte) error {
+	value, err := json.Marshal(map[string]string{vaultAccountKeyField: string(keyPEM)})
+	if err != nil {
+		return err
+	}
+	if err := a.secrets.put(a.secrets.name(strings.ToLower(email)), value); err != nil {
+		return fmt.Errorf("unable to save account key for %s to secrets manager: %w", email, err)
+	}
+	return nil
+}
+
+func (a *SecretsManagerAccount) LoadAccountKey(email string) ([]byte, error) {
+	var key []byte
+	err := a.secrets.get(a.secrets.name(strings.ToLower(email)), func(value []byte) error {
+		var data map[string]string
+		if err := json.Unmarshal(value, &data); err != nil {
+			return fmt.Errorf("unable to unmarshal secret of %s: %w", email, err)
+		}
+		if data[vaultAccountKeyField] == "" {
+			return fmt.Errorf("secret of %s has no %s", email, vaultAccountKeyField)
+		}
+		key = []byte(data[vaultAccountKeyField])
+		return nil
+	})
+	if errors.Is(err, ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read account key for %s from secrets manager: %w", email, err)
+	}
+	return key, nil
+}
+
+// ListAccounts returns the secrets below the prefix holding an account key.
+func (a *SecretsManagerAccount) ListAccounts() ([]string, error) {
+	names, err := a.secrets.list()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list account keys in secrets manager: %w", err)
+	}
+	var emails []string
+	for _, name := range names {
+		if _, err := a.LoadAccountKey(name); err == nil {
+			emails = append(emails, name)
+		}
+	}
+	return emails, nil
+}
+
+func (a *SecretsManagerAccount) DeleteAccountKey(email string) error {
+	if err := a.secrets.delete(a.secrets.name(strings.ToLower(email))); err != nil {
+		return fmt.Errorf("unable to delete account key for %s from secrets manager: %w", email, err)
+	}
+	return nil
+}
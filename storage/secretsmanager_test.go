@@ -0,0 +1,386 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certificate"
+)
+
+// fakeSecret is a secret of fakeSecretsManager with its versions, oldest first.
+type fakeSecret struct {
+	kmsKeyID string
+	tags     map[string]string
+	versions []fakeSecretVersion
+	deleted  bool
+}
+
+type fakeSecretVersion struct {
+	value  string
+	stages []string
+}
+
+// fakeSecretsManager implements the operations of the Secrets Manager JSON API the storage uses,
+// moving AWSCURRENT and AWSPREVIOUS like the service does.
+type fakeSecretsManager struct {
+	mu      sync.Mutex
+	secrets map[string]*fakeSecret
+}
+
+func (f *fakeSecretsManager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var in struct {
+		Name, SecretId, SecretString, KmsKeyId, VersionStage string
+		VersionStages                                        []string
+		Tags                                                 []struct{ Key, Value string }
+		Filters                                              []struct {
+			Key    string
+			Values []string
+		}
+	}
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		fakeSecretsManagerError(w, "InvalidParameterException", err.Error())
+		return
+	}
+	op := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "secretsmanager.")
+	secret, ok := f.secrets[in.SecretId]
+	if !ok && op != "CreateSecret" && op != "ListSecrets" {
+		fakeSecretsManagerError(w, "ResourceNotFoundException", "Secrets Manager can't find the specified secret.")
+		return
+	}
+	if ok && secret.deleted && (op == "PutSecretValue" || op == "GetSecretValue" || op == "DeleteSecret") {
+		fakeSecretsManagerError(w, "InvalidRequestException", "the secret is marked for deletion")
+		return
+	}
+	out := map[string]any{}
+	switch op {
+	case "CreateSecret":
+		if _, ok := f.secrets[in.Name]; ok {
+			fakeSecretsManagerError(w, "ResourceExistsException", "the secret already exists")
+			return
+		}
+		secret := &fakeSecret{kmsKeyID: in.KmsKeyId, tags: map[string]string{}}
+		for _, tag := range in.Tags {
+			secret.tags[tag.Key] = tag.Value
+		}
+		secret.put(in.SecretString)
+		f.secrets[in.Name] = secret
+		out["Name"] = in.Name
+	case "PutSecretValue":
+		secret.put(in.SecretString)
+	case "GetSecretValue":
+		stage := in.VersionStage
+		if stage == "" {
+			stage = awsCurrent
+		}
+		for _, v := range secret.versions {
+			if slices.Contains(v.stages, stage) {
+				out["SecretString"] = v.value
+			}
+		}
+		if out["SecretString"] == nil {
+			fakeSecretsManagerError(w, "ResourceNotFoundException", "no version with stage "+stage)
+			return
+		}
+	case "DescribeSecret":
+		if secret.deleted {
+			out["DeletedDate"] = float64(time.Now().Unix())
+		}
+		var tags []map[string]string
+		for _, key := range slices.Sorted(maps.Keys(secret.tags)) {
+			tags = append(tags, map[string]string{"Key": key, "Value": secret.tags[key]})
+		}
+		out["Tags"] = tags
+	case "DeleteSecret":
+		secret.deleted = true
+	case "RestoreSecret":
+		secret.deleted = false
+	case "ListSecrets":
+		var list []map[string]any
+		for _, name := range slices.Sorted(maps.Keys(f.secrets)) {
+			if f.matches(name, in.Filters) {
+				entry := map[string]any{"Name": name}
+				if f.secrets[name].deleted {
+					entry["DeletedDate"] = float64(time.Now().Unix())
+				}
+				list = append(list, entry)
+			}
+		}
+		out["SecretList"] = list
+	default:
+		fakeSecretsManagerError(w, "InvalidAction", op)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	_ = json.NewEncoder(w).Encode(out)
+}
+
+// put adds a version labelled AWSCURRENT, moving AWSPREVIOUS to the version it replaces.
+func (s *fakeSecret) put(value string) {
+	for i := range s.versions {
+		s.versions[i].stages = slices.DeleteFunc(s.versions[i].stages, func(stage string) bool { return stage == awsPrevious })
+		if slices.Contains(s.versions[i].stages, awsCurrent) {
+			s.versions[i].stages = []string{awsPrevious}
+		}
+	}
+	s.versions = append(s.versions, fakeSecretVersion{value: value, stages: []string{awsCurrent}})
+}
+
+func (f *fakeSecretsManager) matches(name string, filters []struct {
+	Key    string
+	Values []string
+}) bool {
+	for _, filter := range filters {
+		switch filter.Key {
+		case "name":
+			if !strings.HasPrefix(name, filter.Values[0]) {
+				return false
+			}
+		case "tag-key":
+			if _, ok := f.secrets[name].tags[filter.Values[0]]; !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func fakeSecretsManagerError(w http.ResponseWriter, code, message string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, `{"__type":%q,"message":%q}`, code, message)
+}
+
+// newTestSecretsManager starts a fakeSecretsManager and returns the options to reach it with static
+// credentials from a credentials file.
+func newTestSecretsManager(t *testing.T) (Options, *fakeSecretsManager) {
+	t.Helper()
+	fake := &fakeSecretsManager{secrets: map[string]*fakeSecret{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	creds := filepath.Join(t.TempDir(), "credentials")
+	if err := os.WriteFile(creds, []byte("[default]\naws_access_key_id = test\naws_secret_access_key = test\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_PROFILE", "")
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "")
+	return Options{
+		Type:                          "awsSecretsManager",
+		SecretsManagerPrefix:          "coredns",
+		SecretsManagerEndpoint:        srv.URL,
+		SecretsManagerCredentialsFile: creds,
+		SecretsManagerKMSKeyID:        "alias/coredns",
+		SecretsManagerTags:            "team=dns",
+	}, fake
+}
+
+func TestSecretsManagerCertsRoundTrip(t *testing.T) {
+	o, fake := newTestSecretsManager(t)
+	s, err := New(o)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+
+	if _, err := s.Load("example.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Load of a missing certificate = %v, want ErrNotFound", err)
+	}
+
+	for _, cert := range []string{"first", "second"} {
+		in := &Resource{
+			Resource: certificate.Resource{Domain: "*.example.com", Certificate: []byte(cert), PrivateKey: []byte("key")},
+			CADirURL: "https://ca.example/directory",
+		}
+		if err := s.Save(in); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+		out, err := s.Load("*.example.com")
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		if string(out.Certificate) != cert || string(out.PrivateKey) != "key" || out.CADirURL != in.CADirURL {
+			t.Errorf("Load = %+v, want %+v", out, in)
+		}
+	}
+
+	secret := fake.secrets["coredns/_.example.com"]
+	if secret == nil {
+		t.Fatalf("no secret coredns/_.example.com in %v", fake.secrets)
+	}
+	if secret.kmsKeyID != "alias/coredns" || secret.tags["team"] != "dns" || secret.tags["managed-by"] != managedByValue {
+		t.Errorf("secret created with key %q and tags %v", secret.kmsKeyID, secret.tags)
+	}
+	if len(secret.versions) != 2 || !slices.Contains(secret.versions[0].stages, awsPrevious) {
+		t.Fatalf("versions = %+v, want the first one labelled %s", secret.versions, awsPrevious)
+	}
+	var previous map[string]any
+	if err := json.Unmarshal([]byte(secret.versions[0].value), &previous); err != nil {
+		t.Fatal(err)
+	}
+	if previous["tls.crt"] != "first" || previous["tls.key"] != "key" || previous["acme.json"] == nil {
+		t.Errorf("previous version = %v, want the Vault fields of the first certificate", previous)
+	}
+}
+
+func TestSecretsManagerCertsPreviousVersion(t *testing.T) {
+	o, fake := newTestSecretsManager(t)
+	s, err := New(o)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Save(&Resource{Resource: certificate.Resource{Domain: "example.com", Certificate: []byte("cert"), PrivateKey: []byte("key")}}); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// Someone writes a value of their own over it.
+	fake.secrets["coredns/example.com"].put(`{"certificate":"theirs"}`)
+	out, err := s.Load("example.com")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if string(out.Certificate) != "cert" {
+		t.Errorf("Load = %q, want the %s version", out.Certificate, awsPrevious)
+	}
+
+	fake.secrets["coredns/example.com"].put("garbage")
+	if _, err := s.Load("example.com"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Load without a readable version = %v, want an error", err)
+	}
+}
+
+func TestSecretsManagerNotOwned(t *testing.T) {
+	o, fake := newTestSecretsManager(t)
+	fake.secrets["coredns/example.com"] = &fakeSecret{
+		tags:     map[string]string{"managed-by": "terraform"},
+		versions: []fakeSecretVersion{{value: "theirs", stages: []string{awsCurrent}}},
+	}
+	s, err := New(o)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if err := s.Save(&Resource{Resource: certificate.Resource{Domain: "example.com", Certificate: []byte("cert"), PrivateKey: []byte("key")}}); !errors.Is(err, ErrNotOwned) {
+		t.Errorf("Save over a secret of terraform = %v, want ErrNotOwned", err)
+	}
+	a, err := NewAccount(o)
+	if err != nil {
+		t.Fatalf("NewAccount: %v", err)
+	}
+	fake.secrets["coredns/me@test.com"] = &fakeSecret{versions: []fakeSecretVersion{{value: "theirs", stages: []string{awsCurrent}}}}
+	if err := a.SaveAccountKey("me@test.com", []byte("key")); !errors.Is(err, ErrNotOwned) {
+		t.Errorf("SaveAccountKey over an untagged secret = %v, want ErrNotOwned", err)
+	}
+	for _, name := range []string{"coredns/example.com", "coredns/me@test.com"} {
+		if versions := fake.secrets[name].versions; len(versions) != 1 {
+			t.Errorf("secret %s written: %+v", name, versions)
+		}
+	}
+}
+
+func TestSecretsManagerCertsListDelete(t *testing.T) {
+	o, fake := newTestSecretsManager(t)
+	s, err := New(o)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for _, domain := range []string{"a.example.com", "b.example.com"} {
+		if err := s.Save(&Resource{Resource: certificate.Resource{Domain: domain, Certificate: []byte("cert"), PrivateKey: []byte("key")}}); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+	// Secrets the plugin didn't create and account keys sharing the prefix are ignored.
+	fake.secrets["coredns/c.example.com"] = &fakeSecret{versions: []fakeSecretVersion{{value: "{}", stages: []string{awsCurrent}}}}
+	a, err := NewAccount(o)
+	if err != nil {
+		t.Fatalf("NewAccount: %v", err)
+	}
+	if err := a.SaveAccountKey("me@test.com", []byte("key")); err != nil {
+		t.Fatalf("SaveAccountKey: %v", err)
+	}
+
+	list, err := s.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(list) != 2 || list[0].Domain != "a.example.com" || list[1].Domain != "b.example.com" {
+		t.Errorf("List = %v, want a.example.com and b.example.com", list)
+	}
+
+	if err := s.Delete("a.example.com"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if err := s.Delete("a.example.com"); err != nil {
+		t.Errorf("Delete of a deleted certificate: %v", err)
+	}
+	if err := s.Delete("z.example.com"); err != nil {
+		t.Errorf("Delete of a missing certificate: %v", err)
+	}
+	if _, err := s.Load("a.example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Load after Delete = %v, want ErrNotFound", err)
+	}
+	if list, err := s.List(); err != nil || len(list) != 1 {
+		t.Errorf("List after Delete = %v, %v; want b.example.com", list, err)
+	}
+
+	// Saving restores a secret scheduled for deletion.
+	if err := s.Save(&Resource{Resource: certificate.Resource{Domain: "a.example.com", Certificate: []byte("again"), PrivateKey: []byte("key")}}); err != nil {
+		t.Fatalf("Save after Delete: %v", err)
+	}
+	if out, err := s.Load("a.example.com"); err != nil || string(out.Certificate) != "again" {
+		t.Errorf("Load after restore = %v, %v; want the new certificate", out, err)
+	}
+}
+
+func TestSecretsManagerAccountRoundTrip(t *testing.T) {
+	o, _ := newTestSecretsManager(t)
+	a, err := NewAccount(o)
+	if err != nil {
+		t.Fatalf("NewAccount: %v", err)
+	}
+
+	if _, err := a.LoadAccountKey("me@test.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("LoadAccountKey of a missing key = %v, want ErrNotFound", err)
+	}
+	if err := a.SaveAccountKey("Me@Test.com", []byte("key")); err != nil {
+		t.Fatalf("SaveAccountKey: %v", err)
+	}
+	if key, err := a.LoadAccountKey("me@test.com"); err != nil || string(key) != "key" {
+		t.Errorf("LoadAccountKey = %q, %v; want key", key, err)
+	}
+	if emails, err := a.ListAccounts(); err != nil || len(emails) != 1 || emails[0] != "me@test.com" {
+		t.Errorf("ListAccounts = %v, %v; want me@test.com", emails, err)
+	}
+	if err := a.DeleteAccountKey("me@test.com"); err != nil {
+		t.Fatalf("DeleteAccountKey: %v", err)
+	}
+	if _, err := a.LoadAccountKey("me@test.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LoadAccountKey after delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSecretsManagerUnreachable(t *testing.T) {
+	o, _ := newTestSecretsManager(t)
+	o.SecretsManagerEndpoint = "http://127.0.0.1:1"
+	t.Setenv("AWS_MAX_ATTEMPTS", "1")
+	s, err := New(o)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := s.Load("example.com"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Load from an unreachable endpoint = %v, want a storage error", err)
+	}
+}
@@ -0,0 +1,408 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib" // registers the "pgx" driver
+	_ "modernc.org/sqlite"             // registers the "sqlite" driver
+)
+
+// SQL dialects of Options.SQLDriver.
+const (
+	SQLPostgres = "postgres"
+	SQLSQLite   = "sqlite"
+)
+
+// sqlMigrations are the schema versions in order; version n is sqlMigrations[n-1]. A database is
+// migrated to the last version when it is opened. Never change a released migration, add one.
+var sqlMigrations = []func(d sqlDialect) []string{
+	func(d sqlDialect) []string {
+		return []string{
+			`CREATE TABLE acme_certificates (
+				domain        TEXT NOT NULL,
+				version       INTEGER NOT NULL,
+				domains       TEXT NOT NULL,
+				not_before    ` + d.timestamp + `,
+				not_after     ` + d.timestamp + `,
+				issuer        TEXT NOT NULL,
+				ca_directory  TEXT NOT NULL,
+				profile       TEXT NOT NULL,
+				certificate   TEXT NOT NULL,
+				private_key   TEXT NOT NULL,
+				metadata      TEXT NOT NULL,
+				created_at    ` + d.timestamp + ` NOT NULL,
+				PRIMARY KEY (domain, version)
+			)`,
+			`CREATE INDEX acme_certificates_not_after ON acme_certificates (not_after)`,
+			`CREATE TABLE acme_accounts (
+				email       TEXT PRIMARY KEY,
+				private_key TEXT NOT NULL,
+				created_at  ` + d.timestamp + ` NOT NULL,
+				updated_at  ` + d.timestamp + ` NOT NULL
+			)`,
+		}
+	},
+}
+
+// sqlMigrationLock is the PostgreSQL advisory lock serializing the migrations of concurrent instances.
+const sqlMigrationLock = 0x61636d65 // "acme"
+
+type sqlDialect struct {
+	driver    string // the database/sql driver name
+	timestamp string // the column type of points in time
+}
+
+var sqlDialects = map[string]sqlDialect{
+	SQLPostgres: {driver: "pgx", timestamp: "TIMESTAMPTZ"},
+	SQLSQLite:   {driver: "sqlite", timestamp: "TIMESTAMP"},
+}
+
+// openSQL opens the database of o and migrates its schema to the latest version.
+func openSQL(o Options) (*sql.DB, error) {
+	d, ok := sqlDialects[o.SQLDriver]
+	if !ok {
+		return nil, fmt.Errorf("unknown sql driver: %s", o.SQLDriver)
+	}
+	dsn := o.SQLDSN
+	if o.SQLDriver == SQLSQLite {
+		// Write transactions lock the database when they begin, and wait for other processes holding it.
+		dsn = fmt.Sprintf("file:%s?_txlock=immediate&_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)", o.SQLDSN)
+	}
+	db, err := sql.Open(d.driver, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("could not open %s database: %w", o.SQLDriver, err)
+	}
+	if err := migrateSQL(db, o.SQLDriver, d); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate %s database: %w", o.SQLDriver, err)
+	}
+	return db, nil
+}
+
+// migrateSQL applies the migrations the database lacks, in one transaction.
+func migrateSQL(db *sql.DB, name string, d sqlDialect) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if name == SQLPostgres {
+		if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, sqlMigrationLock); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS acme_schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at `+d.timestamp+` NOT NULL
+	)`); err != nil {
+		return err
+	}
+	var current int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM acme_schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+	if current > len(sqlMigrations) {
+		return fmt.Errorf("schema version %d is newer than the latest known version %d", current, len(sqlMigrations))
+	}
+	for version := current + 1; version <= len(sqlMigrations); version++ {
+		for _, stmt := range sqlMigrations[version-1](d) {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("migration %d: %w", version, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT INTO acme_schema_migrations (version, applied_at) VALUES ($1, $2)`, version, time.Now().UTC()); err != nil {
+			return err
+		}
+		log.Infof("migrated %s database to schema version %d", name, version)
+	}
+	return tx.Commit()
+}
+
+// SQLCerts stores certificates in the table acme_certificates, adding a row for every version of a
+// certificate. Load returns the latest.
+type SQLCerts struct {
+	db *sql.DB
+
+	mu   sync.Mutex
+	read map[string]int // the latest version of every domain when this instance last loaded or saved it, 0 if absent
+}
+
+func NewSQLCerts(o Options) (*SQLCerts, error) {
+	db, err := openSQL(o)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLCerts{db: db, read: make(map[string]int)}, nil
+}
+
+func (s *SQLCerts) seen(domain string, version int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.read[domain] = version
+}
+
+// lastRead returns the latest version of domain when this instance last loaded or saved it, and false
+// when it never did.
+func (s *SQLCerts) lastRead(domain string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	version, ok := s.read[domain]
+	return version, ok
+}
+
+// Save adds certs as the next version of its domain. When another instance added a version since this
+// instance loaded the domain, or adds the same version at once, ErrConflict is returned.
+func (s *SQLCerts) Save(certs *Resource) error {
+	meta, err := json.Marshal(certs)
+	if err != nil {
+		return fmt.Errorf("unable to marshal CertResource for domain %s: %w", certs.Domain, err)
+	}
+	var notBefore, notAfter sql.NullTime
+	var issuer string
+	var domains []string
+	if leaf := leafOf(certs); leaf != nil {
+		notBefore = sql.NullTime{Time: leaf.NotBefore.UTC(), Valid: true}
+		notAfter = sql.NullTime{Time: leaf.NotAfter.UTC(), Valid: true}
+		issuer = leaf.Issuer.String()
+		domains = leaf.DNSNames
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("unable to save certificate for domain %s to sql: %w", certs.Domain, err)
+	}
+	defer tx.Rollback()
+
+	var latest int
+	if err := tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM acme_certificates WHERE domain = $1`, certs.Domain).Scan(&latest); err != nil {
+		return fmt.Errorf("unable to save certificate for domain %s to sql: %w", certs.Domain, err)
+	}
+	if read, ok := s.lastRead(certs.Domain); ok && read != latest {
+		return fmt.Errorf("unable to save certificate for domain %s to sql: %w", certs.Domain, ErrConflict)
+	}
+	version := latest + 1
+	_, err = tx.ExecContext(ctx, `INSERT INTO acme_certificates
+		(domain, version, domains, not_before, not_after, issuer, ca_directory, profile, certificate, private_key, metadata, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		certs.Domain, version, strings.Join(domains, ","), notBefore, notAfter, issuer, certs.CADirURL, certs.Profile,
+		string(certs.Certificate), string(certs.PrivateKey), string(meta), time.Now().UTC())
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		if s.versionExists(certs.Domain, version) {
+			err = ErrConflict
+		}
+		return fmt.Errorf("unable to save certificate for domain %s to sql: %w", certs.Domain, err)
+	}
+	s.seen(certs.Domain, version)
+	return nil
+}
+
+// versionExists tells whether version of domain was stored, after the insert of it failed.
+func (s *SQLCerts) versionExists(domain string, version int) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM acme_certificates WHERE domain = $1 AND version = $2`, domain, version).Scan(&n)
+	return err == nil && n > 0
+}
+
+func (s *SQLCerts) Load(domain string) (*Resource, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	var version int
+	var meta, cert, key string
+	err := s.db.QueryRowContext(ctx, `SELECT version, metadata, certificate, private_key FROM acme_certificates
+		WHERE domain = $1 ORDER BY version DESC LIMIT 1`, domain).Scan(&version, &meta, &cert, &key)
+	if errors.Is(err, sql.ErrNoRows) {
+		s.seen(domain, 0)
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate for domain %s from sql: %w", domain, err)
+	}
+	s.seen(domain, version)
+	var resource Resource
+	if err := json.Unmarshal([]byte(meta), &resource); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal metadata of domain %s: %w", domain, err)
+	}
+	resource.Certificate = []byte(cert)
+	resource.PrivateKey = []byte(key)
+	return &resource, nil
+}
+
+func (s *SQLCerts) List() ([]Entry, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	rows, err := s.db.QueryContext(ctx, `SELECT domain FROM acme_certificates GROUP BY domain ORDER BY domain`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list certificates in sql: %w", err)
+	}
+	var domains []string
+	for rows.Next() {
+		var domain string
+		if err := rows.Scan(&domain); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("unable to list certificates in sql: %w", err)
+		}
+		domains = append(domains, domain)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to list certificates in sql: %w", err)
+	}
+
+	var entries []Entry
+	for _, domain := range domains {
+		certs, err := s.Load(domain)
+		if err != nil {
+			log.Warningf("skipping sql certificate %s: %v", domain, err)
+			continue
+		}
+		entries = append(entries, entryOf(certs))
+	}
+	return entries, nil
+}
+
+// Delete removes every version of the certificate of domain.
+func (s *SQLCerts) Delete(domain string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM acme_certificates WHERE domain = $1`, domain); err != nil {
+		return fmt.Errorf("unable to delete certificate for domain %s from sql: %w", domain, err)
+	}
+	s.seen(domain, 0)
+	return nil
+}
+
+// SQLAccount stores account keys in the table acme_accounts, one row per email. Like certificates, a
+// key is only written over the one this instance loaded, so of two instances starting at once only one
+// registers its account.
+type SQLAccount struct {
+	db *sql.DB
+
+	mu   sync.Mutex
+	read map[string]string // the key of every email when this instance last loaded or saved it, "" if absent
+}
+
+func NewSQLAccount(o Options) (*SQLAccount, error) {
+	db, err := openSQL(o)
+	if err != nil {
+		return nil, err
+	}
+	return &SQLAccount{db: db, read: make(map[string]string)}, nil
+}
+
+func (a *SQLAccount) seen(email, key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.read[email] = key
+}
+
+func (a *SQLAccount) lastRead(email string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.read[email]
+}
+
+// SaveAccountKey creates the key of email, or replaces the one this instance loaded. When another
+// instance stored a key in the meantime, ErrConflict is returned.
+func (a *SQLAccount) SaveAccountKey(email string, keyPEM []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	lower := strings.ToLower(email)
+	now := time.Now().UTC()
+	var res sql.Result
+	var err error
+	if loaded := a.lastRead(lower); loaded != "" {
+		res, err = a.db.ExecContext(ctx, `UPDATE acme_accounts SET private_key = $1, updated_at = $2 WHERE email = $3 AND private_key = $4`,
+			string(keyPEM), now, lower, loaded)
+	} else {
+		res, err = a.db.ExecContext(ctx, `INSERT INTO acme_accounts (email, private_key, created_at, updated_at) VALUES ($1, $2, $3, $3)
+			ON CONFLICT (email) DO NOTHING`, lower, string(keyPEM), now)
+	}
+	if err == nil {
+		var n int64
+		if n, err = res.RowsAffected(); err == nil && n == 0 {
+			err = ErrConflict
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("unable to save account key for %s to sql: %w", email, err)
+	}
+	a.seen(lower, string(keyPEM))
+	return nil
+}
+
+func (a *SQLAccount) LoadAccountKey(email string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	lower := strings.ToLower(email)
+	var key string
+	err := a.db.QueryRowContext(ctx, `SELECT private_key FROM acme_accounts WHERE email = $1`, lower).Scan(&key)
+	if errors.Is(err, sql.ErrNoRows) {
+		a.seen(lower, "")
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read account key for %s from sql: %w", email, err)
+	}
+	a.seen(lower, key)
+	return []byte(key), nil
+}
+
+func (a *SQLAccount) ListAccounts() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	rows, err := a.db.QueryContext(ctx, `SELECT email FROM acme_accounts ORDER BY email`)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list account keys in sql: %w", err)
+	}
+	defer rows.Close()
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, fmt.Errorf("unable to list account keys in sql: %w", err)
+		}
+		emails = append(emails, email)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("unable to list account keys in sql: %w", err)
+	}
+	return emails, nil
+}
+
+func (a *SQLAccount) DeleteAccountKey(email string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	lower := strings.ToLower(email)
+	if _, err := a.db.ExecContext(ctx, `DELETE FROM acme_accounts WHERE email = $1`, lower); err != nil {
+		return fmt.Errorf("unable to delete account key for %s from sql: %w", email, err)
+	}
+	a.seen(lower, "")
+	return nil
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-acme/lego/v4/certificate"
+)
+
+func testSQLite(t *testing.T) Options {
+	t.Helper()
+	return Options{Type: "sql", SQLDriver: SQLSQLite, SQLDSN: filepath.Join(t.TempDir(), "acme.db")}
+}
+
+func TestSQLCertsVersions(t *testing.T) {
+	o := testSQLite(t)
+	s, err := New(o)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if _, err := s.Load("example.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Load of a missing certificate = %v, want ErrNotFound", err)
+	}
+
+	notAfter := time.Now().Add(60 * 24 * time.Hour).UTC().Truncate(time.Second)
+	for i, content := range []string{"first", "second"} {
+		certPEM, _ := newTestCert(t, testCert{names: []string{"example.com", "*.example.com"}, notAfter: notAfter.Add(time.Duration(i) * time.Hour)})
+		in := &Resource{
+			Resource: certificate.Resource{Domain: "example.com", Certificate: certPEM, PrivateKey: []byte(content)},
+			CADirURL: "https://ca.example/directory",
+		}
+		if err := s.Save(in); err != nil {
+			t.Fatalf("Save: %v", err)
+		}
+	}
+
+	out, err := s.Load("example.com")
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if string(out.PrivateKey) != "second" || out.CADirURL != "https://ca.example/directory" {
+		t.Errorf("Load = %+v, want the second version", out)
+	}
+
+	// The inventory can be queried directly.
+	db := s.(*SQLCerts).db
+	var versions int
+	var domains, issuer, caDir string
+	var lastNotAfter time.Time
+	if err := db.QueryRow(`SELECT COUNT(*) FROM acme_certificates WHERE domain = 'example.com'`).Scan(&versions); err != nil {
+		t.Fatal(err)
+	}
+	err = db.QueryRow(`SELECT domains, issuer, ca_directory, not_after FROM acme_certificates WHERE domain = 'example.com' ORDER BY version DESC LIMIT 1`).
+		Scan(&domains, &issuer, &caDir, &lastNotAfter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if versions != 2 || domains != "example.com,*.example.com" || issuer != "CN=example.com" || caDir != "https://ca.example/directory" {
+		t.Errorf("rows = %d %q %q %q, want 2 versions of example.com issued by CN=example.com", versions, domains, issuer, caDir)
+	}
+	if !lastNotAfter.Equal(notAfter.Add(time.Hour)) {
+		t.Errorf("not_after = %s, want %s", lastNotAfter, notAfter.Add(time.Hour))
+	}
+
+	list, err := s.List()
+	if err != nil || len(list) != 1 || list[0].Domain != "example.com" || !list[0].NotAfter.Equal(notAfter.Add(time.Hour)) {
+		t.Errorf("List = %v, %v; want the latest example.com", list, err)
+	}
+	if err := s.Delete("example.com"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := s.Load("example.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Load after Delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSQLMigrations(t *testing.T) {
+	o := testSQLite(t)
+	// Opening the database again, as another instance does, applies nothing twice.
+	for range 2 {
+		s, err := NewSQLCerts(o)
+		if err != nil {
+			t.Fatalf("NewSQLCerts: %v", err)
+		}
+		var versions int
+		if err := s.db.QueryRow(`SELECT COUNT(*) FROM acme_schema_migrations`).Scan(&versions); err != nil {
+			t.Fatal(err)
+		}
+		if versions != len(sqlMigrations) {
+			t.Errorf("%d migrations applied, want %d", versions, len(sqlMigrations))
+		}
+		s.db.Close()
+	}
+
+	s, err := NewSQLCerts(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.db.Exec(`INSERT INTO acme_schema_migrations (version, applied_at) VALUES ($1, $2)`, len(sqlMigrations)+1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	s.db.Close()
+	if _, err := NewSQLCerts(o); err == nil {
+		t.Error("a database with a newer schema was opened")
+	}
+}
+
+func TestSQLCertsConcurrentSaves(t *testing.T) {
+	o := testSQLite(t)
+	var stores []*SQLCerts
+	for range 4 {
+		s, err := NewSQLCerts(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stores = append(stores, s)
+	}
+
+	errs := make(chan error)
+	for _, s := range stores {
+		go func() {
+			var err error
+			for range 5 {
+				if err = s.Save(&Resource{Resource: certificate.Resource{Domain: "example.com", PrivateKey: []byte("key")}}); err != nil && !errors.Is(err, ErrConflict) {
+					break
+				}
+				err = nil
+			}
+			errs <- err
+		}()
+	}
+	for range stores {
+		if err := <-errs; err != nil {
+			t.Errorf("Save: %v", err)
+		}
+	}
+
+	// Versions are numbered without gaps or duplicates.
+	var count, maxVersion int
+	if err := stores[0].db.QueryRow(`SELECT COUNT(*), MAX(version) FROM acme_certificates`).Scan(&count, &maxVersion); err != nil {
+		t.Fatal(err)
+	}
+	if count != maxVersion || count == 0 {
+		t.Errorf("%d rows with versions up to %d", count, maxVersion)
+	}
+}
+
+func TestSQLCertsChangedSinceLoad(t *testing.T) {
+	o := testSQLite(t)
+	ours, err := NewSQLCerts(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := NewSQLCerts(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	in := &Resource{Resource: certificate.Resource{Domain: "example.com", PrivateKey: []byte("ours")}}
+	if _, err := ours.Load("example.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Load = %v, want ErrNotFound", err)
+	}
+	if err := theirs.Save(&Resource{Resource: certificate.Resource{Domain: "example.com", PrivateKey: []byte("theirs")}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ours.Save(in); !errors.Is(err, ErrConflict) {
+		t.Errorf("Save of a certificate added since Load = %v, want ErrConflict", err)
+	}
+	if out, err := ours.Load("example.com"); err != nil || string(out.PrivateKey) != "theirs" {
+		t.Fatalf("Load = %v, %v; want the certificate of the other instance", out, err)
+	}
+	if err := ours.Save(in); err != nil {
+		t.Errorf("Save after Load: %v", err)
+	}
+}
+
+func TestSQLAccountConflict(t *testing.T) {
+	o := testSQLite(t)
+	ours, err := NewSQLAccount(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := NewSQLAccount(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := theirs.SaveAccountKey("me@test.com", []byte("theirs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ours.SaveAccountKey("me@test.com", []byte("ours")); !errors.Is(err, ErrConflict) {
+		t.Errorf("SaveAccountKey of an existing key = %v, want ErrConflict", err)
+	}
+	if key, err := ours.LoadAccountKey("me@test.com"); err != nil || string(key) != "theirs" {
+		t.Fatalf("LoadAccountKey = %q, %v; want the key of the other instance", key, err)
+	}
+
+	// A loaded key is replaced unless it was changed in the meantime.
+	if err := theirs.SaveAccountKey("me@test.com", []byte("rotated")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ours.SaveAccountKey("me@test.com", []byte("ours")); !errors.Is(err, ErrConflict) {
+		t.Errorf("SaveAccountKey of a key changed since it was loaded = %v, want ErrConflict", err)
+	}
+	if _, err := ours.LoadAccountKey("me@test.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ours.SaveAccountKey("me@test.com", []byte("ours")); err != nil {
+		t.Errorf("SaveAccountKey after LoadAccountKey: %v", err)
+	}
+}
+
+func TestSQLAccountRoundTrip(t *testing.T) {
+	o := testSQLite(t)
+	a, err := NewAccount(o)
+	if err != nil {
+		t.Fatalf("NewAccount: %v", err)
+	}
+	if _, err := a.LoadAccountKey("me@test.com"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("LoadAccountKey of a missing key = %v, want ErrNotFound", err)
+	}
+	for _, key := range []string{"old", "new"} {
+		if err := a.SaveAccountKey("Me@Test.com", []byte(key)); err != nil {
+			t.Fatalf("SaveAccountKey: %v", err)
+		}
+	}
+	if key, err := a.LoadAccountKey("me@test.com"); err != nil || string(key) != "new" {
+		t.Errorf("LoadAccountKey = %q, %v; want new", key, err)
+	}
+	if emails, err := a.ListAccounts(); err != nil || len(emails) != 1 || emails[0] != "me@test.com" {
+		t.Errorf("ListAccounts = %v, %v; want me@test.com", emails, err)
+	}
+	if err := a.DeleteAccountKey("me@test.com"); err != nil {
+		t.Fatalf("DeleteAccountKey: %v", err)
+	}
+	if _, err := a.LoadAccountKey("me@test.com"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LoadAccountKey after delete = %v, want ErrNotFound", err)
+	}
+}
+
+func TestSQLUnknownDriver(t *testing.T) {
+	if _, err := New(Options{Type: "sql", SQLDriver: "mysql", SQLDSN: "x"}); err == nil {
+		t.Error("expected error for an unknown sql driver")
+	}
+}
@@ -1,40 +1,211 @@
 package storage
 
 import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/fs"
+	"time"
 
 	"github.com/go-acme/lego/v4/certificate"
 )
 
+// requestTimeout bounds every request of a storage to its backend.
+const requestTimeout = 30 * time.Second
+
+// ErrNotFound is returned by Load when the backend answered and holds no certificate for the domain.
+// Any other error means the backend could not be asked.
+var ErrNotFound = errors.New("certificate not found")
+
+// ErrConflict is returned by Save when someone else, such as another instance sharing the storage,
+// changed the certificate since it was loaded. Loading it again returns their version.
+var ErrConflict = errors.New("changed concurrently by someone else")
+
+// ErrNotOwned is returned when the storage holds an entry of the same name written by someone else,
+// such as a Kubernetes Secret of another controller, which the plugin refuses to overwrite.
+var ErrNotOwned = errors.New("not managed by the plugin")
+
 type CertStorage interface {
-	Save(certs *certificate.Resource) error
-	Load(domain string) *certificate.Resource
+	Save(certs *Resource) error
+	Load(domain string) (*Resource, error)
+	// List returns every certificate in the storage. Entries that can't be read are logged and left out.
+	List() ([]Entry, error)
+	// Delete removes the certificate of domain. Deleting a certificate that isn't stored is not an error.
+	Delete(domain string) error
+}
+
+// Watcher is implemented by storages that report changes made by others, such as another instance
+// sharing the storage.
+type Watcher interface {
+	// Watch calls changed with the domain of every certificate someone else writes or deletes, until
+	// stop is closed.
+	Watch(stop <-chan struct{}, changed func(domain string))
+}
+
+// WatcherOf returns the Watcher of s, looking through the encryption of private keys.
+func WatcherOf(s CertStorage) (Watcher, bool) {
+	if e, ok := s.(*encryptedCerts); ok {
+		s = e.CertStorage
+	}
+	w, ok := s.(Watcher)
+	return w, ok
+}
+
+// Recorder is implemented by storages that publish what happens to the certificates they store, such
+// as Kubernetes Events.
+type Recorder interface {
+	// Record publishes an event of the certificate stored as domain. Warnings report failures.
+	Record(domain string, warning bool, reason, message string)
+}
+
+// RecorderOf returns the Recorder of s, looking through the encryption of private keys.
+func RecorderOf(s CertStorage) (Recorder, bool) {
+	if e, ok := s.(*encryptedCerts); ok {
+		s = e.CertStorage
+	}
+	r, ok := s.(Recorder)
+	return r, ok
+}
+
+// Reencrypter is implemented by storages encrypting private keys. Loading a key found in plaintext or
+// encrypted with a retired key provider only notes it, as a read should not write; Reencrypt then
+// writes the keys noted, encrypted with the current provider.
+type Reencrypter interface {
+	Reencrypt()
+}
+
+// Entry describes a stored certificate without its key material.
+type Entry struct {
+	Domain    string    // the name the certificate is stored and loaded under
+	Domains   []string  // the DNS names of the certificate
+	NotBefore time.Time // when the certificate was issued, zero when it can't be parsed
+	NotAfter  time.Time // zero when the certificate can't be parsed
+}
+
+// entryOf returns the Entry of certs.
+func entryOf(certs *Resource) Entry {
+	e := Entry{Domain: certs.Domain}
+	if leaf := leafOf(certs); leaf != nil {
+		e.Domains = leaf.DNSNames
+		e.NotBefore = leaf.NotBefore
+		e.NotAfter = leaf.NotAfter
+	}
+	return e
+}
+
+// leafOf returns the first certificate of the chain of certs, or nil when it can't be parsed.
+func leafOf(certs *Resource) *x509.Certificate {
+	block, _ := pem.Decode(certs.Certificate)
+	if block == nil {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
+
+// Resource is a lego certificate resource together with the ACME directory and profile it was
+// issued with.
+type Resource struct {
+	certificate.Resource
+	CADirURL string `json:"caDirUrl,omitempty"`
+	Profile  string `json:"profile,omitempty"`
 }
 
 type Options struct {
 	Type string
 
-	DiskPath string
-	KeyMode  fs.FileMode
-	Gid      int // group owner for cert files; <= 0 means leave unchanged
+	DiskPath   string
+	DiskLayout string // one of the DiskLayout* constants, empty means DiskLayoutPlugin
+	KeyMode    fs.FileMode
+	Gid        int // group owner for cert files; <= 0 means leave unchanged
 
-	Namespace string
+	Namespace           string
+	ReplicateNamespaces string // space separated namespaces certificate Secrets are copied to
+	ReplicateSelector   string // label selector of further namespaces they are copied to
+
+	SecretName           string // text/template of the certificate Secret name, empty means the domain
+	SecretLabels         string // further labels of every Secret, encoded as a URL query
+	SecretAnnotations    string // further annotations of every Secret, encoded as a URL query
+	SecretCertManager    bool   // add the cert-manager.io annotations to certificate Secrets
+	SecretCACert         bool   // add ca.crt with the issuer chain to certificate Secrets
+	SecretFormats        string // space separated Format* constants added to certificate Secrets
+	SecretPKCS12Password string // the password of FormatPKCS12
+	SecretAdopt          bool   // take over existing Secrets not managed by the plugin
+	EventKind            string // the kind of the object certificate Events are recorded on, empty means the Secret
+	EventName            string
+	EventNamespace       string // empty means Namespace
 
 	VaultMount  string
 	VaultPrefix string
 	VaultAuth   string
 	VaultRole   string
+
+	S3Bucket          string
+	S3Prefix          string
+	S3Endpoint        string // for S3-compatible stores such as MinIO or Ceph, empty means AWS
+	S3Region          string // empty means the region of the AWS configuration
+	S3PathStyle       bool   // address the bucket in the path rather than the host name
+	S3CredentialsFile string // empty means the default AWS credential chain
+	S3SSE             string // server-side encryption of written objects: "", "AES256" or "aws:kms"
+	S3KMSKeyID        string // the KMS key of "aws:kms", empty means the bucket's default key
+
+	EtcdEndpoints string // space separated, empty means http://localhost:2379
+	EtcdPrefix    string
+	EtcdUsername  string
+	EtcdPassword  string
+	EtcdTLS       bool
+	EtcdTLSArgs   [3]string // the arguments of the tls setting: [CERT KEY] [CACERT]
+
+	SQLDriver string // SQLPostgres or SQLSQLite
+	SQLDSN    string // the PostgreSQL connection string, or the path of the SQLite database file
+
+	SecretsManagerPrefix          string
+	SecretsManagerRegion          string // empty means the region of the AWS configuration
+	SecretsManagerEndpoint        string // empty means AWS
+	SecretsManagerCredentialsFile string // empty means the default AWS credential chain
+	SecretsManagerKMSKeyID        string // the KMS key of created secrets, empty means aws/secretsmanager
+	SecretsManagerTags            string // the tags of created secrets, encoded as a URL query
+
+	// Encryption lists the key providers private keys are encrypted with, the current one first.
+	// Unused entries have an empty Type; with none, keys are stored in plaintext.
+	Encryption [MaxEncryptionKeys]KeyOptions
 }
 
 func New(o Options) (CertStorage, error) {
+	s, err := newBackend(o)
+	if err != nil {
+		return nil, err
+	}
+	e, err := newEnvelope(o.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	if e != nil {
+		return &encryptedCerts{CertStorage: s, envelope: e, stale: make(map[string]bool)}, nil
+	}
+	return s, nil
+}
+
+func newBackend(o Options) (CertStorage, error) {
 	switch o.Type {
 	case "disk":
-		return NewDisk(o.DiskPath, o.KeyMode, o.Gid)
+		return NewDisk(o.DiskPath, o.DiskLayout, o.KeyMode, o.Gid)
 	case "kubernetesSecrets":
-		return NewSecrets(o.Namespace)
+		return NewSecrets(o)
 	case "vault":
 		return NewVaultCerts(o)
+	case "s3":
+		return NewS3Certs(o)
+	case "etcd":
+		return NewEtcdCerts(o)
+	case "sql":
+		return NewSQLCerts(o)
+	case "awsSecretsManager":
+		return NewSecretsManagerCerts(o)
 	default:
 		return nil, fmt.Errorf("unknown storage type: %s", o.Type)
 	}
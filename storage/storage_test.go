@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// testCert describes a certificate for newTestCert; zero fields take the defaults.
+type testCert struct {
+	names    []string  // example.com by default
+	notAfter time.Time // a day from now by default
+	issuer   string    // the common name of a test CA that signs it and follows it in the chain; self-signed when empty
+}
+
+// newTestCert returns the PEM chain of the certificate c describes, with its PEM private key.
+func newTestCert(t *testing.T, c testCert) (chain, keyPEM []byte) {
+	t.Helper()
+	if len(c.names) == 0 {
+		c.names = []string{"example.com"}
+	}
+	if c.notAfter.IsZero() {
+		c.notAfter = time.Now().Add(24 * time.Hour)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: c.names[0]},
+		DNSNames:     c.names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     c.notAfter,
+	}
+	parent, parentKey := tmpl, key
+	var caPEM []byte
+	if c.issuer != "" {
+		parentKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		caTmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(1),
+			Subject:               pkix.Name{CommonName: c.issuer},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              c.notAfter,
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+		caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &parentKey.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent, err = x509.ParseCertificate(caDER); err != nil {
+			t.Fatal(err)
+		}
+		caPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), caPEM...)
+	return chain, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
@@ -3,12 +3,12 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"path"
 	"strings"
 
-	"github.com/go-acme/lego/v4/certificate"
 	bao "github.com/openbao/openbao/api/v2"
 )
 
@@ -49,7 +49,7 @@ func vaultKubernetesLogin(client *bao.Client, role string) error {
 		return fmt.Errorf("could not read service account token: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), k8sTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
 	defer cancel()
 
 	secret, err := client.Logical().WriteWithContext(ctx, "auth/kubernetes/login", map[string]interface{}{
@@ -70,6 +70,41 @@ func kvPath(mount, prefix, key string) string {
 	return path.Join(mount, "data", prefix, key)
 }
 
+// kvMetadataPath is the KV v2 path listing the keys below prefix, or deleting every version of key.
+func kvMetadataPath(mount, prefix, key string) string {
+	return path.Join(mount, "metadata", prefix, key)
+}
+
+// vaultList returns the keys directly below prefix, leaving out sub-folders.
+func vaultList(client *bao.Client, mount, prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	secret, err := client.Logical().ListWithContext(ctx, kvMetadataPath(mount, prefix, ""))
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, nil
+	}
+	raw, _ := secret.Data["keys"].([]interface{})
+	var keys []string
+	for _, k := range raw {
+		if key, ok := k.(string); ok && !strings.HasSuffix(key, "/") {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func vaultDelete(client *bao.Client, mount, prefix, key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	_, err := client.Logical().DeleteWithContext(ctx, kvMetadataPath(mount, prefix, key))
+	return err
+}
+
 type VaultCerts struct {
 	client *bao.Client
 	mount  string
@@ -84,13 +119,13 @@ func NewVaultCerts(o Options) (*VaultCerts, error) {
 	return &VaultCerts{client: client, mount: o.VaultMount, prefix: o.VaultPrefix}, nil
 }
 
-func (v *VaultCerts) Save(certs *certificate.Resource) error {
+func (v *VaultCerts) Save(certs *Resource) error {
 	data, err := certToVaultData(certs)
 	if err != nil {
 		return err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), k8sTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
 	defer cancel()
 
 	_, err = v.client.Logical().WriteWithContext(ctx,
@@ -102,21 +137,54 @@ func (v *VaultCerts) Save(certs *certificate.Resource) error {
 	return nil
 }
 
-func (v *VaultCerts) Load(domain string) *certificate.Resource {
-	ctx, cancel := context.WithTimeout(context.Background(), k8sTimeout)
+func (v *VaultCerts) Load(domain string) (*Resource, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
 	defer cancel()
 
 	secret, err := v.client.Logical().ReadWithContext(ctx, kvPath(v.mount, v.prefix, sanitizedDomain(domain)))
-	if err != nil || secret == nil {
-		return nil
+	if err != nil {
+		return nil, fmt.Errorf("unable to read certificate for domain %s from vault: %w", domain, err)
+	}
+	if secret == nil {
+		return nil, ErrNotFound
 	}
+	// A deleted KV v2 version is returned with its metadata but without data.
 	data, ok := secret.Data["data"].(map[string]interface{})
 	if !ok {
-		return nil
+		return nil, ErrNotFound
 	}
 	return vaultDataToCert(data)
 }
 
+// List reads every entry below the prefix. Account keys sharing the prefix are left out, as they have
+// no acme.json.
+func (v *VaultCerts) List() ([]Entry, error) {
+	keys, err := vaultList(v.client, v.mount, v.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list certificates in vault: %w", err)
+	}
+	var entries []Entry
+	for _, key := range keys {
+		certs, err := v.Load(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			log.Warningf("skipping vault entry %s: %v", key, err)
+			continue
+		}
+		entries = append(entries, entryOf(certs))
+	}
+	return entries, nil
+}
+
+func (v *VaultCerts) Delete(domain string) error {
+	if err := vaultDelete(v.client, v.mount, v.prefix, sanitizedDomain(domain)); err != nil {
+		return fmt.Errorf("unable to delete certificate for domain %s from vault: %w", domain, err)
+	}
+	return nil
+}
+
 type VaultAccount struct {
 	client *bao.Client
 	mount  string
@@ -132,7 +200,7 @@ func NewVaultAccount(o Options) (*VaultAccount, error) {
 }
 
 func (v *VaultAccount) SaveAccountKey(email string, keyPEM []byte) error {
-	ctx, cancel := context.WithTimeout(context.Background(), k8sTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
 	defer cancel()
 
 	_, err := v.client.Logical().WriteWithContext(ctx,
@@ -144,26 +212,51 @@ func (v *VaultAccount) SaveAccountKey(email string, keyPEM []byte) error {
 	return nil
 }
 
-func (v *VaultAccount) LoadAccountKey(email string) []byte {
-	ctx, cancel := context.WithTimeout(context.Background(), k8sTimeout)
+func (v *VaultAccount) LoadAccountKey(email string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
 	defer cancel()
 
 	secret, err := v.client.Logical().ReadWithContext(ctx, kvPath(v.mount, v.prefix, strings.ToLower(email)))
-	if err != nil || secret == nil {
-		return nil
+	if err != nil {
+		return nil, fmt.Errorf("unable to read account key for %s from vault: %w", email, err)
+	}
+	if secret == nil {
+		return nil, ErrNotFound
 	}
 	data, ok := secret.Data["data"].(map[string]interface{})
 	if !ok {
-		return nil
+		return nil, ErrNotFound
 	}
 	key, _ := data[vaultAccountKeyField].(string)
 	if key == "" {
-		return nil
+		return nil, fmt.Errorf("vault entry for %s has no %s", email, vaultAccountKeyField)
 	}
-	return []byte(key)
+	return []byte(key), nil
+}
+
+// ListAccounts returns the keys below the prefix holding an account key.
+func (v *VaultAccount) ListAccounts() ([]string, error) {
+	keys, err := vaultList(v.client, v.mount, v.prefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list account keys in vault: %w", err)
+	}
+	var emails []string
+	for _, key := range keys {
+		if _, err := v.LoadAccountKey(key); err == nil {
+			emails = append(emails, key)
+		}
+	}
+	return emails, nil
+}
+
+func (v *VaultAccount) DeleteAccountKey(email string) error {
+	if err := vaultDelete(v.client, v.mount, v.prefix, strings.ToLower(email)); err != nil {
+		return fmt.Errorf("unable to delete account key for %s from vault: %w", email, err)
+	}
+	return nil
 }
 
-func certToVaultData(certs *certificate.Resource) (map[string]interface{}, error) {
+func certToVaultData(certs *Resource) (map[string]interface{}, error) {
 	meta, err := json.Marshal(certs)
 	if err != nil {
 		return nil, fmt.Errorf("unable to marshal CertResource for domain %s: %w", certs.Domain, err)
@@ -175,20 +268,20 @@ func certToVaultData(certs *certificate.Resource) (map[string]interface{}, error
 	}, nil
 }
 
-func vaultDataToCert(data map[string]interface{}) *certificate.Resource {
+func vaultDataToCert(data map[string]interface{}) (*Resource, error) {
 	meta, _ := data["acme.json"].(string)
 	if meta == "" {
-		return nil
+		return nil, fmt.Errorf("vault entry has no acme.json")
 	}
-	var resource certificate.Resource
+	var resource Resource
 	if err := json.Unmarshal([]byte(meta), &resource); err != nil {
-		return nil
+		return nil, fmt.Errorf("unable to unmarshal acme.json from vault: %w", err)
 	}
 	crt, _ := data["tls.crt"].(string)
 	key, _ := data["tls.key"].(string)
 	resource.Certificate = []byte(crt)
 	resource.PrivateKey = []byte(key)
-	return &resource
+	return &resource, nil
 }
 
 func firstNonEmpty(vals ...string) string {
@@ -1,17 +1,26 @@
 package storage
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
 	"testing"
 
 	"github.com/go-acme/lego/v4/certificate"
+	bao "github.com/openbao/openbao/api/v2"
 )
 
 func TestVaultCertDataRoundTrip(t *testing.T) {
-	in := &certificate.Resource{
-		Domain:      "example.com",
-		CertURL:     "https://acme/cert/1",
-		Certificate: []byte("CERTPEM"),
-		PrivateKey:  []byte("KEYPEM"),
+	in := &Resource{
+		Resource: certificate.Resource{
+			Domain:      "example.com",
+			CertURL:     "https://acme/cert/1",
+			Certificate: []byte("CERTPEM"),
+			PrivateKey:  []byte("KEYPEM"),
+		},
+		CADirURL: "https://acme/directory",
 	}
 
 	data, err := certToVaultData(in)
@@ -22,11 +31,11 @@ func TestVaultCertDataRoundTrip(t *testing.T) {
 		t.Fatal("tls.crt should be stored as a string")
 	}
 
-	out := vaultDataToCert(data)
-	if out == nil {
-		t.Fatal("vaultDataToCert returned nil")
+	out, err := vaultDataToCert(data)
+	if err != nil {
+		t.Fatalf("vaultDataToCert: %v", err)
 	}
-	if out.Domain != "example.com" || out.CertURL != "https://acme/cert/1" {
+	if out.Domain != "example.com" || out.CertURL != "https://acme/cert/1" || out.CADirURL != "https://acme/directory" {
 		t.Errorf("metadata not restored: %+v", out)
 	}
 	if string(out.Certificate) != "CERTPEM" || string(out.PrivateKey) != "KEYPEM" {
@@ -35,8 +44,8 @@ func TestVaultCertDataRoundTrip(t *testing.T) {
 }
 
 func TestVaultDataToCertMissingMeta(t *testing.T) {
-	if vaultDataToCert(map[string]interface{}{"tls.crt": "x"}) != nil {
-		t.Error("expected nil when acme.json is absent")
+	if _, err := vaultDataToCert(map[string]interface{}{"tls.crt": "x"}); err == nil {
+		t.Error("expected an error when acme.json is absent")
 	}
 }
 
@@ -57,3 +66,55 @@ func TestKVPath(t *testing.T) {
 		t.Errorf("kvPath = %q", got)
 	}
 }
+
+func TestVaultCertsListDelete(t *testing.T) {
+	entries := map[string]map[string]interface{}{
+		"example.com": {"acme.json": `{"domain":"example.com"}`, "tls.crt": "", "tls.key": ""},
+		"me@test.com": {vaultAccountKeyField: "key"},
+	}
+	var deleted []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := path.Base(r.URL.Path)
+		switch {
+		case r.URL.Query().Get("list") == "true" || r.Method == "LIST":
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": []string{"example.com", "me@test.com", "sub/"}}})
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/v1/secret/metadata/certs/"):
+			deleted = append(deleted, key)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && entries[key] != nil:
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": entries[key]}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := bao.DefaultConfig()
+	cfg.Address = srv.URL
+	client, err := bao.NewClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.SetToken("test")
+	v := &VaultCerts{client: client, mount: "secret", prefix: "certs"}
+
+	list, err := v.List()
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(list) != 1 || list[0].Domain != "example.com" {
+		t.Errorf("List = %v, want only example.com", list)
+	}
+
+	if err := v.Delete("example.com"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if len(deleted) != 1 || deleted[0] != "example.com" {
+		t.Errorf("deleted %v, want the metadata of example.com", deleted)
+	}
+
+	a := &VaultAccount{client: client, mount: "secret", prefix: "certs"}
+	if emails, err := a.ListAccounts(); err != nil || len(emails) != 1 || emails[0] != "me@test.com" {
+		t.Errorf("ListAccounts = %v, %v; want me@test.com", emails, err)
+	}
+}
@@ -2,21 +2,43 @@ package acmednschallenge
 
 import (
 	"errors"
-	"sort"
-	"sync"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/coredns/coredns/plugin/acmednschallenge/config"
+	"github.com/coredns/coredns/plugin/acmednschallenge/storage"
 	"github.com/go-acme/lego/v4/certificate"
 )
 
-type fakeStorage struct{ saves int }
+type fakeStorage struct {
+	saves   int
+	stored  *storage.Resource
+	loadErr error
+}
 
-func (f *fakeStorage) Save(*certificate.Resource) error  { f.saves++; return nil }
-func (f *fakeStorage) Load(string) *certificate.Resource { return nil }
+func (f *fakeStorage) Save(*storage.Resource) error   { f.saves++; return nil }
+func (f *fakeStorage) List() ([]storage.Entry, error) { return nil, nil }
+func (f *fakeStorage) Delete(string) error            { return nil }
+func (f *fakeStorage) Load(string) (*storage.Resource, error) {
+	if f.loadErr != nil {
+		return nil, f.loadErr
+	}
+	if f.stored == nil {
+		return nil, storage.ErrNotFound
+	}
+	return f.stored, nil
+}
 
-func TestUpdateCertForDomainRetry(t *testing.T) {
+func newTestProvider(names ...string) *coreDnsLegoProvider {
+	p := &coreDnsLegoProvider{}
+	for _, n := range names {
+		p.cas = append(p.cas, &certificateAuthority{name: n, dirURL: "https://" + n + "/directory"})
+	}
+	return p
+}
+
+func TestUpdateCertificateRetry(t *testing.T) {
 	tests := []struct {
 		name          string
 		failCount     int
@@ -38,22 +60,30 @@ func TestUpdateCertForDomainRetry(t *testing.T) {
 			store := &fakeStorage{}
 			attempts := 0
 			ac := &acmeChallenge{
-				config:  &config.ACMEChallengeConfig{RetryInterval: tc.retryInterval, MaxRetryCount: tc.maxRetryCount},
-				storage: store,
+				config:          &config.ACMEChallengeConfig{},
+				storage:         store,
+				coreDNSProvider: newTestProvider("primary"),
 			}
-			ac.obtainOrRenew = func(domain string) (bool, *certificate.Resource, error) {
+			ac.obtainOrRenew = func(cert *config.ManagedCertificate, _ *certificateAuthority) (bool, *storage.Resource, error) {
 				attempts++
 				if attempts <= tc.failCount {
 					return false, nil, errors.New("boom")
 				}
-				return tc.isNew, &certificate.Resource{Domain: domain}, nil
+				return tc.isNew, &storage.Resource{Resource: certificate.Resource{Domain: cert.Name}}, nil
 			}
 
-			ac.updateCertForDomain("example.com")
+			cert := &config.ManagedCertificate{Name: "example.com", RetryInterval: tc.retryInterval, MaxRetryCount: tc.maxRetryCount}
+			retries := 0
+			for state, retry := ac.updateCertificate(cert, orderState{}); retry; state, retry = ac.updateCertificate(cert, state) {
+				retries++
+			}
 
 			if attempts != tc.wantAttempts {
 				t.Errorf("attempts = %d, want %d", attempts, tc.wantAttempts)
 			}
+			if retries != attempts-1 {
+				t.Errorf("%d retries requested for %d attempts, want one per failed attempt but the last", retries, attempts)
+			}
 			if store.saves != tc.wantSaves {
 				t.Errorf("saves = %d, want %d", store.saves, tc.wantSaves)
 			}
@@ -61,35 +91,90 @@ func TestUpdateCertForDomainRetry(t *testing.T) {
 	}
 }
 
-func TestCheckAndUpdateCertForAllDomains(t *testing.T) {
-	want := []string{"a.example.com", "b.example.com", "c.example.com"}
+func TestUpdateCertificateFailover(t *testing.T) {
+	tests := []struct {
+		name      string
+		stored    *storage.Resource
+		failing   map[string]bool
+		wantTried []string
+		wantSaves int
+	}{
+		{name: "primary healthy", failing: map[string]bool{}, wantTried: []string{"primary"}, wantSaves: 1},
+		{name: "no certificate fails over", failing: map[string]bool{"primary": true}, wantTried: []string{"primary", "secondary"}, wantSaves: 1},
+		{name: "close to expiry fails over", stored: issueTestCert(t, testCert{notAfter: time.Now().Add(2 * 24 * time.Hour)}), failing: map[string]bool{"primary": true}, wantTried: []string{"primary", "secondary"}, wantSaves: 1},
+		{name: "far from expiry stays with primary", stored: issueTestCert(t, testCert{notAfter: time.Now().Add(8 * 24 * time.Hour)}), failing: map[string]bool{"primary": true}, wantTried: []string{"primary"}, wantSaves: 0},
+		{name: "all failing", failing: map[string]bool{"primary": true, "secondary": true, "tertiary": true}, wantTried: []string{"primary", "secondary", "tertiary"}, wantSaves: 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			store := &fakeStorage{stored: tc.stored}
+			var tried []string
+			ac := &acmeChallenge{
+				config:          &config.ACMEChallengeConfig{CAFailoverBeforeDays: 5},
+				storage:         store,
+				coreDNSProvider: newTestProvider("primary", "secondary", "tertiary"),
+			}
+			ac.obtainOrRenew = func(cert *config.ManagedCertificate, ca *certificateAuthority) (bool, *storage.Resource, error) {
+				tried = append(tried, ca.name)
+				if tc.failing[ca.name] {
+					return false, nil, errors.New("boom")
+				}
+				return true, &storage.Resource{Resource: certificate.Resource{Domain: cert.Name}, CADirURL: ca.dirURL}, nil
+			}
+
+			ac.updateCertificate(&config.ManagedCertificate{Name: "example.com"}, orderState{})
+
+			if strings.Join(tried, ",") != strings.Join(tc.wantTried, ",") {
+				t.Errorf("tried %v, want %v", tried, tc.wantTried)
+			}
+			if store.saves != tc.wantSaves {
+				t.Errorf("saves = %d, want %d", store.saves, tc.wantSaves)
+			}
+		})
+	}
+}
 
-	var mu sync.Mutex
-	var seen []string
+func TestUpdateCertificateZoneStorage(t *testing.T) {
+	blockStore, zoneStore := &fakeStorage{}, &fakeStorage{}
+	zoneOptions := storage.Options{Type: "kubernetesSecrets", Namespace: "net"}
 	ac := &acmeChallenge{
-		config:  &config.ACMEChallengeConfig{ManagedDomains: map[string][]string{}},
-		storage: &fakeStorage{},
+		config:          &config.ACMEChallengeConfig{},
+		storage:         blockStore,
+		storages:        map[storage.Options]storage.CertStorage{zoneOptions: zoneStore},
+		coreDNSProvider: newTestProvider("primary"),
 	}
-	for _, d := range want {
-		ac.config.ManagedDomains[d] = nil
+	ac.obtainOrRenew = func(cert *config.ManagedCertificate, _ *certificateAuthority) (bool, *storage.Resource, error) {
+		return true, &storage.Resource{Resource: certificate.Resource{Domain: cert.Name}}, nil
 	}
-	ac.obtainOrRenew = func(domain string) (bool, *certificate.Resource, error) {
-		mu.Lock()
-		seen = append(seen, domain)
-		mu.Unlock()
-		return false, nil, nil
+
+	ac.updateCertificate(&config.ManagedCertificate{Name: "example.org"}, orderState{})
+	ac.updateCertificate(&config.ManagedCertificate{Name: "example.net", Storage: zoneOptions}, orderState{})
+
+	if blockStore.saves != 1 || zoneStore.saves != 1 {
+		t.Errorf("saves = %d block, %d zone; want one each", blockStore.saves, zoneStore.saves)
 	}
+}
 
-	ac.checkAndUpdateCertForAllDomains()
+func TestCheckCertificateStorageFailure(t *testing.T) {
+	store := &fakeStorage{loadErr: errors.New("vault is sealed")}
+	ac := &acmeChallenge{
+		config:          &config.ACMEChallengeConfig{CAFailoverBeforeDays: 5},
+		storage:         store,
+		coreDNSProvider: newTestProvider("primary", "secondary"),
+	}
+	ac.obtainOrRenew = ac.checkAndCreateOrRenewCert
+
+	// With the storage failing no order is placed: the provider has no lego clients, so any
+	// attempt to order would panic.
+	if _, retry := ac.updateCertificate(&config.ManagedCertificate{Name: "example.com", RetryInterval: time.Millisecond, MaxRetryCount: 3}, orderState{}); retry {
+		t.Error("an order was retried with the storage failing")
+	}
 
-	sort.Strings(seen)
-	if len(seen) != len(want) {
-		t.Fatalf("attempted %v, want %v", seen, want)
+	if store.saves != 0 {
+		t.Errorf("saves = %d, want 0", store.saves)
 	}
-	for i := range want {
-		if seen[i] != want[i] {
-			t.Errorf("attempted %v, want %v", seen, want)
-			break
-		}
+	if ac.shouldFailOver(&config.ManagedCertificate{Name: "example.com"}) {
+		t.Error("shouldFailOver = true with the storage failing, want false")
 	}
 }